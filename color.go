@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// color modes for the --color flag
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+const (
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiReset  = "\x1b[0m"
+)
+
+// colorizer wraps text in ANSI color codes, it does nothing when disabled
+type colorizer struct {
+	enabled bool
+}
+
+// newColorizer returns a colorizer for the given mode, auto only
+// enables color when out is a terminal
+func newColorizer(mode string, out *os.File) (colorizer, error) {
+	switch mode {
+	case colorAlways:
+		return colorizer{true}, nil
+	case colorNever:
+		return colorizer{false}, nil
+	case colorAuto:
+		return colorizer{isTerminal(out)}, nil
+	}
+
+	return colorizer{false}, fmt.Errorf("unknown color mode: %s", mode)
+}
+
+// isTerminal checks out is a terminal, /dev/null is a character device too
+// so its mode does not tell
+func isTerminal(out *os.File) bool {
+	return terminal.IsTerminal(int(out.Fd()))
+}
+
+func (c colorizer) wrap(code string, text string) string {
+	if !c.enabled {
+		return text
+	}
+	return code + text + ansiReset
+}
+
+// Red colors failures
+func (c colorizer) Red(text string) string {
+	return c.wrap(ansiRed, text)
+}
+
+// Green colors additions
+func (c colorizer) Green(text string) string {
+	return c.wrap(ansiGreen, text)
+}
+
+// Yellow colors skips
+func (c colorizer) Yellow(text string) string {
+	return c.wrap(ansiYellow, text)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+// config is the file given with --config
+type config struct {
+	// Groups are the recipient groups a '-k @name' key name encrypts to
+	Groups map[string][]string `yaml:"groups"`
+	// Recipients maps directories relative to the -d directory of
+	// 'reencrypt --to-config' to the key name or '@group' their files are encrypted to
+	Recipients map[string]string `yaml:"recipients"`
+}
+
+// readConfig reads the config file at path, unknown settings are an error
+func readConfig(path string) (config, error) {
+	var cfg config
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("cannot read config file: %s", err)
+	}
+	if err = yamlv2.UnmarshalStrict(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s is not a valid config file: %s", path, err)
+	}
+	for name, members := range cfg.Groups {
+		if len(members) == 0 {
+			return cfg, fmt.Errorf("%s: recipient group '%s' has no members", path, name)
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Everbridge/generate-secure-pillar/sls"
+)
+
+// errNotConfirmed is returned when overwriting files is not confirmed
+var errNotConfirmed = errors.New("overwrite not confirmed, no files were written")
+
+// promptIn is where the answer to the overwrite prompt is read from
+var promptIn io.Reader = os.Stdin
+
+// stdinTerminal reports whether stdin is a terminal someone can answer from
+var stdinTerminal = func() bool {
+	return isTerminal(os.Stdin)
+}
+
+// confirmOverwrite asks before count files are overwritten when stdin is a
+// terminal, anything but y or yes is errNotConfirmed
+// Scripts and pipes are not asked so automation keeps working, nor are
+// --assume-yes and --dry-run runs
+func confirmOverwrite(count int) error {
+	if count == 0 || !askOverwrite() {
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Overwrite %d files? [y/N] ", count)
+	answer, err := bufio.NewReader(promptIn).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+
+	return errNotConfirmed
+}
+
+// askOverwrite reports whether overwriting files is asked about at all
+func askOverwrite() bool {
+	return !assumeYes && !sls.DryRun && stdinTerminal()
+}
+
+// confirmDir confirms overwriting the sls files under dir a recursive run writes,
+// they are only looked for when the question is asked
+func confirmDir(dir string) error {
+	if !askOverwrite() {
+		return nil
+	}
+	slsFiles, count := sls.FindSlsFiles(dir, extensions...)
+	if since := modifiedSinceTime(); !since.IsZero() {
+		count = len(sls.FilesModifiedSince(slsFiles, since))
+	}
+
+	return confirmOverwrite(count)
+}
+
+// confirmUpdate confirms overwriting the input file with --update
+func confirmUpdate() error {
+	if !updateInPlace {
+		return nil
+	}
+
+	return confirmOverwrite(1)
+}
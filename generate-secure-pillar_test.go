@@ -2,16 +2,39 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Everbridge/generate-secure-pillar/pki"
 	"github.com/Everbridge/generate-secure-pillar/sls"
 	yaml "github.com/esilva-everbridge/yaml"
 	"github.com/gosexy/to"
+	"github.com/keybase/go-crypto/openpgp"
+	"github.com/keybase/go-crypto/openpgp/armor"
+	"github.com/keybase/go-crypto/openpgp/packet"
+	"github.com/urfave/cli"
+	yamlv2 "gopkg.in/yaml.v2"
 )
 
 // pgpHeader header const
@@ -547,6 +570,6516 @@ func TestKeyInfo(t *testing.T) {
 	}
 }
 
+func TestSkipEmptyValues(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:empty", "")
+	s.SetValueFromPath("secure_vars:full", "text")
+	s.PerformAction("encrypt")
+
+	if val := s.GetValueFromPath("secure_vars:empty"); to.String(val) != "" {
+		t.Errorf("empty value was encrypted: %#v", val)
+	}
+	if val := s.GetValueFromPath("secure_vars:full"); !strings.Contains(to.String(val), pgpHeader) {
+		t.Errorf("YAML content was not encrypted.")
+	}
+
+	s.PerformAction("decrypt")
+	if val := s.GetValueFromPath("secure_vars:empty"); to.String(val) != "" {
+		t.Errorf("empty value did not round-trip: %#v", val)
+	}
+}
+
+func TestEncryptEmptyValues(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.EncryptEmpty = true
+	s.SetValueFromPath("secure_vars:empty", "")
+	s.PerformAction("encrypt")
+
+	if val := s.GetValueFromPath("secure_vars:empty"); !strings.Contains(to.String(val), pgpHeader) {
+		t.Errorf("empty value was not encrypted: %#v", val)
+	}
+
+	s.PerformAction("decrypt")
+	if val := s.GetValueFromPath("secure_vars:empty"); to.String(val) != "" {
+		t.Errorf("empty value did not round-trip: %#v", val)
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	p := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	if err := p.SelfCheck(); err != nil {
+		t.Errorf("selfcheck failed: %s", err)
+	}
+}
+
+func TestSelfCheckMissingSecRing(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	p := pki.New(pgpKeyName, publicKeyRing, "./testdata/does_not_exist.gpg")
+	err := p.SelfCheck()
+	if err == nil {
+		t.Errorf("selfcheck passed without a secring")
+	} else if !strings.Contains(err.Error(), "no secret keys") {
+		t.Errorf("unexpected selfcheck error: %s", err)
+	}
+}
+
+func TestKeyInfoForElement(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	filePath := "./testdata/new.sls"
+	buffer, err := s.CipherTextYamlBuffer(filePath)
+	if err != nil {
+		t.Errorf("%s", err)
+	} else {
+		sls.WriteSlsFile(buffer, filePath)
+	}
+
+	topLevelElement = "secure_vars"
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	buffer, err = s.KeysForYamlBuffer(filePath)
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+	if err = scanString(buffer.String(), 3, pgpKeyName); err != nil {
+		t.Errorf("Key name count in buffer: %s", err)
+	}
+	if err = scanString(buffer.String(), 0, "bar:"); err != nil {
+		t.Errorf("Found key outside of element in buffer: %s", err)
+	}
+
+	topLevelElement = ""
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	buffer, err = s.PlainTextYamlBuffer(filePath)
+	if err != nil {
+		t.Errorf("%s", err)
+	} else {
+		sls.WriteSlsFile(buffer, filePath)
+	}
+}
+
+func TestPruneEmpty(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	err := s.ReadBytes([]byte("empty: {}\ndb:\n  user: foo\n  pass: {}\n  opts:\n    nested: {}\n  list: []\n"))
+	if err != nil {
+		t.Errorf("Error reading yaml: %s", err)
+	}
+	s.Prune()
+
+	if s.GetValueFromPath("empty") != nil {
+		t.Errorf("empty map was not removed")
+	}
+	if s.GetValueFromPath("db:pass") != nil {
+		t.Errorf("nested empty map was not removed")
+	}
+	if s.GetValueFromPath("db:opts") != nil {
+		t.Errorf("map of empty maps was not removed")
+	}
+	if s.GetValueFromPath("db:list") != nil {
+		t.Errorf("empty list was not removed")
+	}
+	if val := s.GetValueFromPath("db:user"); to.String(val) != "foo" {
+		t.Errorf("non-empty sibling was removed: %#v", val)
+	}
+}
+
+func TestPromTextfile(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	stats := s.ScanDir("./testdata/test")
+	promFile := "./testdata/gsp.prom"
+	err := sls.WritePromTextfile(stats, promFile)
+	if err != nil {
+		t.Errorf("Error writing metrics: %s", err)
+	}
+	defer os.Remove(promFile)
+
+	file, err := os.Open(promFile)
+	if err != nil {
+		t.Fatalf("Error opening metrics: %s", err)
+	}
+	defer file.Close()
+
+	metrics := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			t.Errorf("unparsable metric line: '%s'", line)
+			continue
+		}
+		metrics[fields[0]] = fields[1]
+	}
+
+	wanted := map[string]string{
+		"gsp_files_total":            "3",
+		"gsp_undecryptable_total":    "0",
+		"gsp_plaintext_leaves_total": "6",
+	}
+	for name, val := range wanted {
+		if metrics[name] != val {
+			t.Errorf("metric %s is wrong, got: %s, want: %s.", name, metrics[name], val)
+		}
+	}
+	if metrics["gsp_last_run_timestamp"] == "" {
+		t.Errorf("metric gsp_last_run_timestamp is missing")
+	}
+}
+
+func TestKeyIDFormat(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	p := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	key := p.PublicKey.PrimaryKey
+
+	long := pki.FormatKeyID(key, pki.LongKeyID)
+	if long != fmt.Sprintf("%016X", key.KeyId) {
+		t.Errorf("long key id is wrong, got: %s, want: %016X.", long, key.KeyId)
+	}
+	short := pki.FormatKeyID(key, pki.ShortKeyID)
+	if len(short) != 8 || !strings.HasSuffix(long, short) {
+		t.Errorf("short key id is wrong, got: %s, for long id: %s.", short, long)
+	}
+	fingerprint := pki.FormatKeyID(key, pki.FingerprintKeyID)
+	if len(fingerprint) != 40 || !strings.HasSuffix(fingerprint, long) {
+		t.Errorf("fingerprint is wrong, got: %s, for long id: %s.", fingerprint, long)
+	}
+}
+
+func TestEditFile(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	filePath := "./testdata/edit/edit.sls"
+	buffer, err := s.CipherTextYamlBuffer("./testdata/new.sls")
+	if err != nil {
+		t.Errorf("%s", err)
+	} else {
+		sls.WriteSlsFile(buffer, filePath)
+	}
+	defer os.RemoveAll("./testdata/edit/")
+	before := s.GetValueFromPath("secure_vars:aaa")
+
+	editor, _ := filepath.Abs("./testdata/edit/editor.sh")
+	err = ioutil.WriteFile(editor, []byte("#!/bin/sh\nsed -i.bak 's/qux/changed/' \"$1\"\nrm -f \"$1.bak\"\n"), 0700)
+	if err != nil {
+		t.Fatalf("Error writing editor script: %s", err)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	err = s.EditFile(filePath, editor)
+	if err != nil {
+		t.Errorf("Error editing file: %s", err)
+	}
+
+	err = s.ReadSlsFile(filePath)
+	if err != nil {
+		t.Errorf("Error getting test file: %s", err)
+	}
+	if s.GetValueFromPath("secure_vars:aaa") != before {
+		t.Errorf("unchanged value was re-encrypted")
+	}
+	val := to.String(s.GetValueFromPath("bar:baz"))
+	if !strings.Contains(val, pgpHeader) {
+		t.Errorf("changed value was not encrypted")
+	}
+	plainText, err := s.Pki.DecryptSecret(val)
+	if err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	if plainText != "changed" {
+		t.Errorf("changed value is wrong, got: %s, want: %s.", plainText, "changed")
+	}
+
+	err = ioutil.WriteFile(editor, []byte("#!/bin/sh\nexit 1\n"), 0700)
+	if err != nil {
+		t.Fatalf("Error writing editor script: %s", err)
+	}
+	beforeBytes, _ := ioutil.ReadFile(filePath)
+	err = s.EditFile(filePath, editor)
+	if err == nil {
+		t.Errorf("failed editor did not return an error")
+	}
+	afterBytes, _ := ioutil.ReadFile(filePath)
+	if string(beforeBytes) != string(afterBytes) {
+		t.Errorf("file was written after the editor failed")
+	}
+}
+
+func TestEmptyPubRing(t *testing.T) {
+	emptyRing := "./testdata/empty/pubring.gpg"
+	err := ioutil.WriteFile(emptyRing, []byte{}, 0644)
+	if err != nil {
+		t.Fatalf("Error writing empty keyring: %s", err)
+	}
+	defer os.Remove(emptyRing)
+
+	p := pki.Pki{PublicKeyRing: emptyRing}
+	err = p.LoadPubKeyRing()
+	if err == nil {
+		t.Errorf("empty keyring did not return an error")
+	} else if !strings.Contains(err.Error(), "contains no keys") {
+		t.Errorf("unexpected error for empty keyring: %s", err)
+	}
+}
+
+func TestKeyInfoNoTempFile(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	tmpDir, err := ioutil.TempDir("", "gsp-test-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	oldTmpDir := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", tmpDir)
+	defer os.Setenv("TMPDIR", oldTmpDir)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret("text"))
+	buffer := s.PerformAction("validate")
+	if err = scanString(buffer.String(), 1, pgpKeyName); err != nil {
+		t.Errorf("Key name count in buffer: %s", err)
+	}
+
+	files, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Errorf("Error reading temp dir: %s", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("validate created %d temp files", len(files))
+	}
+}
+
+func TestPlainTextReport(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret("text"))
+	s.SetValueFromPath("secure_vars:plain", "text")
+	sls.WriteSlsFile(s.FormatBuffer(""), "./testdata/scan/one.sls")
+	defer os.RemoveAll("./testdata/scan/")
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("list", "text")
+	s.SetValueFromPath("db:pass", s.Pki.EncryptSecret("text"))
+	sls.WriteSlsFile(s.FormatBuffer(""), "./testdata/scan/two.sls")
+
+	out, err := json.Marshal(s.PlainTextReport("./testdata/scan"))
+	if err != nil {
+		t.Errorf("Error marshaling report: %s", err)
+	}
+	var reports []sls.FileReport
+	if err = json.Unmarshal(out, &reports); err != nil {
+		t.Errorf("Error parsing report: %s", err)
+	}
+
+	wanted := map[string]string{
+		"one.sls": "secure_vars:plain",
+		"two.sls": "list",
+	}
+	if len(reports) != len(wanted) {
+		t.Errorf("report count is wrong, got: %d, want: %d.", len(reports), len(wanted))
+	}
+	for _, report := range reports {
+		path := wanted[filepath.Base(report.File)]
+		if len(report.PlainText) != 1 || report.PlainText[0] != path {
+			t.Errorf("plain text paths for %s are wrong, got: %v, want: [%s].", report.File, report.PlainText, path)
+		}
+	}
+}
+
+func TestEncryptWithoutSecRing(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+	topLevelElement = ""
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Error creating pipe: %s", err)
+	}
+	stderr := os.Stderr
+	os.Stderr = writer
+
+	s := sls.New([]string{"secure_vars:secret"}, []string{"text"}, topLevelElement, publicKeyRing, "./testdata/does_not_exist.gpg", pgpKeyName)
+	s.ProcessYaml()
+	s.SetValueFromPath("secure_vars:plain", "text")
+	s.PerformAction("encrypt")
+
+	writer.Close()
+	os.Stderr = stderr
+	logOutput, _ := ioutil.ReadAll(reader)
+
+	for _, path := range []string{"secure_vars:secret", "secure_vars:plain"} {
+		if !strings.Contains(to.String(s.GetValueFromPath(path)), pgpHeader) {
+			t.Errorf("%s was not encrypted", path)
+		}
+	}
+	if strings.Contains(string(logOutput), "secring") {
+		t.Errorf("secring warning logged while encrypting: %s", logOutput)
+	}
+}
+
+func TestCheckRecipients(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	keyNames := []string{"Dev Salt Master", "Salt Master"}
+	recipients, err := s.Pki.EntitiesByName(keyNames)
+	if err != nil {
+		t.Fatalf("Error finding keys: %s", err)
+	}
+	s.SetValueFromPath("secure_vars:both", s.Pki.EncryptSecretTo("text", recipients))
+	s.SetValueFromPath("secure_vars:one", s.Pki.EncryptSecret("text"))
+	filePath := "./testdata/recipients/recipients.sls"
+	sls.WriteSlsFile(s.FormatBuffer(""), filePath)
+	defer os.RemoveAll("./testdata/recipients/")
+
+	diffs, err := s.CheckRecipients(filePath, keyNames)
+	if err != nil {
+		t.Errorf("Error checking recipients: %s", err)
+	}
+	if len(diffs) != 1 {
+		t.Errorf("diff count is wrong, got: %d, want: %d: %v", len(diffs), 1, diffs)
+	} else if !strings.HasPrefix(diffs[0], "secure_vars:one: missing recipient Salt Master") {
+		t.Errorf("unexpected diff: %s", diffs[0])
+	}
+}
+
+func TestInlineCipherText(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	p := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	inline, err := pki.InlineCipherText(p.EncryptSecret("text"))
+	if err != nil {
+		t.Errorf("Error inlining cipher text: %s", err)
+	}
+	if !strings.HasPrefix(inline, pki.InlinePrefix) || strings.Contains(inline, "\n") {
+		t.Errorf("cipher text is not inline: %s", inline)
+	}
+	plainText, err := p.DecryptSecret(inline)
+	if err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	if plainText != "text" {
+		t.Errorf("decrypted content is wrong, got: %s, want: %s.", plainText, "text")
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.InlineCipherText = true
+	s.SetValueFromPath("secure_vars:secret", "text")
+	buffer := s.PerformAction("encrypt")
+	if err = scanString(buffer.String(), 1, pki.InlinePrefix); err != nil {
+		t.Errorf("inline cipher text count in buffer: %s", err)
+	}
+	if err = scanString(buffer.String(), 0, pgpHeader); err != nil {
+		t.Errorf("Found PGP armor in buffer: %s", err)
+	}
+
+	s.PerformAction("decrypt")
+	if val := s.GetValueFromPath("secure_vars:secret"); to.String(val) != "text" {
+		t.Errorf("inline value did not round-trip: %#v", val)
+	}
+}
+
+func TestInlineLargeValue(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/inlinelarge"
+	filePath := dirPath + "/large.sls"
+	defer os.RemoveAll(dirPath)
+
+	// 96KB that does not compress, inlined it is one line of about 128KB
+	var plain strings.Builder
+	seed := uint32(1)
+	for plain.Len() < 96*1024 {
+		seed = seed*1664525 + 1013904223
+		fmt.Fprintf(&plain, "%08x", seed)
+	}
+	plainText := plain.String()
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.InlineCipherText = true
+	s.SetValueFromPath("secure_vars:secret", plainText)
+	sls.WriteSlsFile(s.PerformAction("encrypt"), filePath)
+
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	longest := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		if len(line) > longest {
+			longest = len(line)
+		}
+	}
+	if longest <= 64*1024 {
+		t.Fatalf("expected an inline line over 64KB, the longest is %d bytes", longest)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	limChan := make(chan bool, 1)
+	if err = s.RotateFile(filePath, limChan); err != nil {
+		t.Fatalf("got error rotating: %s", err)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	if _, err = s.PlainTextYamlBuffer(filePath); err != nil {
+		t.Fatalf("got error decrypting: %s", err)
+	}
+	if val := s.GetValueFromPath("secure_vars:secret"); to.String(val) != plainText {
+		t.Errorf("the large inline value did not round-trip")
+	}
+
+	found, err := s.CheckGitInput(strings.NewReader(filePath+"\n"), ".")
+	if err != nil || len(found) != 0 {
+		t.Errorf("check of a file with a long line failed: %v %v", found, err)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	if err = s.Unflatten(strings.NewReader("secure_vars.secret = "+plainText+"\n"), "."); err != nil {
+		t.Fatalf("got error unflattening: %s", err)
+	}
+	if val := s.GetValueFromPath("secure_vars:secret"); to.String(val) != plainText {
+		t.Errorf("the large flat value was not read")
+	}
+}
+
+func TestRecurseExtensions(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	recurseDir := "./testdata/yaml"
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", "text")
+	sls.WriteSlsFile(s.FormatBuffer(""), recurseDir+"/one.yaml")
+	sls.WriteSlsFile(s.FormatBuffer(""), recurseDir+"/sub/two.yaml")
+	defer os.RemoveAll(recurseDir)
+
+	_, count := sls.FindSlsFiles(recurseDir)
+	if count != 0 {
+		t.Errorf("File count was incorrect, got: %d, want: %d.", count, 0)
+	}
+	yamlFiles, count := sls.FindSlsFiles(recurseDir, ".yaml")
+	if count != 2 {
+		t.Errorf("File count was incorrect, got: %d, want: %d.", count, 2)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.Extensions = []string{".yaml"}
+	s.ProcessDir(recurseDir, "encrypt")
+	for _, file := range yamlFiles {
+		err := s.ReadSlsFile(file)
+		if err != nil {
+			t.Errorf("Returned error")
+		}
+		if !strings.Contains(to.String(s.GetValueFromPath("secure_vars:secret")), pgpHeader) {
+			t.Errorf("YAML content was not encrypted.")
+		}
+	}
+}
+
+func TestUpdateIfAbsent(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New([]string{"bar:baz", "bar:new"}, []string{"foo", "foo"}, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.IfAbsent = true
+	err := s.ReadSlsFile("./testdata/new.sls")
+	if err != nil {
+		t.Errorf("Error getting test file: %s", err)
+	}
+	s.ProcessYaml()
+
+	if val := s.GetValueFromPath("bar:baz"); to.String(val) != "qux" {
+		t.Errorf("existing value was overwritten: %#v", val)
+	}
+	if val := s.GetValueFromPath("bar:new"); !strings.Contains(to.String(val), pgpHeader) {
+		t.Errorf("absent value was not set: %#v", val)
+	}
+}
+
+func TestUpdateIfPresent(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New([]string{"bar:baz", "bar:new"}, []string{"foo", "foo"}, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.IfPresent = true
+	err := s.ReadSlsFile("./testdata/new.sls")
+	if err != nil {
+		t.Errorf("Error getting test file: %s", err)
+	}
+	s.ProcessYaml()
+
+	if val := s.GetValueFromPath("bar:baz"); !strings.Contains(to.String(val), pgpHeader) {
+		t.Errorf("existing value was not updated: %#v", val)
+	}
+	if val := s.GetValueFromPath("bar:new"); val != nil {
+		t.Errorf("absent value was set: %#v", val)
+	}
+}
+
+func TestKeysNDJSON(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	recurseDir := "./testdata/ndjson"
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret("text"))
+	sls.WriteSlsFile(s.FormatBuffer(""), recurseDir+"/one.sls")
+	sls.WriteSlsFile(s.FormatBuffer(""), recurseDir+"/two.sls")
+	defer os.RemoveAll(recurseDir)
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Error creating pipe: %s", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.NDJSON = true
+	s.ProcessDir(recurseDir, "validate")
+
+	writer.Close()
+	os.Stdout = stdout
+
+	files := make(map[string]bool)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var record sls.KeysRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Errorf("line is not valid JSON: %s", scanner.Text())
+			continue
+		}
+		if !strings.Contains(record.Keys["secure_vars:secret"], pgpKeyName) {
+			t.Errorf("key info for %s is wrong: %v", record.File, record.Keys)
+		}
+		files[filepath.Base(record.File)] = true
+	}
+	if len(files) != 2 || !files["one.sls"] || !files["two.sls"] {
+		t.Errorf("expected one record per file, got: %v", files)
+	}
+}
+
+func TestUpdateAllowMissing(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	filePath := "./testdata/missing/missing.sls"
+	s := sls.New([]string{"secure_vars:secret"}, []string{"text"}, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	err := s.ReadSlsFile(filePath)
+	if err == nil {
+		t.Errorf("missing file did not return an error")
+	}
+
+	s.AllowMissing = true
+	err = s.ReadSlsFile(filePath)
+	if err != nil {
+		t.Errorf("Error reading missing file: %s", err)
+	}
+	s.ProcessYaml()
+	sls.WriteSlsFile(s.FormatBuffer(""), filePath)
+	defer os.RemoveAll("./testdata/missing/")
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	err = s.ReadSlsFile(filePath)
+	if err != nil {
+		t.Errorf("file was not created: %s", err)
+	}
+	if !strings.Contains(to.String(s.GetValueFromPath("secure_vars:secret")), pgpHeader) {
+		t.Errorf("YAML content was not encrypted.")
+	}
+}
+
+func TestCheckGitInput(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	gitDir, err := ioutil.TempDir("", "gsp-git-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(gitDir)
+	if out, err := exec.Command("git", "init", "-q", gitDir).CombinedOutput(); err != nil {
+		t.Fatalf("Error creating git repo: %s: %s", err, out)
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret("text"))
+	encrypted := s.FormatBuffer("")
+	s.SetValueFromPath("secure_vars:plain", "text")
+	plain := s.FormatBuffer("")
+
+	var blobList bytes.Buffer
+	for file, buf := range map[string][]byte{"encrypted.sls": encrypted.Bytes(), "plain.sls": plain.Bytes()} {
+		cmd := exec.Command("git", "hash-object", "-w", "--stdin")
+		cmd.Dir = gitDir
+		cmd.Stdin = bytes.NewReader(buf)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("Error writing blob: %s", err)
+		}
+		fmt.Fprintf(&blobList, "%s %s\n", strings.TrimSpace(string(out)), file)
+	}
+
+	found, err := s.CheckGitInput(&blobList, gitDir)
+	if err != nil {
+		t.Errorf("Error checking blobs: %s", err)
+	}
+	if len(found) != 1 || found[0] != "plain.sls: secure_vars:plain" {
+		t.Errorf("plain text values are wrong, got: %v, want: [plain.sls: secure_vars:plain].", found)
+	}
+}
+
+func TestCheckGitPush(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	gitDir, err := ioutil.TempDir("", "gsp-git-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(gitDir)
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=gsp", "-c", "user.email=gsp@example.com"}, args...)...)
+		cmd.Dir = gitDir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %s: %s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(file string, text string) string {
+		if err := ioutil.WriteFile(filepath.Join(gitDir, file), []byte(text), 0644); err != nil {
+			t.Fatalf("Error writing %s: %s", file, err)
+		}
+		git("add", file)
+		git("commit", "-q", "-m", file)
+		return git("rev-parse", "HEAD")
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret("text"))
+	buffer := s.FormatBuffer("")
+	encrypted := buffer.String()
+
+	git("init", "-q")
+	oldRev := commit("secrets.sls", encrypted)
+	plainRev := commit("secrets.sls", "secure_vars:\n  secret: text\n")
+	commit("secrets.sls", encrypted)
+	commit("inc.sls", "include:\n  - other\n")
+	newRev := commit("bad.sls", "secure_vars: [\n")
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	found, err := s.CheckGitInput(strings.NewReader(fmt.Sprintf("%s %s refs/heads/master\n", oldRev, newRev)), gitDir)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	want := []string{fmt.Sprintf("%.12s:secrets.sls: secure_vars:secret", plainRev)}
+	var unchecked []string
+	for _, line := range found {
+		if strings.Contains(line, "not checked") {
+			unchecked = append(unchecked, line[strings.Index(line, ":")+1:strings.Index(line, ".sls")])
+		}
+	}
+	sort.Strings(unchecked)
+	if !reflect.DeepEqual(unchecked, []string{"bad", "inc"}) {
+		t.Errorf("unreadable and include files did not fail the check: %v", found)
+	}
+	if len(found) != 3 || !strings.Contains(strings.Join(found, "\n"), want[0]) {
+		t.Errorf("plain text encrypted by a later commit was not found, got: %v, want: %v", found, want)
+	}
+
+	s.AllowUnchecked = true
+	found, err = s.CheckGitInput(strings.NewReader(fmt.Sprintf("%s %s refs/heads/master\n", oldRev, newRev)), gitDir)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("plain text values are wrong, got: %v, want: %v", found, want)
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New([]string{"secure_vars:big"}, []string{strings.Repeat("x", 11)}, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.MaxValueSize = 10
+	err := s.ProcessYaml()
+	if err == nil {
+		t.Errorf("oversized value did not return an error")
+	} else if !strings.Contains(err.Error(), "secure_vars:big") || !strings.Contains(err.Error(), "11 bytes") {
+		t.Errorf("error does not report the path and size: %s", err)
+	}
+	if s.GetValueFromPath("secure_vars:big") != nil {
+		t.Errorf("oversized value was set")
+	}
+
+	s.SetValueFromPath("secure_vars:big", strings.Repeat("x", 11))
+	err = s.CheckValueSizes()
+	if err == nil || !strings.Contains(err.Error(), "secure_vars:big") {
+		t.Errorf("oversized value was not reported: %v", err)
+	}
+
+	s.SetValueFromPath("secure_vars:big", strings.Repeat("x", 10))
+	if err = s.CheckValueSizes(); err != nil {
+		t.Errorf("value within the limit was reported: %s", err)
+	}
+}
+
+func TestMultipleSecRings(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/secrings"
+	err := os.MkdirAll(dirPath, 0700)
+	if err != nil {
+		t.Errorf("error creating test dir: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	// split the secret keyring into one file per key
+	p := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	if err = p.LoadSecKeyRing(); err != nil {
+		t.Fatalf("unable to load secret keyring: %s", err)
+	}
+	var rings []string
+	var recipients []*openpgp.Entity
+	for index, entity := range p.SecRing {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		ring := filepath.Join(dirPath, fmt.Sprintf("secring%d.gpg", index))
+		file, err := os.Create(ring)
+		if err != nil {
+			t.Fatalf("error creating secring: %s", err)
+		}
+		if err = entity.SerializePrivate(file, nil); err != nil {
+			t.Fatalf("error writing secring: %s", err)
+		}
+		file.Close()
+		rings = append(rings, ring)
+		recipients = append(recipients, entity)
+	}
+	if len(rings) < 2 {
+		t.Skip("need at least two secret keys to test multiple secrings")
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, rings[0], pgpKeyName)
+	if err = s.Pki.SetSecretKeyRings(rings); err != nil {
+		t.Errorf("error setting secrings: %s", err)
+	}
+	for index, recipient := range recipients {
+		cipherText := s.Pki.EncryptSecretTo(fmt.Sprintf("secret%d", index), []*openpgp.Entity{recipient})
+		s.SetValueFromPath(fmt.Sprintf("secure_vars:key%d", index), cipherText)
+	}
+	s.PerformAction("decrypt")
+	for index := range recipients {
+		path := fmt.Sprintf("secure_vars:key%d", index)
+		want := fmt.Sprintf("secret%d", index)
+		if val := s.GetValueFromPath(path); to.String(val) != want {
+			t.Errorf("%s did not decrypt, got: %s, want: %s", path, to.String(val), want)
+		}
+	}
+}
+
+func TestColorNever(t *testing.T) {
+	color, err := newColorizer(colorNever, os.Stdout)
+	if err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	for _, text := range []string{color.Red("removed"), color.Green("added"), color.Yellow("skipped")} {
+		if strings.Contains(text, "\x1b[") {
+			t.Errorf("found ANSI codes with color never: %q", text)
+		}
+	}
+
+	color, err = newColorizer(colorAlways, os.Stdout)
+	if err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	if text := color.Red("removed"); text != ansiRed+"removed"+ansiReset {
+		t.Errorf("expected red text with color always, got: %q", text)
+	}
+
+	if _, err = newColorizer("sometimes", os.Stdout); err == nil {
+		t.Errorf("expected an error for an unknown color mode")
+	}
+}
+
+// markColors marks colored text so a test can see what was colored
+type markColors struct{}
+
+func (markColors) Red(text string) string    { return "<red>" + text + "</red>" }
+func (markColors) Yellow(text string) string { return "<yellow>" + text + "</yellow>" }
+
+func TestColorSummary(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	defer devNull.Close()
+	if color, _ := newColorizer(colorAuto, devNull); color.enabled {
+		t.Errorf("color auto was enabled for %s", os.DevNull)
+	}
+
+	dirPath := "./testdata/colorsummary"
+	defer os.RemoveAll(dirPath)
+	if err = os.MkdirAll(dirPath, 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	files := map[string]string{"good.sls": "secure_vars:\n  secret: text\n", "inc.sls": "include:\n  - other\n", "bad.sls": "secure_vars: [\n"}
+	for file, text := range files {
+		if err = ioutil.WriteFile(filepath.Join(dirPath, file), []byte(text), 0600); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.Colors = markColors{}
+	s.ProcessDir(dirPath, "encrypt")
+	os.Stderr = stderr
+	w.Close()
+	logged, _ := ioutil.ReadAll(r)
+	sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+
+	if !strings.Contains(string(logged), "<yellow>1 skipped</yellow>") || !strings.Contains(string(logged), "<red>1 failed</red>") {
+		t.Errorf("expected the skipped and failed counts to be colored, got: %s", logged)
+	}
+}
+
+func TestFlattenRoundTrip(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	doc := []byte(`secure_vars:
+  db.host: example.com
+  'weird\[key': value
+  password: secret
+  port: 5432
+  enabled: true
+  nothing:
+  empty_map: {}
+  empty_list: []
+  users:
+  - name: one
+    tags: [a, b]
+  - name: two
+`)
+
+	for _, sep := range []string{sls.DefaultSeparator, "/"} {
+		s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		err := s.ReadBytes(doc)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		s.SetValueFromPath("secure_vars:password", s.Pki.EncryptSecret("secret"))
+		original := s.Yaml.Values
+
+		buffer, err := s.Flatten(sep)
+		if err != nil {
+			t.Errorf("got error flattening: %s", err)
+		}
+		if err = scanString(buffer.String(), 1, "secure_vars"+sep+"port = 5432"); err != nil {
+			t.Errorf("flat output with separator '%s': %s", sep, err)
+		}
+		if err = scanString(buffer.String(), 0, "\n-----END"); err != nil {
+			t.Errorf("cipher text was not kept on one line: %s", err)
+		}
+
+		u := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		err = u.Unflatten(strings.NewReader(buffer.String()), sep)
+		if err != nil {
+			t.Errorf("got error unflattening: %s", err)
+		}
+		if !reflect.DeepEqual(original, u.Yaml.Values) {
+			t.Errorf("round trip with separator '%s' changed the values:\n%s", sep, buffer.String())
+		}
+		if val := u.GetValueFromPath("secure_vars:password"); !strings.HasPrefix(to.String(val), pgpHeader) {
+			t.Errorf("cipher text was not preserved: %s", to.String(val))
+		}
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	for _, bad := range []string{"a.b", "a..b = 1", "a[x] = 1", ".a = 1"} {
+		if err := s.Unflatten(strings.NewReader(bad), sls.DefaultSeparator); err == nil {
+			t.Errorf("expected an error for '%s'", bad)
+		}
+	}
+}
+
+func TestNewFromReaders(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+
+	// read the keyrings into memory, nothing below touches the files
+	paths := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	pubBytes, err := ioutil.ReadFile(paths.PublicKeyRing)
+	if err != nil {
+		t.Fatalf("Error reading public keyring: %s", err)
+	}
+	secBytes, err := ioutil.ReadFile(paths.SecretKeyRing)
+	if err != nil {
+		t.Fatalf("Error reading secret keyring: %s", err)
+	}
+
+	p, err := pki.NewFromReaders(pgpKeyName, bytes.NewReader(pubBytes), bytes.NewReader(secBytes))
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	cipherText := p.EncryptSecret("text")
+	plainText, err := p.DecryptSecret(cipherText)
+	if err != nil {
+		t.Errorf("got error decrypting: %s", err)
+	}
+	if plainText != "text" {
+		t.Errorf("decrypted content is wrong, got: %s, want: %s.", plainText, "text")
+	}
+
+	encryptOnly, err := pki.NewFromReaders(pgpKeyName, bytes.NewReader(pubBytes), nil)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	cipherText = encryptOnly.EncryptSecret("text")
+	if _, err = encryptOnly.DecryptSecret(cipherText); err == nil {
+		t.Errorf("decrypt without a secret keyring did not return an error")
+	}
+
+	_, err = pki.NewFromReaders(pgpKeyName, bytes.NewReader([]byte{}), nil)
+	if err == nil || !strings.Contains(err.Error(), "contains no keys") {
+		t.Errorf("unexpected error for an empty public keyring: %v", err)
+	}
+	_, err = pki.NewFromReaders("No Such Key", bytes.NewReader(pubBytes), nil)
+	if err == nil || !strings.Contains(err.Error(), "unable to find key") {
+		t.Errorf("unexpected error for a missing key: %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/dryrun"
+	plainFile := dirPath + "/plain.sls"
+	cipherFile := dirPath + "/cipher.sls"
+	newFile := dirPath + "/new.sls"
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", "text")
+	sls.WriteSlsFile(s.FormatBuffer(""), plainFile)
+	sls.WriteSlsFile(s.PerformAction("encrypt"), cipherFile)
+	plainBytes, _ := ioutil.ReadFile(plainFile)
+	cipherBytes, _ := ioutil.ReadFile(cipherFile)
+
+	sls.DryRun = true
+	defer func() { sls.DryRun = false }()
+
+	unchanged := func(command string) {
+		if buf, _ := ioutil.ReadFile(plainFile); !bytes.Equal(buf, plainBytes) {
+			t.Errorf("%s wrote %s under dry run", command, plainFile)
+		}
+		if buf, _ := ioutil.ReadFile(cipherFile); !bytes.Equal(buf, cipherBytes) {
+			t.Errorf("%s wrote %s under dry run", command, cipherFile)
+		}
+		if _, err := os.Stat(newFile); !os.IsNotExist(err) {
+			t.Errorf("%s created %s under dry run", command, newFile)
+		}
+	}
+
+	// create
+	s = sls.New([]string{"secret"}, []string{"text"}, "secure_vars", publicKeyRing, secretKeyRing, pgpKeyName)
+	if err := s.ProcessYaml(); err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	sls.WriteSlsFile(s.FormatBuffer(""), newFile)
+	unchanged("create")
+
+	// update
+	s = sls.New([]string{"secret"}, []string{"changed"}, "secure_vars", publicKeyRing, secretKeyRing, pgpKeyName)
+	if err := s.ReadSlsFile(cipherFile); err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	if err := s.ProcessYaml(); err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	sls.WriteSlsFile(s.FormatBuffer(""), cipherFile)
+	unchanged("update")
+
+	// encrypt all --update
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	buffer, err := s.CipherTextYamlBuffer(plainFile)
+	if err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	sls.WriteSlsFile(buffer, plainFile)
+	unchanged("encrypt")
+
+	// decrypt all --update
+	buffer, err = s.PlainTextYamlBuffer(cipherFile)
+	if err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	sls.WriteSlsFile(buffer, cipherFile)
+	unchanged("decrypt")
+
+	// rotate
+	limChan := make(chan bool, 1)
+	s.RotateFile(cipherFile, limChan)
+	<-limChan
+	close(limChan)
+	unchanged("rotate")
+
+	// encrypt recurse
+	s.ProcessDir(dirPath, "encrypt")
+	unchanged("recurse")
+}
+
+func TestMergeKeys(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/merge"
+	filePath := dirPath + "/merge.sls"
+	err := os.MkdirAll(dirPath, 0700)
+	if err != nil {
+		t.Fatalf("error creating test dir: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+	err = ioutil.WriteFile(filePath, []byte(`#!yaml|gpg
+
+defaults: &defaults
+  user: admin
+  password: secret
+prod:
+  <<: *defaults
+  host: prod.example.com
+`), 0644)
+	if err != nil {
+		t.Fatalf("error writing test file: %s", err)
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	buffer, err := s.CipherTextYamlBuffer(filePath)
+	if err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	if err = scanString(buffer.String(), 1, "<<: *defaults"); err != nil {
+		t.Errorf("merge key did not survive encryption: %s", err)
+	}
+	if err = scanString(buffer.String(), 1, "&defaults"); err != nil {
+		t.Errorf("anchor did not survive encryption: %s", err)
+	}
+	if err = scanString(buffer.String(), 0, "!!merge"); err != nil {
+		t.Errorf("merge key was written with an explicit tag: %s", err)
+	}
+	// the merged-in values are only encrypted once, where they are defined
+	if err = scanString(buffer.String(), 3, pgpHeader); err != nil {
+		t.Errorf("encrypted value count: %s", err)
+	}
+	if !strings.Contains(to.String(s.GetValueFromPath("prod:password")), pgpHeader) {
+		t.Errorf("merged value was not encrypted: %s", to.String(s.GetValueFromPath("prod:password")))
+	}
+	sls.WriteSlsFile(buffer, filePath)
+
+	buffer, err = s.PlainTextYamlBuffer(filePath)
+	if err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	if err = scanString(buffer.String(), 1, "<<: *defaults"); err != nil {
+		t.Errorf("merge key did not survive decryption: %s", err)
+	}
+	if err = scanString(buffer.String(), 0, pgpHeader); err != nil {
+		t.Errorf("found encrypted values after decryption: %s", err)
+	}
+	if val := to.String(s.GetValueFromPath("prod:password")); val != "secret" {
+		t.Errorf("merged value did not round-trip, got: %s, want: %s", val, "secret")
+	}
+}
+
+func TestResolveAnchors(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	doc := []byte(`defaults: &defaults
+  password: &password secret
+prod:
+  <<: *defaults
+  admin_password: *password
+`)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.ResolveAnchors = true
+	err := s.ReadBytes(doc)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	buffer := s.PerformAction("encrypt")
+	if err = scanString(buffer.String(), 0, "*"); err != nil {
+		t.Errorf("found an alias with resolved anchors: %s", err)
+	}
+	if err = scanString(buffer.String(), 3, pgpHeader); err != nil {
+		t.Errorf("encrypted value count: %s", err)
+	}
+
+	paths := []string{"defaults:password", "prod:password", "prod:admin_password"}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		cipherText := to.String(s.GetValueFromPath(path))
+		if !strings.Contains(cipherText, pgpHeader) {
+			t.Errorf("%s was not encrypted", path)
+		}
+		if seen[cipherText] {
+			t.Errorf("%s shares its cipher text with another path", path)
+		}
+		seen[cipherText] = true
+	}
+
+	s.PerformAction("decrypt")
+	for _, path := range paths {
+		if val := to.String(s.GetValueFromPath(path)); val != "secret" {
+			t.Errorf("%s did not round-trip, got: %s, want: %s", path, val, "secret")
+		}
+	}
+}
+
+func TestRotatePanicRecovery(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+	keyIDFormat = pki.LongKeyID
+
+	dirPath := "./testdata/panic"
+	err := os.MkdirAll(dirPath, 0700)
+	if err != nil {
+		t.Fatalf("error creating test dir: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	goodFile := dirPath + "/good.sls"
+	badFile := dirPath + "/bad.sls"
+	if err = ioutil.WriteFile(goodFile, []byte("secure_vars:\n  secret: text\n"), 0644); err != nil {
+		t.Fatalf("error writing test file: %s", err)
+	}
+	// the null list item makes doSlice panic
+	if err = ioutil.WriteFile(badFile, []byte("secure_vars:\n  list:\n  - text\n  - ~\n"), 0644); err != nil {
+		t.Fatalf("error writing test file: %s", err)
+	}
+
+	count, failed := processFiles(dirPath)
+	if count != 2 {
+		t.Errorf("File count was incorrect, got: %d, want: %d.", count, 2)
+	}
+	if len(failed) != 1 || !strings.HasSuffix(failed[0], "bad.sls") {
+		t.Errorf("expected only bad.sls to fail, got: %v", failed)
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	if err = s.ReadSlsFile(goodFile); err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	if !strings.Contains(to.String(s.GetValueFromPath("secure_vars:secret")), pgpHeader) {
+		t.Errorf("good.sls was not encrypted")
+	}
+
+	if err = rotateFiles(dirPath); err == nil {
+		t.Errorf("expected an error for the failed file")
+	}
+}
+
+func TestSortKeys(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	doc := []byte(`defaults: &defaults
+  zeta: one
+  alpha: two
+prod:
+  <<: *defaults
+  zulu: three
+  bravo: four
+`)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	if err := s.ReadBytes(doc); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	buffer := s.PerformAction("decrypt")
+	out := buffer.String()
+	if strings.Index(out, "zeta:") > strings.Index(out, "alpha:") || strings.Index(out, "zulu:") > strings.Index(out, "bravo:") {
+		t.Errorf("key order was not preserved:\n%s", out)
+	}
+
+	s.SortKeys = true
+	if err := s.ReadBytes(doc); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	buffer = s.PerformAction("decrypt")
+	out = buffer.String()
+	if strings.Index(out, "zeta:") < strings.Index(out, "alpha:") || strings.Index(out, "zulu:") < strings.Index(out, "bravo:") {
+		t.Errorf("keys were not sorted:\n%s", out)
+	}
+	if err := scanString(out, 1, "<<: *defaults"); err != nil {
+		t.Errorf("merge key did not survive sorting: %s", err)
+	}
+
+	// sorting would put the alias ahead of its anchor, so the order is kept
+	doc = []byte(`z_defaults: &defaults
+  key: value
+a_prod:
+  <<: *defaults
+`)
+	if err := s.ReadBytes(doc); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	buffer = s.PerformAction("decrypt")
+	out = buffer.String()
+	if strings.Index(out, "z_defaults:") > strings.Index(out, "a_prod:") {
+		t.Errorf("sorting moved an alias ahead of its anchor:\n%s", out)
+	}
+}
+
+func TestSplitDir(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	splitDir := "./testdata/split"
+	defer os.RemoveAll(splitDir)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	err := s.ReadBytes([]byte("secure_vars:\n  db:\n    password: secret\n  port: \"5432\"\n  keys:\n  - one\n  - two\n"))
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	s.PerformAction("encrypt")
+	s.PerformAction("decrypt")
+
+	err = s.WriteSplitDir(splitDir, "_")
+	if err != nil {
+		t.Errorf("got error: %s", err)
+	}
+
+	want := map[string]string{
+		"secure_vars_db_password": "secret",
+		"secure_vars_port":        "5432",
+		"secure_vars_keys_0":      "one",
+		"secure_vars_keys_1":      "two",
+	}
+	files, err := ioutil.ReadDir(splitDir)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(files) != len(want) {
+		t.Errorf("File count was incorrect, got: %d, want: %d.", len(files), len(want))
+	}
+	for name, val := range want {
+		filePath := filepath.Join(splitDir, name)
+		buf, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			t.Errorf("got error: %s", err)
+			continue
+		}
+		if string(buf) != val {
+			t.Errorf("%s has the wrong contents, got: %s, want: %s", name, string(buf), val)
+		}
+		if fi, err := os.Stat(filePath); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("%s has the wrong permissions: %v", name, fi.Mode())
+		}
+	}
+
+	if err = s.ReadBytes([]byte("secure_vars:\n  a/b: secret\n")); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if err = s.WriteSplitDir(splitDir, "_"); err == nil {
+		t.Errorf("expected an error for a path separator in a key")
+	}
+
+	// two paths that join to the same file name
+	if err = s.ReadBytes([]byte("a:\n  b.c: x\na.b:\n  c: y\n")); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if err = s.WriteSplitDir(splitDir, "."); err == nil || !strings.Contains(err.Error(), "more than one value") {
+		t.Errorf("expected an error for two values written to one file, got: %v", err)
+	}
+
+	// an existing wider file is replaced rather than written to
+	filePath := filepath.Join(splitDir, "secure_vars_port")
+	if err = os.Chmod(filePath, 0644); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	before, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if err = s.ReadBytes([]byte("secure_vars:\n  port: \"5433\"\n")); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if err = s.WriteSplitDir(splitDir, "_"); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	after, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if os.SameFile(before, after) || after.Mode().Perm() != 0600 {
+		t.Errorf("expected a new 0600 file, got mode %04o", after.Mode().Perm())
+	}
+}
+
+func TestIsStdin(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	if !isStdin(inputFlag.Value) {
+		t.Errorf("default input '%s' is not STDIN", inputFlag.Value)
+	}
+	if !isStdin("-") {
+		t.Errorf("'-' is not STDIN")
+	}
+	if !isStdin(os.Stdin.Name()) {
+		t.Errorf("'%s' is not STDIN", os.Stdin.Name())
+	}
+	if isStdin("./testdata/new.sls") {
+		t.Errorf("an explicit path is STDIN")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	go func() {
+		fmt.Fprint(w, "secure_vars:\n  secret: text\n")
+		w.Close()
+	}()
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	buffer, err := s.CipherTextYamlBuffer("-")
+	if err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	if err = scanString(buffer.String(), 1, pgpHeader); err != nil {
+		t.Errorf("STDIN was not encrypted: %s", err)
+	}
+}
+
+func TestPassphraseCommand(t *testing.T) {
+	pgpKeyName = "Passphrase Test"
+	publicKeyRing = "./testdata/passphrase/pubring.gpg"
+	secretKeyRing = "./testdata/passphrase/secring.gpg"
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	cipherText := s.Pki.EncryptSecret("text")
+	if _, err := s.Pki.DecryptSecret(cipherText); err == nil {
+		t.Errorf("decrypt without a passphrase did not return an error")
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.Pki.PassphraseCommand = "false"
+	if _, err := s.Pki.DecryptSecret(cipherText); err == nil || !strings.Contains(err.Error(), "passphrase command failed") {
+		t.Errorf("unexpected error for a failing passphrase command: %v", err)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.Pki.PassphraseCommand = "echo test passphrase"
+	plainText, err := s.Pki.DecryptSecret(cipherText)
+	if err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	if plainText != "text" {
+		t.Errorf("decrypted content is wrong, got: %s, want: %s.", plainText, "text")
+	}
+	if err = s.Pki.SelfCheck(); err != nil {
+		t.Errorf("selfcheck failed with a passphrase command: %s", err)
+	}
+}
+
+func TestShowRecipients(t *testing.T) {
+	pgpKeyName = "Passphrase Test"
+	publicKeyRing = "./testdata/passphrase/pubring.gpg"
+	secretKeyRing = "./testdata/passphrase/secring.gpg"
+	topLevelElement = ""
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Error creating pipe: %s", err)
+	}
+	stderr := os.Stderr
+	os.Stderr = writer
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", "text")
+	s.PerformAction("encrypt")
+	showRecipients = true
+	printRecipients(&s)
+	showRecipients = false
+
+	writer.Close()
+	os.Stderr = stderr
+	output, _ := ioutil.ReadAll(reader)
+
+	want := "encrypted to: F86785BAB6EE4057A4A8AC79D1E0535BDFC00FAF Passphrase Test <passphrase@example.com>\n"
+	if string(output) != want {
+		t.Errorf("unexpected recipients output, got: %q, want: %q", output, want)
+	}
+}
+
+func TestFindSlsFilesUnreadableDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("directory permissions are not enforced for root")
+	}
+
+	dirPath := "./testdata/unreadable"
+	err := os.MkdirAll(dirPath+"/locked", 0700)
+	if err != nil {
+		t.Fatalf("error creating test dir: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+	for _, file := range []string{dirPath + "/one.sls", dirPath + "/locked/two.sls"} {
+		if err = ioutil.WriteFile(file, []byte("key: value\n"), 0644); err != nil {
+			t.Fatalf("error writing test file: %s", err)
+		}
+	}
+	if err = os.Chmod(dirPath+"/locked", 0); err != nil {
+		t.Fatalf("error changing permissions: %s", err)
+	}
+	defer os.Chmod(dirPath+"/locked", 0700)
+
+	slsFiles, count := sls.FindSlsFiles(dirPath)
+	if count != 1 {
+		t.Errorf("File count was incorrect, got: %d, want: %d.", count, 1)
+	}
+	if count > 0 && !strings.HasSuffix(slsFiles[0], "one.sls") {
+		t.Errorf("unexpected file found: %s", slsFiles[0])
+	}
+}
+
+func TestRecurseSkipsIncludes(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/includes"
+	err := os.MkdirAll(dirPath+"/sub", 0700)
+	if err != nil {
+		t.Fatalf("error creating test dir: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	include := []byte("include:\n  - new\n")
+	files := map[string][]byte{
+		dirPath + "/plain.sls":     []byte("secure_vars:\n  secret: text\n"),
+		dirPath + "/inc.sls":       include,
+		dirPath + "/sub/inc2.sls":  include,
+		dirPath + "/sub/plain.sls": []byte("secure_vars:\n  secret: text\n"),
+	}
+	for file, buf := range files {
+		if err = ioutil.WriteFile(file, buf, 0644); err != nil {
+			t.Fatalf("error writing test file: %s", err)
+		}
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.Verbose = true
+	skipped := s.ProcessDir(dirPath, "encrypt")
+	if len(skipped) != 2 {
+		t.Errorf("skipped file count was incorrect, got: %d, want: %d.", len(skipped), 2)
+	}
+	for _, file := range skipped {
+		if !strings.HasSuffix(file, "inc.sls") && !strings.HasSuffix(file, "inc2.sls") {
+			t.Errorf("unexpected skipped file: %s", file)
+		}
+	}
+
+	for file, buf := range files {
+		out, _ := ioutil.ReadFile(file)
+		if bytes.Equal(buf, include) {
+			if !bytes.Equal(out, include) {
+				t.Errorf("%s was changed: %s", file, out)
+			}
+		} else if err = scanString(string(out), 1, pgpHeader); err != nil {
+			t.Errorf("%s was not encrypted: %s", file, err)
+		}
+	}
+}
+
+func TestDecryptWithoutRecipientKey(t *testing.T) {
+	pgpKeyName = "Passphrase Test"
+	publicKeyRing = "./testdata/passphrase/pubring.gpg"
+	secretKeyRing = "./testdata/passphrase/secring.gpg"
+	topLevelElement = ""
+
+	p := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	cipherText := p.EncryptSecret("text")
+
+	// decrypt with a secret keyring that does not hold the passphrase test key
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	other := pki.New("Dev Salt Master", publicKeyRing, secretKeyRing)
+	_, err := other.DecryptSecret(cipherText)
+	if err == nil {
+		t.Fatalf("decrypt without the recipient key did not return an error")
+	}
+	want := fmt.Sprintf("this file is not encrypted to any key you hold (recipients: %s)", pki.FormatKeyID(p.PublicKey.Subkeys[0].PublicKey, pki.LongKeyID))
+	if err.Error() != want {
+		t.Errorf("unexpected error, got: %s, want: %s", err, want)
+	}
+}
+
+func TestVerifyRotation(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/verify"
+	filePath := dirPath + "/rotate.sls"
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", "text")
+	sls.WriteSlsFile(s.PerformAction("encrypt"), filePath)
+	original, _ := ioutil.ReadFile(filePath)
+
+	// rotate to a key the secret keyring does not hold so verification fails
+	s = sls.New(secretNames, secretValues, topLevelElement, "./testdata/passphrase/pubring.gpg", secretKeyRing, "Passphrase Test")
+	s.VerifyRotation = true
+	limChan := make(chan bool, 1)
+	s.RotateFile(filePath, limChan)
+	<-limChan
+	if buf, _ := ioutil.ReadFile(filePath); !bytes.Equal(buf, original) {
+		t.Errorf("file was written after failing verification")
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.VerifyRotation = true
+	s.RotateFile(filePath, limChan)
+	<-limChan
+	close(limChan)
+	if buf, _ := ioutil.ReadFile(filePath); bytes.Equal(buf, original) {
+		t.Errorf("file was not written after passing verification")
+	}
+	buffer, err := s.PlainTextYamlBuffer(filePath)
+	if err != nil {
+		t.Errorf("got error: %s", err)
+	}
+	if err = scanString(buffer.String(), 1, "secret: text"); err != nil {
+		t.Errorf("rotated value did not decrypt: %s", err)
+	}
+}
+
+func TestGnuPGHome(t *testing.T) {
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	home, err := ioutil.TempDir("", "gsp-gnupg-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(home)
+	gnupgHome := os.Getenv("GNUPGHOME")
+	defer os.Setenv("GNUPGHOME", gnupgHome)
+	os.Setenv("GNUPGHOME", home)
+
+	// with no keyrings the legacy names are used
+	if ring := pki.DefaultPubRing(); ring != filepath.Join(home, "pubring.gpg") {
+		t.Errorf("unexpected default public keyring: %s", ring)
+	}
+	if ring := pki.DefaultSecRing(); ring != filepath.Join(home, "secring.gpg") {
+		t.Errorf("unexpected default secret keyring: %s", ring)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(home, "pubring.kbx"), []byte{}, 0600); err != nil {
+		t.Fatalf("Error writing keyring: %s", err)
+	}
+	if ring := pki.DefaultPubRing(); ring != filepath.Join(home, "pubring.kbx") {
+		t.Errorf("pubring.kbx was not found: %s", ring)
+	}
+
+	pubRing, err := ioutil.ReadFile(publicKeyRing)
+	if err != nil {
+		t.Fatalf("Error reading keyring: %s", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(home, "pubring.gpg"), pubRing, 0600); err != nil {
+		t.Fatalf("Error writing keyring: %s", err)
+	}
+	ring := pki.DefaultPubRing()
+	if ring != filepath.Join(home, "pubring.gpg") {
+		t.Errorf("pubring.gpg was not preferred: %s", ring)
+	}
+	p := pki.New("Dev Salt Master", ring, pki.DefaultSecRing())
+	if p.PublicKey == nil {
+		t.Errorf("key was not found in the GNUPGHOME keyring")
+	}
+}
+
+func TestRotateBackupDir(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+	keyIDFormat = pki.LongKeyID
+
+	dirPath := "./testdata/backup"
+	rotateDir := dirPath + "/pillar"
+	backupDir = dirPath + "/saved"
+	defer func() { backupDir = "" }()
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", "text")
+	originals := make(map[string][]byte)
+	for _, file := range []string{"one.sls", "sub/two.sls"} {
+		sls.WriteSlsFile(s.PerformAction("encrypt"), filepath.Join(rotateDir, file))
+		originals[file], _ = ioutil.ReadFile(filepath.Join(rotateDir, file))
+	}
+
+	if err := rotateFiles(rotateDir); err != nil {
+		t.Errorf("got error: %s", err)
+	}
+
+	for file, original := range originals {
+		saved, err := ioutil.ReadFile(filepath.Join(backupDir, file))
+		if err != nil {
+			t.Errorf("%s was not backed up: %s", file, err)
+			continue
+		}
+		if !bytes.Equal(saved, original) {
+			t.Errorf("backup of %s does not match the original", file)
+		}
+		rotated, _ := ioutil.ReadFile(filepath.Join(rotateDir, file))
+		if bytes.Equal(rotated, original) {
+			t.Errorf("%s was not rotated", file)
+		}
+	}
+}
+
+func TestDecryptRecurseNoSecRing(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/nosecring"
+
+	if os.Getenv("GSP_TEST_NO_SECRING") != "" {
+		// the public keyring holds no secret keys
+		s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, publicKeyRing, pgpKeyName)
+		s.ProcessDir(dirPath, "decrypt")
+		return
+	}
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", "text")
+	originals := make(map[string][]byte)
+	for _, file := range []string{"one.sls", "two.sls"} {
+		sls.WriteSlsFile(s.PerformAction("encrypt"), filepath.Join(dirPath, file))
+		originals[file], _ = ioutil.ReadFile(filepath.Join(dirPath, file))
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDecryptRecurseNoSecRing$")
+	cmd.Env = append(os.Environ(), "GSP_TEST_NO_SECRING=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Errorf("decrypt recurse without a secret key did not exit with an error")
+	}
+	if !strings.Contains(string(out), "no usable secret keyring") {
+		t.Errorf("expected a secret keyring error, got: %s", out)
+	}
+
+	for file, original := range originals {
+		content, _ := ioutil.ReadFile(filepath.Join(dirPath, file))
+		if !bytes.Equal(content, original) {
+			t.Errorf("%s was changed", file)
+		}
+	}
+}
+
+func TestWalkDir(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/walk"
+	err := os.MkdirAll(dirPath, 0700)
+	if err != nil {
+		t.Fatalf("error creating test dir: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	files := map[string][]byte{
+		filepath.Join(dirPath, "plain.sls"): []byte("secure_vars:\n  secret: text\n"),
+		filepath.Join(dirPath, "inc.sls"):   []byte("include:\n  - new\n"),
+	}
+	for file, buf := range files {
+		if err = ioutil.WriteFile(file, buf, 0644); err != nil {
+			t.Fatalf("error writing test file: %s", err)
+		}
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	results, err := s.WalkDir(dirPath, "encrypt")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(results) != len(files) {
+		t.Fatalf("result count was incorrect, got: %d, want: %d.", len(results), len(files))
+	}
+
+	for _, result := range results {
+		switch filepath.Base(result.Path) {
+		case "inc.sls":
+			if !errors.Is(result.Err, sls.ErrContainsIncludes) {
+				t.Errorf("expected ErrContainsIncludes for %s, got: %v", result.Path, result.Err)
+			}
+		case "plain.sls":
+			if result.Err != nil {
+				t.Errorf("got error for %s: %s", result.Path, result.Err)
+			}
+			buffer := result.Buffer
+			if !strings.Contains(buffer.String(), pgpHeader) {
+				t.Errorf("%s was not encrypted: %s", result.Path, buffer.String())
+			}
+		default:
+			t.Errorf("unexpected result: %s", result.Path)
+		}
+	}
+
+	for file, buf := range files {
+		out, _ := ioutil.ReadFile(file)
+		if !bytes.Equal(out, buf) {
+			t.Errorf("%s was modified", file)
+		}
+	}
+
+	if _, err = s.WalkDir(filepath.Join(dirPath, "plain.sls"), "encrypt"); err == nil {
+		t.Errorf("expected an error walking a file")
+	}
+	if _, err = s.WalkDir(dirPath, "bogus"); err == nil {
+		t.Errorf("expected an error for an unknown action")
+	}
+
+	// walks of different Sls values run at once without touching the run progress
+	doneBefore, totalBefore := sls.Progress()
+	walkers := []sls.Sls{
+		sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName),
+		sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName),
+	}
+	walkers[1].SummaryOnly = true
+	var wg sync.WaitGroup
+	for i := range walkers {
+		wg.Add(1)
+		go func(walker *sls.Sls) {
+			defer wg.Done()
+			if results, err := walker.WalkDir(dirPath, "encrypt"); err != nil || len(results) != len(files) {
+				t.Errorf("expected %d results, got: %d %v", len(files), len(results), err)
+			}
+		}(&walkers[i])
+	}
+	wg.Wait()
+	if done, total := sls.Progress(); done != doneBefore || total != totalBefore {
+		t.Errorf("expected WalkDir not to change the progress, got: %d of %d, was: %d of %d", done, total, doneBefore, totalBefore)
+	}
+}
+
+func TestUpdateEncryptIfChanged(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/ifchanged"
+	slsFile := dirPath + "/test.sls"
+	defer os.RemoveAll(dirPath)
+
+	update := func(value string) []byte {
+		s := sls.New([]string{"secure_vars:secret"}, []string{value}, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.AllowMissing = true
+		s.EncryptIfChanged = true
+		if err := s.ReadSlsFile(slsFile); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if err := s.ProcessYaml(); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		sls.WriteSlsFile(s.FormatBuffer(""), slsFile)
+		out, _ := ioutil.ReadFile(slsFile)
+		return out
+	}
+
+	first := update("some text")
+	second := update("some text")
+	if !bytes.Equal(first, second) {
+		t.Errorf("updating with the same value changed the file:\n%s\n%s", first, second)
+	}
+
+	third := update("other text")
+	if bytes.Equal(second, third) {
+		t.Errorf("updating with a new value did not change the file")
+	}
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	buffer, err := s.PlainTextYamlBuffer(slsFile)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if !strings.Contains(buffer.String(), "other text") {
+		t.Errorf("value was not updated: %s", buffer.String())
+	}
+}
+
+func TestScanForIncludes(t *testing.T) {
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+
+	err := s.ScanForIncludes(strings.NewReader("secure_vars:\n  secret: text\n"))
+	if err != nil {
+		t.Errorf("got error: %s", err)
+	}
+
+	err = s.ScanForIncludes(strings.NewReader("# comment\ninclude:\n  - new\n"))
+	if !errors.Is(err, sls.ErrContainsIncludes) {
+		t.Errorf("expected ErrContainsIncludes, got: %v", err)
+	}
+	if err != nil && !strings.HasPrefix(err.Error(), "line 2 ") {
+		t.Errorf("error does not name the line: %s", err)
+	}
+
+	err = s.ReadBytes([]byte("include:\n  - new\n"))
+	if !errors.Is(err, sls.ErrContainsIncludes) {
+		t.Errorf("expected ErrContainsIncludes from ReadBytes, got: %v", err)
+	}
+}
+
+func TestValueStdinJSON(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	for _, input := range []string{`["text"]`, `{}`, `{"secure_vars": {"port": 8080}}`, `{"secure_vars:a": "x", "secure_vars": {"a": "y"}}`} {
+		if _, _, err := sls.ReadSecretsJSON(strings.NewReader(input)); err == nil {
+			t.Errorf("expected an error for %s", input)
+		}
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+	names, values := secretNames, secretValues
+	defer func() {
+		os.Stdin = stdin
+		secretNames, secretValues = names, values
+		valueStdinJSON = false
+	}()
+	go func() {
+		fmt.Fprint(w, `{"secure_vars:user": "admin", "secure_vars": {"db": {"password": "secret text"}}, "other": "value"}`)
+		w.Close()
+	}()
+
+	secretNames, secretValues = nil, nil
+	valueStdinJSON = true
+	readStdinSecrets()
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	if err = s.ProcessYaml(); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	want := map[string]string{
+		"secure_vars:user":        "admin",
+		"secure_vars:db:password": "secret text",
+		"other":                   "value",
+	}
+	for path, plainText := range want {
+		cipherText, ok := s.GetValueFromPath(path).(string)
+		if !ok || !strings.Contains(cipherText, pgpHeader) {
+			t.Errorf("'%s' was not encrypted: %v", path, s.GetValueFromPath(path))
+			continue
+		}
+		decrypted, err := s.Pki.DecryptSecret(cipherText)
+		if err != nil || decrypted != plainText {
+			t.Errorf("'%s' decrypted to '%s', want: '%s' (%v)", path, decrypted, plainText, err)
+		}
+	}
+}
+
+func TestResolveFilePaths(t *testing.T) {
+	input, output := inputFilePath, outputFilePath
+	defer func() { inputFilePath, outputFilePath = input, output }()
+
+	cases := []struct {
+		input, output string
+		update        bool
+		want          string
+		fail          bool
+	}{
+		{"./testdata/new.sls", os.Stdout.Name(), false, os.Stdout.Name(), false},
+		{"./testdata/new.sls", os.Stdout.Name(), true, "./testdata/new.sls", false},
+		{"./testdata/new.sls", "testdata/new.sls", true, "./testdata/new.sls", false},
+		{"./testdata/new.sls", "./testdata/other.sls", false, "./testdata/other.sls", false},
+		{"./testdata/new.sls", "./testdata/other.sls", true, "", true},
+		{sls.StdinPath, os.Stdout.Name(), true, "", true},
+		{sls.StdinPath, "./testdata/other.sls", true, "", true},
+	}
+	for _, c := range cases {
+		inputFilePath, outputFilePath = c.input, c.output
+		err := resolveFilePaths(c.update)
+		if c.fail {
+			if err == nil {
+				t.Errorf("expected an error for input %s, output %s, update %v", c.input, c.output, c.update)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("got error for input %s, output %s, update %v: %s", c.input, c.output, c.update, err)
+		}
+		if outputFilePath != c.want {
+			t.Errorf("output was incorrect, got: %s, want: %s.", outputFilePath, c.want)
+		}
+	}
+}
+
+func TestFastKeys(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	cipherText := s.Pki.EncryptSecret("text")
+	inline, err := pki.InlineCipherText(cipherText)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	for _, val := range []string{cipherText, inline} {
+		full, err := s.Pki.KeyUsedForEncryptedText(val)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		fast, err := s.Pki.KeyUsedForEncryptedTextFast(val)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if full != fast {
+			t.Errorf("fast key was incorrect, got: %s, want: %s.", fast, full)
+		}
+	}
+
+	dirPath := "./testdata/fastkeys"
+	slsFile := dirPath + "/test.sls"
+	defer os.RemoveAll(dirPath)
+	s.SetValueFromPath("secure_vars:secret", "text")
+	s.SetValueFromPath("secure_vars:other", "more text")
+	sls.WriteSlsFile(s.PerformAction("encrypt"), slsFile)
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	full, err := s.KeysForYamlBuffer(slsFile)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	s.FastKeys = true
+	fast, err := s.KeysForYamlBuffer(slsFile)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if full.String() != fast.String() {
+		t.Errorf("fast keys were incorrect, got:\n%s\nwant:\n%s", fast.String(), full.String())
+	}
+}
+
+func BenchmarkKeyUsedForEncryptedText(b *testing.B) {
+	pubRing, _ := filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	secRing, _ := filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	s := sls.New(secretNames, secretValues, "", pubRing, secRing, "Dev Salt Master")
+	cipherText := s.Pki.EncryptSecret("text")
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := s.Pki.KeyUsedForEncryptedText(cipherText); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKeyUsedForEncryptedTextFast(b *testing.B) {
+	pubRing, _ := filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	secRing, _ := filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	s := sls.New(secretNames, secretValues, "", pubRing, secRing, "Dev Salt Master")
+	cipherText := s.Pki.EncryptSecret("text")
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := s.Pki.KeyUsedForEncryptedTextFast(cipherText); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestUpdateAppend(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/append"
+	slsFile := dirPath + "/test.sls"
+	defer os.RemoveAll(dirPath)
+
+	update := func(name string, value string) error {
+		s := sls.New([]string{name}, []string{value}, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.AllowMissing = true
+		s.Append = true
+		if err := s.ReadSlsFile(slsFile); err != nil {
+			return err
+		}
+		if err := s.ProcessYaml(); err != nil {
+			return err
+		}
+		sls.WriteSlsFile(s.FormatBuffer(""), slsFile)
+		return nil
+	}
+
+	for _, value := range []string{"first key", "second key"} {
+		if err := update("secure_vars:api_keys", value); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	if err := s.ReadSlsFile(slsFile); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	list, ok := s.GetValueFromPath("secure_vars:api_keys").([]interface{})
+	if !ok || len(list) != 2 {
+		t.Fatalf("expected a list of 2 values, got: %v", s.GetValueFromPath("secure_vars:api_keys"))
+	}
+	for index, want := range []string{"first key", "second key"} {
+		cipherText, _ := list[index].(string)
+		if !strings.Contains(cipherText, pgpHeader) {
+			t.Errorf("list item %d was not encrypted: %v", index, list[index])
+			continue
+		}
+		plainText, err := s.Pki.DecryptSecret(cipherText)
+		if err != nil || plainText != want {
+			t.Errorf("list item %d decrypted to '%s', want: '%s' (%v)", index, plainText, want, err)
+		}
+	}
+
+	if err := update("secure_vars", "text"); err == nil {
+		t.Errorf("expected an error appending to a value that is not a list")
+	}
+}
+
+func TestModifiedSince(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/modified"
+	err := os.MkdirAll(dirPath, 0700)
+	if err != nil {
+		t.Fatalf("error creating test dir: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, file := range []string{"old.sls", "new.sls"} {
+		filePath := filepath.Join(dirPath, file)
+		if err = ioutil.WriteFile(filePath, []byte("secure_vars:\n  secret: text\n"), 0644); err != nil {
+			t.Fatalf("error writing test file: %s", err)
+		}
+		if file == "old.sls" {
+			if err = os.Chtimes(filePath, old, old); err != nil {
+				t.Fatalf("error setting mtime: %s", err)
+			}
+		}
+	}
+
+	defer func() { modifiedSince = "" }()
+	modifiedSince = "24h"
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.ModifiedSince = modifiedSinceTime()
+	results, err := s.WalkDir(dirPath, "encrypt")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(results) != 1 || filepath.Base(results[0].Path) != "new.sls" {
+		t.Errorf("expected only new.sls to be processed, got: %v", results)
+	}
+
+	modifiedSince = old.Add(-time.Hour).Format(time.RFC3339)
+	s.ModifiedSince = modifiedSinceTime()
+	results, err = s.WalkDir(dirPath, "encrypt")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(results) != 2 {
+		t.Errorf("expected both files to be processed, got: %d", len(results))
+	}
+}
+
+func TestRepair(t *testing.T) {
+	damaged := "\n#!yaml|gpg\n\n\n#!yaml|gpg\n\nsecure_vars:\n  secret: text\n"
+	buffer, stray := sls.Repair([]byte(damaged))
+	if stray != 1 {
+		t.Errorf("stray header count was incorrect, got: %d, want: %d.", stray, 1)
+	}
+	want := "#!yaml|gpg\n\nsecure_vars:\n  secret: text\n"
+	if buffer.String() != want {
+		t.Errorf("repaired file was incorrect, got:\n%s\nwant:\n%s", buffer.String(), want)
+	}
+
+	buffer, stray = sls.Repair([]byte(want))
+	if stray != 0 || buffer.String() != want {
+		t.Errorf("a valid file was changed, got %d stray headers:\n%s", stray, buffer.String())
+	}
+}
+
+func TestEncryptKeyPattern(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	defer func() { encryptKeyPattern = "" }()
+	encryptKeyPattern = "_(password|token|key)$"
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	setKeyPattern(&s)
+	err := s.ReadBytes([]byte("db_password: top\nsecure_vars:\n  db_password: secret\n  api_token: token\n  username: admin\n  host: db.example.com\n  ssh_key:\n    - first\n  hosts:\n    - one\n"))
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	s.PerformAction("encrypt")
+
+	for _, path := range []string{"db_password", "secure_vars:db_password", "secure_vars:api_token"} {
+		val, _ := s.GetValueFromPath(path).(string)
+		if !strings.Contains(val, pgpHeader) {
+			t.Errorf("'%s' was not encrypted: %s", path, val)
+		}
+	}
+	for path, want := range map[string]string{"secure_vars:username": "admin", "secure_vars:host": "db.example.com"} {
+		if val := s.GetValueFromPath(path); val != want {
+			t.Errorf("'%s' was incorrect, got: %v, want: %s.", path, val, want)
+		}
+	}
+	sshKeys, _ := s.GetValueFromPath("secure_vars:ssh_key").([]interface{})
+	if len(sshKeys) != 1 || !strings.Contains(to.String(sshKeys[0]), pgpHeader) {
+		t.Errorf("list under a matching key was not encrypted: %v", sshKeys)
+	}
+	hosts, _ := s.GetValueFromPath("secure_vars:hosts").([]interface{})
+	if len(hosts) != 1 || hosts[0] != "one" {
+		t.Errorf("list under another key was changed: %v", hosts)
+	}
+}
+
+func TestRotateLogsTarget(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	var out bytes.Buffer
+	logger.Out = &out
+	defer func() { logger.Out = os.Stderr }()
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	logRotateTarget(&s)
+
+	recipients := s.Pki.RecipientFingerprints()
+	if len(recipients) != 1 || !strings.Contains(recipients[0], pgpKeyName) {
+		t.Fatalf("unexpected recipients: %v", recipients)
+	}
+	if !strings.Contains(out.String(), recipients[0]) {
+		t.Errorf("target key was not logged, got: %s", out.String())
+	}
+}
+
+func TestAllowNonSls(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/nonsls"
+	yamlFile := dirPath + "/secrets.yaml"
+	err := os.MkdirAll(dirPath, 0700)
+	if err != nil {
+		t.Fatalf("error creating test dir: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+	if err = ioutil.WriteFile(yamlFile, []byte("secure_vars:\n  secret: text\n"), 0644); err != nil {
+		t.Fatalf("error writing test file: %s", err)
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	found, err := s.CheckGitInput(strings.NewReader(yamlFile+"\n"), ".")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(found) != 0 {
+		t.Errorf("a .yaml file was checked without --allow-non-sls: %v", found)
+	}
+	s.AllowNonSls = true
+	found, err = s.CheckGitInput(strings.NewReader(yamlFile+"\n"), ".")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(found) != 1 {
+		t.Errorf("plain text value count was incorrect, got: %d, want: %d.", len(found), 1)
+	}
+
+	buffer, err := s.CipherTextYamlBuffer(yamlFile)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	sls.WriteSlsFile(buffer, yamlFile)
+	out, _ := ioutil.ReadFile(yamlFile)
+	if !strings.HasPrefix(string(out), "#!yaml|gpg\n") {
+		t.Errorf("gpg header was not written: %s", out)
+	}
+	if err = scanString(string(out), 1, pgpHeader); err != nil {
+		t.Errorf("%s was not encrypted: %s", yamlFile, err)
+	}
+}
+
+func TestKeysCSV(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	entity, err := openpgp.NewEntity("Doe, Jane", "", "jane@example.com", nil)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	// prefer SHA256, the default preference RIPEMD160 is not compiled in
+	for name, identity := range entity.Identities {
+		identity.SelfSignature.PreferredHash = []uint8{8}
+		if err = identity.SelfSignature.SignUserId(name, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+	var pub bytes.Buffer
+	if err = entity.Serialize(&pub); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	p, err := pki.NewFromReaders("Doe, Jane", &pub, nil)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	dirPath := "./testdata/keyscsv"
+	slsFile := dirPath + "/test.sls"
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.Pki = &p
+	s.SetValueFromPath("secure_vars:secret", "text")
+	s.SetValueFromPath("secure_vars:plain", "")
+	sls.WriteSlsFile(s.PerformAction("encrypt"), slsFile)
+
+	records, err := s.KeysCSVRecords(slsFile, "test.sls")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	var out bytes.Buffer
+	writer := csv.NewWriter(&out)
+	writer.Write(sls.KeysCSVHeader)
+	writer.WriteAll(records)
+
+	uid := "Doe, Jane <jane@example.com>"
+	if !strings.Contains(out.String(), `"`+uid+`"`) {
+		t.Errorf("UID with a comma was not quoted: %s", out.String())
+	}
+
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatalf("CSV output was not well formed: %s", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("row count was incorrect, got: %d, want: %d.", len(rows), 2)
+	}
+	want := []string{"test.sls", "secure_vars:secret", fmt.Sprintf("%016X", entity.Subkeys[0].PublicKey.KeyId), uid}
+	if !reflect.DeepEqual(rows[1], want) {
+		t.Errorf("row was incorrect, got: %v, want: %v.", rows[1], want)
+	}
+}
+
+func TestStampRotated(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/stamp"
+	slsFile := dirPath + "/test.sls"
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", "text")
+	s.SetValueFromPath("secure_vars:list", "")
+	s.Yaml.Values["secure_vars"].(map[interface{}]interface{})["list"] = []interface{}{"item"}
+	sls.WriteSlsFile(s.PerformAction("encrypt"), slsFile)
+
+	rotate := func() []string {
+		s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.StampRotated = true
+		limChan := make(chan bool, 1)
+		s.RotateFile(slsFile, limChan)
+		<-limChan
+
+		out, _ := ioutil.ReadFile(slsFile)
+		var stamps []string
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "# rotated: ") {
+				stamps = append(stamps, strings.TrimSpace(line))
+			}
+		}
+		if !strings.HasPrefix(string(out), "#!yaml|gpg\n") {
+			t.Errorf("gpg header was not kept: %s", out)
+		}
+		return stamps
+	}
+
+	first := rotate()
+	if len(first) != 2 {
+		t.Fatalf("stamp count was incorrect, got: %d, want: %d.", len(first), 2)
+	}
+	keyID := pki.FormatKeyID(s.Pki.PublicKey.PrimaryKey, pki.LongKeyID)
+	if !strings.HasSuffix(first[0], " by "+keyID) {
+		t.Errorf("stamp does not name the key %s: %s", keyID, first[0])
+	}
+
+	time.Sleep(time.Second)
+	second := rotate()
+	if len(second) != 2 {
+		t.Fatalf("stamp count was incorrect, got: %d, want: %d.", len(second), 2)
+	}
+	if second[0] == first[0] {
+		t.Errorf("stamp was not updated: %s", second[0])
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	if _, err := s.PlainTextYamlBuffer(slsFile); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if val := s.GetValueFromPath("secure_vars:secret"); val != "text" {
+		t.Errorf("value was incorrect after rotation, got: %v", val)
+	}
+}
+
+func TestStrictRecipients(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/strict"
+	slsFile := dirPath + "/test.sls"
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	recipients, err := s.Pki.EntitiesByName([]string{"Dev Salt Master", "Salt Master"})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	s.SetValueFromPath("secure_vars:shared", s.Pki.EncryptSecretTo("shared text", recipients))
+	s.SetValueFromPath("secure_vars:secret", "text")
+	sls.WriteSlsFile(s.PerformAction("encrypt"), slsFile)
+	original, _ := ioutil.ReadFile(slsFile)
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.AllowedRecipients = []string{"Dev Salt Master"}
+	found, err := s.DisallowedRecipients(slsFile)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(found) != 1 || !strings.HasPrefix(found[0], "secure_vars:shared: disallowed recipient Salt Master") {
+		t.Errorf("unexpected violations: %v", found)
+	}
+
+	if _, err = s.PlainTextYamlBuffer(slsFile); err == nil || !strings.Contains(err.Error(), "secure_vars:shared") {
+		t.Errorf("expected an error naming the value, got: %v", err)
+	}
+	content, _ := ioutil.ReadFile(slsFile)
+	if !bytes.Equal(content, original) {
+		t.Errorf("%s was changed", slsFile)
+	}
+
+	s.AllowedRecipients = []string{"Dev Salt Master", "Salt Master"}
+	if found, err = s.DisallowedRecipients(slsFile); err != nil || len(found) != 0 {
+		t.Errorf("unexpected violations with both keys allowed: %v (%v)", found, err)
+	}
+	if _, err = s.PlainTextYamlBuffer(slsFile); err != nil {
+		t.Errorf("got error: %s", err)
+	}
+}
+
+func TestValueSources(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/valuesources"
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+	valueFile := dirPath + "/password"
+	if err := ioutil.WriteFile(valueFile, []byte("file text\n"), 0600); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	os.Setenv("GSP_TEST_VALUE", "env text")
+	defer os.Unsetenv("GSP_TEST_VALUE")
+
+	cases := []struct {
+		source sls.ValueSource
+		ref    string
+		want   string
+	}{
+		{sls.LiteralSource{}, "literal text", "literal text"},
+		{sls.FileSource{}, valueFile, "file text"},
+		{sls.EnvSource{}, "GSP_TEST_VALUE", "env text"},
+		{sls.CommandSource{}, "echo command text", "command text"},
+	}
+	for _, c := range cases {
+		val, err := c.source.Resolve(c.ref)
+		if err != nil || val != c.want {
+			t.Errorf("%T resolved '%s' to '%s', want: '%s' (%v)", c.source, c.ref, val, c.want, err)
+		}
+	}
+
+	failing := []struct {
+		source sls.ValueSource
+		ref    string
+	}{
+		{sls.FileSource{}, dirPath + "/missing"},
+		{sls.EnvSource{}, "GSP_TEST_UNSET_VALUE"},
+		{sls.CommandSource{}, "false"},
+		{sls.CommandSource{}, ""},
+	}
+	for _, f := range failing {
+		if _, err := f.source.Resolve(f.ref); err == nil {
+			t.Errorf("expected %T to fail for '%s'", f.source, f.ref)
+		}
+	}
+
+	s := sls.New([]string{"secret"}, []string{valueFile}, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.ValueSource = sls.FileSource{}
+	if err := s.ProcessYaml(); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	decrypted, err := s.Pki.DecryptSecret(s.GetValueFromPath("secret").(string))
+	if err != nil || decrypted != "file text" {
+		t.Errorf("secret decrypted to '%s', want: 'file text' (%v)", decrypted, err)
+	}
+
+	s = sls.New([]string{"secret"}, []string{"GSP_TEST_UNSET_VALUE"}, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.ValueSource = sls.EnvSource{}
+	if err := s.ProcessYaml(); err == nil {
+		t.Errorf("expected an error for an unset environment variable")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+	keyIDFormat = pki.LongKeyID
+
+	dirPath := "./testdata/timeout"
+
+	switch os.Getenv("GSP_TEST_TIMEOUT") {
+	case "walk":
+		timeout = time.Millisecond
+		startTimeout()
+		// the run is slow to reach the directory
+		time.Sleep(50 * time.Millisecond)
+		s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.Context = runCtx
+		processDir(&s, dirPath, "encrypt")
+		return
+	case "hang":
+		timeout = 200 * time.Millisecond
+		timeoutGrace = 100 * time.Millisecond
+		startTimeout()
+		s := sls.New([]string{"secret"}, []string{"sleep 10"}, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.ValueSource = sls.CommandSource{}
+		_ = s.ProcessYaml()
+		return
+	case "hook":
+		timeout = 200 * time.Millisecond
+		timeoutGrace = 100 * time.Millisecond
+		startTimeout()
+		s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.Context = runCtx
+		s.PreHook, _ = filepath.Abs(filepath.Join(dirPath, "hook.sh"))
+		processDir(&s, dirPath, "encrypt")
+		return
+	}
+	defer os.RemoveAll(dirPath)
+
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dirPath, "hook.sh"), []byte("#!/bin/sh\nsleep 10\n"), 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	originals := make(map[string][]byte)
+	for _, file := range []string{"one.sls", "two.sls"} {
+		originals[file] = []byte("secure_vars:\n  secret: text\n")
+		if err := ioutil.WriteFile(filepath.Join(dirPath, file), originals[file], 0600); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+
+	for _, mode := range []string{"walk", "hang", "hook"} {
+		start := time.Now()
+		cmd := exec.Command(os.Args[0], "-test.run=^TestTimeout$")
+		cmd.Env = append(os.Environ(), "GSP_TEST_TIMEOUT="+mode)
+		out, err := cmd.CombinedOutput()
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.ExitCode() != sls.TimeoutExitCode {
+			t.Errorf("%s: expected exit status %d, got: %v", mode, sls.TimeoutExitCode, err)
+		}
+		if !strings.Contains(string(out), "timed out") {
+			t.Errorf("%s: expected a timeout summary, got: %s", mode, out)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("%s: the timeout did not stop the run", mode)
+		}
+		if mode == "hook" && !strings.Contains(string(out), "0 of 2 files were processed, 2 were not") {
+			t.Errorf("%s: expected the files processed and not processed, got: %s", mode, out)
+		}
+	}
+
+	for file, original := range originals {
+		content, _ := ioutil.ReadFile(filepath.Join(dirPath, file))
+		if !bytes.Equal(content, original) {
+			t.Errorf("%s was changed after the deadline", file)
+		}
+	}
+
+	// the library returns the timeout and leaves exiting to the caller
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.Context = ctx
+	if _, err := s.ProcessDirErr(dirPath, "encrypt"); !errors.Is(err, sls.ErrTimedOut) {
+		t.Errorf("expected ErrTimedOut, got: %v", err)
+	}
+	if _, err := s.WalkDir(dirPath, "encrypt"); !errors.Is(err, sls.ErrTimedOut) {
+		t.Errorf("expected ErrTimedOut, got: %v", err)
+	}
+	runCtx = ctx
+	defer func() { runCtx = context.Background() }()
+	if err := rotateFiles(dirPath); !errors.Is(err, sls.ErrTimedOut) {
+		t.Errorf("expected ErrTimedOut, got: %v", err)
+	}
+	for file, original := range originals {
+		content, _ := ioutil.ReadFile(filepath.Join(dirPath, file))
+		if !bytes.Equal(content, original) {
+			t.Errorf("%s was changed after the run timed out", file)
+		}
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/verifyfile"
+	filePath := dirPath + "/verify.sls"
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:good", "text")
+	s.SetValueFromPath("secure_vars:bad", "text")
+	s.SetValueFromPath("secure_vars:plain", "text")
+	buffer := s.PerformAction("encrypt")
+	sls.WriteSlsFile(buffer, filePath)
+
+	// only the public keyring is needed
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, publicKeyRing, pgpKeyName)
+	found, err := s.VerifyFile(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(found) != 0 {
+		t.Errorf("expected no malformed values, got: %v", found)
+	}
+
+	// corrupt a character in the middle of the armor of one value
+	cipherText := s.GetValueFromPath("secure_vars:bad").(string)
+	lines := strings.Split(cipherText, "\n")
+	line := lines[3]
+	corrupt := "A"
+	if line[10:11] == corrupt {
+		corrupt = "B"
+	}
+	lines[3] = line[:10] + corrupt + line[11:]
+	s.SetValueFromPath("secure_vars:bad", strings.Join(lines, "\n"))
+	sls.WriteSlsFile(s.FormatBuffer(""), filePath)
+
+	found, err = s.VerifyFile(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(found) != 1 || !strings.HasPrefix(found[0], "secure_vars:bad: ") {
+		t.Errorf("expected secure_vars:bad to be malformed, got: %v", found)
+	}
+}
+
+func TestStringKeys(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	yamlText := `releases:
+  2019:
+    notes: old
+  2:
+    notes: two
+hosts:
+  - one
+  - two
+  - name: three
+`
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.StringKeys = true
+	if err := s.ReadBytes([]byte(yamlText)); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	gets := map[string]interface{}{
+		"releases:2019:notes": "old",
+		"releases:2:notes":    "two",
+		"hosts:1":             "two",
+		"hosts:2:name":        "three",
+		"hosts:3":             nil,
+		"hosts:name":          nil,
+		"releases:2020":       nil,
+	}
+	for path, want := range gets {
+		if got := s.GetValueFromPath(path); got != want {
+			t.Errorf("%s: got %v, want: %v", path, got, want)
+		}
+	}
+
+	sets := map[string]string{
+		"releases:2019:notes":    "new",
+		"releases:2:notes":       "second",
+		"hosts:2:name":           "third",
+		"hosts:0":                "first",
+		"releases:2020:password": "text",
+	}
+	for path, val := range sets {
+		if err := s.SetValueFromPath(path, val); err != nil {
+			t.Errorf("%s: got error: %s", path, err)
+		}
+		if got := s.GetValueFromPath(path); got != val {
+			t.Errorf("%s: got %v after setting it, want: %s", path, got, val)
+		}
+	}
+	if err := s.SetValueFromPath("hosts:5", "text"); err == nil {
+		t.Errorf("expected an error for an index past the end of a list")
+	}
+
+	// the int keys are kept rather than duplicated as strings
+	releases := s.GetValueFromPath("releases").(map[interface{}]interface{})
+	if len(releases) != 3 {
+		t.Errorf("expected 3 releases, got: %v", releases)
+	}
+	if _, ok := releases[2019]; !ok {
+		t.Errorf("the 2019 key is no longer an int: %v", releases)
+	}
+
+	s.StringKeys = false
+	if got := s.GetValueFromPath("releases:2019:notes"); got != nil {
+		t.Errorf("expected no value for an int key without StringKeys, got: %v", got)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/hooks"
+	slsDir := dirPath + "/sls"
+	if err := os.MkdirAll(slsDir, 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	plainText := []byte("secure_vars:\n  secret: text\n")
+	for _, file := range []string{"one.sls", "two.sls"} {
+		if err := ioutil.WriteFile(filepath.Join(slsDir, file), plainText, 0600); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+	logPath, _ := filepath.Abs(dirPath + "/hook.log")
+	hookPath := dirPath + "/hook.sh"
+	script := fmt.Sprintf("echo \"$1 $%s\" >> %s\n", sls.HookFileEnv, logPath)
+	if err := ioutil.WriteFile(hookPath, []byte(script), 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.PostHook = "sh " + hookPath
+	s.ProcessDir(slsDir, "encrypt")
+
+	out, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	sort.Strings(lines)
+	var want []string
+	for _, file := range []string{"one.sls", "two.sls"} {
+		path, _ := filepath.Abs(filepath.Join(slsDir, file))
+		want = append(want, path+" "+path)
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got hook runs: %v, want: %v", lines, want)
+	}
+
+	// a failed pre-hook leaves the file as it was
+	for _, file := range []string{"one.sls", "two.sls"} {
+		if err = ioutil.WriteFile(filepath.Join(slsDir, file), plainText, 0600); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.PreHook = "false"
+	s.ProcessDir(slsDir, "encrypt")
+	for _, file := range []string{"one.sls", "two.sls"} {
+		content, _ := ioutil.ReadFile(filepath.Join(slsDir, file))
+		if !bytes.Equal(content, plainText) {
+			t.Errorf("%s was written after its pre-hook failed", file)
+		}
+	}
+}
+
+func TestDedupeAnchors(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/dedupe"
+	filePath := dirPath + "/dedupe.sls"
+	defer os.RemoveAll(dirPath)
+
+	yamlText := `secure_vars:
+  db_password: shared text
+  api_password: shared text
+  admin_password: shared text
+  user: other text
+`
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.DedupeAnchors = true
+	if err := s.ReadBytes([]byte(yamlText)); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	buffer := s.PerformAction("encrypt")
+	sls.WriteSlsFile(buffer, filePath)
+
+	out := buffer.String()
+	anchors := regexp.MustCompile(`&[A-Za-z0-9_-]+`).FindAllString(out, -1)
+	if len(anchors) != 1 {
+		t.Fatalf("expected one anchor, got: %v\n%s", anchors, out)
+	}
+	alias := "*" + strings.TrimPrefix(anchors[0], "&")
+	if count := strings.Count(out, alias); count != 2 {
+		t.Errorf("expected 2 uses of %s, got %d\n%s", alias, count, out)
+	}
+	if count := strings.Count(out, pgpHeader); count != 2 {
+		t.Errorf("expected 2 encrypted values, got %d\n%s", count, out)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	buffer, err := s.PlainTextYamlBuffer(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if strings.Contains(buffer.String(), alias) {
+		t.Errorf("expected the aliases to be expanded:\n%s", buffer.String())
+	}
+	for _, key := range []string{"db_password", "api_password", "admin_password"} {
+		if val := s.GetValueFromPath("secure_vars:" + key); val != "shared text" {
+			t.Errorf("%s decrypted to %v", key, val)
+		}
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.KeepAnchors = true
+	buffer, err = s.PlainTextYamlBuffer(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if count := strings.Count(buffer.String(), alias); count != 2 {
+		t.Errorf("expected the aliases to be kept:\n%s", buffer.String())
+	}
+	if val := s.GetValueFromPath("secure_vars:api_password"); val != "shared text" {
+		t.Errorf("api_password decrypted to %v", val)
+	}
+}
+
+func TestSummaryOnly(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/summaryonly"
+
+	if os.Getenv("GSP_TEST_SUMMARY_ONLY") != "" {
+		sls.SummaryOnly = true
+		s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.ProcessDir(dirPath, "encrypt")
+		return
+	}
+
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+	for _, file := range []string{"one.sls", "two.sls"} {
+		if err := ioutil.WriteFile(filepath.Join(dirPath, file), []byte("secure_vars:\n  secret: text\n"), 0600); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSummaryOnly$")
+	cmd.Env = append(os.Environ(), "GSP_TEST_SUMMARY_ONLY=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("got error: %s %s", err, out)
+	}
+
+	var logLines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "time=") {
+			logLines = append(logLines, line)
+		}
+	}
+	if len(logLines) != 1 || !strings.Contains(logLines[0], "processed 2 files: 2 encrypted, 0 skipped, 0 failed") {
+		t.Errorf("expected only the summary line, got: %s", out)
+	}
+}
+
+func TestRecipientSelf(t *testing.T) {
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+
+	// a team key the operator does not have the secret key for
+	entity, err := openpgp.NewEntity("Team Key", "", "team@example.com", nil)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	// prefer SHA256, the default preference RIPEMD160 is not compiled in, and
+	// list the older ciphers so it shares one with the test keys
+	for name, identity := range entity.Identities {
+		identity.SelfSignature.PreferredHash = []uint8{8, 2}
+		identity.SelfSignature.PreferredSymmetric = []uint8{9, 8, 7, 3, 2}
+		if err = identity.SelfSignature.SignUserId(name, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+
+	newPki := func() *pki.Pki {
+		var pub bytes.Buffer
+		if err := entity.Serialize(&pub); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		pubRing, err := ioutil.ReadFile(publicKeyRing)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		pub.Write(pubRing)
+		p, err := pki.NewFromReaders("Team Key", &pub, nil)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		p.SecretKeyRing = secretKeyRing
+		return &p
+	}
+
+	p := newPki()
+	cipherText := p.EncryptSecret("text")
+	if _, err = p.DecryptSecret(cipherText); err == nil {
+		t.Fatalf("expected the team key alone not to be decryptable by the operator")
+	}
+
+	p = newPki()
+	p.RecipientSelf = true
+	self, err := p.SelfKey()
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	cipherText = p.EncryptSecret("text")
+	ids, err := pki.RecipientKeyIDs(cipherText)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("expected 2 recipients, got: %d", len(ids))
+	}
+	recipients := p.RecipientFingerprints()
+	if len(recipients) != 2 || !strings.Contains(recipients[1], pki.EntityName(self)) {
+		t.Errorf("your own key is not a recipient: %v", recipients)
+	}
+	plainText, err := p.DecryptSecret(cipherText)
+	if err != nil || plainText != "text" {
+		t.Errorf("got '%s', want: 'text' (%v)", plainText, err)
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	// a key to add, the operator does not have its secret key
+	entity, err := openpgp.NewEntity("Team Key", "", "team@example.com", nil)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	// prefer SHA256, the default preference RIPEMD160 is not compiled in, and
+	// list the older ciphers so it shares one with the test keys
+	for name, identity := range entity.Identities {
+		identity.SelfSignature.PreferredHash = []uint8{8, 2}
+		identity.SelfSignature.PreferredSymmetric = []uint8{9, 8, 7, 3, 2}
+		if err = identity.SelfSignature.SignUserId(name, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+	var pub bytes.Buffer
+	if err = entity.Serialize(&pub); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	pubRing, err := ioutil.ReadFile(publicKeyRing)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	pub.Write(pubRing)
+	p, err := pki.NewFromReaders("Dev Salt Master", &pub, nil)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	p.SecretKeyRing = secretKeyRing
+
+	dirPath := "./testdata/rewrap"
+	filePath := dirPath + "/rewrap.sls"
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, "Dev Salt Master")
+	s.Pki = &p
+	s.SetValueFromPath("secure_vars:secret", "text")
+	s.Yaml.Values["hosts"] = []interface{}{"host text"}
+	sls.WriteSlsFile(s.PerformAction("encrypt"), filePath)
+
+	_, err = s.Rewrap(filePath, nil, []string{"Dev Salt Master"})
+	if err == nil || !strings.Contains(err.Error(), "no recipients left") {
+		t.Errorf("expected an error for a value left without recipients, got: %v", err)
+	}
+
+	// add the team key and take away the key the values were encrypted to
+	buffer, err := s.Rewrap(filePath, []string{"Team Key"}, []string{"Dev Salt Master"})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	sls.WriteSlsFile(buffer, filePath)
+
+	team, _ := s.Pki.EntitiesByName([]string{"Team Key"})
+	for _, path := range []string{"secure_vars:secret", "hosts"} {
+		val := s.GetValueFromPath(path)
+		if list, ok := val.([]interface{}); ok {
+			val = list[0]
+		}
+		cipherText, _ := val.(string)
+		missing, extra, err := s.Pki.RecipientDiff(cipherText, team)
+		if err != nil || len(missing) > 0 || len(extra) > 0 {
+			t.Errorf("%s: missing %v, extra %v (%v)", path, missing, extra, err)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	depth := sls.DefaultMaxDepth + 10
+	yamlText := "secure_vars: " + strings.Repeat("{a: ", depth) + "text" + strings.Repeat("}", depth) + "\n"
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	err := s.ReadBytes([]byte(yamlText))
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("more than %d levels", sls.DefaultMaxDepth)) {
+		t.Errorf("expected a nesting error, got: %v", err)
+	}
+
+	var vals interface{} = "text"
+	for i := 0; i < depth; i++ {
+		vals = []interface{}{vals}
+	}
+	if _, err = s.ProcessValuesErr(vals, "encrypt"); err == nil {
+		t.Errorf("expected a nesting error for deeply nested lists")
+	}
+
+	s.MaxDepth = 0
+	if err = s.ReadBytes([]byte(yamlText)); err != nil {
+		t.Errorf("expected no error without a limit, got: %s", err)
+	}
+
+	s.MaxDepth = 3
+	if err = s.ReadBytes([]byte("secure_vars:\n  a:\n    b: text\n")); err != nil {
+		t.Errorf("expected no error within the limit, got: %s", err)
+	}
+	if err = s.ReadBytes([]byte("secure_vars:\n  a:\n    b:\n      - text\n")); err == nil {
+		t.Errorf("expected a nesting error one level past the limit")
+	}
+}
+
+func TestEncryptComments(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/comments"
+	filePath := dirPath + "/comments.sls"
+	defer os.RemoveAll(dirPath)
+
+	yamlText := `#!yaml|gpg
+
+secure_vars:
+  # the old password was hunter2
+  db_password: text
+  user: admin # shared with the reporting job
+`
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.EncryptComments = true
+	if err := s.ReadBytes([]byte(yamlText)); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	buffer := s.PerformAction("encrypt")
+	sls.WriteSlsFile(buffer, filePath)
+
+	out := buffer.String()
+	if strings.Contains(out, "hunter2") || strings.Contains(out, "reporting job") {
+		t.Errorf("comments were left in plain text:\n%s", out)
+	}
+	if !strings.HasPrefix(out, "#!yaml|gpg") || strings.Count(out, "#!yaml|gpg") != 1 {
+		t.Errorf("expected one renderer line at the top:\n%s", out)
+	}
+	cipherText, ok := s.GetValueFromPath(sls.CommentsKey).(string)
+	if !ok || !strings.Contains(cipherText, pgpHeader) {
+		t.Fatalf("comments were not encrypted under %s:\n%s", sls.CommentsKey, out)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	buffer, err := s.PlainTextYamlBuffer(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	out = buffer.String()
+	for _, comment := range []string{"# the old password was hunter2\n  db_password: text", "user: admin # shared with the reporting job"} {
+		if !strings.Contains(out, comment) {
+			t.Errorf("'%s' was not restored:\n%s", comment, out)
+		}
+	}
+	if strings.Contains(out, sls.CommentsKey) {
+		t.Errorf("%s was not removed:\n%s", sls.CommentsKey, out)
+	}
+}
+
+func TestRotateEncryptedComments(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/rotatecomments"
+	filePath := dirPath + "/comments.sls"
+	defer os.RemoveAll(dirPath)
+
+	yamlText := `#!yaml|gpg
+
+secure_vars:
+  # the old password was hunter2
+  db_password: text
+  user: admin # shared with the reporting job
+`
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.EncryptComments = true
+	if err := s.ReadBytes([]byte(yamlText)); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	sls.WriteSlsFile(s.PerformAction("encrypt"), filePath)
+
+	checkEncrypted := func(step string) {
+		buf, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		out := string(buf)
+		if strings.Contains(out, "hunter2") || strings.Contains(out, "reporting job") {
+			t.Errorf("comments were left in plain text after %s:\n%s", step, out)
+		}
+		if !strings.Contains(out, sls.CommentsKey) {
+			t.Errorf("%s was lost after %s:\n%s", sls.CommentsKey, step, out)
+		}
+	}
+
+	// without EncryptComments, as rotate and encrypt --update are usually run
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	limChan := make(chan bool, 1)
+	if err := s.RotateFile(filePath, limChan); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	checkEncrypted("rotate")
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	buffer, err := s.CipherTextYamlBuffer(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	sls.WriteSlsFile(buffer, filePath)
+	checkEncrypted("encrypt")
+
+	editor, _ := filepath.Abs(dirPath + "/editor.sh")
+	err = ioutil.WriteFile(editor, []byte("#!/bin/sh\nsed -i.bak 's/admin/root/' \"$1\"\nrm -f \"$1.bak\"\n"), 0700)
+	if err != nil {
+		t.Fatalf("Error writing editor script: %s", err)
+	}
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	if err = s.EditFile(filePath, editor); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	checkEncrypted("edit")
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	buffer, err = s.PlainTextYamlBuffer(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	out := buffer.String()
+	for _, comment := range []string{"# the old password was hunter2\n  db_password: text", "user: root # shared with the reporting job"} {
+		if !strings.Contains(out, comment) {
+			t.Errorf("'%s' was not restored:\n%s", comment, out)
+		}
+	}
+}
+
+func TestSecRingPerms(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	if ring := os.Getenv("GSP_TEST_PERMS"); ring != "" {
+		s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, ring, pgpKeyName)
+		if err := s.Pki.CheckSecRing(); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		return
+	}
+
+	dirPath := "./testdata/perms"
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	secring, err := ioutil.ReadFile(secretKeyRing)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	openRing := filepath.Join(dirPath, "open.gpg")
+	privateRing := filepath.Join(dirPath, "private.gpg")
+	for ring, mode := range map[string]os.FileMode{openRing: 0644, privateRing: 0600} {
+		if err = ioutil.WriteFile(ring, secring, mode); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		// the umask may have cleared bits of the mode
+		if err = os.Chmod(ring, mode); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+
+	for ring, warned := range map[string]bool{openRing: true, privateRing: false} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSecRingPerms$")
+		cmd.Env = append(os.Environ(), "GSP_TEST_PERMS="+ring)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("got error: %s %s", err, out)
+		}
+		if strings.Contains(string(out), "is readable by others") != warned {
+			t.Errorf("%s: expected warning %t, got: %s", ring, warned, out)
+		}
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, openRing, pgpKeyName)
+	s.Pki.StrictPerms = true
+	if err = s.Pki.CheckSecRing(); err == nil || !strings.Contains(err.Error(), "refusing to use it") {
+		t.Errorf("expected a strict perms error, got: %v", err)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, privateRing, pgpKeyName)
+	s.Pki.StrictPerms = true
+	if err = s.Pki.CheckSecRing(); err != nil {
+		t.Errorf("got error: %s", err)
+	}
+}
+
+func TestPathsFromFile(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/pathsfile"
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	slsPath := filepath.Join(dirPath, "paths.sls")
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:db_password", s.Pki.EncryptSecret("db text"))
+	s.SetValueFromPath("secure_vars:api_key", s.Pki.EncryptSecret("api text"))
+	s.SetValueFromPath("other_vars:token", s.Pki.EncryptSecret("token text"))
+	sls.WriteSlsFile(s.FormatBuffer(""), slsPath)
+
+	listPath := filepath.Join(dirPath, "paths.txt")
+	list := "# secrets the deploy needs\nsecure_vars:db_password\n\n  other_vars:token  \n# secure_vars:api_key\n"
+	if err := ioutil.WriteFile(listPath, []byte(list), 0600); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	paths, err := readPathsFile(listPath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if !reflect.DeepEqual(paths, []string{"secure_vars:db_password", "other_vars:token"}) {
+		t.Fatalf("unexpected paths: %v", paths)
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Error creating pipe: %s", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	if err = s.ReadSlsFile(slsPath); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	for _, path := range paths {
+		pathAction(&s, path, "decrypt")
+	}
+
+	writer.Close()
+	os.Stdout = stdout
+
+	out, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	expected := "secure_vars:db_password: db text\nother_vars:token: token text\n"
+	if string(out) != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+
+	emptyPath := filepath.Join(dirPath, "empty.txt")
+	if err = ioutil.WriteFile(emptyPath, []byte("# nothing\n\n"), 0600); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if _, err = readPathsFile(emptyPath); err == nil {
+		t.Error("expected an error for a file without paths")
+	}
+}
+
+func TestReplaceKey(t *testing.T) {
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	// the new key, the operator does not have its secret key
+	entity, err := openpgp.NewEntity("New Team Key", "", "newteam@example.com", nil)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	for name, identity := range entity.Identities {
+		identity.SelfSignature.PreferredHash = []uint8{8, 2}
+		identity.SelfSignature.PreferredSymmetric = []uint8{9, 8, 7, 3, 2}
+		if err = identity.SelfSignature.SignUserId(name, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+	var pub bytes.Buffer
+	if err = entity.Serialize(&pub); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	pubRing, err := ioutil.ReadFile(publicKeyRing)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	pub.Write(pubRing)
+	p, err := pki.NewFromReaders("Dev Salt Master", &pub, nil)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	p.SecretKeyRing = secretKeyRing
+
+	dirPath := "./testdata/replacekey"
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, "Dev Salt Master")
+	s.Pki = &p
+	keys, err := s.Pki.EntitiesByName([]string{"Dev Salt Master", "Salt Master", "New Team Key"})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	oldKey, otherKey, newKey := keys[0], keys[1], keys[2]
+
+	// one.sls mixes values encrypted to the old key with one that is not, two.sls never used the old key
+	s.SetValueFromPath("secure_vars:old", s.Pki.EncryptSecretTo("old text", []*openpgp.Entity{oldKey}))
+	s.SetValueFromPath("secure_vars:both", s.Pki.EncryptSecretTo("both text", []*openpgp.Entity{oldKey, otherKey}))
+	otherText := s.Pki.EncryptSecretTo("other text", []*openpgp.Entity{otherKey})
+	s.SetValueFromPath("secure_vars:other", otherText)
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/one.sls")
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, "Dev Salt Master")
+	s.Pki = &p
+	s.SetValueFromPath("secure_vars:other", otherText)
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/two.sls")
+	two, err := ioutil.ReadFile(dirPath + "/two.sls")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	if _, err = s.ReplaceKey(dirPath, "Dev Salt Master", "Dev Salt Master"); err == nil {
+		t.Error("expected an error replacing a key with itself")
+	}
+
+	changed, err := s.ReplaceKey(dirPath, "Dev Salt Master", "New Team Key")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if changed != 1 {
+		t.Errorf("expected 1 file to change, got %d", changed)
+	}
+
+	after, err := ioutil.ReadFile(dirPath + "/two.sls")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if !bytes.Equal(two, after) {
+		t.Error("a file without values encrypted to the old key was rewritten")
+	}
+
+	if err = s.ReadSlsFile(dirPath + "/one.sls"); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if s.GetValueFromPath("secure_vars:other") != otherText {
+		t.Error("a value not encrypted to the old key was re-encrypted")
+	}
+	for path, desired := range map[string][]*openpgp.Entity{
+		"secure_vars:old":  {newKey},
+		"secure_vars:both": {otherKey, newKey},
+	} {
+		cipherText, _ := s.GetValueFromPath(path).(string)
+		missing, extra, err := s.Pki.RecipientDiff(cipherText, desired)
+		if err != nil || len(missing) > 0 || len(extra) > 0 {
+			t.Errorf("%s: missing %v, extra %v (%v)", path, missing, extra, err)
+		}
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/manifest"
+	manifestFile := dirPath + "/recipients.yaml"
+	if err := os.MkdirAll(dirPath+"/sub", 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+	for _, file := range []string{"one.sls", "sub/two.sls"} {
+		if err := ioutil.WriteFile(filepath.Join(dirPath, file), []byte("secure_vars:\n  secret: text\n"), 0600); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.ProcessDir(dirPath, "encrypt")
+	if err := s.WriteManifest(dirPath, manifestFile); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	manifest, err := sls.ReadManifest(manifestFile)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	fingerprint := pki.FormatKeyID(s.Pki.PublicKey.PrimaryKey, pki.FingerprintKeyID)
+	for _, file := range []string{"one.sls", "sub/two.sls"} {
+		if !reflect.DeepEqual(manifest.Files[file], []string{fingerprint}) {
+			t.Errorf("%s: expected [%s], got %v", file, fingerprint, manifest.Files[file])
+		}
+	}
+
+	actual, err := s.BuildManifest(dirPath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if drift := manifest.Drift(actual); len(drift) > 0 {
+		t.Errorf("expected no drift, got: %v", drift)
+	}
+
+	// re-encrypt one file to a second key
+	recipients, err := s.Pki.EntitiesByName([]string{"Dev Salt Master", "Salt Master"})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecretTo("text", recipients))
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/sub/two.sls")
+
+	actual, err = s.BuildManifest(dirPath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	drift := manifest.Drift(actual)
+	added := pki.FormatKeyID(recipients[1].PrimaryKey, pki.FingerprintKeyID)
+	if len(drift) != 1 || drift[0] != "sub/two.sls: added "+added {
+		t.Errorf("expected sub/two.sls to have drifted, got: %v", drift)
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/verifymanifest"
+	manifestFile := dirPath + ".yaml"
+	defer os.RemoveAll(dirPath)
+	defer os.Remove(manifestFile)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret("text"))
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/one.sls")
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/two.sls")
+	if err := s.WriteManifest(dirPath, manifestFile); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	drift, err := s.VerifyManifest(manifestFile, dirPath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(drift) > 0 {
+		t.Errorf("expected a matching tree, got: %v", drift)
+	}
+
+	// one file gains a recipient, another file is new
+	recipients, err := s.Pki.EntitiesByName([]string{"Dev Salt Master", "Salt Master"})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecretTo("text", recipients))
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/two.sls")
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/three.sls")
+
+	drift, err = s.VerifyManifest(manifestFile, dirPath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	added := pki.FormatKeyID(recipients[1].PrimaryKey, pki.FingerprintKeyID)
+	expected := []string{"three.sls: not in the manifest", "two.sls: added " + added}
+	if !reflect.DeepEqual(drift, expected) {
+		t.Errorf("expected %v, got %v", expected, drift)
+	}
+
+	if _, err = s.VerifyManifest(dirPath+"/one.sls", dirPath); err == nil {
+		t.Error("expected an error for a file that is not a manifest")
+	}
+}
+
+func TestInputIsDir(t *testing.T) {
+	dirPath := "./testdata/inputdir"
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+	defer func() {
+		inputFilePath = ""
+		autoRecurse = false
+	}()
+
+	inputFilePath = dirPath
+	isDir, err := inputIsDir("encrypt")
+	if !isDir || err == nil || !strings.Contains(err.Error(), "did you mean 'encrypt recurse -d "+dirPath+"'?") {
+		t.Errorf("expected a did you mean error, got: %v", err)
+	}
+
+	autoRecurse = true
+	if isDir, err = inputIsDir("encrypt"); !isDir || err != nil {
+		t.Errorf("expected the directory to be recursed, got %t: %v", isDir, err)
+	}
+
+	inputFilePath = "./testdata/new.sls"
+	if isDir, err = inputIsDir("encrypt"); isDir || err != nil {
+		t.Errorf("expected a file not to be recursed, got %t: %v", isDir, err)
+	}
+}
+
+func TestPreserveRenderer(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/renderer"
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	docs := map[string]string{
+		"plain.sls": "#!jinja|yaml\n\nsecure_vars:\n  secret: text\n",
+		"merge.sls": "#!jinja|yaml\n\ndefaults: &defaults\n  secret: text\nsecure_vars:\n  <<: *defaults\n",
+	}
+	for name, doc := range docs {
+		filePath := filepath.Join(dirPath, name)
+		if err := ioutil.WriteFile(filePath, []byte(doc), 0600); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+
+		s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		buffer, err := s.CipherTextYamlBuffer(filePath)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if !strings.HasPrefix(buffer.String(), "#!yaml|gpg\n") {
+			t.Errorf("%s: expected the gpg renderer without --preserve-unknown-renderer, got: %s", name, buffer.String())
+		}
+
+		s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.PreserveRenderer = true
+		buffer, err = s.CipherTextYamlBuffer(filePath)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if !strings.HasPrefix(buffer.String(), "#!jinja|yaml|gpg\n") || strings.Count(buffer.String(), "#!") != 1 {
+			t.Errorf("%s: expected the renderer chain with gpg appended once, got: %s", name, buffer.String())
+		}
+		sls.WriteSlsFile(buffer, filePath)
+
+		// gpg is already in the chain, decrypting leaves it as it is
+		buffer, err = s.PlainTextYamlBuffer(filePath)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if !strings.HasPrefix(buffer.String(), "#!jinja|yaml|gpg\n") || strings.Count(buffer.String(), "#!") != 1 {
+			t.Errorf("%s: expected the renderer chain to be kept, got: %s", name, buffer.String())
+		}
+	}
+}
+
+func TestRotateChunkSize(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+	keyIDFormat = pki.LongKeyID
+
+	chunks := chunkFiles([]string{"a", "b", "c", "d", "e"}, 2)
+	if !reflect.DeepEqual(chunks, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}) {
+		t.Errorf("unexpected chunks: %v", chunks)
+	}
+
+	dirPath := "./testdata/chunks"
+	writeSyntheticTree(t, dirPath, 25)
+	defer os.RemoveAll(dirPath)
+
+	chunkSize = 10
+	defer func() { chunkSize = 0 }()
+	count, failed := processFiles(dirPath)
+	if count != 25 || len(failed) > 0 {
+		t.Errorf("expected 25 files to rotate, got %d with failures %v", count, failed)
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	slsFiles, _ := sls.FindSlsFiles(dirPath)
+	for _, file := range slsFiles {
+		if err := s.ReadSlsFile(file); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if !strings.Contains(to.String(s.GetValueFromPath("secure_vars:secret")), pgpHeader) {
+			t.Errorf("%s was not encrypted", file)
+		}
+	}
+}
+
+// TestRotateChunkSizePassphrase rotates an encrypted tree with several workers
+// sharing one passphrase protected keyring, run it with -race to check the
+// workers never decrypt the shared keys in place
+func TestRotateChunkSizePassphrase(t *testing.T) {
+	pgpKeyName = "Passphrase Test"
+	publicKeyRing, _ = filepath.Abs("./testdata/passphrase/pubring.gpg")
+	secretKeyRing, _ = filepath.Abs("./testdata/passphrase/secring.gpg")
+	topLevelElement = ""
+	keyIDFormat = pki.LongKeyID
+	passphraseCommand = "echo test passphrase"
+	defer func() { passphraseCommand = "" }()
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	dirPath := "./testdata/chunkspassphrase"
+	defer os.RemoveAll(dirPath)
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	for i := 0; i < 12; i++ {
+		s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret(fmt.Sprintf("text%d", i)))
+		filePath := filepath.Join(dirPath, fmt.Sprintf("file%d.sls", i))
+		if err := os.MkdirAll(dirPath, 0700); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		buffer := s.FormatBuffer("")
+		if err := ioutil.WriteFile(filePath, buffer.Bytes(), 0600); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+
+	chunkSize = 6
+	defer func() { chunkSize = 0 }()
+	count, failed := processFiles(dirPath)
+	if count != 12 || len(failed) > 0 {
+		t.Errorf("expected 12 files to rotate, got %d with failures %v", count, failed)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.Pki.PassphraseCommand = passphraseCommand
+	for i := 0; i < 12; i++ {
+		buffer, err := s.PlainTextYamlBuffer(filepath.Join(dirPath, fmt.Sprintf("file%d.sls", i)))
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if want := fmt.Sprintf("secret: text%d", i); !strings.Contains(buffer.String(), want) {
+			t.Errorf("file%d.sls did not decrypt to %q: %s", i, want, buffer.String())
+		}
+	}
+}
+
+// BenchmarkRotateChunkSize compares the allocations and the peak heap of
+// rotating a synthetic tree with the keyrings read for every file and shared
+// in chunks, the peak heap of a chunked run stays bounded by the chunk size
+func BenchmarkRotateChunkSize(b *testing.B) {
+	pgpKeyName = "Dev Salt Master"
+	publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	topLevelElement = ""
+	keyIDFormat = pki.LongKeyID
+	defer func() { chunkSize = 0 }()
+
+	dirPath := "./testdata/chunkbench"
+	writeSyntheticTree(b, dirPath, 200)
+	defer os.RemoveAll(dirPath)
+
+	for _, size := range []int{0, 50} {
+		b.Run(fmt.Sprintf("chunk-size-%d", size), func(b *testing.B) {
+			chunkSize = size
+			b.ReportAllocs()
+			peak := sampleHeap()
+			for i := 0; i < b.N; i++ {
+				processFiles(dirPath)
+			}
+			b.ReportMetric(float64(peak())/(1<<20), "peak-heap-MB")
+		})
+	}
+}
+
+// sampleHeap samples the heap in use until the returned func is called,
+// which returns the largest sample
+func sampleHeap() func() uint64 {
+	var peak uint64
+	stop, done := make(chan bool), make(chan bool)
+	go func() {
+		defer close(done)
+		var stats runtime.MemStats
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > peak {
+				peak = stats.HeapInuse
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() uint64 {
+		close(stop)
+		<-done
+		return peak
+	}
+}
+
+// writeSyntheticTree writes count plain text sls files spread over a few directories
+func writeSyntheticTree(tb testing.TB, dirPath string, count int) {
+	for i := 0; i < count; i++ {
+		filePath := filepath.Join(dirPath, fmt.Sprintf("dir%d", i%5), fmt.Sprintf("file%d.sls", i))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+			tb.Fatalf("got error: %s", err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte("secure_vars:\n  secret: text\n"), 0600); err != nil {
+			tb.Fatalf("got error: %s", err)
+		}
+	}
+}
+
+func TestRejectPlaceholders(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New([]string{"secure_vars:db_password"}, []string{"changeme"}, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.Placeholders = sls.DefaultPlaceholders
+	err := s.ProcessYaml()
+	if err == nil || !strings.Contains(err.Error(), "'secure_vars:db_password' is the placeholder") {
+		t.Errorf("expected a placeholder error, got: %v", err)
+	}
+
+	s = sls.New([]string{"secure_vars:db_password"}, []string{"a real secret"}, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.Placeholders = sls.DefaultPlaceholders
+	if err = s.ProcessYaml(); err != nil {
+		t.Errorf("got error: %s", err)
+	}
+
+	// without the check placeholders are encrypted as any other value
+	s = sls.New([]string{"secure_vars:db_password"}, []string{"CHANGEME"}, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	if err = s.ProcessYaml(); err != nil {
+		t.Errorf("got error: %s", err)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.Placeholders = []string{"REPLACE_ME"}
+	s.SetValueFromPath("secure_vars:api_key", "text")
+	s.Yaml.Values["hosts"] = []interface{}{"host", " replace_me "}
+	err = s.CheckPlaceholders()
+	if err == nil || !strings.Contains(err.Error(), "'hosts:1'") {
+		t.Errorf("expected a placeholder error for the list item, got: %v", err)
+	}
+	s.Yaml.Values["hosts"] = []interface{}{"host", "TODO"}
+	if err = s.CheckPlaceholders(); err != nil {
+		t.Errorf("got error: %s", err)
+	}
+}
+
+func TestSecRingCommand(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/seccommand"
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	// the command emits the test keys armored
+	secring, err := ioutil.ReadFile(secretKeyRing)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	var armored bytes.Buffer
+	writer, err := armor.Encode(&armored, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if _, err = writer.Write(secring); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	writer.Close()
+	keyFile := filepath.Join(dirPath, "secring.asc")
+	if err = ioutil.WriteFile(keyFile, armored.Bytes(), 0600); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	badFile := filepath.Join(dirPath, "bad.asc")
+	if err = ioutil.WriteFile(badFile, []byte("not a key\n"), 0600); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	// the secret keyring file does not exist, the keys only come from the command
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, filepath.Join(dirPath, "missing.gpg"), pgpKeyName)
+	s.Pki.SecRingCommand = "cat " + keyFile
+	cipherText := s.Pki.EncryptSecret("text")
+	plainText, err := s.Pki.DecryptSecret(cipherText)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if plainText != "text" {
+		t.Errorf("expected 'text', got: %s", plainText)
+	}
+
+	// the loaded keys are kept, the command is not run again
+	s.Pki.SecRingCommand = "false"
+	if _, err = s.Pki.DecryptSecret(cipherText); err != nil {
+		t.Errorf("expected the loaded keys to be kept, got: %s", err)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, filepath.Join(dirPath, "missing.gpg"), pgpKeyName)
+	s.Pki.SecRingCommand = "cat " + badFile
+	if _, err = s.Pki.DecryptSecret(cipherText); err == nil || !strings.Contains(err.Error(), "not a valid keyring") {
+		t.Errorf("expected an invalid keyring error, got: %v", err)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, filepath.Join(dirPath, "missing.gpg"), pgpKeyName)
+	s.Pki.SecRingCommand = "false"
+	if _, err = s.Pki.DecryptSecret(cipherText); err == nil || !strings.Contains(err.Error(), "secret keyring command failed") {
+		t.Errorf("expected a command error, got: %v", err)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, filepath.Join(dirPath, "missing.gpg"), pgpKeyName)
+	s.Pki.SecRingCommand = " "
+	if _, err = s.Pki.DecryptSecret(cipherText); err == nil || !strings.Contains(err.Error(), "no secret keyring command given") {
+		t.Errorf("expected an empty command error, got: %v", err)
+	}
+}
+
+func TestForceStringValues(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/forcestrings"
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	values := "  zip: \"0123\"\n  flag: \"true\"\n  answer: \"yes\"\n"
+	docs := map[string]string{
+		"plain.sls": "secure_vars:\n" + values,
+		"merge.sls": "defaults: &defaults\n" + values + "secure_vars:\n  <<: *defaults\n",
+	}
+	for name, doc := range docs {
+		filePath := filepath.Join(dirPath, name)
+		if err := ioutil.WriteFile(filePath, []byte(doc), 0600); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		buffer, err := s.CipherTextYamlBuffer(filePath)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		sls.WriteSlsFile(buffer, filePath)
+
+		s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.ForceStringValues = true
+		buffer, err = s.PlainTextYamlBuffer(filePath)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		for _, quoted := range []string{`zip: "0123"`, `flag: "true"`, `answer: "yes"`} {
+			if !strings.Contains(buffer.String(), quoted) {
+				t.Errorf("%s: expected %s in: %s", name, quoted, buffer.String())
+			}
+		}
+
+		// a YAML 1.1 reader keeps them strings
+		var vals map[string]map[string]interface{}
+		if err = yamlv2.Unmarshal(buffer.Bytes(), &vals); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		for key, want := range map[string]string{"zip": "0123", "flag": "true", "answer": "yes"} {
+			if got, ok := vals["secure_vars"][key].(string); !ok || got != want {
+				t.Errorf("%s: expected %s to be the string %q, got %#v", name, key, want, vals["secure_vars"][key])
+			}
+		}
+	}
+}
+
+func TestRecipientTree(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/recipienttree"
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	keys, err := s.Pki.EntitiesByName([]string{"Dev Salt Master", "Salt Master"})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	recipients := make([]string, len(keys))
+	for index, key := range keys {
+		recipients[index] = pki.FormatKeyID(key.PrimaryKey, pki.FingerprintKeyID) + " " + pki.EntityName(key)
+	}
+
+	// teamA uses one key, teamB the other
+	for index, team := range []string{"teamA", "teamB"} {
+		s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecretTo("text", []*openpgp.Entity{keys[index]}))
+		sls.WriteSlsFile(s.FormatBuffer(""), filepath.Join(dirPath, team, "one.sls"))
+		sls.WriteSlsFile(s.FormatBuffer(""), filepath.Join(dirPath, team, "nested", "two.sls"))
+	}
+
+	tree, err := s.RecipientTree(dirPath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	sorted := append([]string{}, recipients...)
+	sort.Strings(sorted)
+	expected := []string{
+		dirPath + "/: " + strings.Join(sorted, ", "),
+		"  teamA/: " + recipients[0],
+		"    nested/: " + recipients[0],
+		"  teamB/: " + recipients[1],
+		"    nested/: " + recipients[1],
+	}
+	if lines := tree.Lines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+
+	out, err := json.Marshal(tree)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	var decoded sls.RecipientTree
+	if err = json.Unmarshal(out, &decoded); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(decoded.Children) != 2 || decoded.Children[1].Name != "teamB" || !reflect.DeepEqual(decoded.Children[1].Recipients, []string{recipients[1]}) {
+		t.Errorf("unexpected JSON tree: %s", out)
+	}
+}
+
+func TestIgnoreDecryptErrors(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	// a key the operator does not have the secret key of
+	entity, err := openpgp.NewEntity("Other Team Key", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	for name, identity := range entity.Identities {
+		identity.SelfSignature.PreferredHash = []uint8{8, 2}
+		identity.SelfSignature.PreferredSymmetric = []uint8{9, 8, 7, 3, 2}
+		if err = identity.SelfSignature.SignUserId(name, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+
+	dirPath := "./testdata/decrypterrors"
+	filePath := dirPath + "/partial.sls"
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:mine", s.Pki.EncryptSecret("my text"))
+	s.SetValueFromPath("secure_vars:theirs", s.Pki.EncryptSecretTo("their text", []*openpgp.Entity{entity}))
+	sls.WriteSlsFile(s.FormatBuffer(""), filePath)
+
+	// strict by default, nothing is returned for the file
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	buffer, err := s.PlainTextYamlBuffer(filePath)
+	if !errors.Is(err, sls.ErrDecryptFailed) || !strings.Contains(err.Error(), "theirs:") {
+		t.Errorf("expected a decrypt error naming the value, got: %v", err)
+	}
+	if buffer.Len() > 0 {
+		t.Errorf("expected no output for the file, got: %s", buffer.String())
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.IgnoreDecryptErrors = true
+	buffer, err = s.PlainTextYamlBuffer(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if s.GetValueFromPath("secure_vars:mine") != "my text" {
+		t.Errorf("expected the value that can be decrypted to be decrypted, got: %v", s.GetValueFromPath("secure_vars:mine"))
+	}
+	if !strings.Contains(to.String(s.GetValueFromPath("secure_vars:theirs")), pgpHeader) {
+		t.Errorf("expected the value that cannot be decrypted to stay encrypted, got: %v", s.GetValueFromPath("secure_vars:theirs"))
+	}
+	if !strings.Contains(buffer.String(), "my text") {
+		t.Errorf("expected the partly decrypted file, got: %s", buffer.String())
+	}
+}
+
+func TestArmorHeaders(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	filePath := "./testdata/armorheaders/headers.sls"
+	defer os.RemoveAll(filepath.Dir(filePath))
+
+	headers, err := pki.ParseArmorHeaders([]string{"Comment=rotated 2024-01", "Rotated-By= ops "})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	for _, bad := range []string{"Comment", "=value", "Bad Key=value"} {
+		if _, err = pki.ParseArmorHeaders([]string{bad}); err == nil {
+			t.Errorf("expected an error for '%s'", bad)
+		}
+	}
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.Pki.ArmorHeaders = headers
+	cipherText := s.Pki.EncryptSecret("text")
+	if !strings.Contains(cipherText, "\nComment: rotated 2024-01\n") {
+		t.Errorf("armor header not found in: %s", cipherText)
+	}
+	plainText, err := s.Pki.DecryptSecret(cipherText)
+	if err != nil || plainText != "text" {
+		t.Errorf("expected 'text', got '%s' (%v)", plainText, err)
+	}
+
+	s.SetValueFromPath("secure_vars:secret", cipherText)
+	s.SetValueFromPath("secure_vars:plain", "text")
+	sls.WriteSlsFile(s.FormatBuffer(""), filePath)
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	found, err := s.ArmorHeaders(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	expected := []string{
+		"secure_vars:secret: Comment: rotated 2024-01",
+		"secure_vars:secret: Rotated-By: ops",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %v, got %v", expected, found)
+	}
+}
+
+func TestDecryptValue(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	cipherText := s.Pki.EncryptSecret("multi\nline text")
+
+	// copied from a file the message is indented and has no trailing newline
+	indented := "  " + strings.Replace(strings.TrimSpace(cipherText), "\n", "\n  ", -1)
+	plainText, err := decryptValue(s.Pki, "", strings.NewReader(indented))
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if plainText != "multi\nline text" {
+		t.Errorf("expected 'multi\\nline text', got '%s'", plainText)
+	}
+
+	inline, err := pki.InlineCipherText(cipherText)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	plainText, err = decryptValue(s.Pki, inline, strings.NewReader(""))
+	if err != nil || plainText != "multi\nline text" {
+		t.Errorf("expected 'multi\\nline text', got '%s' (%v)", plainText, err)
+	}
+
+	_, err = decryptValue(s.Pki, "", strings.NewReader("not a message"))
+	if err == nil || !strings.Contains(err.Error(), "not an armored PGP message") {
+		t.Errorf("expected a not an armored PGP message error, got %v", err)
+	}
+}
+
+func TestEncryptValue(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	cipherText, err := encryptValue(s.Pki, "", strings.NewReader("secret text\n"), []string{"Salt Master", "Dev Salt Master"})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	ids, err := pki.RecipientKeyIDs(cipherText)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("expected 2 recipients, got %d", len(ids))
+	}
+
+	plainText, err := decryptValue(s.Pki, "", strings.NewReader(cipherText))
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if plainText != "secret text" {
+		t.Errorf("expected 'secret text', got '%s'", plainText)
+	}
+
+	if _, err = encryptValue(s.Pki, "text", strings.NewReader(""), []string{"No Such Key"}); err == nil {
+		t.Errorf("expected an error for an unknown recipient")
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+	keyIDFormat = pki.LongKeyID
+
+	// a key the operator does not have the secret key of
+	entity, err := openpgp.NewEntity("Other Team Key", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	for name, identity := range entity.Identities {
+		identity.SelfSignature.PreferredHash = []uint8{8, 2}
+		identity.SelfSignature.PreferredSymmetric = []uint8{9, 8, 7, 3, 2}
+		if err = identity.SelfSignature.SignUserId(name, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+
+	dirPath := "./testdata/failfast"
+	defer os.RemoveAll(dirPath)
+
+	// the first file cannot be decrypted, the second can
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecretTo("their text", []*openpgp.Entity{entity}))
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/a.sls")
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret("my text"))
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/b.sls")
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	results, err := s.WalkDir(dirPath, "decrypt")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(results) != 2 || results[0].Err == nil || results[1].Err != nil {
+		t.Errorf("expected the first of 2 files to fail, got %d results", len(results))
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.FailFast = true
+	results, err = s.WalkDir(dirPath, "decrypt")
+	if !errors.Is(err, sls.ErrFailFast) {
+		t.Errorf("expected a fail fast error, got: %v", err)
+	}
+	if len(results) != 1 || !errors.Is(results[0].Err, sls.ErrDecryptFailed) {
+		t.Errorf("expected to stop after the first file, got %d results", len(results))
+	}
+
+	// one worker so the first file is finished before the second would start
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	count, failed := processFiles(dirPath)
+	if count != 2 || len(failed) != 1 {
+		t.Errorf("expected 2 files rotated with 1 failure, got %d with %v", count, failed)
+	}
+
+	failFast = true
+	defer func() { failFast = false }()
+	count, failed = processFiles(dirPath)
+	if count != 1 || len(failed) != 1 {
+		t.Errorf("expected to stop after the first file, got %d with %v", count, failed)
+	}
+	if err = rotateFiles(dirPath); !errors.Is(err, sls.ErrFailFast) {
+		t.Errorf("expected a fail fast error, got: %v", err)
+	}
+}
+
+func TestSuggestPaths(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	err := s.ReadBytes([]byte("db:\n  prod:\n    password: one\n    port: 5432\n  staging:\n    password: two\nhosts:\n  - web1\n"))
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{"db:prd:password", []string{"db:prod:password"}},
+		{"db:prod:passwrd", []string{"db:prod:password", "db:prod:port"}},
+		{"db:prod:prot", []string{"db:prod:port"}},
+		{"hosts:1", []string{"hosts:0", "hosts"}},
+		{"something:else:entirely", []string{}},
+	}
+	for _, test := range tests {
+		if suggestions := s.SuggestPaths(test.path); !reflect.DeepEqual(suggestions, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.path, test.expected, suggestions)
+		}
+	}
+}
+
+func TestNoPlainTextLogged(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	plainText := "correct horse battery staple"
+
+	dirPath := "./testdata/nolog"
+	defer os.RemoveAll(dirPath)
+	defer func() { pki.Paranoid = false }()
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", plainText)
+	s.SetValueFromPath("secure_vars:placeholder", "CHANGEME")
+	s.SetValueFromPath("secure_vars:short", "ok")
+	buffer := s.PerformAction("encrypt")
+	// a corrupted body fails in the OpenPGP library
+	lines := strings.Split(s.GetValueFromPath("secure_vars:short").(string), "\n")
+	lines[len(lines)/2] = strings.Repeat("A", len(lines[len(lines)/2]))
+	s.SetValueFromPath("secure_vars:broken", strings.Join(lines, "\n"))
+	buffer = s.FormatBuffer("")
+	sls.WriteSlsFile(buffer, filepath.Join(dirPath, "one.sls"))
+
+	for _, paranoid := range []bool{false, true} {
+		pki.Paranoid = paranoid
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		stderr := os.Stderr
+		os.Stderr = w
+
+		s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.IgnoreDecryptErrors = true
+		s.Verbose = true
+		s.ProcessDir(dirPath, "decrypt")
+		s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.OnError = sls.OnErrorContinue
+		s.Placeholders = []string{"changeme"}
+		s.ProcessDir(dirPath, "encrypt")
+
+		os.Stderr = stderr
+		w.Close()
+		logged, _ := ioutil.ReadAll(r)
+		s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+
+		if strings.Contains(string(logged), plainText) {
+			t.Errorf("a plain text value was logged: %s", logged)
+		}
+		if !strings.Contains(string(logged), "broken") || !strings.Contains(string(logged), "placeholder") {
+			t.Errorf("expected the failed values to be logged by key, got: %s", logged)
+		}
+		if strings.Contains(string(logged), "openpgp") == paranoid {
+			t.Errorf("library error text with paranoid %v: %s", paranoid, logged)
+		}
+		sls.WriteSlsFile(buffer, filepath.Join(dirPath, "one.sls"))
+	}
+}
+
+// values must never be passed to the logger or into errors, which end up logged
+func TestLogCallsLeaveOutValues(t *testing.T) {
+	valueNames := map[string]bool{"plainText": true, "strVal": true, "val": true, "vals": true,
+		"value": true, "item": true, "thing": true, "plain": true, "secret": true}
+
+	fset := token.NewFileSet()
+	for _, dir := range []string{".", "./sls", "./pki"} {
+		pkgs, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool {
+			return !strings.HasSuffix(info.Name(), "_test.go")
+		}, 0)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		for _, pkg := range pkgs {
+			ast.Inspect(pkg, func(node ast.Node) bool {
+				call, ok := node.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				sel, ok := call.Fun.(*ast.SelectorExpr)
+				if !ok {
+					return true
+				}
+				recv, ok := sel.X.(*ast.Ident)
+				if !ok || !(recv.Name == "logger" || recv.Name == "fmt" && sel.Sel.Name == "Errorf") {
+					return true
+				}
+				for _, arg := range call.Args {
+					if ident, ok := arg.(*ast.Ident); ok && valueNames[ident.Name] {
+						t.Errorf("%s: %s.%s is given the value '%s'", fset.Position(call.Pos()), recv.Name, sel.Sel.Name, ident.Name)
+					}
+				}
+				return true
+			})
+		}
+	}
+}
+
+func TestRecipientGroups(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/groups"
+	configFile := dirPath + "/gsp.yaml"
+	defer os.RemoveAll(dirPath)
+	os.MkdirAll(dirPath, 0700)
+
+	ioutil.WriteFile(configFile, []byte("groups:\n  prod: [\"Dev Salt Master\", \"Salt Master\"]\n  broken: [\"No Such Key\"]\n"), 0644)
+	cfg, err := readConfig(configFile)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	pki.Groups = cfg.Groups
+	defer func() { pki.Groups = nil }()
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, "@prod")
+	cipherText := s.Pki.EncryptSecret("text")
+	ids, err := pki.RecipientKeyIDs(cipherText)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("expected 2 recipients, got %d", len(ids))
+	}
+	if fingerprints := s.Pki.RecipientFingerprints(); len(fingerprints) != 2 {
+		t.Errorf("expected 2 recipient fingerprints, got %v", fingerprints)
+	}
+	plainText, err := s.Pki.DecryptSecret(cipherText)
+	if err != nil || plainText != "text" {
+		t.Errorf("expected 'text', got '%s' (%v)", plainText, err)
+	}
+
+	pub, err := os.Open(publicKeyRing)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	defer pub.Close()
+	for name, expected := range map[string]string{
+		"@staging": "unknown recipient group 'staging'",
+		"@broken":  "recipient group 'broken': unable to find key 'No Such Key'",
+	} {
+		pub.Seek(0, 0)
+		_, err = pki.NewFromReaders(name, pub, nil)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected '%s', got %v", name, expected, err)
+		}
+	}
+
+	ioutil.WriteFile(configFile, []byte("grops:\n  prod: [\"Salt Master\"]\n"), 0644)
+	if _, err = readConfig(configFile); err == nil {
+		t.Errorf("expected an error for an unknown setting")
+	}
+}
+
+func TestReencryptToConfig(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/reencrypt"
+	configFile := "./testdata/reencrypt.yaml"
+	defer os.RemoveAll(dirPath)
+	defer os.Remove(configFile)
+
+	ioutil.WriteFile(configFile, []byte("groups:\n  prod: [\"Dev Salt Master\", \"Salt Master\"]\nrecipients:\n  .: \"Dev Salt Master\"\n  prod: \"@prod\"\n"), 0644)
+	cfg, err := readConfig(configFile)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	pki.Groups = cfg.Groups
+	defer func() { pki.Groups = nil }()
+
+	// every file starts out encrypted to the dev key only
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret("text"))
+	for _, file := range []string{"dev.sls", "prod/one.sls", "prod/nested/two.sls"} {
+		sls.WriteSlsFile(s.FormatBuffer(""), filepath.Join(dirPath, file))
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	changed, err := s.Reencrypt(dirPath, cfg.Recipients)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if expected := []string{"prod/nested/two.sls", "prod/one.sls"}; !reflect.DeepEqual(changed, expected) {
+		t.Errorf("expected %v to change, got %v", expected, changed)
+	}
+
+	prod, err := s.Pki.KeysFor("@prod")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	for _, file := range []string{"prod/one.sls", "prod/nested/two.sls"} {
+		s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		if err = s.ReadSlsFile(filepath.Join(dirPath, file)); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		cipherText := to.String(s.GetValueFromPath("secure_vars:secret"))
+		missing, extra, err := s.Pki.RecipientDiff(cipherText, prod)
+		if err != nil || len(missing) > 0 || len(extra) > 0 {
+			t.Errorf("%s: expected the prod group, missing %v extra %v (%v)", file, missing, extra, err)
+		}
+		if plainText, _ := s.Pki.DecryptSecret(cipherText); plainText != "text" {
+			t.Errorf("%s: expected 'text', got '%s'", file, plainText)
+		}
+	}
+
+	// the tree has converged, nothing changes
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	if changed, err = s.Reencrypt(dirPath, cfg.Recipients); err != nil || len(changed) > 0 {
+		t.Errorf("expected no changes, got %v (%v)", changed, err)
+	}
+}
+
+func TestKeyCacheDir(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/keycache"
+	defer os.RemoveAll(dirPath)
+	os.MkdirAll(dirPath, 0700)
+
+	ring, err := ioutil.ReadFile(publicKeyRing)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	ringPath, _ := filepath.Abs(filepath.Join(dirPath, "pubring.gpg"))
+	ioutil.WriteFile(ringPath, ring, 0644)
+	info, _ := os.Stat(ringPath)
+
+	pki.KeyCacheDir = filepath.Join(dirPath, "cache")
+	defer func() { pki.KeyCacheDir = "" }()
+
+	s := sls.New(secretNames, secretValues, topLevelElement, ringPath, secretKeyRing, pgpKeyName)
+	fingerprint := pki.FormatKeyID(s.Pki.PublicKey.PrimaryKey, pki.FingerprintKeyID)
+	entry := filepath.Join(pki.KeyCacheDir, mustReadDirName(t, pki.KeyCacheDir))
+
+	// a keyring that cannot be parsed but has the same modification time is not read
+	ioutil.WriteFile(ringPath, []byte("not a keyring"), 0644)
+	os.Chtimes(ringPath, info.ModTime(), info.ModTime())
+	s = sls.New(secretNames, secretValues, topLevelElement, ringPath, secretKeyRing, pgpKeyName)
+	if got := pki.FormatKeyID(s.Pki.PublicKey.PrimaryKey, pki.FingerprintKeyID); got != fingerprint {
+		t.Errorf("expected the cached key %s, got %s", fingerprint, got)
+	}
+	cipherText := s.Pki.EncryptSecret("text")
+	if plainText, err := s.Pki.DecryptSecret(cipherText); err != nil || plainText != "text" {
+		t.Errorf("expected 'text', got '%s' (%v)", plainText, err)
+	}
+
+	// a changed keyring is read again, and the full keyring is read when other keys are needed
+	ioutil.WriteFile(ringPath, ring, 0644)
+	later := info.ModTime().Add(time.Minute)
+	os.Chtimes(ringPath, later, later)
+	s = sls.New(secretNames, secretValues, topLevelElement, ringPath, secretKeyRing, pgpKeyName)
+	if cached, err := os.Stat(entry); err != nil || !cached.ModTime().Equal(later) {
+		t.Errorf("expected the cache entry to be refreshed")
+	}
+	s = sls.New(secretNames, secretValues, topLevelElement, ringPath, secretKeyRing, pgpKeyName)
+	if _, err = s.Pki.EntitiesByName([]string{"Salt Master"}); err != nil {
+		t.Errorf("got error: %s", err)
+	}
+}
+
+// mustReadDirName returns the name of the only entry of dir
+func mustReadDirName(t *testing.T, dir string) string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one entry in %s, got %d (%v)", dir, len(entries), err)
+	}
+
+	return entries[0].Name()
+}
+
+func TestKeyBlockValue(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	filePath := "./testdata/keyblock/keyblock.sls"
+	defer os.RemoveAll(filepath.Dir(filePath))
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	var keyBlock bytes.Buffer
+	w, err := armor.Encode(&keyBlock, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if err = s.Pki.PublicKey.Serialize(w); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	w.Close()
+
+	s.SetValueFromPath("secure_vars:key", keyBlock.String())
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret("text"))
+	sls.WriteSlsFile(s.FormatBuffer(""), filePath)
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	_, err = s.PlainTextYamlBuffer(filePath)
+	if !errors.Is(err, sls.ErrDecryptFailed) || !strings.Contains(err.Error(), "key: "+pki.ErrKeyBlock.Error()) {
+		t.Errorf("expected a key block error, got: %v", err)
+	}
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	found, err := s.VerifyFile(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if expected := []string{"secure_vars:key: " + pki.ErrKeyBlock.Error()}; !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %v, got %v", expected, found)
+	}
+
+	if _, err = s.Pki.DecryptSecret(keyBlock.String()); !errors.Is(err, pki.ErrKeyBlock) {
+		t.Errorf("expected a key block error, got: %v", err)
+	}
+	if _, err = decryptValue(s.Pki, keyBlock.String(), strings.NewReader("")); !errors.Is(err, pki.ErrKeyBlock) {
+		t.Errorf("expected a key block error, got: %v", err)
+	}
+}
+
+func TestNormalizeArmor(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	filePath := "./testdata/normalizearmor/normalize.sls"
+	defer os.RemoveAll(filepath.Dir(filePath))
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	cipherText := s.Pki.EncryptSecret("text")
+
+	// re-wrap the body to 76 character CRLF lines with trailing whitespace, as some tools write it
+	lines := strings.Split(cipherText, "\n")
+	body := strings.Join(lines[2:len(lines)-2], "")
+	var wrapped []string
+	wrapped = append(wrapped, lines[0], "")
+	for len(body) > 76 {
+		wrapped = append(wrapped, body[:76]+"  ")
+		body = body[76:]
+	}
+	wrapped = append(wrapped, body, lines[len(lines)-2], lines[len(lines)-1])
+	mangled := strings.Join(wrapped, "\r\n") + "\r\n"
+	if mangled == cipherText {
+		t.Fatal("expected the re-wrapped armor to differ")
+	}
+
+	normalized, err := pki.NormalizeArmor(mangled)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if normalized != cipherText {
+		t.Errorf("expected:\n%s\ngot:\n%s", cipherText, normalized)
+	}
+	if again, _ := pki.NormalizeArmor(normalized); again != normalized {
+		t.Errorf("expected canonical armor to be unchanged, got:\n%s", again)
+	}
+
+	// headers are written in key order whatever order they were read in
+	withHeaders := strings.Replace(mangled, "\r\n\r\n", "\r\nVersion: other 1.0\r\nComment: from elsewhere\r\n\r\n", 1)
+	normalized, err = pki.NormalizeArmor(withHeaders)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if !strings.HasPrefix(normalized, "-----BEGIN PGP MESSAGE-----\nComment: from elsewhere\nVersion: other 1.0\n\n") {
+		t.Errorf("expected sorted headers, got:\n%s", normalized)
+	}
+
+	inline, err := pki.InlineCipherText(cipherText)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if normalized, _ = pki.NormalizeArmor(inline); normalized != inline {
+		t.Errorf("expected inline cipher text to be unchanged, got '%s'", normalized)
+	}
+	if _, err = pki.NormalizeArmor("-----BEGIN PGP MESSAGE-----\n\nnot armor\n-----END PGP MESSAGE-----"); err == nil {
+		t.Error("expected an error for a broken armored block")
+	}
+
+	s.SetValueFromPath("secure_vars:secret", mangled)
+	sls.WriteSlsFile(s.FormatBuffer(""), filePath)
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	if err = s.ReadSlsFile(filePath); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	written := s.GetValueFromPath("secure_vars:secret")
+	if written != cipherText {
+		t.Errorf("expected the written value to be canonical, got:\n%v", written)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+	keyIDFormat = pki.LongKeyID
+
+	dirPath := "./testdata/onerror"
+	defer os.RemoveAll(dirPath)
+	broken := "-----BEGIN PGP MESSAGE-----\n\nbroken\n-----END PGP MESSAGE-----"
+
+	// a.sls has a value that fails, b.sls cannot be read at all and c.sls is fine
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:password", "CHANGEME")
+	s.SetValueFromPath("secure_vars:user", "admin")
+	s.SetValueFromPath("secure_vars:token", broken)
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/a.sls")
+	if err := ioutil.WriteFile(dirPath+"/b.sls", []byte("secure_vars: [unclosed\n"), 0644); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:user", "admin")
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/c.sls")
+
+	if !sls.ValidOnError(sls.OnErrorContinue) || sls.ValidOnError("ignore") {
+		t.Error("expected only the known policies to be valid")
+	}
+
+	walk := func(policy string, action string) ([]sls.FileResult, error) {
+		s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.Placeholders = sls.DefaultPlaceholders
+		s.OnError = policy
+		return s.WalkDir(dirPath, action)
+	}
+
+	for _, action := range []string{"encrypt", "decrypt"} {
+		results, err := walk(sls.OnErrorSkipFile, action)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if len(results) != 3 || results[0].Err == nil || results[1].Err == nil || results[2].Err != nil {
+			t.Errorf("%s skip-file: expected a.sls and b.sls to fail, got %v", action, results)
+		}
+
+		results, err = walk(sls.OnErrorContinue, action)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if len(results) != 3 || results[0].Err != nil || results[1].Err == nil || results[2].Err != nil {
+			t.Errorf("%s continue: expected only b.sls to fail, got %v", action, results)
+		} else if !strings.Contains(results[0].Buffer.String(), "    broken\n") {
+			t.Errorf("%s continue: expected the broken value to be left as it is:\n%s", action, results[0].Buffer.String())
+		}
+
+		results, err = walk(sls.OnErrorAbort, action)
+		if !errors.Is(err, sls.ErrFailFast) {
+			t.Errorf("%s abort: expected a fail fast error, got: %v", action, err)
+		}
+		if len(results) != 1 {
+			t.Errorf("%s abort: expected to stop after a.sls, got %d results", action, len(results))
+		}
+	}
+
+	results, _ := walk(sls.OnErrorContinue, "encrypt")
+	out := results[0].Buffer.String()
+	if !strings.Contains(out, "password: CHANGEME") || strings.Contains(out, "user: admin") {
+		t.Errorf("expected only the placeholder to be left as plain text:\n%s", out)
+	}
+
+	// the values left as plain text are found by path in lists and nested maps
+	// whichever way the file is encrypted
+	nested := []byte("secure_vars:\n  list:\n  - CHANGEME\n  - admin\n  nested:\n    password: CHANGEME\n    user: admin\n")
+	for _, mode := range []string{"node", "resolve-anchors", "dedupe-anchors"} {
+		s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+		s.Placeholders = sls.DefaultPlaceholders
+		s.OnError = sls.OnErrorContinue
+		s.ResolveAnchors = mode == "resolve-anchors"
+		s.DedupeAnchors = mode == "dedupe-anchors"
+		if err := s.ReadBytes(nested); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		s.PerformAction("encrypt")
+		if list := s.GetValueFromPath("secure_vars:list").([]interface{}); to.String(list[0]) != "CHANGEME" || !strings.Contains(to.String(list[1]), "PGP MESSAGE") {
+			t.Errorf("%s: expected only the placeholder in the list to be left as plain text, got %v", mode, list)
+		}
+		if to.String(s.GetValueFromPath("secure_vars:nested:password")) != "CHANGEME" || !strings.Contains(to.String(s.GetValueFromPath("secure_vars:nested:user")), "PGP MESSAGE") {
+			t.Errorf("%s: expected only the nested placeholder to be left as plain text", mode)
+		}
+	}
+
+	// rotating stops starting files with abort
+	rotatePath := "./testdata/onerrorrotate"
+	defer os.RemoveAll(rotatePath)
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:token", broken)
+	sls.WriteSlsFile(s.FormatBuffer(""), rotatePath+"/a.sls")
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:user", s.Pki.EncryptSecret("admin"))
+	sls.WriteSlsFile(s.FormatBuffer(""), rotatePath+"/b.sls")
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	onError = sls.OnErrorAbort
+	defer func() { onError = "" }()
+	count, failed := processFiles(rotatePath)
+	if count != 1 || len(failed) != 1 {
+		t.Errorf("expected to stop after the first file, got %d with %v", count, failed)
+	}
+}
+
+func TestInitSlsDirectory(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/initsls"
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	keys, err := s.Pki.EntitiesByName([]string{"Dev Salt Master", "Salt Master"})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	recipients := make([]string, len(keys))
+	for index, key := range keys {
+		recipients[index] = pki.FormatKeyID(key.PrimaryKey, pki.FingerprintKeyID) + " " + pki.EntityName(key)
+	}
+
+	// the state 'prod' is prod/init.sls, the state 'prod.web' is prod/web/init.sls
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecretTo("text", []*openpgp.Entity{keys[0]}))
+	sls.WriteSlsFile(s.FormatBuffer(""), filepath.Join(dirPath, "prod", "init.sls"))
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecretTo("text", []*openpgp.Entity{keys[1]}))
+	sls.WriteSlsFile(s.FormatBuffer(""), filepath.Join(dirPath, "prod", "web", "init.sls"))
+
+	tree, err := s.RecipientTree(dirPath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	sorted := append([]string{}, recipients...)
+	sort.Strings(sorted)
+	expected := []string{
+		dirPath + "/: " + strings.Join(sorted, ", "),
+		"  prod/: " + strings.Join(sorted, ", "),
+		"    web/: " + recipients[1],
+	}
+	if lines := tree.Lines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+
+	// the policy of prod/web applies to its init.sls, the one of prod to the other
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	changed, err := s.Reencrypt(dirPath, map[string]string{"prod": "Salt Master", "prod/web": "Dev Salt Master"})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if expected := []string{"prod/init.sls", "prod/web/init.sls"}; !reflect.DeepEqual(changed, expected) {
+		t.Errorf("expected %v to change, got %v", expected, changed)
+	}
+	tree, err = s.RecipientTree(dirPath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	expected = []string{
+		dirPath + "/: " + strings.Join(sorted, ", "),
+		"  prod/: " + strings.Join(sorted, ", "),
+		"    web/: " + recipients[0],
+	}
+	if lines := tree.Lines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestConfirmOverwrite(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+	keyIDFormat = pki.LongKeyID
+
+	dirPath := "./testdata/confirm"
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret("text"))
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/one.sls")
+	before, err := ioutil.ReadFile(dirPath + "/one.sls")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	defer func(terminal func() bool, in io.Reader) {
+		stdinTerminal, promptIn, assumeYes = terminal, in, false
+	}(stdinTerminal, promptIn)
+
+	// scripts and pipes are never asked
+	stdinTerminal = func() bool { return false }
+	promptIn = strings.NewReader("n\n")
+	if err = confirmOverwrite(1); err != nil {
+		t.Errorf("expected no question without a terminal, got: %s", err)
+	}
+
+	stdinTerminal = func() bool { return true }
+	for answer, expected := range map[string]error{"n\n": errNotConfirmed, "\n": errNotConfirmed, "": errNotConfirmed, "y\n": nil, "YES\n": nil} {
+		promptIn = strings.NewReader(answer)
+		if err = confirmOverwrite(1); err != expected {
+			t.Errorf("answer %q: expected %v, got %v", answer, expected, err)
+		}
+	}
+
+	// answering no to rotating a directory leaves its files as they are
+	promptIn = strings.NewReader("n\n")
+	if err = rotateFiles(dirPath); err != errNotConfirmed {
+		t.Errorf("expected the rotation not to be confirmed, got: %v", err)
+	}
+	after, err := ioutil.ReadFile(dirPath + "/one.sls")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("expected the file not to be written")
+	}
+
+	assumeYes = true
+	promptIn = strings.NewReader("n\n")
+	if err = confirmDir(dirPath); err != nil {
+		t.Errorf("expected --assume-yes not to ask, got: %s", err)
+	}
+}
+
+func TestConfirmInPlaceCommands(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+	keyIDFormat = pki.LongKeyID
+
+	dirPath := "./testdata/confirmcommands"
+	filePath := dirPath + "/one.sls"
+
+	if command := os.Getenv("GSP_TEST_CONFIRM"); command != "" {
+		// a terminal that answers no
+		stdinTerminal = func() bool { return true }
+		promptIn = strings.NewReader("n\n")
+		inputFilePath, updateInPlace, recurseDir = filePath, true, dirPath
+		addKeys = cli.StringSlice{"Salt Master"}
+		oldKey, newKey = "Dev Salt Master", "Salt Master"
+		toConfig, configPath = true, dirPath+"/gsp.yaml"
+		for _, cmd := range appCommands {
+			if cmd.Name == command {
+				_ = cmd.Action.(func(*cli.Context) error)(nil)
+			}
+		}
+		return
+	}
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret("text"))
+	sls.WriteSlsFile(s.FormatBuffer(""), filePath)
+	before, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	for _, command := range []string{"prune", "repair", "rewrap", "replace-key", "reencrypt"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestConfirmInPlaceCommands$")
+		cmd.Env = append(os.Environ(), "GSP_TEST_CONFIRM="+command)
+		out, err := cmd.CombinedOutput()
+		if _, ok := err.(*exec.ExitError); !ok || !strings.Contains(string(out), errNotConfirmed.Error()) {
+			t.Errorf("%s: expected the overwrite not to be confirmed, got: %v %s", command, err, out)
+		}
+		after, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if !bytes.Equal(before, after) {
+			t.Errorf("%s: expected the file not to be written", command)
+		}
+	}
+}
+
+func TestBinaryFileValue(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	dirPath := "./testdata/binaryvalue"
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	defer os.RemoveAll(dirPath)
+
+	// every byte value, including NUL, invalid UTF-8 and a trailing newline
+	binary := make([]byte, 0, 257)
+	for b := 0; b < 256; b++ {
+		binary = append(binary, byte(b))
+	}
+	binary = append(binary, '\n')
+	keystore := dirPath + "/keystore.jks"
+	if err := ioutil.WriteFile(keystore, binary, 0600); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	s := sls.New([]string{"cert"}, []string{keystore}, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.ValueSource = sls.Base64FileSource{}
+	if err := s.ProcessYaml(); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	filePath := dirPath + "/binary.sls"
+	sls.WriteSlsFile(s.FormatBuffer(""), filePath)
+
+	s = sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	if err := s.ReadSlsFile(filePath); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	plainText, err := s.Pki.DecryptSecret(to.String(s.GetValueFromPath("cert")))
+	if err != nil || plainText != base64.StdEncoding.EncodeToString(binary) {
+		t.Errorf("expected the base64 of the file, got '%s' (%v)", plainText, err)
+	}
+
+	decoded := dirPath + "/decoded.jks"
+	if err = s.WriteBinaryValue("cert", decoded); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	out, err := ioutil.ReadFile(decoded)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if !bytes.Equal(out, binary) {
+		t.Errorf("expected the decoded bytes to match the original file, got %d bytes", len(out))
+	}
+	if info, _ := os.Stat(decoded); runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	// text values are not base64 and missing paths are reported
+	s.SetValueFromPath("text", s.Pki.EncryptSecret("not base64!"))
+	if err = s.WriteBinaryValue("text", decoded); err == nil {
+		t.Error("expected an error for a value that is not base64")
+	}
+	if err = s.WriteBinaryValue("missing", decoded); err == nil {
+		t.Error("expected an error for a missing path")
+	}
+}
+
+func TestOnlyIfEncrypted(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret("decrypted text"))
+	s.SetValueFromPath("secure_vars:plain", "plain text")
+	s.SetValueFromPath("other:plain", "more plain text")
+
+	if os.Getenv("GSP_TEST_ONLY_IF_ENCRYPTED") != "" {
+		onlyIfEncrypted = true
+		decryptPaths(&s, strings.Split(os.Getenv("GSP_TEST_ONLY_IF_ENCRYPTED"), ","))
+		return
+	}
+
+	if !sls.HasEncryptedValue(s.GetValueFromPath("secure_vars")) || sls.HasEncryptedValue(s.GetValueFromPath("other")) {
+		t.Error("expected only secure_vars to hold an encrypted value")
+	}
+
+	cases := []struct {
+		paths    string
+		status   int
+		printed  []string
+		withheld []string
+	}{
+		{"secure_vars:secret", 0, []string{"secure_vars:secret: decrypted text"}, nil},
+		{"secure_vars:plain", notEncryptedExitCode, nil, []string{"plain text"}},
+		{"secure_vars:secret,other", notEncryptedExitCode, []string{"secure_vars:secret: decrypted text"}, []string{"more plain text"}},
+	}
+	for _, c := range cases {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestOnlyIfEncrypted$")
+		cmd.Env = append(os.Environ(), "GSP_TEST_ONLY_IF_ENCRYPTED="+c.paths)
+		output, err := cmd.CombinedOutput()
+		status := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			status = exitErr.ExitCode()
+		}
+		if status != c.status {
+			t.Errorf("%s: expected exit status %d, got %d: %s", c.paths, c.status, status, output)
+		}
+		for _, text := range c.printed {
+			if !strings.Contains(string(output), text) {
+				t.Errorf("%s: expected '%s' to be printed, got: %s", c.paths, text, output)
+			}
+		}
+		for _, text := range c.withheld {
+			if strings.Contains(string(output), text) {
+				t.Errorf("%s: expected '%s' not to be printed, got: %s", c.paths, text, output)
+			}
+		}
+	}
+}
+
+func TestRotateToLatestSubkey(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	// a key made two days ago, whose encryption subkey is replaced below
+	older := &packet.Config{RSABits: 1024, Time: func() time.Time { return time.Now().Add(-48 * time.Hour) }}
+	entity, err := openpgp.NewEntity("Rotating Key", "", "rotating@example.com", older)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	for name, identity := range entity.Identities {
+		identity.SelfSignature.PreferredHash = []uint8{8, 2}
+		identity.SelfSignature.PreferredSymmetric = []uint8{9, 8, 7, 3, 2}
+		if err = identity.SelfSignature.SignUserId(name, entity.PrimaryKey, entity.PrivateKey, older); err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+	}
+	oldSubkey := entity.Subkeys[0].PublicKey.KeyId
+
+	dirPath := "./testdata/latestsubkey"
+	defer os.RemoveAll(dirPath)
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.Pki.PubRing = append(s.Pki.PubRing, entity)
+	s.Pki.SecRing = append(s.Pki.SecRing, entity)
+	devText := s.Pki.EncryptSecret("dev text")
+	s.SetValueFromPath("secure_vars:rotating", s.Pki.EncryptSecretTo("rotating text", []*openpgp.Entity{entity, s.Pki.PublicKey}))
+	s.SetValueFromPath("secure_vars:dev", devText)
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/one.sls")
+	s.Yaml.Values = map[string]interface{}{}
+	s.SetValueFromPath("secure_vars:dev", devText)
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/two.sls")
+
+	// nothing is superseded yet
+	changed, err := s.RotateSubkeys(dirPath)
+	if err != nil || len(changed) > 0 {
+		t.Fatalf("expected no changes before the subkey is rotated, got %v (%v)", changed, err)
+	}
+
+	// the owner adds a new encryption subkey, bound to the same primary key
+	newer, err := openpgp.NewEntity("New Subkey", "", "rotating@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	subkey := newer.Subkeys[0]
+	subkey.Sig.IssuerKeyId = &entity.PrimaryKey.KeyId
+	if err = subkey.Sig.SignKey(subkey.PublicKey, entity.PrivateKey, nil); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	entity.Subkeys = append(entity.Subkeys, subkey)
+	if latest, ok := pki.LatestEncryptionKeyID(entity, time.Now()); !ok || latest != subkey.PublicKey.KeyId {
+		t.Fatalf("expected the new subkey %016X to be the latest, got %016X", subkey.PublicKey.KeyId, latest)
+	}
+
+	changed, err = s.RotateSubkeys(dirPath)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if !reflect.DeepEqual(changed, []string{"one.sls"}) {
+		t.Errorf("expected only one.sls to change, got %v", changed)
+	}
+
+	if err = s.ReadSlsFile(dirPath + "/one.sls"); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	rotated := to.String(s.GetValueFromPath("secure_vars:rotating"))
+	ids, err := pki.RecipientKeyIDs(rotated)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	found := make(map[uint64]bool)
+	for _, id := range ids {
+		found[id] = true
+	}
+	if len(ids) != 2 || !found[subkey.PublicKey.KeyId] || found[oldSubkey] {
+		t.Errorf("expected the new subkey and the dev key, got %v", ids)
+	}
+	if plainText, err := s.Pki.DecryptSecret(rotated); err != nil || plainText != "rotating text" {
+		t.Errorf("expected 'rotating text', got '%s' (%v)", plainText, err)
+	}
+	if to.String(s.GetValueFromPath("secure_vars:dev")) != devText {
+		t.Error("expected the value encrypted to a current key to be left as it is")
+	}
+
+	// converged, a single file works the same way
+	if changed, err = s.RotateSubkeys(dirPath + "/one.sls"); err != nil || len(changed) > 0 {
+		t.Errorf("expected no changes, got %v (%v)", changed, err)
+	}
+}
+
+func TestMultipleKeys(t *testing.T) {
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, "Dev Salt Master, Salt Master")
+	if len(s.Pki.EncryptionKeys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(s.Pki.EncryptionKeys))
+	}
+	cipherText := s.Pki.EncryptSecret("text")
+	ids, err := pki.RecipientKeyIDs(cipherText)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("expected the value to be encrypted to 2 keys, got %d", len(ids))
+	}
+	keys, err := s.Pki.KeyUsedForEncryptedText(cipherText)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if !strings.Contains(keys, "Dev Salt Master") || !strings.Contains(keys, "Salt Master <saltmaster@example.com>") {
+		t.Errorf("expected both keys to be reported, got:\n%s", keys)
+	}
+	fast, err := s.Pki.KeyUsedForEncryptedTextFast(cipherText)
+	if err != nil || fast != keys {
+		t.Errorf("fast keys were incorrect, got:\n%s\nwant:\n%s", fast, keys)
+	}
+
+	pubRing, _ := s.Pki.ExpandTilde(publicKeyRing)
+	pub, err := ioutil.ReadFile(pubRing)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	p, err := pki.NewFromReaders("Dev Salt Master,devsaltmaster@example.com", bytes.NewReader(pub), nil)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if len(p.EncryptionKeys) != 1 {
+		t.Errorf("expected a key named twice to be used once, got %d keys", len(p.EncryptionKeys))
+	}
+	_, err = pki.NewFromReaders("Dev Salt Master,Nope,Also Nope", bytes.NewReader(pub), nil)
+	if err == nil || !strings.Contains(err.Error(), "'Nope', 'Also Nope'") {
+		t.Errorf("expected every missing key to be listed, got: %v", err)
+	}
+}
+
+func TestKeyInfoCommand(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	p := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+	info := p.KeyInfo(p.PublicKey)
+	want := []string{
+		"fingerprint: " + pki.FormatKeyID(p.PublicKey.PrimaryKey, pki.FingerprintKeyID) + "\n",
+		"uid: Dev Salt Master <devsaltmaster@example.com>\n",
+		"expires: never\n",
+		fmt.Sprintf("encryption subkey: %016X created ", p.PublicKey.Subkeys[0].PublicKey.KeyId),
+		"secret key: present\n",
+	}
+	for _, line := range want {
+		if !strings.Contains(info, line) {
+			t.Errorf("expected key info to contain %q, got:\n%s", line, info)
+		}
+	}
+
+	// a key whose encryption subkey expires in a day and that has no secret key here
+	entity, err := openpgp.NewEntity("Expiring Key", "", "expiring@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	subkey := entity.Subkeys[0]
+	lifetime := uint32(24 * 60 * 60)
+	subkey.Sig.KeyLifetimeSecs = &lifetime
+	if err = subkey.Sig.SignKey(subkey.PublicKey, entity.PrivateKey, nil); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	expiry := subkey.PublicKey.CreationTime.Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	info = p.KeyInfo(entity)
+	want = []string{
+		"fingerprint: " + pki.FormatKeyID(entity.PrimaryKey, pki.FingerprintKeyID) + "\n",
+		fmt.Sprintf("encryption subkey: %016X created ", subkey.PublicKey.KeyId),
+		"expires " + expiry + ", used for encryption\n",
+		"secret key: missing\n",
+	}
+	for _, line := range want {
+		if !strings.Contains(info, line) {
+			t.Errorf("expected key info to contain %q, got:\n%s", line, info)
+		}
+	}
+}
+
+func TestGnuPGKeybox(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+
+	home, err := ioutil.TempDir("", "gsp-gnupg-")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(home)
+	defer exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run()
+	gnupgHome := os.Getenv("GNUPGHOME")
+	defer os.Setenv("GNUPGHOME", gnupgHome)
+	os.Setenv("GNUPGHOME", home)
+
+	// a GnuPG 2.1 or later home has pubring.kbx and private-keys-v1.d
+	out, err := exec.Command("gpg", "--homedir", home, "--batch", "--import", publicKeyRing, secretKeyRing).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Error importing keys: %s %s", err, out)
+	}
+	pubRing := pki.DefaultPubRing()
+	if pubRing != filepath.Join(home, "pubring.kbx") {
+		t.Fatalf("pubring.kbx was not found: %s", pubRing)
+	}
+	if ring := pki.DefaultSecRing(); ring != filepath.Join(home, pki.PrivateKeysDir) {
+		t.Errorf("private-keys-v1.d was not found: %s", ring)
+	}
+
+	for _, secRing := range []string{pki.DefaultSecRing(), filepath.Join(home, "secring.gpg")} {
+		p := pki.New("Dev Salt Master", pubRing, secRing)
+		if p.PublicKey == nil {
+			t.Fatalf("key was not found in pubring.kbx")
+		}
+		plainText, err := p.DecryptSecret(p.EncryptSecret("text"))
+		if err != nil {
+			t.Fatalf("got error decrypting with %s: %s", secRing, err)
+		}
+		if plainText != "text" {
+			t.Errorf("expected 'text', got '%s'", plainText)
+		}
+	}
+}
+
+func TestOutputPerms(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+
+	for _, bad := range []string{"", "0", "0999", "01777", "rw-r-----"} {
+		if _, err := sls.ParseOutputPerms(bad); err == nil {
+			t.Errorf("expected an error for '%s'", bad)
+		}
+	}
+	perms, err := sls.ParseOutputPerms("0600")
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	dirPath := "./testdata/outputperms"
+	defer os.RemoveAll(dirPath)
+	defer func() { sls.OutputPerms = 0 }()
+
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	s.SetValueFromPath("secure_vars:secret", s.Pki.EncryptSecret("text"))
+
+	// a new file, and an existing file that was more open
+	newFile := dirPath + "/new.sls"
+	oldFile := dirPath + "/old.sls"
+	sls.WriteSlsFile(s.FormatBuffer(""), oldFile)
+	if err = os.Chmod(oldFile, 0644); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	before, err := os.Stat(oldFile)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	sls.OutputPerms = perms
+	for _, file := range []string{newFile, oldFile} {
+		sls.WriteSlsFile(s.FormatBuffer(""), file)
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("expected %s to be 0600, got %04o", file, info.Mode().Perm())
+		}
+	}
+	// the 0644 file was replaced, not written to
+	after, err := os.Stat(oldFile)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if os.SameFile(before, after) {
+		t.Error("expected the existing file to be replaced by a new one")
+	}
+	if files, _ := filepath.Glob(dirPath + "/.gsp-*"); len(files) > 0 {
+		t.Errorf("expected no temp files to be left, got %v", files)
+	}
+
+	// without --output-perms an existing file keeps its mode
+	sls.OutputPerms = 0
+	if err = os.Chmod(oldFile, 0640); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	sls.WriteSlsFile(s.FormatBuffer(""), oldFile)
+	info, err := os.Stat(oldFile)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("expected the file to stay 0640, got %04o", info.Mode().Perm())
+	}
+}
+
+func TestRotateUnreadableFiles(t *testing.T) {
+	pgpKeyName = "Dev Salt Master"
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		publicKeyRing, _ = filepath.Abs(os.Getenv("SALT_PUB_KEYRING"))
+	} else {
+		publicKeyRing = "~/.gnupg/pubring.gpg"
+	}
+
+	if os.Getenv("SALT_SEC_KEYRING") != "" {
+		secretKeyRing, _ = filepath.Abs(os.Getenv("SALT_SEC_KEYRING"))
+	} else {
+		secretKeyRing = "~/.gnupg/secring.gpg"
+	}
+	topLevelElement = ""
+	keyIDFormat = pki.LongKeyID
+
+	dirPath := "./testdata/rotateunreadable"
+	defer os.RemoveAll(dirPath)
+
+	// a file with include directives, a malformed file and a good file
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	cipherText := s.Pki.EncryptSecret("text")
+	inc := []byte("include:\n  - other\nsecure_vars:\n  user: admin\n")
+	bad := []byte("secure_vars: [unclosed\n")
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if err := ioutil.WriteFile(dirPath+"/inc.sls", inc, 0644); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	if err := ioutil.WriteFile(dirPath+"/bad.sls", bad, 0644); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	s.SetValueFromPath("secure_vars:secret", cipherText)
+	sls.WriteSlsFile(s.FormatBuffer(""), dirPath+"/good.sls")
+
+	limChan := make(chan bool, 1)
+	if err := s.RotateFile(dirPath+"/inc.sls", limChan); !errors.Is(err, sls.ErrContainsIncludes) {
+		t.Errorf("expected an include error, got: %v", err)
+	}
+	<-limChan
+
+	count, failed := processFiles(dirPath)
+	if count != 3 {
+		t.Errorf("expected 3 files to be started, got %d", count)
+	}
+	if len(failed) != 1 || filepath.Base(failed[0]) != "bad.sls" {
+		t.Errorf("expected only bad.sls to fail, got %v", failed)
+	}
+	for name, want := range map[string][]byte{"inc.sls": inc, "bad.sls": bad} {
+		got, err := ioutil.ReadFile(filepath.Join(dirPath, name))
+		if err != nil {
+			t.Fatalf("got error: %s", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("expected %s to be left as it is, got:\n%s", name, got)
+		}
+	}
+	if err := s.ReadSlsFile(dirPath + "/good.sls"); err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+	rotated := to.String(s.GetValueFromPath("secure_vars:secret"))
+	if rotated == cipherText {
+		t.Error("expected good.sls to be rotated")
+	}
+	if plainText, err := s.Pki.DecryptSecret(rotated); err != nil || plainText != "text" {
+		t.Errorf("expected 'text', got '%s' (%v)", plainText, err)
+	}
+	if err := rotateFiles(dirPath); err == nil || !strings.Contains(err.Error(), "bad.sls") {
+		t.Errorf("expected the rotation to fail for bad.sls, got: %v", err)
+	}
+}
+
 func scanString(buffer string, wantedCount int, term string) error {
 	var err error
 	encCount := 0
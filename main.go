@@ -2,10 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Everbridge/generate-secure-pillar/pki"
 	"github.com/Everbridge/generate-secure-pillar/sls"
 
 	"github.com/sirupsen/logrus"
@@ -17,22 +29,113 @@ var logger = logrus.New()
 var inputFilePath string
 var outputFilePath = os.Stdout.Name()
 var pgpKeyName string
+var pgpKeyNames cli.StringSlice
 var publicKeyRing = ""
 var secretKeyRing = ""
+var secretKeyRings cli.StringSlice
 var recurseDir string
 var secretNames cli.StringSlice
 var secretValues cli.StringSlice
 var topLevelElement string
 var yamlPath string
+var pathsFile string
+var decodeBinaryPath string
+var onlyIfEncrypted bool
+var toLatestSubkey bool
 var updateInPlace bool
+var encryptEmpty bool
+var pruneEmpty bool
+var promTextfile string
+var keyIDFormat string
+var tempDir string
+var outputFormat string
+var recipientNames cli.StringSlice
+var inlineCipherText bool
+var extensions cli.StringSlice
+var ifAbsent bool
+var ifPresent bool
+var encryptIfChanged bool
+var valueStdinJSON bool
+var fastKeys bool
+var appendValue bool
+var modifiedSince string
+var encryptKeyPattern string
+var allowNonSls bool
+var stampRotated bool
+var strictRecipients bool
+var allowedKeys cli.StringSlice
+var valueFiles cli.StringSlice
+var fileValues cli.StringSlice
+var valueEnvs cli.StringSlice
+var valueCmds cli.StringSlice
+var ndjson bool
+var allowMissing bool
+var gitStdin bool
+var allowUnchecked bool
+var maxValueSize int
+var maxDepth int
+var colorMode = colorAuto
+var separator string
+var dryRun bool
+var outputPerms string
+var summaryOnly bool
+var recipientSelf bool
+var strictPerms bool
+var addKeys cli.StringSlice
+var removeKeys cli.StringSlice
+var oldKey string
+var newKey string
+var manifestPath string
+var autoRecurse bool
+var preserveRenderer bool
+var chunkSize int
+var rejectPlaceholders bool
+var secRingCommand string
+var armorHeaders cli.StringSlice
+var cipherValue string
+var plainValue string
+var valueRecipients cli.StringSlice
+var forceStringValues bool
+var ignoreDecryptErrors bool
+var failFast bool
+var onError string
+var assumeYes bool
+var paranoid bool
+var configPath string
+var appConfig config
+var toConfig bool
+var keyCacheDir string
+var placeholders cli.StringSlice
+var resolveAnchors bool
+var stringKeys bool
+var preHook string
+var postHook string
+var failOnHook bool
+var dedupeAnchors bool
+var keepAnchors bool
+var encryptComments bool
+var sortKeys bool
+var splitDir string
+var passphraseCommand string
+var showRecipients bool
+var verbose bool
+var verifyRotation bool
+var backupDir string
+var timeout time.Duration
 
-var defaultPubRing = "~/.gnupg/pubring.gpg"
-var defaultSecRing = "~/.gnupg/secring.gpg"
+// runCtx ends when --timeout passes, newSls hands it to each Sls
+var runCtx = context.Background()
+
+// timeoutGrace is how long the current file may run on after --timeout passes
+var timeoutGrace = 30 * time.Second
+
+var defaultPubRing = pki.DefaultPubRing()
+var defaultSecRing = pki.DefaultSecRing()
 
 var inputFlag = cli.StringFlag{
 	Name:        "file, f",
-	Value:       os.Stdin.Name(),
-	Usage:       "input file (defaults to STDIN)",
+	Value:       sls.StdinPath,
+	Usage:       "input file, '-' for STDIN (defaults to STDIN)",
 	Destination: &inputFilePath,
 }
 
@@ -60,18 +163,175 @@ var secValsFlag = cli.StringSliceFlag{
 	Value: &secretValues,
 }
 
+var hookFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:        "pre-hook",
+		Usage:       "command to run before each file is written, with the file path as its last argument and in $" + sls.HookFileEnv + ", the file is not written if it fails",
+		Destination: &preHook,
+	},
+	cli.StringFlag{
+		Name:        "post-hook",
+		Usage:       "command to run after each file is written, with the file path as its last argument and in $" + sls.HookFileEnv,
+		Destination: &postHook,
+	},
+	cli.BoolFlag{
+		Name:        "fail-on-hook",
+		Usage:       "stop with an error when a hook fails instead of logging it",
+		Destination: &failOnHook,
+	},
+}
+
+var valueSourceFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "value-file",
+		Usage: "file(s) holding the secret value(s), a trailing newline is dropped",
+		Value: &valueFiles,
+	},
+	cli.StringSliceFlag{
+		Name:  "file-value",
+		Usage: "file(s) whose raw contents, base64 encoded, are the secret value(s), for binary secrets like certificates and keystores",
+		Value: &fileValues,
+	},
+	cli.StringSliceFlag{
+		Name:  "value-env",
+		Usage: "environment variable(s) holding the secret value(s)",
+		Value: &valueEnvs,
+	},
+	cli.StringSliceFlag{
+		Name:  "value-cmd",
+		Usage: "command(s) whose output is the secret value(s), a trailing newline is dropped",
+		Value: &valueCmds,
+	},
+}
+
+var valueStdinJSONFlag = cli.BoolFlag{
+	Name:        "value-stdin-json",
+	Usage:       "read a JSON object of secret names (colon paths or nested objects) to string values from STDIN",
+	Destination: &valueStdinJSON,
+}
+
+var separatorFlag = cli.StringFlag{
+	Name:        "separator",
+	Value:       sls.DefaultSeparator,
+	Usage:       "separator used to join the keys of a flattened path",
+	Destination: &separator,
+}
+
+var fastKeysFlag = cli.BoolFlag{
+	Name:        "fast",
+	Usage:       "read only the key packets of each value, without decrypting the session key",
+	Destination: &fastKeys,
+}
+
+var showRecipientsFlag = cli.BoolFlag{
+	Name:        "show-recipients",
+	Usage:       "print the fingerprint of the key(s) values were encrypted to on STDERR",
+	Destination: &showRecipients,
+}
+
+var placeholderFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:        "reject-placeholders",
+		Usage:       "refuse to encrypt a value that is a placeholder such as CHANGEME",
+		Destination: &rejectPlaceholders,
+	},
+	cli.StringSliceFlag{
+		Name:  "placeholder",
+		Usage: "value --reject-placeholders refuses, may be given more than once (default: CHANGEME, TODO, FIXME, xxx)",
+		Value: &placeholders,
+	},
+}
+
+var autoRecurseFlag = cli.BoolFlag{
+	Name:        "auto-recurse",
+	Usage:       "when --file is a directory process every sls file in it as recurse -d does",
+	Destination: &autoRecurse,
+}
+
+var writeManifestFlag = cli.StringFlag{
+	Name:        "write-manifest",
+	Usage:       "write the fingerprints of the keys each file's values are encrypted to to this file",
+	Destination: &manifestPath,
+}
+
 var updateFlag = cli.BoolFlag{
 	Name:        "update, u",
 	Usage:       "update the input file",
 	Destination: &updateInPlace,
 }
 
+var allowMissingFlag = cli.BoolFlag{
+	Name:        "allow-missing",
+	Usage:       "start from an empty document if the input file does not exist",
+	Destination: &allowMissing,
+}
+
 var dirFlag = cli.StringFlag{
 	Name:        "dir, d",
 	Usage:       "recurse over all .sls files in the given directory",
 	Destination: &recurseDir,
 }
 
+var encryptKeyPatternFlag = cli.StringFlag{
+	Name:        "encrypt-key-pattern",
+	Usage:       "only encrypt values whose map key matches the regular expression, e.g. '_(password|token|key)$'",
+	Destination: &encryptKeyPattern,
+}
+
+var dedupeAnchorsFlag = cli.BoolFlag{
+	Name:        "dedupe-anchors",
+	Usage:       "encrypt values with the same plain text once under a YAML anchor and make the others aliases of it",
+	Destination: &dedupeAnchors,
+}
+
+var encryptCommentsFlag = cli.BoolFlag{
+	Name:        "encrypt-comments",
+	Usage:       "move the comments of a file into one encrypted value under '" + sls.CommentsKey + "', decrypting restores them",
+	Destination: &encryptComments,
+}
+
+var forceStringValuesFlag = cli.BoolFlag{
+	Name:        "force-string-values",
+	Usage:       "double quote decrypted string values so values like 0123, true or yes are not read back as numbers or booleans",
+	Destination: &forceStringValues,
+}
+
+var failFastFlag = cli.BoolFlag{
+	Name:        "fail-fast",
+	Usage:       "stop at the first file that fails instead of reporting the failures after processing every file",
+	Destination: &failFast,
+}
+
+var ignoreDecryptErrorsFlag = cli.BoolFlag{
+	Name:        "ignore-decrypt-errors",
+	Usage:       "write files with the values that cannot be decrypted left encrypted instead of leaving the whole file as it is",
+	Destination: &ignoreDecryptErrors,
+}
+
+var keepAnchorsFlag = cli.BoolFlag{
+	Name:        "keep-anchors",
+	Usage:       "keep YAML anchors and aliases when decrypting instead of expanding them to separate values",
+	Destination: &keepAnchors,
+}
+
+var strictRecipientsFlag = cli.BoolFlag{
+	Name:        "strict-recipients",
+	Usage:       "fail without decrypting if any value is encrypted to a key that is not an --allowed-key",
+	Destination: &strictRecipients,
+}
+
+var allowedKeyFlag = cli.StringSliceFlag{
+	Name:  "allowed-key",
+	Usage: "key name(s), email(s), or ID(s) values may be encrypted to with --strict-recipients",
+	Value: &allowedKeys,
+}
+
+var modifiedSinceFlag = cli.StringFlag{
+	Name:        "modified-since",
+	Usage:       "only process files modified within a duration (e.g. 24h) or since an RFC 3339 timestamp",
+	Destination: &modifiedSince,
+}
+
 var appFlags = []cli.Flag{
 	cli.StringFlag{
 		Name:        "pubring, pub",
@@ -79,22 +339,171 @@ var appFlags = []cli.Flag{
 		Usage:       "PGP public keyring",
 		Destination: &publicKeyRing,
 	},
+	cli.StringSliceFlag{
+		Name:  "secring, sec",
+		Usage: "PGP private keyring, may be given more than once to merge keyrings (defaults to " + defaultSecRing + ")",
+		Value: &secretKeyRings,
+	},
+	cli.BoolFlag{
+		Name:        "strict-perms",
+		Usage:       "refuse to use a secret keyring that is readable by its group or others",
+		Destination: &strictPerms,
+	},
+	cli.StringFlag{
+		Name:        "passphrase-command",
+		Usage:       "command whose trimmed output is used as the passphrase of the secret key",
+		Destination: &passphraseCommand,
+	},
+	cli.StringFlag{
+		Name:        "secring-command",
+		Usage:       "command whose output, an armored or binary secret keyring, is read when a secret key is first needed instead of --secring",
+		Destination: &secRingCommand,
+	},
+	cli.StringSliceFlag{
+		Name:  "armor-header",
+		Usage: "key=value header added to the PGP armor of each encrypted value, may be given more than once",
+		Value: &armorHeaders,
+	},
 	cli.StringFlag{
-		Name:        "secring, sec",
-		Value:       defaultSecRing,
-		Usage:       "PGP private keyring",
-		Destination: &secretKeyRing,
+		Name:        "key-cache-dir",
+		Usage:       "cache the -k key here so later runs skip reading the public keyring until it changes",
+		Destination: &keyCacheDir,
 	},
 	cli.StringFlag{
-		Name:        "pgp_key, k",
-		Usage:       "PGP key name, email, or ID to use for encryption",
-		Destination: &pgpKeyName,
+		Name:        "config",
+		Usage:       "YAML config file defining recipient groups, e.g. 'groups: {prod: [keyA, keyB]}'",
+		Destination: &configPath,
+	},
+	cli.StringSliceFlag{
+		Name:  "pgp_key, k",
+		Usage: "PGP key name, email, or ID to use for encryption, or '@group' for the keys of a recipient group from --config, may be given more than once or comma separated to encrypt to all of them",
+		Value: &pgpKeyNames,
+	},
+	cli.BoolFlag{
+		Name:        "recipient-self",
+		Usage:       "also encrypt to your own key, the first key in the secret keyring that has its secret key",
+		Destination: &recipientSelf,
 	},
 	cli.StringFlag{
 		Name:        "element, e",
 		Usage:       "Name of the top level element under which encrypted key/value pairs are kept",
 		Destination: &topLevelElement,
 	},
+	cli.BoolFlag{
+		Name:        "encrypt-empty",
+		Usage:       "encrypt empty string values, by default they are left as empty strings",
+		Destination: &encryptEmpty,
+	},
+	cli.BoolFlag{
+		Name:        "prune-empty",
+		Usage:       "remove empty maps and lists before writing",
+		Destination: &pruneEmpty,
+	},
+	cli.StringFlag{
+		Name:        "key-id-format",
+		Value:       pki.LongKeyID,
+		Usage:       "format for key IDs in key output: short, long, or fingerprint",
+		Destination: &keyIDFormat,
+	},
+	cli.StringFlag{
+		Name:        "temp-dir",
+		Usage:       "directory for temp files holding decrypted content (defaults to /dev/shm when available)",
+		Destination: &tempDir,
+	},
+	cli.BoolFlag{
+		Name:        "inline-ciphertext",
+		Usage:       "store encrypted values as a single line of base64 prefixed with 'gpg-b64:'",
+		Destination: &inlineCipherText,
+	},
+	cli.StringSliceFlag{
+		Name:  "ext",
+		Usage: "file extension(s) to match when recursing over a directory (default: .sls)",
+		Value: &extensions,
+	},
+	cli.IntFlag{
+		Name:        "max-value-size",
+		Value:       sls.DefaultMaxValueSize,
+		Usage:       "maximum size in bytes of a plain text value to encrypt, 0 for no limit",
+		Destination: &maxValueSize,
+	},
+	cli.IntFlag{
+		Name:        "max-depth",
+		Value:       sls.DefaultMaxDepth,
+		Usage:       "maximum levels of nested maps and lists in a file, 0 for no limit",
+		Destination: &maxDepth,
+	},
+	cli.BoolFlag{
+		Name:        "resolve-anchors",
+		Usage:       "expand YAML anchors, aliases and merge keys so every value is encrypted on its own",
+		Destination: &resolveAnchors,
+	},
+	cli.BoolFlag{
+		Name:        "string-keys, canonical-paths",
+		Usage:       "treat numeric path parts as map keys under maps and as list indices only under lists, e.g. 'releases:2019:notes'",
+		Destination: &stringKeys,
+	},
+	cli.BoolFlag{
+		Name:        "preserve-unknown-renderer",
+		Usage:       "keep the '#!' renderer line a file was read with, adding '|gpg' when values are encrypted, instead of writing '#!yaml|gpg'",
+		Destination: &preserveRenderer,
+	},
+	cli.BoolFlag{
+		Name:        "sort-keys",
+		Usage:       "sort map keys alphabetically when writing files that keep their key order",
+		Destination: &sortKeys,
+	},
+	cli.BoolFlag{
+		Name:        "allow-non-sls",
+		Usage:       "check files named on STDIN whatever their extension, single file commands take any file",
+		Destination: &allowNonSls,
+	},
+	cli.BoolFlag{
+		Name:        "verbose",
+		Usage:       "list the files skipped for include directives when recursing and the keys each rotated file is encrypted to",
+		Destination: &verbose,
+	},
+	cli.StringFlag{
+		Name:        "output-perms",
+		Usage:       "octal mode such as 0640 to give every file written, new or overwritten (default new files are 0644)",
+		Destination: &outputPerms,
+	},
+	cli.BoolFlag{
+		Name:        "dry-run",
+		Usage:       "log the files that would be written and how many values changed without writing them",
+		Destination: &dryRun,
+	},
+	cli.BoolFlag{
+		Name:        "assume-yes",
+		Usage:       "overwrite files without asking, the question is only asked when stdin is a terminal",
+		Destination: &assumeYes,
+	},
+	cli.BoolFlag{
+		Name:        "paranoid",
+		Usage:       "leave the text of OpenPGP library errors out of the errors logged for values that fail to encrypt or decrypt",
+		Destination: &paranoid,
+	},
+	cli.StringFlag{
+		Name:        "onerror",
+		Value:       sls.OnErrorSkipFile,
+		Usage:       "what a failed value stops: abort (the whole run), skip-file (its file, the rest are processed) or continue (nothing, it is left as it is)",
+		Destination: &onError,
+	},
+	cli.BoolFlag{
+		Name:        "summary-only",
+		Usage:       "leave out the per file log lines when recursing and rotating, the totals at the end are still logged",
+		Destination: &summaryOnly,
+	},
+	cli.DurationFlag{
+		Name:        "timeout",
+		Usage:       "stop after this long, e.g. 10m, the current file is finished and the exit status is 124",
+		Destination: &timeout,
+	},
+	cli.StringFlag{
+		Name:        "color",
+		Value:       colorAuto,
+		Usage:       "color output: auto, always or never (auto only colors a terminal)",
+		Destination: &colorMode,
+	},
 }
 
 var appHelp = fmt.Sprintf(`%s
@@ -110,6 +519,28 @@ var appHelp = fmt.Sprintf(`%s
 	# update an existing value
 	$ generate-secure-pillar -k "Salt Master" update --name secret_name --value secret_value3 --file new.sls
 	
+	# set a value, creating the file if it does not exist
+	$ generate-secure-pillar -k "Salt Master" update --allow-missing --name secret_name --value secret_value --file new.sls
+
+	# set a value only if it is not already set
+	$ generate-secure-pillar -k "Salt Master" update --if-absent --name secret_name --value secret_value --file new.sls
+
+	# update a value, leaving the cipher text as is when the value has not changed (requires imported private key)
+	$ generate-secure-pillar -k "Salt Master" update --encrypt-if-changed --name secret_name --value secret_value --file new.sls
+
+	# append a value to the list at a path
+	$ generate-secure-pillar -k "Salt Master" update --append --name api_keys --value new_api_key --file new.sls
+
+	# create a file from a JSON object of secret names to values read from STDIN
+	$ echo '{"secure_vars": {"db_password": "secret"}}' | generate-secure-pillar -k "Salt Master" create --value-stdin-json --outfile new.sls
+
+	# create a file reading the secret value from a file, --value-env and --value-cmd read it from an environment variable or a command's output
+	$ generate-secure-pillar -k "Salt Master" create --name db_password --value-file ./db_password.txt --outfile new.sls
+
+	# store a certificate or other binary file base64 encoded, and write it back out decoded
+	$ generate-secure-pillar -k "Salt Master" create --name cert --file-value ./server.crt --outfile new.sls
+	$ generate-secure-pillar decrypt path --path secure_vars:cert --file new.sls --decode-binary ./server.crt
+
 	# encrypt all plain text values in a file
 	$ generate-secure-pillar -k "Salt Master" encrypt all --file us1.sls --outfile us1.sls
 	# or use --update flag
@@ -117,15 +548,30 @@ var appHelp = fmt.Sprintf(`%s
 	
 	# encrypt all plain text values in a file under the element 'secret_stuff'
 	$ generate-secure-pillar -k "Salt Master" --element secret_stuff encrypt all --file us1.sls --outfile us1.sls
+
+	# encrypt only the values whose key looks like a secret, leaving the others as plain text
+	$ generate-secure-pillar -k "Salt Master" encrypt all --file us1.sls --update --encrypt-key-pattern '_(password|token|key)$'
 	
 	# recurse through all sls files, encrypting all values
 	$ generate-secure-pillar -k "Salt Master" encrypt recurse -d /path/to/pillar/secure/stuff
+
+	# recurse through the sls files changed in the last day, encrypting all values
+	$ generate-secure-pillar -k "Salt Master" encrypt recurse -d /path/to/pillar/secure/stuff --modified-since 24h
 	
+	# recurse through all .yaml files, encrypting all values
+	$ generate-secure-pillar -k "Salt Master" --ext .yaml encrypt recurse -d /path/to/pillar/secure/stuff
+
 	# recurse through all sls files, decrypting all values (requires imported private key)
 	$ generate-secure-pillar decrypt recurse -d /path/to/pillar/secure/stuff
+
+	# fail without decrypting if any value is encrypted to a key other than the allowed ones
+	$ generate-secure-pillar decrypt recurse -d /path/to/pillar/secure/stuff --strict-recipients --allowed-key "Salt Master"
 	
 	# decrypt a specific existing value (requires imported private key)
 	$ generate-secure-pillar decrypt path --path "some:yaml:path" --file new.sls
+
+	# decrypt a value from a script, exiting with status 4 instead of printing it when it is still plain text
+	$ generate-secure-pillar decrypt path --only-if-encrypted --path "some:yaml:path" --file new.sls
 	
 	# decrypt all files and re-encrypt with given key (requires imported private key)
 	$ generate-secure-pillar -k "New Salt Master Key" rotate -d /path/to/pillar/secure/stuff
@@ -133,12 +579,194 @@ var appHelp = fmt.Sprintf(`%s
 	# show all PGP key IDs used in a file
 	$ generate-secure-pillar keys all --file us1.sls
 
+	# show the PGP key IDs used under the element 'secret_stuff' in a file
+	$ generate-secure-pillar --element secret_stuff keys all --file us1.sls
+
 	# show all keys used in all files in a given directory
 	$ generate-secure-pillar keys recurse -d /path/to/pillar/secure/stuff
 
+	# show all keys used in all files in a given directory, reading only the key packets of each value
+	$ generate-secure-pillar keys recurse -d /path/to/pillar/secure/stuff --fast
+
+	# encrypt a file with a header in the PGP armor of each value, then show the headers
+	$ generate-secure-pillar --armor-header "Comment=rotated 2024-01" -k "Salt Master" encrypt all --file us1.sls --update
+	$ generate-secure-pillar keys headers --file us1.sls
+
+	# export the keys used for every value in a directory as CSV
+	$ generate-secure-pillar keys recurse -d /path/to/pillar/secure/stuff --format csv > keys.csv
+
+	# stream the keys used in all files in a directory as one JSON object per line
+	$ generate-secure-pillar keys recurse -d /path/to/pillar/secure/stuff --ndjson
+
+	# show all keys used in a directory and write node-exporter metrics
+	$ generate-secure-pillar keys recurse -d /path/to/pillar/secure/stuff --prom-textfile /var/lib/node_exporter/gsp.prom
+
 	# show the PGP Key ID used for an element at a path in a file
 	$ generate-secure-pillar keys path --path "some:yaml:path" --file new.sls
 
+	# check that every value in a file is encrypted to exactly the given keys
+	$ generate-secure-pillar recipients check --file us1.sls -k "Team A" -k "Team B"
+
+	# check the cipher text in a file is intact without a secret key, e.g. after a merge
+	$ generate-secure-pillar verify-file --file us1.sls
+
+	# show which keys protect which directories of a tree
+	$ generate-secure-pillar recipients tree -d /path/to/pillar
+
+	# fail when the recipients of a directory differ from a committed manifest
+	$ generate-secure-pillar verify-manifest --manifest recipients.yaml -d /path/to/pillar/secure/stuff
+
+	# add a key to and remove a key from the recipients of every value in a file
+	$ generate-secure-pillar rewrap --add-key "Team B" --remove-key "Team A" --file us1.sls --update
+
+	# replace one key with another wherever values were encrypted to it
+	$ generate-secure-pillar replace-key --old "Team A" --new "Team A 2019" -d /path/to/pillar/secure/stuff
+
+	# reject a push containing plain text values from a git pre-receive hook
+	$ generate-secure-pillar -k "Salt Master" check --git-stdin
+
+	# check explicitly named files whatever their extension
+	$ echo pillar/secrets.yaml | generate-secure-pillar -k "Salt Master" --allow-non-sls check --git-stdin
+
+	# list the plain text values in all files in a directory as JSON
+	$ generate-secure-pillar scan recurse -d /path/to/pillar/secure/stuff --format json
+
+	# edit the decrypted contents of a file with $EDITOR (requires imported private key)
+	$ generate-secure-pillar -k "Salt Master" edit --file us1.sls
+
+	# remove empty maps and lists from a file
+	$ generate-secure-pillar prune --file us1.sls --update
+
+	# reduce repeated '#!yaml|gpg' headers in a file to one
+	$ generate-secure-pillar repair --file us1.sls --update
+
+	# encrypt YAML read from STDIN, '-' or leaving out --file both read STDIN
+	$ cat us1.sls | generate-secure-pillar -k "Salt Master" encrypt all --file - > us1.enc.sls
+
+	# decrypt a file keeping values like "0123", "true" and "yes" strings for Salt's YAML reader
+	$ generate-secure-pillar decrypt all --force-string-values --file us1.sls --update
+
+	# decrypt the values of a file that can be decrypted, leaving the rest encrypted
+	$ generate-secure-pillar decrypt all --ignore-decrypt-errors --file us1.sls --update
+
+	# encrypt a file to every key of the 'prod' recipient group defined in a config file
+	$ generate-secure-pillar --config gsp.yaml -k @prod encrypt all --file us1.sls --update
+
+	# re-encrypt a directory so each file is encrypted to the recipients its directory has in a config file
+	$ generate-secure-pillar --config gsp.yaml -k @prod reencrypt --to-config -d /path/to/pillar
+
+	# encrypt files one at a time in a loop, reading the public keyring only on the first run
+	$ for f in *.sls; do generate-secure-pillar --key-cache-dir ~/.cache/gsp -k "Salt Master" encrypt all --file $f --update; done
+
+	# encrypt a directory from a script run in a terminal without being asked to confirm
+	$ generate-secure-pillar --assume-yes encrypt recurse -d /path/to/pillar/secure/stuff
+
+	# decrypt a directory, logging only this tool's own text for values that fail to decrypt
+	$ generate-secure-pillar --paranoid decrypt recurse -d /path/to/pillar/secure/stuff
+
+	# decrypt a directory, stopping at the first file that fails
+	$ generate-secure-pillar decrypt recurse -d /path/to/pillar/secure/stuff --fail-fast
+
+	# encrypt a directory, leaving values that fail the checks as they are instead of skipping their files
+	$ generate-secure-pillar --onerror continue encrypt recurse -d /path/to/pillar/secure/stuff
+
+	# decrypt a file to one file per value, e.g. /run/secrets/secure_vars.db_password
+	$ generate-secure-pillar decrypt all --file us1.sls --split-dir /run/secrets
+
+	# encrypt a file with every aliased value expanded and encrypted on its own
+	$ generate-secure-pillar --resolve-anchors encrypt all --file us1.sls --update
+
+	# encrypt to the team key and to your own key so you can still decrypt the file
+	$ generate-secure-pillar -k "Team Key" --recipient-self encrypt all --file us1.sls --update
+
+	# encrypt to a CI key and to each operator's key so any of them can decrypt the file
+	$ generate-secure-pillar -k "CI Key" -k "Alice" -k "Bob" encrypt all --file us1.sls --update
+
+	# update a value in a map keyed by year
+	$ generate-secure-pillar -k "Salt Master" --string-keys update --name releases:2019:password --value secret --file new.sls
+
+	# encrypt a '#!jinja|yaml' file, writing '#!jinja|yaml|gpg' instead of '#!yaml|gpg'
+	$ generate-secure-pillar -k "Salt Master" --preserve-unknown-renderer encrypt all --file us1.sls --update
+
+	# encrypt a file with each repeated value encrypted once under a YAML anchor
+	$ generate-secure-pillar -k "Salt Master" encrypt all --dedupe-anchors --file us1.sls --update
+
+	# encrypt a file, refusing values left as CHANGEME, TODO, FIXME or xxx
+	$ generate-secure-pillar -k "Salt Master" encrypt all --reject-placeholders --file us1.sls --update
+
+	# encrypt a file's comments along with its values
+	$ generate-secure-pillar -k "Salt Master" encrypt all --encrypt-comments --file us1.sls --update
+
+	# encrypt a directory and record the keys each file is encrypted to for CI to check
+	$ generate-secure-pillar -k "Salt Master" encrypt recurse -d /path/to/pillar/secure/stuff --write-manifest recipients.yaml
+
+	# encrypt every file in a directory given to --file as if it were given to recurse -d
+	$ generate-secure-pillar -k "Salt Master" encrypt all --file /path/to/pillar/secure/stuff --auto-recurse
+
+	# encrypt a directory writing each file 0640 for the salt group to read
+	$ generate-secure-pillar --output-perms 0640 -k "Salt Master" encrypt recurse -d /path/to/pillar/secure/stuff
+
+	# show which files encrypting a directory would change without writing them
+	$ generate-secure-pillar --dry-run encrypt recurse -d /path/to/pillar/secure/stuff
+
+	# refresh a cache after each file a recursive encrypt writes
+	$ generate-secure-pillar -k "Salt Master" encrypt recurse -d /path/to/pillar/secure/stuff --post-hook "/usr/local/bin/refresh-cache"
+
+	# encrypt a directory logging only the totals at the end
+	$ generate-secure-pillar --summary-only encrypt recurse -d /path/to/pillar/secure/stuff
+
+	# encrypt a directory in CI, stopping with exit status 124 after ten minutes
+	$ generate-secure-pillar --timeout 10m encrypt recurse -d /path/to/pillar/secure/stuff
+
+	# list the values in a file as flat 'a.b.c = <value>' lines and rebuild the file from them
+	$ generate-secure-pillar flatten --file us1.sls --outfile us1.flat
+	$ generate-secure-pillar unflatten --file us1.flat --outfile us1.sls
+
+	# show the fingerprint, expiry and encryption subkeys of a key before using it
+	$ generate-secure-pillar -k "Salt Master" key-info
+
+	# verify the keyrings with an encrypt/decrypt round-trip (requires imported private key)
+	$ generate-secure-pillar -k "Salt Master" selfcheck
+
+	# encrypt a file and print the fingerprint of the key it was encrypted to
+	$ generate-secure-pillar -k "Salt Master" encrypt all --file us1.sls --update --show-recipients
+
+	# decrypt a file with a passphrase protected secret key, the passphrase is read from a credential helper
+	$ generate-secure-pillar --passphrase-command "pass show salt/gpg" decrypt all --file us1.sls
+
+	# decrypt a file with a secret key fetched only when it is needed, it is never written to disk
+	$ generate-secure-pillar --secring-command "vault kv get -field=key secret/salt/gpg" decrypt all --file us1.sls
+
+	# decrypt a file, refusing a secret keyring that others can read
+	$ generate-secure-pillar --strict-perms decrypt all --file us1.sls
+
+	# rotate a directory, keeping copies of the original files under a backup directory
+	$ generate-secure-pillar -k "New Salt Master Key" rotate -d /path/to/pillar/secure/stuff --backup-dir /path/to/backup
+
+	# rotate a directory, checking that every new value decrypts before writing each file
+	$ generate-secure-pillar -k "New Salt Master Key" rotate -d /path/to/pillar/secure/stuff --verify-rotation
+
+	# rotate a directory, noting when and to which key each value was rotated in a comment
+	$ generate-secure-pillar -k "New Salt Master Key" rotate -d /path/to/pillar/secure/stuff --stamp-rotated
+
+	# decrypt each path listed in a file, one per line
+	$ generate-secure-pillar decrypt path --file us1.sls --paths-from-file paths.txt
+
+	# encrypt a single value to two keys for pasting into a file managed elsewhere
+	$ echo -n "secret" | generate-secure-pillar -k "Salt Master" encrypt value --recipient "Dev Salt Master"
+
+	# decrypt a single armored value copied from a file
+	$ pbpaste | generate-secure-pillar decrypt value
+
+	# rotate a large directory 500 files at a time to keep memory use flat
+	$ generate-secure-pillar -k "New Salt Master Key" rotate -d /path/to/pillar/secure/stuff --chunk-size 500
+
+	# re-encrypt only the values encrypted to a subkey its owner has since replaced
+	$ generate-secure-pillar rotate --to-latest-subkey -d /path/to/pillar/secure/stuff
+
+	# decrypt a file with keys split across more than one secret keyring
+	$ generate-secure-pillar --secring ~/.gnupg/secring.gpg --secring team.gpg decrypt all --file us1.sls --update
+
 `, cli.AppHelpTemplate)
 
 var appCommands = []cli.Command{
@@ -147,41 +775,94 @@ var appCommands = []cli.Command{
 		Aliases: []string{"c"},
 		Usage:   "create a new sls file",
 		Action: func(c *cli.Context) error {
-			s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
-			s.ProcessYaml()
+			readStdinSecrets()
+			source := valueSource()
+			s := newSls()
+			s.ValueSource = source
+			err := s.ProcessYaml()
+			if err != nil {
+				logger.Fatal(err)
+			}
 			buffer := s.FormatBuffer("")
 			sls.WriteSlsFile(buffer, outputFilePath)
+			printRecipients(&s)
 			return nil
 		},
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			outputFlag,
 			secNamesFlag,
 			secValsFlag,
-		},
+			valueStdinJSONFlag,
+			showRecipientsFlag,
+		}, append(valueSourceFlags, placeholderFlags...)...),
 	},
 	{
 		Name:    "update",
 		Aliases: []string{"u"},
 		Usage:   "update the value of the given key in the given file",
 		Action: func(c *cli.Context) error {
-			if inputFilePath != os.Stdin.Name() {
-				outputFilePath = inputFilePath
+			if err := resolveFilePaths(!isStdin(inputFilePath)); err != nil {
+				logger.Fatal(err)
+			}
+			if ifAbsent && ifPresent {
+				logger.Fatal("--if-absent and --if-present cannot be used together")
+			}
+			if valueStdinJSON && isStdin(inputFilePath) {
+				logger.Fatal("--value-stdin-json reads STDIN, --file must name a file")
+			}
+			readStdinSecrets()
+			source := valueSource()
+			s := newSls()
+			s.ValueSource = source
+			s.IfAbsent = ifAbsent
+			s.IfPresent = ifPresent
+			s.AllowMissing = allowMissing
+			s.EncryptIfChanged = encryptIfChanged
+			s.Append = appendValue
+			if encryptIfChanged {
+				requireSecRing(&s)
 			}
-			s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
 			err := s.ReadSlsFile(inputFilePath)
 			if err != nil {
 				logger.Fatal(err)
 			}
-			s.ProcessYaml()
+			err = s.ProcessYaml()
+			if err != nil {
+				logger.Fatal(err)
+			}
 			buffer := s.FormatBuffer("")
 			sls.WriteSlsFile(buffer, outputFilePath)
+			printRecipients(&s)
 			return nil
 		},
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			inputFlag,
 			secNamesFlag,
 			secValsFlag,
-		},
+			valueStdinJSONFlag,
+			allowMissingFlag,
+			showRecipientsFlag,
+			cli.BoolFlag{
+				Name:        "if-absent",
+				Usage:       "only set values for paths that do not already have one",
+				Destination: &ifAbsent,
+			},
+			cli.BoolFlag{
+				Name:        "if-present",
+				Usage:       "only update values for paths that already have one",
+				Destination: &ifPresent,
+			},
+			cli.BoolFlag{
+				Name:        "encrypt-if-changed",
+				Usage:       "only re-encrypt values whose existing value decrypts to different plain text (requires the secret keyring)",
+				Destination: &encryptIfChanged,
+			},
+			cli.BoolFlag{
+				Name:        "append",
+				Usage:       "append the values to the list at each path instead of replacing it",
+				Destination: &appendValue,
+			},
+		}, valueSourceFlags...),
 	},
 	{
 		Name:    "encrypt",
@@ -193,29 +874,87 @@ var appCommands = []cli.Command{
 		Subcommands: []cli.Command{
 			{
 				Name: "all",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					inputFlag,
 					outputFlag,
 					updateFlag,
-				},
+					allowMissingFlag,
+					showRecipientsFlag,
+					encryptKeyPatternFlag,
+					dedupeAnchorsFlag,
+					encryptCommentsFlag,
+					autoRecurseFlag,
+				}, placeholderFlags...),
 				Action: func(c *cli.Context) error {
-					s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
-					if inputFilePath != os.Stdin.Name() && updateInPlace {
-						outputFilePath = inputFilePath
+					s := newSls()
+					s.AllowMissing = allowMissing
+					setKeyPattern(&s)
+					if recurseInput("encrypt") {
+						if err := confirmDir(inputFilePath); err != nil {
+							logger.Fatal(err)
+						}
+						processDir(&s, inputFilePath, "encrypt")
+						printRecipients(&s)
+						return nil
+					}
+					if err := resolveFilePaths(updateInPlace); err != nil {
+						logger.Fatal(err)
+					}
+					if err := confirmUpdate(); err != nil {
+						logger.Fatal(err)
 					}
 					buffer, err := s.CipherTextYamlBuffer(inputFilePath)
 					safeWrite(buffer, err)
+					printRecipients(&s)
 					return nil
 				},
 			},
 			{
 				Name: "recurse",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					dirFlag,
+					modifiedSinceFlag,
+					showRecipientsFlag,
+					encryptKeyPatternFlag,
+					dedupeAnchorsFlag,
+					encryptCommentsFlag,
+					writeManifestFlag,
+					failFastFlag,
+				}, append(hookFlags, placeholderFlags...)...),
+				Action: func(c *cli.Context) error {
+					s := newSls()
+					setKeyPattern(&s)
+					if err := confirmDir(recurseDir); err != nil {
+						logger.Fatal(err)
+					}
+					processDir(&s, recurseDir, "encrypt")
+					printRecipients(&s)
+					writeManifest(&s, recurseDir)
+					return nil
+				},
+			},
+			{
+				Name:  "value",
+				Usage: "encrypt a single value read from STDIN and print the armored PGP message",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:        "value",
+						Usage:       "value to encrypt instead of reading STDIN",
+						Destination: &plainValue,
+					},
+					cli.StringSliceFlag{
+						Name:  "recipient, r",
+						Usage: "also encrypt to this key name, email, or ID, may be given more than once",
+						Value: &valueRecipients,
+					},
 				},
 				Action: func(c *cli.Context) error {
-					s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
-					s.ProcessDir(recurseDir, "encrypt")
+					s := newSls()
+					cipherText, err := encryptValue(s.Pki, plainValue, os.Stdin, valueRecipients)
+					if err != nil {
+						logger.Fatal(err)
+					}
+					fmt.Print(cipherText)
 					return nil
 				},
 			},
@@ -236,25 +975,74 @@ var appCommands = []cli.Command{
 					inputFlag,
 					outputFlag,
 					updateFlag,
+					separatorFlag,
+					cli.StringFlag{
+						Name:        "split-dir",
+						Usage:       "write each decrypted value to its own 0600 file in this directory instead of writing YAML",
+						Destination: &splitDir,
+					},
+					strictRecipientsFlag,
+					allowedKeyFlag,
+					keepAnchorsFlag,
+					forceStringValuesFlag,
+					ignoreDecryptErrorsFlag,
+					autoRecurseFlag,
 				},
 				Action: func(c *cli.Context) error {
-					s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
-					if inputFilePath != os.Stdin.Name() && updateInPlace {
-						outputFilePath = inputFilePath
+					s := newSls()
+					if recurseInput("decrypt") {
+						setAllowedRecipients(&s)
+						checkAllowedRecipients(&s, inputFilePath)
+						if err := confirmDir(inputFilePath); err != nil {
+							logger.Fatal(err)
+						}
+						processDir(&s, inputFilePath, "decrypt")
+						return nil
+					}
+					if err := resolveFilePaths(updateInPlace); err != nil {
+						logger.Fatal(err)
 					}
+					if splitDir == "" {
+						if err := confirmUpdate(); err != nil {
+							logger.Fatal(err)
+						}
+					}
+					requireSecRing(&s)
+					setAllowedRecipients(&s)
 					buffer, err := s.PlainTextYamlBuffer(inputFilePath)
+					if splitDir != "" {
+						if err == nil {
+							err = s.WriteSplitDir(splitDir, separator)
+						}
+						if err != nil {
+							logger.Fatal(err)
+						}
+						return nil
+					}
 					safeWrite(buffer, err)
 					return nil
 				},
 			},
 			{
 				Name: "recurse",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					dirFlag,
-				},
+					modifiedSinceFlag,
+					strictRecipientsFlag,
+					allowedKeyFlag,
+					keepAnchorsFlag,
+					forceStringValuesFlag,
+					ignoreDecryptErrorsFlag,
+					failFastFlag,
+				}, hookFlags...),
 				Action: func(c *cli.Context) error {
-					s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
-					s.ProcessDir(recurseDir, "decrypt")
+					s := newSls()
+					setAllowedRecipients(&s)
+					checkAllowedRecipients(&s, recurseDir)
+					if err := confirmDir(recurseDir); err != nil {
+						logger.Fatal(err)
+					}
+					processDir(&s, recurseDir, "decrypt")
 					return nil
 				},
 			},
@@ -267,44 +1055,147 @@ var appCommands = []cli.Command{
 						Usage:       "YAML path to decrypt",
 						Destination: &yamlPath,
 					},
+					ignoreDecryptErrorsFlag,
+					cli.StringFlag{
+						Name:        "paths-from-file",
+						Usage:       "file of YAML paths to decrypt, one per line, blank lines and '#' comments are skipped",
+						Destination: &pathsFile,
+					},
+					cli.BoolFlag{
+						Name:        "only-if-encrypted",
+						Usage:       "leave out paths holding no encrypted value and exit with status 4 after printing the rest",
+						Destination: &onlyIfEncrypted,
+					},
+					cli.StringFlag{
+						Name:        "decode-binary",
+						Usage:       "base64 decode the value at --path, as stored by --file-value, and write the bytes to this 0600 file instead of printing it",
+						Destination: &decodeBinaryPath,
+					},
 				},
 				Action: func(c *cli.Context) error {
-					s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+					paths := []string{yamlPath}
+					if pathsFile != "" {
+						var err error
+						if paths, err = readPathsFile(pathsFile); err != nil {
+							logger.Fatal(err)
+						}
+						if yamlPath != "" {
+							paths = append([]string{yamlPath}, paths...)
+						}
+					}
+					if decodeBinaryPath != "" && len(paths) != 1 {
+						logger.Fatal("--decode-binary writes a single value, give one --path")
+					}
+					s := newSls()
 					err := s.ReadSlsFile(inputFilePath)
 					if err != nil {
 						logger.Fatal(err)
 					}
-					pathAction(&s, yamlPath, "decrypt")
+					if decodeBinaryPath != "" {
+						if err = s.WriteBinaryValue(paths[0], decodeBinaryPath); err != nil {
+							logger.Fatal(err)
+						}
+						return nil
+					}
+					decryptPaths(&s, paths)
 
 					return nil
 				},
 			},
+			{
+				Name:  "value",
+				Usage: "decrypt a single armored PGP message read from STDIN and print the plain text",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:        "value",
+						Usage:       "armored PGP message to decrypt instead of reading STDIN",
+						Destination: &cipherValue,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					s := newSls()
+					plainText, err := decryptValue(s.Pki, cipherValue, os.Stdin)
+					if err != nil {
+						logger.Fatal(err)
+					}
+					fmt.Println(plainText)
+					return nil
+				},
+			},
 		},
 	},
 	{
 		Name:    "rotate",
 		Aliases: []string{"r"},
 		Usage:   "decrypt existing files and re-encrypt with a new key",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			dirFlag,
+			modifiedSinceFlag,
 			cli.StringFlag{
 				Name:        "infile, f",
 				Usage:       "input file",
 				Destination: &inputFilePath,
 			},
-		},
+			cli.StringFlag{
+				Name:        "backup-dir",
+				Usage:       "copy each file to the same relative path under this directory before rotating it",
+				Destination: &backupDir,
+			},
+			cli.BoolFlag{
+				Name:        "verify-rotation",
+				Usage:       "decrypt each new value and only write the file if all of them match the original plain text",
+				Destination: &verifyRotation,
+			},
+			cli.IntFlag{
+				Name:        "chunk-size",
+				Usage:       "rotate the files of a directory this many at a time, reading the keyrings once and freeing memory between chunks",
+				Destination: &chunkSize,
+			},
+			cli.BoolFlag{
+				Name:        "stamp-rotated",
+				Usage:       "write a '# rotated: <time> by <key id>' comment above each rotated value",
+				Destination: &stampRotated,
+			},
+			cli.BoolFlag{
+				Name:        "to-latest-subkey",
+				Usage:       "only re-encrypt values encrypted to an encryption subkey their recipient has since replaced, to the same recipients",
+				Destination: &toLatestSubkey,
+			},
+			writeManifestFlag,
+			ignoreDecryptErrorsFlag,
+			failFastFlag,
+		}, hookFlags...),
 		Action: func(c *cli.Context) error {
+			if toLatestSubkey {
+				rotateSubkeys()
+				return nil
+			}
 			if inputFilePath != "" {
-				s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+				if manifestPath != "" {
+					logger.Fatal("--write-manifest records a directory, use it with --dir")
+				}
+				if err := confirmOverwrite(1); err != nil {
+					logger.Fatal(err)
+				}
+				s := newSls()
+				requireSecRing(&s)
+				logRotateTarget(&s)
+				s.BackupDir = backupDir
+				s.BackupRoot = filepath.Dir(inputFilePath)
 				limChan := make(chan bool, 1)
 				s.RotateFile(inputFilePath, limChan)
 				<-limChan
 				close(limChan)
 			} else {
 				err := rotateFiles(recurseDir)
+				if errors.Is(err, sls.ErrTimedOut) {
+					os.Exit(sls.TimeoutExitCode)
+				}
 				if err != nil {
 					logger.Fatalf("%s", err)
 				}
+				s := newSls()
+				writeManifest(&s, recurseDir)
 			}
 			return nil
 		},
@@ -323,11 +1214,13 @@ var appCommands = []cli.Command{
 				Flags: []cli.Flag{
 					inputFlag,
 					outputFlag,
+					fastKeysFlag,
 				},
 				Action: func(c *cli.Context) error {
-					s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
-					if inputFilePath != os.Stdin.Name() && updateInPlace {
-						outputFilePath = inputFilePath
+					s := newSls()
+					s.FastKeys = fastKeys
+					if err := resolveFilePaths(updateInPlace); err != nil {
+						logger.Fatal(err)
 					}
 					buffer, err := s.KeysForYamlBuffer(inputFilePath)
 					if err != nil {
@@ -341,10 +1234,47 @@ var appCommands = []cli.Command{
 				Name: "recurse",
 				Flags: []cli.Flag{
 					dirFlag,
+					modifiedSinceFlag,
+					cli.StringFlag{
+						Name:        "prom-textfile",
+						Usage:       "write node-exporter textfile metrics to the given path",
+						Destination: &promTextfile,
+					},
+					cli.BoolFlag{
+						Name:        "ndjson",
+						Usage:       "print one JSON object per file as each file is processed",
+						Destination: &ndjson,
+					},
+					fastKeysFlag,
+					cli.StringFlag{
+						Name:        "format",
+						Value:       "text",
+						Usage:       "output format: text or csv (file,path,keyid,uid rows for every recipient of every value)",
+						Destination: &outputFormat,
+					},
 				},
 				Action: func(c *cli.Context) error {
-					s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
-					s.ProcessDir(recurseDir, "validate")
+					s := newSls()
+					s.NDJSON = ndjson
+					s.FastKeys = fastKeys
+					switch outputFormat {
+					case "text":
+					case "csv":
+						if ndjson {
+							logger.Fatal("--ndjson cannot be used with --format csv")
+						}
+						s.KeysCSV = true
+					default:
+						logger.Fatalf("unknown format: %s", outputFormat)
+					}
+					if promTextfile != "" {
+						stats := s.ScanDir(recurseDir)
+						err := sls.WritePromTextfile(stats, promTextfile)
+						if err != nil {
+							logger.Fatalf("error writing metrics: %s", err)
+						}
+					}
+					processDir(&s, recurseDir, "validate")
 					return nil
 				},
 			},
@@ -359,7 +1289,7 @@ var appCommands = []cli.Command{
 					},
 				},
 				Action: func(c *cli.Context) error {
-					s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+					s := newSls()
 					err := s.ReadSlsFile(inputFilePath)
 					if err != nil {
 						logger.Fatal(err)
@@ -369,12 +1299,510 @@ var appCommands = []cli.Command{
 					return nil
 				},
 			},
-		},
-	},
-}
-
-func main() {
-	app := cli.NewApp()
+			{
+				Name:  "headers",
+				Usage: "show the armor headers of each encrypted value",
+				Flags: []cli.Flag{
+					inputFlag,
+				},
+				Action: func(c *cli.Context) error {
+					s := newSls()
+					headers, err := s.ArmorHeaders(inputFilePath)
+					if err != nil {
+						logger.Fatal(err)
+					}
+					for _, header := range headers {
+						fmt.Println(header)
+					}
+					return nil
+				},
+			},
+		},
+	},
+	{
+		Name:  "recipients",
+		Usage: "check the recipients of encrypted values",
+		Action: func(c *cli.Context) error {
+			return cli.ShowCommandHelp(c, "")
+		},
+		Subcommands: []cli.Command{
+			{
+				Name: "check",
+				Flags: []cli.Flag{
+					inputFlag,
+					cli.StringSliceFlag{
+						Name:  "key, k",
+						Usage: "desired recipient key name(s), email(s), or ID(s)",
+						Value: &recipientNames,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					s := newSls()
+					diffs, err := s.CheckRecipients(inputFilePath, recipientNames)
+					if err != nil {
+						logger.Fatal(err)
+					}
+					color := newColor()
+					for _, diff := range diffs {
+						switch {
+						case strings.Contains(diff, ": missing recipient "):
+							fmt.Println(color.Green(diff))
+						default:
+							fmt.Println(color.Red(diff))
+						}
+					}
+					if len(diffs) > 0 {
+						logger.Fatalf("%d values do not match the desired recipients", len(diffs))
+					}
+					logger.Infof("all values match the desired recipients")
+					return nil
+				},
+			},
+			{
+				Name:  "tree",
+				Usage: "show the keys used under each directory of a tree",
+				Flags: []cli.Flag{
+					dirFlag,
+					cli.StringFlag{
+						Name:        "format",
+						Value:       "text",
+						Usage:       "output format: text or json",
+						Destination: &outputFormat,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					s := newSls()
+					tree, err := s.RecipientTree(recurseDir)
+					if err != nil {
+						logger.Fatal(err)
+					}
+					switch outputFormat {
+					case "json":
+						out, err := json.MarshalIndent(tree, "", "  ")
+						if err != nil {
+							logger.Fatal(err)
+						}
+						fmt.Printf("%s\n", out)
+					case "text":
+						for _, line := range tree.Lines() {
+							fmt.Println(line)
+						}
+					default:
+						logger.Fatalf("unknown format: %s", outputFormat)
+					}
+					return nil
+				},
+			},
+		},
+	},
+	{
+		Name:  "check",
+		Usage: "exit non-zero if plain text values are found",
+		Flags: []cli.Flag{
+			inputFlag,
+			cli.BoolFlag{
+				Name:        "git-stdin",
+				Usage:       "read git hook 'oldrev newrev refname' lines, 'objectid path' lines, or file paths from STDIN",
+				Destination: &gitStdin,
+			},
+			cli.BoolFlag{
+				Name:        "allow-unchecked",
+				Usage:       "warn rather than fail on files read from STDIN that cannot be parsed or contain include directives",
+				Destination: &allowUnchecked,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			s := newSls()
+			s.AllowUnchecked = allowUnchecked
+			var found []string
+			if gitStdin {
+				var err error
+				found, err = s.CheckGitInput(os.Stdin, "")
+				if err != nil {
+					logger.Fatal(err)
+				}
+			} else {
+				paths, err := s.PlainTextPaths(inputFilePath)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				for _, path := range paths {
+					found = append(found, fmt.Sprintf("%s: %s", inputFilePath, path))
+				}
+			}
+			color := newColor()
+			for _, line := range found {
+				fmt.Println(color.Red(line))
+			}
+			if len(found) > 0 {
+				logger.Fatalf("found %d plain text values or unchecked files", len(found))
+			}
+			return nil
+		},
+	},
+	{
+		Name:  "verify-file",
+		Usage: "check every encrypted value is well formed PGP encrypted to known keys, using only the public keyring",
+		Flags: []cli.Flag{
+			inputFlag,
+		},
+		Action: func(c *cli.Context) error {
+			s := newSls()
+			found, err := s.VerifyFile(inputFilePath)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			color := newColor()
+			for _, line := range found {
+				fmt.Println(color.Red(line))
+			}
+			if len(found) > 0 {
+				logger.Fatalf("found %d malformed values", len(found))
+			}
+			logger.Infof("all encrypted values are well formed")
+			return nil
+		},
+	},
+	{
+		Name:  "verify-manifest",
+		Usage: "exit non-zero if the recipients of the files in a directory differ from a manifest written by --write-manifest",
+		Flags: []cli.Flag{
+			dirFlag,
+			cli.StringFlag{
+				Name:        "manifest",
+				Usage:       "manifest written by --write-manifest",
+				Destination: &manifestPath,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if manifestPath == "" {
+				logger.Fatal("--manifest is required")
+			}
+			s := newSls()
+			drift, err := s.VerifyManifest(manifestPath, recurseDir)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			color := newColor()
+			for _, line := range drift {
+				fmt.Println(color.Red(line))
+			}
+			if len(drift) > 0 {
+				logger.Fatalf("found %d differences from %s", len(drift), manifestPath)
+			}
+			logger.Infof("the recipients of every file match %s", manifestPath)
+			return nil
+		},
+	},
+	{
+		Name:  "scan",
+		Usage: "report plain text values",
+		Action: func(c *cli.Context) error {
+			return cli.ShowCommandHelp(c, "")
+		},
+		Subcommands: []cli.Command{
+			{
+				Name: "recurse",
+				Flags: []cli.Flag{
+					dirFlag,
+					modifiedSinceFlag,
+					cli.StringFlag{
+						Name:        "format",
+						Value:       "text",
+						Usage:       "output format: text or json",
+						Destination: &outputFormat,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					s := newSls()
+					reports := s.PlainTextReport(recurseDir)
+					switch outputFormat {
+					case "json":
+						out, err := json.MarshalIndent(reports, "", "  ")
+						if err != nil {
+							logger.Fatal(err)
+						}
+						fmt.Printf("%s\n", out)
+					case "text":
+						color := newColor()
+						for _, report := range reports {
+							for _, path := range report.PlainText {
+								fmt.Println(color.Yellow(fmt.Sprintf("%s: %s", report.File, path)))
+							}
+						}
+					default:
+						logger.Fatalf("unknown format: %s", outputFormat)
+					}
+					return nil
+				},
+			},
+		},
+	},
+	{
+		Name:  "edit",
+		Usage: "decrypt a file, open it in $EDITOR and re-encrypt the changed values",
+		Flags: []cli.Flag{
+			inputFlag,
+		},
+		Action: func(c *cli.Context) error {
+			editor := os.Getenv("EDITOR")
+			if editor == "" {
+				editor = "vi"
+			}
+			s := newSls()
+			err := s.EditFile(inputFilePath, editor)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			return nil
+		},
+	},
+	{
+		Name:  "prune",
+		Usage: "remove empty maps and lists from a file",
+		Flags: []cli.Flag{
+			inputFlag,
+			outputFlag,
+			updateFlag,
+		},
+		Action: func(c *cli.Context) error {
+			s := newSls()
+			if err := resolveFilePaths(updateInPlace); err != nil {
+				logger.Fatal(err)
+			}
+			if err := confirmUpdate(); err != nil {
+				logger.Fatal(err)
+			}
+			err := s.ReadSlsFile(inputFilePath)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			s.Prune()
+			buffer := s.FormatBuffer("")
+			sls.WriteSlsFile(buffer, outputFilePath)
+			return nil
+		},
+	},
+	{
+		Name:  "repair",
+		Usage: "reduce the '#!yaml|gpg' header to one and drop leading blank lines without decrypting",
+		Flags: []cli.Flag{
+			inputFlag,
+			outputFlag,
+			updateFlag,
+		},
+		Action: func(c *cli.Context) error {
+			if err := resolveFilePaths(updateInPlace); err != nil {
+				logger.Fatal(err)
+			}
+			if err := confirmUpdate(); err != nil {
+				logger.Fatal(err)
+			}
+			var buf []byte
+			var err error
+			if isStdin(inputFilePath) {
+				buf, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				buf, err = ioutil.ReadFile(inputFilePath)
+			}
+			if err != nil {
+				logger.Fatal(err)
+			}
+			buffer, stray := sls.Repair(buf)
+			logger.Infof("removed %d stray headers", stray)
+			sls.WriteSlsFile(buffer, outputFilePath)
+			return nil
+		},
+	},
+	{
+		Name:  "rewrap",
+		Usage: "re-encrypt each value to its current recipients with keys added or removed",
+		Flags: []cli.Flag{
+			inputFlag,
+			outputFlag,
+			updateFlag,
+			cli.StringSliceFlag{
+				Name:  "add-key",
+				Usage: "key name(s), email(s), or ID(s) to add to the recipients of each value",
+				Value: &addKeys,
+			},
+			cli.StringSliceFlag{
+				Name:  "remove-key",
+				Usage: "key name(s), email(s), or ID(s) to remove from the recipients of each value",
+				Value: &removeKeys,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if len(addKeys) == 0 && len(removeKeys) == 0 {
+				logger.Fatal("give at least one --add-key or --remove-key")
+			}
+			if err := resolveFilePaths(updateInPlace); err != nil {
+				logger.Fatal(err)
+			}
+			if err := confirmUpdate(); err != nil {
+				logger.Fatal(err)
+			}
+			s := newSls()
+			requireSecRing(&s)
+			buffer, err := s.Rewrap(inputFilePath, addKeys, removeKeys)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			sls.WriteSlsFile(buffer, outputFilePath)
+			return nil
+		},
+	},
+	{
+		Name:  "replace-key",
+		Usage: "re-encrypt the values encrypted to one key to a new key, leaving their other recipients and all other values as they are",
+		Flags: append([]cli.Flag{
+			dirFlag,
+			modifiedSinceFlag,
+			cli.StringFlag{
+				Name:        "old",
+				Usage:       "key name, email, or ID to replace",
+				Destination: &oldKey,
+			},
+			cli.StringFlag{
+				Name:        "new",
+				Usage:       "key name, email, or ID to encrypt to instead",
+				Destination: &newKey,
+			},
+		}, hookFlags...),
+		Action: func(c *cli.Context) error {
+			if oldKey == "" || newKey == "" {
+				logger.Fatal("both --old and --new are required")
+			}
+			if err := confirmDir(recurseDir); err != nil {
+				logger.Fatal(err)
+			}
+			s := newSls()
+			changed, err := s.ReplaceKey(recurseDir, oldKey, newKey)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			logger.Infof("replaced the key in %d files", changed)
+			return nil
+		},
+	},
+	{
+		Name:  "reencrypt",
+		Usage: "re-encrypt the values of each file whose recipients differ from those --config gives for its directory",
+		Flags: append([]cli.Flag{
+			dirFlag,
+			modifiedSinceFlag,
+			cli.BoolFlag{
+				Name:        "to-config",
+				Usage:       "converge to the 'recipients' of --config, the deepest directory listed applies to a file",
+				Destination: &toConfig,
+			},
+		}, hookFlags...),
+		Action: func(c *cli.Context) error {
+			if !toConfig {
+				logger.Fatal("reencrypt needs --to-config")
+			}
+			if configPath == "" {
+				logger.Fatal("--to-config needs --config")
+			}
+			if err := confirmDir(recurseDir); err != nil {
+				logger.Fatal(err)
+			}
+			s := newSls()
+			changed, err := s.Reencrypt(recurseDir, appConfig.Recipients)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			for _, file := range changed {
+				fmt.Println(file)
+			}
+			logger.Infof("re-encrypted %d files", len(changed))
+			return nil
+		},
+	},
+	{
+		Name:  "flatten",
+		Usage: "write a file as 'a.b.c = <value>' lines, cipher text is kept as is",
+		Flags: []cli.Flag{
+			inputFlag,
+			outputFlag,
+			separatorFlag,
+		},
+		Action: func(c *cli.Context) error {
+			s := newSls()
+			err := s.ReadSlsFile(inputFilePath)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			buffer, err := s.Flatten(separator)
+			safeWrite(buffer, err)
+			return nil
+		},
+	},
+	{
+		Name:  "unflatten",
+		Usage: "rebuild a YAML file from 'a.b.c = <value>' lines",
+		Flags: []cli.Flag{
+			inputFlag,
+			outputFlag,
+			separatorFlag,
+		},
+		Action: func(c *cli.Context) error {
+			s := newSls()
+			in := os.Stdin
+			if !isStdin(inputFilePath) {
+				var err error
+				in, err = os.Open(inputFilePath)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				defer in.Close()
+			}
+			err := s.Unflatten(in, separator)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			buffer := s.FormatBuffer("")
+			sls.WriteSlsFile(buffer, outputFilePath)
+			return nil
+		},
+	},
+	{
+		Name:  "key-info",
+		Usage: "show the fingerprint, user ids, expiry and encryption subkeys of the -k key(s) and whether their secret keys are present",
+		Action: func(c *cli.Context) error {
+			p := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+			if err := p.SetSecretKeyRings(secretKeyRings); err != nil {
+				logger.Fatal(err)
+			}
+			var infos []string
+			for _, entity := range p.EncryptionKeys {
+				infos = append(infos, p.KeyInfo(entity))
+			}
+			fmt.Print(strings.Join(infos, "\n"))
+			return nil
+		},
+	},
+	{
+		Name:  "selfcheck",
+		Usage: "verify the keyrings with an encrypt/decrypt round-trip",
+		Action: func(c *cli.Context) error {
+			p := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
+			if err := p.SetSecretKeyRings(secretKeyRings); err != nil {
+				logger.Fatal(err)
+			}
+			p.PassphraseCommand = passphraseCommand
+			err := p.SelfCheck()
+			if err != nil {
+				logger.Fatalf("selfcheck failed: %s", err)
+			}
+			logger.Infof("selfcheck passed for key '%s'", pgpKeyName)
+			return nil
+		},
+	},
+}
+
+func main() {
+	app := cli.NewApp()
 	app.Version = "1.0.318"
 	app.Authors = []cli.Author{
 		cli.Author{
@@ -388,6 +1816,37 @@ func main() {
 	app.Copyright = "(c) 2018 Everbridge, Inc."
 	app.Usage = "Create and update encrypted content or decrypt encrypted content."
 	app.Flags = appFlags
+	app.Before = func(c *cli.Context) error {
+		if len(secretKeyRings) == 0 {
+			secretKeyRings = cli.StringSlice{defaultSecRing}
+		}
+		secretKeyRing = secretKeyRings[0]
+		pgpKeyName = strings.Join(pgpKeyNames, pki.KeyNameSeparator)
+		sls.DryRun = dryRun
+		if outputPerms != "" {
+			perms, err := sls.ParseOutputPerms(outputPerms)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			sls.OutputPerms = perms
+		}
+		sls.SummaryOnly = summaryOnly
+		pki.Paranoid = paranoid
+		pki.KeyCacheDir = keyCacheDir
+		if !sls.ValidOnError(onError) {
+			logger.Fatalf("unknown --onerror policy '%s', use %s, %s or %s", onError, sls.OnErrorAbort, sls.OnErrorSkipFile, sls.OnErrorContinue)
+		}
+		if configPath != "" {
+			var err error
+			appConfig, err = readConfig(configPath)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			pki.Groups = appConfig.Groups
+		}
+		startTimeout()
+		return nil
+	}
 
 	app.Commands = appCommands
 
@@ -397,6 +1856,343 @@ func main() {
 	}
 }
 
+func newSls() sls.Sls {
+	s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
+	setSlsOptions(&s)
+	if err := s.Pki.SetSecretKeyRings(secretKeyRings); err != nil {
+		logger.Fatal(err)
+	}
+	s.Pki.PassphraseCommand = passphraseCommand
+	s.Pki.SecRingCommand = secRingCommand
+	s.Pki.RecipientSelf = recipientSelf
+	s.Pki.StrictPerms = strictPerms
+	headers, err := pki.ParseArmorHeaders(armorHeaders)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if len(headers) > 0 {
+		s.Pki.ArmorHeaders = headers
+	}
+	if !pki.ValidKeyIDFormat(keyIDFormat) {
+		logger.Fatalf("unknown key id format: %s", keyIDFormat)
+	}
+	s.Pki.KeyIDFormat = keyIDFormat
+
+	return s
+}
+
+// newSlsWithPki returns a Sls using a copy of keyrings newSls already loaded
+func newSlsWithPki(p *pki.Pki) sls.Sls {
+	shared := *p
+	s := sls.NewWithPki(secretNames, secretValues, topLevelElement, &shared)
+	setSlsOptions(&s)
+
+	return s
+}
+
+// setSlsOptions copies the flags to s
+func setSlsOptions(s *sls.Sls) {
+	s.EncryptEmpty = encryptEmpty
+	s.PruneEmpty = pruneEmpty
+	s.TempDir = tempDir
+	s.InlineCipherText = inlineCipherText
+	s.Extensions = extensions
+	s.MaxValueSize = maxValueSize
+	s.MaxDepth = maxDepth
+	s.ResolveAnchors = resolveAnchors
+	s.StringKeys = stringKeys
+	s.PreHook = preHook
+	s.PostHook = postHook
+	s.FailOnHook = failOnHook
+	s.DedupeAnchors = dedupeAnchors
+	s.KeepAnchors = keepAnchors
+	s.EncryptComments = encryptComments
+	s.PreserveRenderer = preserveRenderer
+	s.ForceStringValues = forceStringValues
+	s.IgnoreDecryptErrors = ignoreDecryptErrors
+	s.FailFast = failFast
+	s.Colors = newLogColor()
+	if onError != "" {
+		s.OnError = onError
+	}
+	if rejectPlaceholders {
+		s.Placeholders = placeholders
+		if len(s.Placeholders) == 0 {
+			s.Placeholders = sls.DefaultPlaceholders
+		}
+	}
+	s.SortKeys = sortKeys
+	s.Verbose = verbose
+	s.VerifyRotation = verifyRotation
+	s.StampRotated = stampRotated
+	s.ModifiedSince = modifiedSinceTime()
+	s.AllowNonSls = allowNonSls
+	s.Context = runCtx
+}
+
+// startTimeout sets the deadline of the run when --timeout is given
+// Recursing stops before the next file once it passes, a file still being
+// read or encrypted after timeoutGrace is abandoned and the run exits, a
+// file being written is finished first
+func startTimeout() {
+	if timeout <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	runCtx = ctx
+	go func() {
+		defer cancel()
+		<-ctx.Done()
+		time.Sleep(timeoutGrace)
+		done, total := sls.Progress()
+		if total > 0 {
+			logger.Errorf("timed out after %s, the current file did not finish within %s: %d of %d files were processed, %d were not",
+				timeout, timeoutGrace, done, total, total-done)
+		} else {
+			logger.Errorf("timed out after %s, the current file did not finish within %s", timeout, timeoutGrace)
+		}
+		sls.WaitIdle()
+		os.Exit(sls.TimeoutExitCode)
+	}()
+}
+
+// processDir runs ProcessDir on recurseDir and exits with TimeoutExitCode
+// when the run timed out
+func processDir(s *sls.Sls, recurseDir string, action string) {
+	if _, err := s.ProcessDirErr(recurseDir, action); errors.Is(err, sls.ErrTimedOut) {
+		os.Exit(sls.TimeoutExitCode)
+	}
+}
+
+// isStdin checks if a file path means STDIN, either '-' or the name of STDIN
+func isStdin(path string) bool {
+	return path == sls.StdinPath || path == os.Stdin.Name()
+}
+
+// recurseInput reports whether --file is a directory to process as recurse -d does
+func recurseInput(command string) bool {
+	isDir, err := inputIsDir(command)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	return isDir
+}
+
+// inputIsDir reports whether --file is a directory, without --auto-recurse
+// that is an error suggesting the recurse form of the command
+func inputIsDir(command string) (bool, error) {
+	if isStdin(inputFilePath) {
+		return false, nil
+	}
+	info, err := os.Stat(inputFilePath)
+	if err != nil || !info.IsDir() {
+		return false, nil
+	}
+	if !autoRecurse {
+		return true, fmt.Errorf("%s is a directory, did you mean '%s recurse -d %s'? --auto-recurse does this for you", inputFilePath, command, inputFilePath)
+	}
+	if outputFilePath != os.Stdout.Name() && !updateInPlace {
+		return true, fmt.Errorf("--outfile cannot be used when --file is a directory, each file is updated in place")
+	}
+	logger.Infof("%s is a directory, processing it as '%s recurse -d %s'", inputFilePath, command, inputFilePath)
+
+	return true, nil
+}
+
+// resolveFilePaths sets the output file to the input file when updating in place
+// It refuses --update with STDIN or with an --outfile other than the input file
+func resolveFilePaths(update bool) error {
+	if update {
+		if isStdin(inputFilePath) {
+			return fmt.Errorf("--update cannot be used when reading STDIN")
+		}
+		if outputFilePath != os.Stdout.Name() {
+			inPath, err := filepath.Abs(inputFilePath)
+			if err != nil {
+				return err
+			}
+			outPath, err := filepath.Abs(outputFilePath)
+			if err != nil {
+				return err
+			}
+			if inPath != outPath {
+				return fmt.Errorf("--update writes to the input file %s, it cannot be used with --outfile %s", inputFilePath, outputFilePath)
+			}
+		}
+		outputFilePath = inputFilePath
+	}
+	if outputFilePath != os.Stdout.Name() {
+		logger.Infof("input: %s, output: %s", inputFilePath, outputFilePath)
+	}
+
+	return nil
+}
+
+// setKeyPattern compiles --encrypt-key-pattern into the key pattern of s
+func setKeyPattern(s *sls.Sls) {
+	if encryptKeyPattern == "" {
+		return
+	}
+	pattern, err := regexp.Compile(encryptKeyPattern)
+	if err != nil {
+		logger.Fatalf("invalid --encrypt-key-pattern: %s", err)
+	}
+	s.KeyPattern = pattern
+}
+
+// setAllowedRecipients sets the keys values may be encrypted to when --strict-recipients is given
+func setAllowedRecipients(s *sls.Sls) {
+	if !strictRecipients {
+		return
+	}
+	if len(allowedKeys) == 0 {
+		logger.Fatal("--strict-recipients needs at least one --allowed-key")
+	}
+	s.AllowedRecipients = allowedKeys
+}
+
+// checkAllowedRecipients exits before any file is decrypted, listing every value in
+// the directory that is encrypted to a key that is not allowed
+func checkAllowedRecipients(s *sls.Sls, dir string) {
+	if len(s.AllowedRecipients) == 0 {
+		return
+	}
+	slsFiles, _ := sls.FindSlsFiles(dir, extensions...)
+	count := 0
+	for _, file := range slsFiles {
+		found, err := s.DisallowedRecipients(file)
+		if errors.Is(err, sls.ErrContainsIncludes) {
+			continue
+		}
+		if err != nil {
+			logger.Fatal(err)
+		}
+		for _, line := range found {
+			fmt.Printf("%s: %s\n", file, line)
+		}
+		count += len(found)
+	}
+	if count > 0 {
+		logger.Fatalf("%d values are encrypted to keys that are not allowed, no files were changed", count)
+	}
+}
+
+// modifiedSinceTime parses --modified-since as a duration before now or an RFC 3339 timestamp
+// The zero time is returned when it is not set
+func modifiedSinceTime() time.Time {
+	if modifiedSince == "" {
+		return time.Time{}
+	}
+	if duration, err := time.ParseDuration(modifiedSince); err == nil {
+		return time.Now().Add(-duration)
+	}
+	since, err := time.Parse(time.RFC3339, modifiedSince)
+	if err != nil {
+		logger.Fatalf("--modified-since must be a duration or an RFC 3339 timestamp: %s", modifiedSince)
+	}
+
+	return since
+}
+
+// readStdinSecrets sets the secret names and values from a JSON object on STDIN when --value-stdin-json is given
+func readStdinSecrets() {
+	if !valueStdinJSON {
+		return
+	}
+	if len(secretNames) > 0 || len(secretValues) > 0 || len(valueFiles) > 0 || len(valueEnvs) > 0 || len(valueCmds) > 0 {
+		logger.Fatal("--value-stdin-json cannot be used with --name or any of the --value flags")
+	}
+	names, values, err := sls.ReadSecretsJSON(os.Stdin)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	secretNames = cli.StringSlice(names)
+	secretValues = cli.StringSlice(values)
+}
+
+// valueSource returns the source named by whichever of --value, --value-file,
+// --file-value, --value-env or --value-cmd was given and sets the secret values to its references
+func valueSource() sls.ValueSource {
+	sources := []struct {
+		refs   cli.StringSlice
+		source sls.ValueSource
+	}{
+		{secretValues, sls.LiteralSource{}},
+		{valueFiles, sls.FileSource{}},
+		{fileValues, sls.Base64FileSource{}},
+		{valueEnvs, sls.EnvSource{}},
+		{valueCmds, sls.CommandSource{}},
+	}
+
+	var chosen sls.ValueSource = sls.LiteralSource{}
+	used := 0
+	for _, src := range sources {
+		if len(src.refs) == 0 {
+			continue
+		}
+		used++
+		secretValues = src.refs
+		chosen = src.source
+	}
+	if used > 1 {
+		logger.Fatal("only one of --value, --value-file, --file-value, --value-env and --value-cmd can be used")
+	}
+
+	return chosen
+}
+
+// requireSecRing exits before any file is read unless a secret key is available
+func requireSecRing(s *sls.Sls) {
+	if err := s.Pki.CheckSecRing(); err != nil {
+		logger.Fatalf("no usable secret keyring, no files were changed: %s", err)
+	}
+}
+
+// writeManifest writes the recipients of each file under recurseDir when --write-manifest is given
+func writeManifest(s *sls.Sls, recurseDir string) {
+	if manifestPath == "" {
+		return
+	}
+	if err := s.WriteManifest(recurseDir, manifestPath); err != nil {
+		logger.Fatalf("unable to write manifest: %s", err)
+	}
+}
+
+// printRecipients prints the keys values were encrypted to once per run when --show-recipients is set
+func printRecipients(s *sls.Sls) {
+	if !showRecipients {
+		return
+	}
+	for _, recipient := range s.Pki.RecipientFingerprints() {
+		fmt.Fprintf(os.Stderr, "encrypted to: %s\n", recipient)
+	}
+}
+
+// logRotateTarget logs the fingerprint and name of the key(s) rotated files are encrypted to
+func logRotateTarget(s *sls.Sls) {
+	logger.Infof("rotating to %s", strings.Join(s.Pki.RecipientFingerprints(), ", "))
+}
+
+// newLogColor returns the colorizer for log messages, which are written to stderr
+func newLogColor() colorizer {
+	color, err := newColorizer(colorMode, os.Stderr)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	return color
+}
+
+func newColor() colorizer {
+	color, err := newColorizer(colorMode, os.Stdout)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	return color
+}
+
 func safeWrite(buffer bytes.Buffer, err error) {
 	if err != nil {
 		logger.Fatalf("%s", err)
@@ -405,39 +2201,291 @@ func safeWrite(buffer bytes.Buffer, err error) {
 	}
 }
 
-func pathAction(s *sls.Sls, path string, action string) {
+// readPathsFile returns the YAML paths listed one per line in filePath
+// blank lines and lines starting with '#' are skipped
+func readPathsFile(filePath string) ([]string, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read paths file: %s", err)
+	}
+
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s lists no paths", filePath)
+	}
+
+	return paths, nil
+}
+
+// encryptValue encrypts value, or the text read from in without its final
+// newline when value is empty, to the -k key and the named keys
+func encryptValue(p *pki.Pki, value string, in io.Reader, names []string) (string, error) {
+	if value == "" {
+		data, err := ioutil.ReadAll(in)
+		if err != nil {
+			return "", fmt.Errorf("cannot read STDIN: %s", err)
+		}
+		value = strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	}
+
+	recipients, err := p.RecipientsWith(names)
+	if err != nil {
+		return "", err
+	}
+
+	return p.EncryptSecretTo(value, recipients), nil
+}
+
+// decryptValue decrypts the armored or inline PGP message in value, or read from in when value is empty
+func decryptValue(p *pki.Pki, value string, in io.Reader) (string, error) {
+	if value == "" {
+		data, err := ioutil.ReadAll(in)
+		if err != nil {
+			return "", fmt.Errorf("cannot read STDIN: %s", err)
+		}
+		value = string(data)
+	}
+
+	// a value copied from a YAML file keeps the indentation of its block
+	lines := strings.Split(strings.TrimSpace(value), "\n")
+	for index, line := range lines {
+		lines[index] = strings.TrimSpace(line)
+	}
+	cipherText := strings.Join(lines, "\n")
+	if pki.IsKeyBlock(cipherText) {
+		return "", pki.ErrKeyBlock
+	}
+	if !pki.IsInline(cipherText) {
+		if !strings.HasPrefix(cipherText, "-----BEGIN PGP MESSAGE-----") {
+			return "", fmt.Errorf("input is not an armored PGP message, it should start with '-----BEGIN PGP MESSAGE-----'")
+		}
+		cipherText += "\n"
+	}
+
+	plainText, err := p.DecryptSecret(cipherText)
+	if err != nil {
+		return "", err
+	}
+
+	return plainText, nil
+}
+
+// notEncryptedExitCode is the exit status of decrypt path --only-if-encrypted
+// when a path held no encrypted value
+const notEncryptedExitCode = 4
+
+// decryptPaths prints the decrypted value of each path, with --only-if-encrypted
+// paths holding no encrypted value are left out and the run exits with
+// notEncryptedExitCode once the others are printed
+func decryptPaths(s *sls.Sls, paths []string) {
+	var plain []string
+	for _, path := range paths {
+		if pathAction(s, path, "decrypt") {
+			plain = append(plain, path)
+		}
+	}
+	if len(plain) > 0 {
+		logger.Warnf("not encrypted, not printed: '%s'", strings.Join(plain, "', '"))
+		os.Exit(notEncryptedExitCode)
+	}
+}
+
+// pathAction prints the value at path after applying action to it
+// It reports whether the value was left out because it holds no encrypted
+// value when decrypting with --only-if-encrypted
+func pathAction(s *sls.Sls, path string, action string) bool {
 	vals := s.GetValueFromPath(path)
 	if vals != nil {
-		vals = s.ProcessValues(vals, action)
+		if action == "decrypt" && onlyIfEncrypted && !sls.HasEncryptedValue(vals) {
+			return true
+		}
+		vals, err := s.ProcessValuesErr(vals, action)
+		if err != nil {
+			logger.Fatal(err)
+		}
 		fmt.Printf("%s: %s\n", path, vals)
 	} else {
-		logger.Warnf("unable to find path: '%s'", path)
+		suggestions := s.SuggestPaths(path)
+		switch len(suggestions) {
+		case 0:
+			logger.Warnf("unable to find path: '%s'", path)
+		case 1:
+			logger.Warnf("unable to find path: '%s', did you mean '%s'?", path, suggestions[0])
+		default:
+			logger.Warnf("unable to find path: '%s', did you mean one of '%s'?", path, strings.Join(suggestions, "', '"))
+		}
 	}
+
+	return false
 }
 
-func processFiles(recurseDir string) int {
+func processFiles(recurseDir string) (int, []string) {
 	var fileCount int
-	slsFiles, count := sls.FindSlsFiles(recurseDir)
+	var failed, skipped []string
+	var failedLock sync.Mutex
+
+	slsFiles, count := sls.FindSlsFiles(recurseDir, extensions...)
 	if count == 0 {
 		logger.Fatalf("%s has no sls files", recurseDir)
 	}
+	if since := modifiedSinceTime(); !since.IsZero() {
+		slsFiles = sls.FilesModifiedSince(slsFiles, since)
+		logger.Infof("%d of %d files modified since %s", len(slsFiles), count, since.Format(time.RFC3339))
+	}
+
+	// run holds the options of the run, with --chunk-size its keyrings are
+	// read once and shared by every file
+	run := newSls()
+	sls.AddFiles(len(slsFiles))
+	var shared *pki.Pki
+	chunks := [][]string{slsFiles}
+	if chunkSize > 0 {
+		requireSecRing(&run)
+		// unlocked once here, the workers never decrypt the shared keys in place
+		if err := run.Pki.UnlockSecretKeys(); err != nil {
+			logger.Fatalf("unable to unlock the secret keys: %s", err)
+		}
+		shared = run.Pki
+		chunks = chunkFiles(slsFiles, chunkSize)
+	}
 
 	cores := runtime.GOMAXPROCS(0)
 	limChan := make(chan bool, cores)
 
-	for i := 0; i < cores; i++ {
-		limChan <- true
-	}
+	for index, chunk := range chunks {
+		for i := 0; i < cores; i++ {
+			limChan <- true
+		}
 
-	for _, file := range slsFiles {
-		<-limChan
-		s := sls.New(secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName)
-		go s.RotateFile(file, limChan)
-		fileCount++
+		for _, file := range chunk {
+			<-limChan
+			if runCtx.Err() != nil || stopRotation(&run, &failedLock, &failed) {
+				limChan <- true
+				break
+			}
+			var s sls.Sls
+			if shared != nil {
+				s = newSlsWithPki(shared)
+			} else {
+				s = newSls()
+			}
+			s.BackupDir = backupDir
+			s.BackupRoot = recurseDir
+			go func(s sls.Sls, file string) {
+				// a panic in one file is logged as a failure for that file
+				// and the token is released so the rest of the batch runs
+				defer func() {
+					if r := recover(); r != nil {
+						logger.Errorf("error processing %s: %v", file, r)
+						failedLock.Lock()
+						failed = append(failed, file)
+						failedLock.Unlock()
+						sls.FileDone()
+						limChan <- true
+					}
+				}()
+				err := s.RotateFile(file, limChan)
+				sls.FileDone()
+				failedLock.Lock()
+				defer failedLock.Unlock()
+				if errors.Is(err, sls.ErrContainsIncludes) {
+					skipped = append(skipped, file)
+				} else if err != nil {
+					failed = append(failed, file)
+				}
+			}(s, file)
+			fileCount++
+		}
+
+		// wait for the running workers to hand back their tokens
+		for i := 0; i < cores; i++ {
+			<-limChan
+		}
+		if runCtx.Err() != nil || stopRotation(&run, &failedLock, &failed) {
+			break
+		}
+		if len(chunks) > 1 {
+			// the buffers of the chunk are garbage now, hand the memory back before the next one
+			debug.FreeOSMemory()
+			if !sls.SummaryOnly {
+				logger.Infof("finished chunk %d of %d", index+1, len(chunks))
+			}
+		}
 	}
 	close(limChan)
 
-	return fileCount
+	if len(skipped) > 0 {
+		logger.Warn(newLogColor().Yellow(fmt.Sprintf("skipped %d files containing include directives", len(skipped))))
+		if verbose {
+			for _, file := range skipped {
+				logger.Warnf("skipped %s", file)
+			}
+		}
+	}
+	if runCtx.Err() != nil {
+		logger.Errorf("%s after %s: %d of %d files were processed", sls.ErrTimedOut, timeout, fileCount, len(slsFiles))
+	}
+
+	return fileCount, failed
+}
+
+// stopRotation checks whether --fail-fast or --onerror abort should stop
+// starting files, files already being rotated are finished
+func stopRotation(s *sls.Sls, failedLock *sync.Mutex, failed *[]string) bool {
+	if !s.AbortOnError() {
+		return false
+	}
+	failedLock.Lock()
+	defer failedLock.Unlock()
+
+	return len(*failed) > 0
+}
+
+// chunkFiles splits files into chunks of at most size files
+func chunkFiles(files []string, size int) [][]string {
+	var chunks [][]string
+	for size < len(files) {
+		chunks = append(chunks, files[:size])
+		files = files[size:]
+	}
+
+	return append(chunks, files)
+}
+
+// rotateSubkeys re-encrypts the values of --infile or --dir encrypted to a
+// superseded subkey and prints the files changed
+func rotateSubkeys() {
+	var err error
+	target := inputFilePath
+	switch {
+	case inputFilePath != "":
+		err = confirmOverwrite(1)
+	case recurseDir != "":
+		target = recurseDir
+		err = confirmDir(recurseDir)
+	default:
+		err = fmt.Errorf("--to-latest-subkey needs --infile or --dir")
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+	s := newSls()
+	requireSecRing(&s)
+	changed, err := s.RotateSubkeys(target)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	for _, file := range changed {
+		fmt.Println(file)
+	}
+	logger.Infof("re-encrypted %d files to the latest subkeys", len(changed))
 }
 
 func rotateFiles(recurseDir string) error {
@@ -446,8 +2494,23 @@ func rotateFiles(recurseDir string) error {
 		logger.Fatalf("cannot stat %s: %s", recurseDir, err)
 	}
 	if info.IsDir() && info.Name() != ".." {
-		count := processFiles(recurseDir)
+		if err = confirmDir(recurseDir); err != nil {
+			return err
+		}
+		s := newSls()
+		requireSecRing(&s)
+		logRotateTarget(&s)
+		count, failed := processFiles(recurseDir)
 		logger.Infof("Finished processing %d files.\n", count)
+		if runCtx.Err() != nil {
+			return sls.ErrTimedOut
+		}
+		if len(failed) > 0 && s.AbortOnError() {
+			return fmt.Errorf("%w, %d files were started: %s", sls.ErrFailFast, count, strings.Join(failed, ", "))
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("%s: %s", newLogColor().Red(fmt.Sprintf("%d of %d files failed", len(failed), count)), strings.Join(failed, ", "))
+		}
 	} else {
 		logger.Fatalf("%s is not a directory", recurseDir)
 	}
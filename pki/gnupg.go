@@ -0,0 +1,120 @@
+package pki
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/keybase/go-crypto/openpgp"
+)
+
+// GPGCommand is the gpg binary secret keys are exported with when GnuPG 2.1 or
+// later keeps them in private-keys-v1.d rather than a secring.gpg
+var GPGCommand = "gpg"
+
+// PrivateKeysDir is where GnuPG 2.1 and later keep secret keys in its home
+const PrivateKeysDir = "private-keys-v1.d"
+
+// keyboxMagic marks the header blob of a GnuPG keybox such as pubring.kbx
+var keyboxMagic = []byte("KBXf")
+
+// keybox blob types, only OpenPGP blobs hold keys read here
+const (
+	keyboxHeaderBlob  = 1
+	keyboxOpenPGPBlob = 2
+)
+
+// readKeyRing reads an OpenPGP keyring, or the OpenPGP keys of a GnuPG keybox
+func readKeyRing(in io.Reader) (openpgp.EntityList, error) {
+	reader := bufio.NewReader(in)
+	if head, err := reader.Peek(12); err == nil && head[4] == keyboxHeaderBlob && bytes.Equal(head[8:12], keyboxMagic) {
+		keyBlocks, err := readKeybox(reader)
+		if err != nil {
+			return nil, err
+		}
+		return openpgp.ReadKeyRing(bytes.NewReader(keyBlocks))
+	}
+
+	return openpgp.ReadKeyRing(reader)
+}
+
+// readKeybox returns the keyblocks of the OpenPGP blobs of a keybox one after another
+// Each blob starts with its length and type, an OpenPGP blob gives the offset
+// and length of its keyblock at bytes 8 and 12
+func readKeybox(in io.Reader) ([]byte, error) {
+	var keyBlocks bytes.Buffer
+	for {
+		var length uint32
+		err := binary.Read(in, binary.BigEndian, &length)
+		if err == io.EOF {
+			return keyBlocks.Bytes(), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read keybox: %s", err)
+		}
+		if length < 16 {
+			return nil, fmt.Errorf("cannot read keybox: blob of %d bytes is too short", length)
+		}
+		blob := make([]byte, length)
+		binary.BigEndian.PutUint32(blob, length)
+		if _, err = io.ReadFull(in, blob[4:]); err != nil {
+			return nil, fmt.Errorf("cannot read keybox: %s", err)
+		}
+		if blob[4] != keyboxOpenPGPBlob {
+			continue
+		}
+		offset := binary.BigEndian.Uint32(blob[8:12])
+		size := binary.BigEndian.Uint32(blob[12:16])
+		if uint64(offset)+uint64(size) > uint64(length) {
+			return nil, fmt.Errorf("cannot read keybox: keyblock runs past the end of its blob")
+		}
+		keyBlocks.Write(blob[offset : offset+size])
+	}
+}
+
+// gnupgHomeFor returns the GnuPG home to export secret keys from for a secret
+// keyring that is either a private-keys-v1.d directory or a secring.gpg that
+// does not exist next to one
+func gnupgHomeFor(secretKeyRing string) (string, bool) {
+	dir := secretKeyRing
+	if filepath.Base(secretKeyRing) != PrivateKeysDir {
+		if _, err := os.Stat(secretKeyRing); !os.IsNotExist(err) {
+			return "", false
+		}
+		dir = filepath.Join(filepath.Dir(secretKeyRing), PrivateKeysDir)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", false
+	}
+
+	return filepath.Dir(dir), true
+}
+
+// exportSecretKeys returns the secret keys of a GnuPG home exported by gpg,
+// the keys are kept in memory and never written to disk
+// Keys protected by a passphrase stay protected, gpg may ask for it to export them
+func exportSecretKeys(home string) (openpgp.EntityList, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(GPGCommand, "--homedir", home, "--batch", "--export-secret-keys")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s --export-secret-keys failed: %s %s", GPGCommand, err, strings.TrimSpace(stderr.String()))
+	}
+
+	secRing, err := openpgp.ReadKeyRing(bytes.NewReader(out))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read secret keys exported from %s: %s", home, err)
+	}
+	if len(secRing) == 0 {
+		return nil, fmt.Errorf("%s has no secret keys", filepath.Join(home, PrivateKeysDir))
+	}
+
+	return secRing, nil
+}
@@ -0,0 +1,52 @@
+package pki
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keybase/go-crypto/openpgp"
+)
+
+// GroupPrefix marks a key name as the name of a recipient group, e.g. '@prod'
+const GroupPrefix = "@"
+
+// Groups maps the name of each recipient group to the key names, emails, or
+// IDs of its members, a '@name' key name encrypts to all of them
+var Groups map[string][]string
+
+// IsGroup checks for a recipient group name
+func IsGroup(name string) bool {
+	return strings.HasPrefix(name, GroupPrefix)
+}
+
+// GroupEntities returns the keys of the members of a recipient group in the order they are listed
+func (p *Pki) GroupEntities(name string) ([]*openpgp.Entity, error) {
+	group := strings.TrimPrefix(name, GroupPrefix)
+	members, ok := Groups[group]
+	if !ok {
+		return nil, fmt.Errorf("unknown recipient group '%s'", group)
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("recipient group '%s' has no members", group)
+	}
+
+	var entities []*openpgp.Entity
+	for _, member := range members {
+		entity := p.GetKeyByID(p.PublicKeys(), member)
+		if entity == nil {
+			return nil, fmt.Errorf("recipient group '%s': unable to find key '%s' in %s", group, member, ringLabel("public", p.PublicKeyRing))
+		}
+		entities = append(entities, entity)
+	}
+
+	return entities, nil
+}
+
+// KeysFor returns the key a key name, email, or ID names, or the keys of the members of a '@group'
+func (p *Pki) KeysFor(name string) ([]*openpgp.Entity, error) {
+	if IsGroup(name) {
+		return p.GroupEntities(name)
+	}
+
+	return p.EntitiesByName([]string{name})
+}
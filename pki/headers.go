@@ -0,0 +1,50 @@
+package pki
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keybase/go-crypto/openpgp/armor"
+)
+
+// ParseArmorHeaders converts key=value pairs to armor headers
+func ParseArmorHeaders(pairs []string) (map[string]string, error) {
+	headers := make(map[string]string)
+
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return headers, fmt.Errorf("armor header '%s' is not in the form key=value", pair)
+		}
+		if strings.ContainsAny(key, ": \t") {
+			return headers, fmt.Errorf("armor header key '%s' cannot contain a colon or whitespace", key)
+		}
+		value := strings.TrimSpace(parts[1])
+		if strings.ContainsAny(value, "\r\n") {
+			return headers, fmt.Errorf("armor header '%s' cannot span lines", key)
+		}
+		headers[key] = value
+	}
+
+	return headers, nil
+}
+
+// ArmorHeaders returns the headers of an armored message, they are read
+// without decrypting so no secret keyring is needed
+// Inline cipher text carries no headers
+func ArmorHeaders(cipherText string) (map[string]string, error) {
+	if IsInline(cipherText) {
+		return map[string]string{}, nil
+	}
+
+	block, err := armor.Decode(strings.NewReader(cipherText))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode PGP armor: %s", err)
+	}
+	if block.Type != "PGP MESSAGE" {
+		return nil, fmt.Errorf("block type is not PGP MESSAGE: %s", block.Type)
+	}
+
+	return block.Header, nil
+}
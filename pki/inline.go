@@ -0,0 +1,64 @@
+package pki
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/keybase/go-crypto/openpgp/armor"
+)
+
+// InlinePrefix marks cipher text stored as a single line of base64
+const InlinePrefix = "gpg-b64:"
+
+// IsInline checks for cipher text in the inline form
+func IsInline(cipherText string) bool {
+	return strings.HasPrefix(cipherText, InlinePrefix)
+}
+
+// InlineCipherText converts an armored PGP message to a single prefixed base64 line
+func InlineCipherText(cipherText string) (string, error) {
+	block, err := armor.Decode(strings.NewReader(cipherText))
+	if err != nil {
+		return cipherText, scrubError("unable to decode PGP armor", err)
+	}
+	if block.Type != "PGP MESSAGE" {
+		return cipherText, fmt.Errorf("block type is not PGP MESSAGE: %s", block.Type)
+	}
+
+	body, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		return cipherText, scrubError("unable to read PGP message", err)
+	}
+
+	return InlinePrefix + base64.StdEncoding.EncodeToString(body), nil
+}
+
+// ArmorCipherText converts inline cipher text back to an armored PGP message
+// Cipher text that is not in the inline form is returned as is
+func ArmorCipherText(cipherText string) (string, error) {
+	if !IsInline(cipherText) {
+		return cipherText, nil
+	}
+
+	body, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(cipherText, InlinePrefix))
+	if err != nil {
+		return cipherText, scrubError("unable to decode inline cipher text", err)
+	}
+
+	var buffer bytes.Buffer
+	w, err := armor.Encode(&buffer, "PGP MESSAGE", nil)
+	if err != nil {
+		return cipherText, err
+	}
+	if _, err = w.Write(body); err != nil {
+		return cipherText, err
+	}
+	if err = w.Close(); err != nil {
+		return cipherText, err
+	}
+
+	return buffer.String(), nil
+}
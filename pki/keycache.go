@@ -0,0 +1,85 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/keybase/go-crypto/openpgp"
+)
+
+// KeyCacheDir is a directory where New caches the key it looks up, so later
+// runs with the same keyring and key name do not read the whole keyring
+// An entry is used while the keyring has the modification time it was cached with
+var KeyCacheDir string
+
+// keyCachePath returns the cache entry of the named key of a keyring
+func keyCachePath(publicKeyRing string, name string) string {
+	sum := sha256.Sum256([]byte(publicKeyRing + "\x00" + name))
+
+	return filepath.Join(KeyCacheDir, hex.EncodeToString(sum[:])+".gpg")
+}
+
+// readCachedKey returns the cached key, or nil when there is no entry or the
+// keyring has changed since it was cached
+func readCachedKey(publicKeyRing string, name string) *openpgp.Entity {
+	ring, err := os.Stat(publicKeyRing)
+	if err != nil {
+		return nil
+	}
+	cachePath := keyCachePath(publicKeyRing, name)
+	cached, err := os.Stat(cachePath)
+	if err != nil || !cached.ModTime().Equal(ring.ModTime()) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		return nil
+	}
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+	if err != nil || len(entities) != 1 {
+		logger.Warnf("ignoring unreadable key cache entry %s", cachePath)
+		return nil
+	}
+
+	return entities[0]
+}
+
+// writeCachedKey caches the key with the modification time of the keyring
+func writeCachedKey(publicKeyRing string, name string, entity *openpgp.Entity) error {
+	ring, err := os.Stat(publicKeyRing)
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	if err = entity.Serialize(&buffer); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(KeyCacheDir, 0700); err != nil {
+		return err
+	}
+	cachePath := keyCachePath(publicKeyRing, name)
+	if err = ioutil.WriteFile(cachePath, buffer.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	return os.Chtimes(cachePath, ring.ModTime(), ring.ModTime())
+}
+
+// PublicKeys returns the public keyring, read in full the first time it is
+// needed when New took the key from KeyCacheDir
+func (p *Pki) PublicKeys() openpgp.EntityList {
+	if p.cachedKey {
+		if err := p.LoadPubKeyRing(); err != nil {
+			logger.Fatal(err)
+		}
+		p.cachedKey = false
+	}
+
+	return p.PubRing
+}
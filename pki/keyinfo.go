@@ -0,0 +1,89 @@
+package pki
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/keybase/go-crypto/openpgp"
+	"github.com/keybase/go-crypto/openpgp/packet"
+)
+
+// KeyInfo describes a key: its fingerprint, user ids, creation and expiry,
+// its encryption subkeys and whether its secret key is in the secret keyrings
+func (p *Pki) KeyInfo(entity *openpgp.Entity) string {
+	var buffer bytes.Buffer
+	now := time.Now()
+
+	fmt.Fprintf(&buffer, "fingerprint: %s\n", FormatKeyID(entity.PrimaryKey, FingerprintKeyID))
+	fmt.Fprintf(&buffer, "key id: %016X\n", entity.PrimaryKey.KeyId)
+	var names []string
+	for name := range entity.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&buffer, "uid: %s\n", name)
+	}
+	fmt.Fprintf(&buffer, "created: %s\n", formatKeyTime(entity.PrimaryKey.CreationTime))
+	var lifetime *uint32
+	if identity := primaryIdentity(entity); identity != nil && identity.SelfSignature != nil {
+		lifetime = identity.SelfSignature.KeyLifetimeSecs
+	}
+	fmt.Fprintf(&buffer, "expires: %s\n", keyExpiry(entity.PrimaryKey, lifetime, now))
+
+	latest, _ := LatestEncryptionKeyID(entity, now)
+	encryptionKeys := 0
+	for _, subkey := range entity.Subkeys {
+		if !subkey.Sig.FlagsValid || !(subkey.Sig.FlagEncryptCommunications || subkey.Sig.FlagEncryptStorage) ||
+			!subkey.PublicKey.PubKeyAlgo.CanEncrypt() {
+			continue
+		}
+		encryptionKeys++
+		used := ""
+		if subkey.PublicKey.KeyId == latest {
+			used = ", used for encryption"
+		}
+		fmt.Fprintf(&buffer, "encryption subkey: %016X created %s, expires %s%s\n", subkey.PublicKey.KeyId,
+			formatKeyTime(subkey.PublicKey.CreationTime), keyExpiry(subkey.PublicKey, subkey.Sig.KeyLifetimeSecs, now), used)
+	}
+	if encryptionKeys == 0 {
+		buffer.WriteString("encryption subkey: none\n")
+	}
+
+	fmt.Fprintf(&buffer, "secret key: %s\n", p.secretKeyState(entity))
+
+	return buffer.String()
+}
+
+// secretKeyState reports whether the secret key of entity is in the secret keyrings
+func (p *Pki) secretKeyState(entity *openpgp.Entity) string {
+	if err := p.LoadSecKeyRing(); err != nil {
+		return fmt.Sprintf("unknown, %s", err)
+	}
+	for _, key := range p.SecRing.KeysById(entity.PrimaryKey.KeyId, nil) {
+		if key.Entity != nil && key.Entity.PrivateKey != nil {
+			return "present"
+		}
+	}
+
+	return "missing"
+}
+
+func formatKeyTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// keyExpiry formats when a key with the given lifetime expires, noting when it already has
+func keyExpiry(key *packet.PublicKey, lifetime *uint32, now time.Time) string {
+	if lifetime == nil || *lifetime == 0 {
+		return "never"
+	}
+	expiry := key.CreationTime.Add(time.Duration(*lifetime) * time.Second)
+	if now.After(expiry) {
+		return formatKeyTime(expiry) + " (expired)"
+	}
+
+	return formatKeyTime(expiry)
+}
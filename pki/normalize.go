@@ -0,0 +1,62 @@
+package pki
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/keybase/go-crypto/openpgp/armor"
+)
+
+// NormalizeArmor re-wraps an armored message to the canonical form written by
+// EncryptSecret: 64 character lines, no trailing whitespace and headers sorted
+// by key, the message itself is not decrypted or re-encrypted
+// Inline cipher text has no line wrapping and is returned unchanged
+func NormalizeArmor(cipherText string) (string, error) {
+	if IsInline(cipherText) {
+		return cipherText, nil
+	}
+
+	lines := strings.Split(strings.TrimSpace(cipherText), "\n")
+	for index, line := range lines {
+		lines[index] = strings.TrimSpace(line)
+	}
+	block, err := armor.Decode(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return cipherText, scrubError("unable to decode PGP armor", err)
+	}
+	body, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		return cipherText, scrubError("unable to read PGP armor", err)
+	}
+
+	// armor.Encode writes headers in map order, they are added after so the output is stable
+	var encoded bytes.Buffer
+	w, err := armor.Encode(&encoded, block.Type, nil)
+	if err != nil {
+		return cipherText, err
+	}
+	if _, err = w.Write(body); err != nil {
+		return cipherText, err
+	}
+	if err = w.Close(); err != nil {
+		return cipherText, err
+	}
+
+	keys := make([]string, 0, len(block.Header))
+	for key := range block.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := strings.SplitN(encoded.String(), "\n", 2)
+	var out strings.Builder
+	out.WriteString(parts[0] + "\n")
+	for _, key := range keys {
+		out.WriteString(key + ": " + block.Header[key] + "\n")
+	}
+	out.WriteString(parts[1])
+
+	return out.String(), nil
+}
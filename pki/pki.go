@@ -3,29 +3,60 @@ package pki
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"os/user"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/keybase/go-crypto/openpgp"
 	"github.com/keybase/go-crypto/openpgp/armor"
+	"github.com/keybase/go-crypto/openpgp/packet"
 	"github.com/sirupsen/logrus"
 )
 
+// KeyNameSeparator separates the names of the keys values are encrypted to
+const KeyNameSeparator = ","
+
+// key id formats for key output
+const (
+	ShortKeyID       = "short"
+	LongKeyID        = "long"
+	FingerprintKeyID = "fingerprint"
+)
+
 var logger *logrus.Logger
 
+// unlockLock serializes decrypting secret keys, copies of a Pki share them
+var unlockLock sync.Mutex
+
 // Pki pki info
 type Pki struct {
-	PublicKeyRing string
-	SecretKeyRing string
-	PgpKeyName    string
-	PublicKey     *openpgp.Entity
-	PubRing       openpgp.EntityList
-	SecRing       openpgp.EntityList
+	PublicKeyRing     string
+	SecretKeyRing     string
+	PgpKeyName        string
+	PublicKey         *openpgp.Entity
+	EncryptionKeys    []*openpgp.Entity
+	PubRing           openpgp.EntityList
+	SecRing           openpgp.EntityList
+	KeyIDFormat       string
+	SecretKeyRings    []string
+	PassphraseCommand string
+	RecipientSelf     bool
+	StrictPerms       bool
+	SecRingCommand    string
+	ArmorHeaders      map[string]string
+	passphrase        []byte
+	selfKey           *openpgp.Entity
+	cachedKey         bool
 }
 
 // New returns a pki object
@@ -33,7 +64,7 @@ func New(pgpKeyName string, publicKeyRing string, secretKeyRing string) Pki {
 	var err error
 	logger = logrus.New()
 
-	p := Pki{publicKeyRing, secretKeyRing, pgpKeyName, nil, nil, nil}
+	p := Pki{PublicKeyRing: publicKeyRing, SecretKeyRing: secretKeyRing, PgpKeyName: pgpKeyName, KeyIDFormat: LongKeyID}
 	publicKeyRing, err = p.ExpandTilde(p.PublicKeyRing)
 	if err != nil {
 		logger.Fatal("cannot expand public key ring path: ", err)
@@ -45,42 +76,304 @@ func New(pgpKeyName string, publicKeyRing string, secretKeyRing string) Pki {
 		logger.Fatal("cannot expand secret key ring path: ", err)
 	}
 	p.SecretKeyRing = secKeyRing
+	p.SecretKeyRings = []string{secKeyRing}
+
+	useCache := KeyCacheDir != "" && !IsGroup(pgpKeyName) && !strings.Contains(pgpKeyName, KeyNameSeparator)
+	if useCache {
+		if entity := readCachedKey(p.PublicKeyRing, pgpKeyName); entity != nil {
+			p.PublicKey = entity
+			p.EncryptionKeys = []*openpgp.Entity{entity}
+			p.PubRing = openpgp.EntityList{entity}
+			p.cachedKey = true
+			return p
+		}
+	}
 
-	p.setSecKeyRing()
-	p.setPubKeyRing()
+	pubringFile, err := os.Open(p.PublicKeyRing)
+	if err != nil {
+		logger.Fatalf("cannot read public key ring: %s", err)
+	}
+	defer pubringFile.Close()
 
-	p.PublicKey = p.GetKeyByID(p.PubRing, p.PgpKeyName)
-	if p.PublicKey == nil {
-		logger.Fatalf("unable to find key '%s' in %s", p.PgpKeyName, p.PublicKeyRing)
+	// the secret keyring is loaded the first time it is needed
+	if err = p.loadKeyRings(pubringFile, nil); err != nil {
+		logger.Fatal(err)
+	}
+	if useCache {
+		if err = writeCachedKey(p.PublicKeyRing, pgpKeyName, p.PublicKey); err != nil {
+			logger.Warnf("unable to cache key '%s': %s", pgpKeyName, err)
+		}
 	}
 
 	return p
 }
 
-func (p *Pki) setSecKeyRing() {
-	secretKeyRing, err := p.ExpandTilde(p.SecretKeyRing)
+// NewFromReaders returns a pki object with the keyrings read from the given readers
+// sec may be nil when only encryption is needed
+func NewFromReaders(pgpKeyName string, pub io.Reader, sec io.Reader) (Pki, error) {
+	if logger == nil {
+		logger = logrus.New()
+	}
+
+	p := Pki{PgpKeyName: pgpKeyName, KeyIDFormat: LongKeyID}
+	err := p.loadKeyRings(pub, sec)
+
+	return p, err
+}
+
+func (p *Pki) loadKeyRings(pub io.Reader, sec io.Reader) error {
+	if err := p.readPubKeyRing(pub); err != nil {
+		return err
+	}
+
+	if sec != nil {
+		secRing, err := openpgp.ReadKeyRing(sec)
+		if err != nil {
+			return fmt.Errorf("cannot read private keys: %s", err)
+		}
+		if len(secRing) == 0 {
+			return fmt.Errorf("%s contains no keys", ringLabel("secret", p.SecretKeyRing))
+		}
+		p.SecRing = secRing
+	}
+
+	keys, missing, err := p.keysForNames(p.keyNames(p.PgpKeyName))
 	if err != nil {
-		logger.Warnf("error reading secring: %s", err)
+		return err
 	}
-	p.SecretKeyRing = secretKeyRing
+	switch {
+	case len(missing) == 1:
+		return fmt.Errorf("unable to find key '%s' in %s", missing[0], ringLabel("public", p.PublicKeyRing))
+	case len(missing) > 1:
+		return fmt.Errorf("unable to find keys '%s' in %s", strings.Join(missing, "', '"), ringLabel("public", p.PublicKeyRing))
+	}
+	// the first key stands in for all of them where a single key is used
+	p.PublicKey = keys[0]
+	p.EncryptionKeys = keys
+
+	return nil
+}
+
+// keyNames splits a comma separated list of key names, emails, IDs, or
+// '@group' names, leaving out empty names
+// Names with a comma in them, e.g. 'Doe, Jane', are kept whole when a key
+// in the public keyring has that name
+func (p *Pki) keyNames(pgpKeyName string) []string {
+	var names []string
+	parts := strings.Split(pgpKeyName, KeyNameSeparator)
+	for start := 0; start < len(parts); {
+		end := start + 1
+		for try := len(parts); try > end; try-- {
+			if p.GetKeyByID(p.PubRing, strings.TrimSpace(strings.Join(parts[start:try], KeyNameSeparator))) != nil {
+				end = try
+				break
+			}
+		}
+		if name := strings.TrimSpace(strings.Join(parts[start:end], KeyNameSeparator)); name != "" {
+			names = append(names, name)
+		}
+		start = end
+	}
+
+	return names
+}
+
+// keysForNames returns the keys for each of names, each key once, and the
+// names that are not in the public keyring
+// An unknown group is an error as a misspelt group is not a missing key
+func (p *Pki) keysForNames(names []string) ([]*openpgp.Entity, []string, error) {
+	var keys []*openpgp.Entity
+	var missing []string
+	if len(names) == 0 {
+		missing = append(missing, "")
+	}
+
+	seen := make(map[uint64]bool)
+	for _, name := range names {
+		var found []*openpgp.Entity
+		if IsGroup(name) {
+			members, err := p.GroupEntities(name)
+			if err != nil {
+				return keys, missing, err
+			}
+			found = members
+		} else if entity := p.GetKeyByID(p.PubRing, name); entity != nil {
+			found = []*openpgp.Entity{entity}
+		} else {
+			missing = append(missing, name)
+		}
+		for _, entity := range found {
+			if !seen[entity.PrimaryKey.KeyId] {
+				seen[entity.PrimaryKey.KeyId] = true
+				keys = append(keys, entity)
+			}
+		}
+	}
+
+	return keys, missing, nil
+}
+
+// ringLabel names a keyring in messages, keyrings read from a reader have no path
+func ringLabel(kind string, path string) string {
+	if path == "" {
+		return kind + " keyring"
+	}
+	return kind + " keyring " + path
+}
+
+// SetSecretKeyRings replaces the secret keyrings, all of them are merged when loaded
+func (p *Pki) SetSecretKeyRings(secretKeyRings []string) error {
+	if len(secretKeyRings) == 0 {
+		return nil
+	}
+
+	var rings []string
+	for _, ring := range secretKeyRings {
+		secKeyRing, err := p.ExpandTilde(ring)
+		if err != nil {
+			return fmt.Errorf("cannot expand secret key ring path: %s", err)
+		}
+		rings = append(rings, secKeyRing)
+	}
+	p.SecretKeyRing = rings[0]
+	p.SecretKeyRings = rings
+	p.SecRing = nil
+
+	return nil
+}
+
+// LoadSecKeyRing reads the secret keyrings the first time they are needed
+// so encrypt only operations work without a secret keyring
+// Keys from all of the secret keyrings are merged into SecRing
+// A keyring readable by group or others is warned about, or refused with StrictPerms
+// With SecRingCommand the keys are read from its output instead of any file
+func (p *Pki) LoadSecKeyRing() error {
+	if p.SecRing != nil {
+		return nil
+	}
+	if p.SecRingCommand != "" {
+		secRing, err := p.runSecRingCommand()
+		if err != nil {
+			return err
+		}
+		p.SecRing = secRing
+		return nil
+	}
+
+	rings := p.SecretKeyRings
+	if len(rings) == 0 {
+		if p.SecretKeyRing == "" {
+			return fmt.Errorf("no secret keyring given")
+		}
+		rings = []string{p.SecretKeyRing}
+	}
+
+	var secRing openpgp.EntityList
+	for _, ring := range rings {
+		if err := p.checkSecRingPerms(ring); err != nil {
+			return err
+		}
+		privring, err := readSecKeyRing(ring)
+		if err != nil {
+			return err
+		}
+		secRing = append(secRing, privring...)
+	}
+	if len(secRing) == 0 {
+		return fmt.Errorf("secret keyring %s contains no keys", strings.Join(rings, ", "))
+	}
+	p.SecRing = secRing
+
+	return nil
+}
+
+// checkSecRingPerms warns when a secret keyring can be read by its group or
+// others, with StrictPerms it is an error
+func (p *Pki) checkSecRingPerms(secretKeyRing string) error {
+	info, err := os.Stat(secretKeyRing)
+	if err != nil {
+		// let reading the keyring report the problem
+		return nil
+	}
+
+	mode := info.Mode().Perm()
+	if mode&0044 == 0 {
+		return nil
+	}
+	if p.StrictPerms {
+		return fmt.Errorf("secret keyring %s is readable by others (mode %04o), refusing to use it", secretKeyRing, mode)
+	}
+	logger.Warnf("secret keyring %s is readable by others (mode %04o), it should be 0600", secretKeyRing, mode)
+
+	return nil
+}
+
+// runSecRingCommand returns the keys the secret keyring command writes to
+// STDOUT, armored or binary, the output is never written to disk
+func (p *Pki) runSecRingCommand() (openpgp.EntityList, error) {
+	args := strings.Fields(p.SecRingCommand)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no secret keyring command given")
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("secret keyring command failed: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	secRing, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(out))
+	if err != nil {
+		secRing, err = openpgp.ReadKeyRing(bytes.NewReader(out))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("secret keyring command output is not a valid keyring: %s", err)
+	}
+	if len(secRing) == 0 {
+		return nil, fmt.Errorf("secret keyring command output contains no keys")
+	}
+
+	return secRing, nil
+}
+
+// readSecKeyRing reads a secret keyring, without secring.gpg the secret keys
+// of GnuPG 2.1 and later are exported from private-keys-v1.d with gpg
+func readSecKeyRing(secretKeyRing string) (openpgp.EntityList, error) {
+	if home, ok := gnupgHomeFor(secretKeyRing); ok {
+		return exportSecretKeys(home)
+	}
+
 	privringFile, err := os.Open(secretKeyRing)
 	if err != nil {
-		logger.Warnf("unable to open secring: %s", err)
+		return nil, fmt.Errorf("unable to open secring: %s", err)
 	}
+	defer privringFile.Close()
+
 	privring, err := openpgp.ReadKeyRing(privringFile)
 	if err != nil {
-		logger.Warnf("cannot read private keys: %s", err)
-	} else if privring == nil {
-		logger.Warnf(fmt.Sprintf("%s is empty!", p.SecretKeyRing))
-	} else {
-		p.SecRing = privring
+		return nil, fmt.Errorf("cannot read private keys from %s: %s", secretKeyRing, err)
 	}
-	if err = privringFile.Close(); err != nil {
-		logger.Fatal("error closing secring: ", err)
+
+	return privring, nil
+}
+
+// CheckSecRing returns an error unless the secret keyrings can be read and hold a secret key
+func (p *Pki) CheckSecRing() error {
+	if err := p.LoadSecKeyRing(); err != nil {
+		return err
 	}
+	for _, entity := range p.SecRing {
+		if entity.PrivateKey != nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s holds no secret keys", ringLabel("secret", strings.Join(p.SecretKeyRings, ", ")))
 }
 
-func (p *Pki) setPubKeyRing() {
+// LoadPubKeyRing reads the public keyring, an empty keyring is an error
+func (p *Pki) LoadPubKeyRing() error {
 	publicKeyRing, err := p.ExpandTilde(p.PublicKeyRing)
 	if err != nil {
 		logger.Warnf("error reading pubring: %s", err)
@@ -88,46 +381,68 @@ func (p *Pki) setPubKeyRing() {
 	p.PublicKeyRing = publicKeyRing
 	pubringFile, err := os.Open(p.PublicKeyRing)
 	if err != nil {
-		logger.Fatal("cannot read public key ring: ", err)
+		return fmt.Errorf("cannot read public key ring: %s", err)
 	}
-	pubring, err := openpgp.ReadKeyRing(pubringFile)
+	defer pubringFile.Close()
+
+	return p.readPubKeyRing(pubringFile)
+}
+
+func (p *Pki) readPubKeyRing(in io.Reader) error {
+	pubring, err := readKeyRing(in)
 	if err != nil {
-		logger.Fatal("cannot read public keys: ", err)
+		return fmt.Errorf("cannot read public keys: %s", err)
 	}
-	p.PubRing = pubring
-	if err = pubringFile.Close(); err != nil {
-		logger.Fatal("error closing pubring: ", err)
+	if len(pubring) == 0 {
+		return fmt.Errorf("%s contains no keys", ringLabel("public", p.PublicKeyRing))
 	}
+	p.PubRing = pubring
+
+	return nil
 }
 
-// EncryptSecret returns encrypted plainText
+// EncryptSecret returns plainText encrypted to all of the named keys, and with RecipientSelf to the operator's own key
 func (p *Pki) EncryptSecret(plainText string) (cipherText string) {
+	if len(p.PubRing) == 0 {
+		logger.Fatalf("public keyring %s contains no keys", p.PublicKeyRing)
+	}
+	if p.PublicKey == nil {
+		logger.Fatalf("unable to find key '%s' in %s", p.PgpKeyName, p.PublicKeyRing)
+	}
+
+	return p.EncryptSecretTo(plainText, p.recipients())
+}
+
+// EncryptSecretTo returns plainText encrypted to all of the given keys
+func (p *Pki) EncryptSecretTo(plainText string, recipients []*openpgp.Entity) (cipherText string) {
 	var memBuffer bytes.Buffer
 
+	// the plain text is always text, binary values are base64 encoded before
+	// they get here (see sls.Base64FileSource) so they decrypt as text too
 	hints := openpgp.FileHints{IsBinary: false, ModTime: time.Time{}}
 	writer := bufio.NewWriter(&memBuffer)
-	w, err := armor.Encode(writer, "PGP MESSAGE", nil)
+	w, err := armor.Encode(writer, "PGP MESSAGE", p.ArmorHeaders)
 	if err != nil {
-		logger.Fatal("Encode error: ", err)
+		logger.Fatal(scrubError("Encode error", err))
 	}
 
-	plainFile, err := openpgp.Encrypt(w, []*openpgp.Entity{p.PublicKey}, nil, &hints, nil)
+	plainFile, err := openpgp.Encrypt(w, recipients, nil, &hints, nil)
 	if err != nil {
-		logger.Fatal("Encryption error: ", err)
+		logger.Fatal(scrubError("Encryption error", err))
 	}
 
 	if _, err = fmt.Fprintf(plainFile, "%s", plainText); err != nil {
-		logger.Fatal(err)
+		logger.Fatal(scrubError("unable to encrypt value", err))
 	}
 
 	if err = plainFile.Close(); err != nil {
-		logger.Fatal("unable to close file: ", err)
+		logger.Fatal(scrubError("unable to close file", err))
 	}
 	if err = w.Close(); err != nil {
-		logger.Fatal(err)
+		logger.Fatal(scrubError("unable to close armor", err))
 	}
 	if err = writer.Flush(); err != nil {
-		logger.Fatal("error flusing writer: ", err)
+		logger.Fatal(scrubError("error flusing writer", err))
 	}
 
 	return memBuffer.String()
@@ -135,36 +450,174 @@ func (p *Pki) EncryptSecret(plainText string) (cipherText string) {
 
 // DecryptSecret returns decrypted cipherText
 func (p *Pki) DecryptSecret(cipherText string) (plainText string, err error) {
-	privringFile, err := os.Open(p.SecretKeyRing)
-	if err != nil {
-		return cipherText, fmt.Errorf("unable to open secring: %s", err)
+	if err = p.LoadSecKeyRing(); err != nil {
+		return cipherText, err
 	}
-	privring, err := openpgp.ReadKeyRing(privringFile)
+
+	armored, err := ArmorCipherText(cipherText)
 	if err != nil {
-		return cipherText, fmt.Errorf("cannot read private keys: %s", err)
-	} else if privring == nil {
-		return cipherText, fmt.Errorf(fmt.Sprintf("%s is empty!", p.SecretKeyRing))
+		return cipherText, err
+	}
+
+	if err = p.checkRecipients(armored); err != nil {
+		return cipherText, err
 	}
 
-	decbuf := bytes.NewBuffer([]byte(cipherText))
+	decbuf := bytes.NewBuffer([]byte(armored))
 	block, err := armor.Decode(decbuf)
+	if err != nil {
+		return cipherText, scrubError("unable to decode PGP armor", err)
+	}
+	if strings.HasSuffix(block.Type, "KEY BLOCK") {
+		return cipherText, ErrKeyBlock
+	}
 	if block.Type != "PGP MESSAGE" {
-		return cipherText, fmt.Errorf("block type is not PGP MESSAGE: %s", err)
+		return cipherText, fmt.Errorf("block type is not PGP MESSAGE: %s", block.Type)
 	}
 
-	md, err := openpgp.ReadMessage(block.Body, privring, nil, nil)
+	md, err := openpgp.ReadMessage(block.Body, p.SecRing, p.prompt, nil)
 	if err != nil {
-		return cipherText, fmt.Errorf("unable to read PGP message: %s", err)
+		return cipherText, scrubError("unable to read PGP message", err)
 	}
 
 	bytes, err := ioutil.ReadAll(md.UnverifiedBody)
 	if err != nil {
-		return cipherText, fmt.Errorf("unable to read message body: %s", err)
+		return cipherText, scrubError("unable to read message body", err)
 	}
 
 	return string(bytes), err
 }
 
+// SelfCheck encrypts a random string with the public key and decrypts it
+// with the secret keyring, returning an error describing the first failure
+func (p *Pki) SelfCheck() error {
+	if p.PublicKey == nil {
+		return fmt.Errorf("unable to find key '%s' in %s", p.PgpKeyName, p.PublicKeyRing)
+	}
+	if err := p.LoadSecKeyRing(); err != nil {
+		return fmt.Errorf("no secret keys available: %s", err)
+	}
+
+	keys := p.SecRing.KeysById(p.PublicKey.PrimaryKey.KeyId, nil)
+	if len(keys) == 0 {
+		return fmt.Errorf("secret key for '%s' not found in %s", p.PgpKeyName, p.SecretKeyRing)
+	}
+	entity := keys[0].Entity
+	needsPassphrase := entity.PrivateKey != nil && entity.PrivateKey.Encrypted
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+			needsPassphrase = true
+		}
+	}
+	if needsPassphrase && p.PassphraseCommand == "" {
+		return fmt.Errorf("secret key for '%s' needs a passphrase", p.PgpKeyName)
+	}
+
+	randBytes := make([]byte, 16)
+	if _, err := rand.Read(randBytes); err != nil {
+		return fmt.Errorf("unable to generate test string: %s", err)
+	}
+	plainText := hex.EncodeToString(randBytes)
+
+	cipherText := p.EncryptSecret(plainText)
+	decrypted, err := p.DecryptSecret(cipherText)
+	if err != nil {
+		return fmt.Errorf("decrypt failed: %s", err)
+	}
+	if decrypted != plainText {
+		return fmt.Errorf("decrypted text does not match the original")
+	}
+
+	return nil
+}
+
+// Passphrase runs the passphrase command the first time it is needed and
+// returns its trimmed output
+func (p *Pki) Passphrase() ([]byte, error) {
+	if p.passphrase != nil {
+		return p.passphrase, nil
+	}
+
+	args := strings.Fields(p.PassphraseCommand)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no passphrase command given")
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("passphrase command failed: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	p.passphrase = bytes.TrimSpace(out)
+
+	return p.passphrase, nil
+}
+
+// prompt decrypts the candidate secret keys with the passphrase when openpgp asks for it
+func (p *Pki) prompt(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+	if symmetric {
+		return nil, fmt.Errorf("symmetric encryption is not supported")
+	}
+	if p.PassphraseCommand == "" {
+		return nil, fmt.Errorf("secret key needs a passphrase, use a passphrase command")
+	}
+	passphrase, err := p.Passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	unlockLock.Lock()
+	defer unlockLock.Unlock()
+	for _, key := range keys {
+		if key.PrivateKey == nil || !key.PrivateKey.Encrypted {
+			continue
+		}
+		if err = key.PrivateKey.Decrypt(passphrase); err != nil {
+			return nil, fmt.Errorf("passphrase does not decrypt key %s: %s", FormatKeyID(key.PublicKey, p.KeyIDFormat), err)
+		}
+	}
+
+	return passphrase, nil
+}
+
+// UnlockSecretKeys decrypts the secret keys the passphrase opens, so copies of
+// a Pki used by many goroutines read the keys and never decrypt them in place
+// Keys it does not open are left as they are and fail to decrypt as before
+func (p *Pki) UnlockSecretKeys() error {
+	if err := p.LoadSecKeyRing(); err != nil {
+		return err
+	}
+
+	var locked []*packet.PrivateKey
+	for _, entity := range p.SecRing {
+		if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+			locked = append(locked, entity.PrivateKey)
+		}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+				locked = append(locked, subkey.PrivateKey)
+			}
+		}
+	}
+	if len(locked) == 0 || p.PassphraseCommand == "" {
+		return nil
+	}
+	passphrase, err := p.Passphrase()
+	if err != nil {
+		return err
+	}
+
+	unlockLock.Lock()
+	defer unlockLock.Unlock()
+	for _, key := range locked {
+		// a failed decrypt leaves the key untouched
+		_ = key.Decrypt(passphrase)
+	}
+
+	return nil
+}
+
 // GetKeyByID returns a keyring by the given ID
 func (p *Pki) GetKeyByID(keyring openpgp.EntityList, id interface{}) *openpgp.Entity {
 	for _, entity := range keyring {
@@ -195,6 +648,45 @@ func (p *Pki) GetKeyByID(keyring openpgp.EntityList, id interface{}) *openpgp.En
 	return nil
 }
 
+// GnuPGHome returns $GNUPGHOME, or ~/.gnupg when it is not set
+func GnuPGHome() string {
+	if home := os.Getenv("GNUPGHOME"); home != "" {
+		return home
+	}
+	return "~/.gnupg"
+}
+
+// DefaultPubRing returns the public keyring in the GnuPG home, the legacy
+// pubring.gpg is used when it exists, then pubring.kbx
+func DefaultPubRing() string {
+	return probeKeyRing("pubring.gpg", "pubring.kbx")
+}
+
+// DefaultSecRing returns the secret keyring in the GnuPG home, the legacy
+// secring.gpg is used when it exists, then the private-keys-v1.d of GnuPG 2.1
+// and later, whose keys are exported with gpg
+func DefaultSecRing() string {
+	return probeKeyRing("secring.gpg", PrivateKeysDir)
+}
+
+// probeKeyRing returns the first of the named files that exists in the GnuPG home
+func probeKeyRing(names ...string) string {
+	home := GnuPGHome()
+	var p Pki
+	for _, name := range names {
+		path := filepath.Join(home, name)
+		expanded, err := p.ExpandTilde(path)
+		if err != nil {
+			continue
+		}
+		if _, err = os.Stat(expanded); err == nil {
+			return path
+		}
+	}
+
+	return filepath.Join(home, names[0])
+}
+
 // ExpandTilde does exactly what it says on the tin
 func (p *Pki) ExpandTilde(path string) (string, error) {
 	if len(path) == 0 || path[0] != '~' {
@@ -208,7 +700,7 @@ func (p *Pki) ExpandTilde(path string) (string, error) {
 	return filepath.Join(usr.HomeDir, path[1:]), nil
 }
 
-// KeyUsedForEncryptedFile gets the key used to encrypt a file
+// KeyUsedForEncryptedFile gets the keys used to encrypt a file, a line for each
 func (p *Pki) KeyUsedForEncryptedFile(file string) (string, error) {
 	filePath, err := filepath.Abs(file)
 	if err != nil {
@@ -219,6 +711,40 @@ func (p *Pki) KeyUsedForEncryptedFile(file string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer in.Close()
+
+	return p.keyUsedForReader(in)
+}
+
+// KeyUsedForEncryptedText gets the keys used to encrypt an armored string, a line for each
+func (p *Pki) KeyUsedForEncryptedText(cipherText string) (string, error) {
+	armored, err := ArmorCipherText(cipherText)
+	if err != nil {
+		return "", err
+	}
+
+	return p.keyUsedForReader(strings.NewReader(armored))
+}
+
+// KeyUsedForEncryptedTextFast gets the keys used to encrypt an armored string
+// from its key packets only, the session key and message body are not read
+func (p *Pki) KeyUsedForEncryptedTextFast(cipherText string) (string, error) {
+	if err := p.LoadSecKeyRing(); err != nil {
+		return "", err
+	}
+
+	ids, err := RecipientKeyIDs(cipherText)
+	if err != nil {
+		return "", err
+	}
+
+	return p.keyStringForIDs(ids)
+}
+
+func (p *Pki) keyUsedForReader(in io.Reader) (string, error) {
+	if err := p.LoadSecKeyRing(); err != nil {
+		return "", err
+	}
 
 	block, err := armor.Decode(in)
 	if err != nil {
@@ -233,15 +759,23 @@ func (p *Pki) KeyUsedForEncryptedFile(file string) (string, error) {
 		return "", fmt.Errorf("unable to read PGP message: %s", err)
 	}
 
-	for index := 0; index < len(md.EncryptedToKeyIds); index++ {
-		id := md.EncryptedToKeyIds[index]
+	return p.keyStringForIDs(md.EncryptedToKeyIds)
+}
+
+// keyStringForIDs returns a line for each of the ids in the secret keyring
+func (p *Pki) keyStringForIDs(ids []uint64) (string, error) {
+	var keyStrs []string
+	for _, id := range ids {
 		keyStr := p.keyStringForID(id)
 		if keyStr != "" {
-			return keyStr, nil
+			keyStrs = append(keyStrs, keyStr)
 		}
 	}
+	if len(keyStrs) == 0 {
+		return "", fmt.Errorf("unable to find key for ids used")
+	}
 
-	return "", fmt.Errorf("unable to find key for ids used")
+	return strings.Join(keyStrs, ""), nil
 }
 
 func (p *Pki) keyStringForID(id uint64) string {
@@ -252,10 +786,28 @@ func (p *Pki) keyStringForID(id uint64) string {
 			if key.Entity != nil {
 				for k := range key.Entity.Identities {
 					// return the first valid key
-					return fmt.Sprintf("%X: %s\n", id, k)
+					return fmt.Sprintf("%s: %s\n", FormatKeyID(key.PublicKey, p.KeyIDFormat), k)
 				}
 			}
 		}
 	}
 	return ""
 }
+
+// ValidKeyIDFormat checks for a known key id format
+func ValidKeyIDFormat(format string) bool {
+	return format == ShortKeyID || format == LongKeyID || format == FingerprintKeyID
+}
+
+// FormatKeyID formats the id of a public key as a short (8 hex), long (16 hex)
+// or fingerprint (40 hex) string, unknown formats fall back to the long id
+func FormatKeyID(key *packet.PublicKey, format string) string {
+	switch format {
+	case ShortKeyID:
+		return fmt.Sprintf("%08X", uint32(key.KeyId))
+	case FingerprintKeyID:
+		return fmt.Sprintf("%X", key.Fingerprint[:])
+	}
+
+	return fmt.Sprintf("%016X", key.KeyId)
+}
@@ -0,0 +1,360 @@
+package pki
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/keybase/go-crypto/openpgp"
+	"github.com/keybase/go-crypto/openpgp/armor"
+	"github.com/keybase/go-crypto/openpgp/packet"
+)
+
+// RecipientKeyIDs returns the ids of the keys an armored message was encrypted to
+// The message is not decrypted so no secret keyring is needed
+func RecipientKeyIDs(cipherText string) ([]uint64, error) {
+	var ids []uint64
+
+	armored, err := ArmorCipherText(cipherText)
+	if err != nil {
+		return ids, err
+	}
+
+	block, err := armor.Decode(strings.NewReader(armored))
+	if err != nil {
+		return ids, fmt.Errorf("unable to decode PGP armor: %s", err)
+	}
+	if block.Type != "PGP MESSAGE" {
+		return ids, fmt.Errorf("block type is not PGP MESSAGE: %s", block.Type)
+	}
+
+	packets := packet.NewReader(block.Body)
+	for {
+		pkt, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ids, fmt.Errorf("unable to read PGP message: %s", err)
+		}
+		key, ok := pkt.(*packet.EncryptedKey)
+		if !ok {
+			// the encrypted data follows the key packets
+			break
+		}
+		ids = append(ids, key.KeyId)
+	}
+
+	return ids, nil
+}
+
+// EntitiesByName looks up each of the named keys in the public keyring
+func (p *Pki) EntitiesByName(names []string) ([]*openpgp.Entity, error) {
+	var entities []*openpgp.Entity
+
+	for _, name := range names {
+		entity := p.GetKeyByID(p.PublicKeys(), name)
+		if entity == nil {
+			return entities, fmt.Errorf("unable to find key '%s' in %s", name, p.PublicKeyRing)
+		}
+		entities = append(entities, entity)
+	}
+
+	return entities, nil
+}
+
+// RecipientDiff compares the recipients of an armored message to the desired keys
+// returning the desired keys it was not encrypted to and any extra recipients
+func (p *Pki) RecipientDiff(cipherText string, desired []*openpgp.Entity) (missing []string, extra []string, err error) {
+	ids, err := RecipientKeyIDs(cipherText)
+	if err != nil {
+		return missing, extra, err
+	}
+
+	found := make(map[uint64]bool)
+	for _, id := range ids {
+		found[id] = true
+	}
+
+	known := make(map[uint64]bool)
+	for _, entity := range desired {
+		encryptedTo := false
+		for _, id := range EntityKeyIDs(entity) {
+			known[id] = true
+			if found[id] {
+				encryptedTo = true
+			}
+		}
+		if !encryptedTo {
+			missing = append(missing, EntityName(entity))
+		}
+	}
+
+	for _, id := range ids {
+		if known[id] {
+			continue
+		}
+		name := fmt.Sprintf("%016X", id)
+		keys := p.PublicKeys().KeysById(id, nil)
+		if len(keys) > 0 && keys[0].Entity != nil {
+			name = EntityName(keys[0].Entity)
+		}
+		extra = append(extra, name)
+	}
+
+	return missing, extra, nil
+}
+
+// EntityKeyIDs returns the ids of the primary key and all sub keys of an entity
+func EntityKeyIDs(entity *openpgp.Entity) []uint64 {
+	ids := []uint64{entity.PrimaryKey.KeyId}
+	for _, subkey := range entity.Subkeys {
+		ids = append(ids, subkey.PublicKey.KeyId)
+	}
+
+	return ids
+}
+
+// EntityName returns the first identity of an entity in sorted order
+func EntityName(entity *openpgp.Entity) string {
+	var names []string
+	for name := range entity.Identities {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("%016X", entity.PrimaryKey.KeyId)
+	}
+	sort.Strings(names)
+
+	return names[0]
+}
+
+// RecipientFingerprints returns the fingerprint and name of each key EncryptSecret encrypts to
+func (p *Pki) RecipientFingerprints() []string {
+	if p.PublicKey == nil {
+		return nil
+	}
+
+	var fingerprints []string
+	for _, entity := range p.recipients() {
+		fingerprints = append(fingerprints, fmt.Sprintf("%s %s", FormatKeyID(entity.PrimaryKey, FingerprintKeyID), EntityName(entity)))
+	}
+
+	return fingerprints
+}
+
+// RecipientsWith returns the keys EncryptSecret encrypts to together with
+// the named keys from the public keyring, each key once
+func (p *Pki) RecipientsWith(names []string) ([]*openpgp.Entity, error) {
+	var recipients []*openpgp.Entity
+	if p.PublicKey != nil {
+		recipients = p.recipients()
+	}
+
+	named, err := p.EntitiesByName(names)
+	if err != nil {
+		return recipients, err
+	}
+	for _, entity := range named {
+		found := false
+		for _, recipient := range recipients {
+			if recipient.PrimaryKey.KeyId == entity.PrimaryKey.KeyId {
+				found = true
+				break
+			}
+		}
+		if !found {
+			recipients = append(recipients, entity)
+		}
+	}
+	if len(recipients) == 0 {
+		return recipients, fmt.Errorf("no keys to encrypt to")
+	}
+
+	return recipients, nil
+}
+
+// recipients returns the keys values are encrypted to, the named keys and the
+// members of the named groups, and with RecipientSelf the operator's own key
+// when it is not one of them
+func (p *Pki) recipients() []*openpgp.Entity {
+	recipients := append([]*openpgp.Entity{}, p.EncryptionKeys...)
+	if len(recipients) == 0 {
+		recipients = append(recipients, p.PublicKey)
+	}
+	if !p.RecipientSelf {
+		return recipients
+	}
+
+	if p.selfKey == nil {
+		self, err := p.SelfKey()
+		if err != nil {
+			logger.Fatalf("unable to add your own key as a recipient: %s", err)
+		}
+		p.selfKey = self
+	}
+	for _, recipient := range recipients {
+		if recipient.PrimaryKey.KeyId == p.selfKey.PrimaryKey.KeyId {
+			return recipients
+		}
+	}
+
+	return append(recipients, p.selfKey)
+}
+
+// SelfKey returns the public key of the first key in the secret keyring that
+// has its secret key, taken from the public keyring when it is there
+func (p *Pki) SelfKey() (*openpgp.Entity, error) {
+	if err := p.CheckSecRing(); err != nil {
+		return nil, err
+	}
+
+	for _, entity := range p.SecRing {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if keys := p.PublicKeys().KeysById(entity.PrimaryKey.KeyId, nil); len(keys) > 0 && keys[0].Entity != nil {
+			return keys[0].Entity, nil
+		}
+		return entity, nil
+	}
+
+	return nil, fmt.Errorf("no secret key found")
+}
+
+// checkRecipients returns an error naming the recipients when a message is
+// not encrypted to any key in the secret keyring
+func (p *Pki) checkRecipients(cipherText string) error {
+	ids, err := RecipientKeyIDs(cipherText)
+	if err != nil || len(ids) == 0 {
+		// let the decryption report the problem
+		return nil
+	}
+
+	var names []string
+	for _, id := range ids {
+		// hidden recipients could be any key
+		if id == 0 || len(p.SecRing.KeysById(id, nil)) > 0 {
+			return nil
+		}
+		name := fmt.Sprintf("%016X", id)
+		keys := p.PublicKeys().KeysById(id, nil)
+		if len(keys) > 0 && keys[0].Entity != nil {
+			name = fmt.Sprintf("%s %s", name, EntityName(keys[0].Entity))
+		}
+		names = append(names, name)
+	}
+
+	return fmt.Errorf("this file is not encrypted to any key you hold (recipients: %s)", strings.Join(names, ", "))
+}
+
+// Recipient is a key an armored message was encrypted to
+type Recipient struct {
+	KeyID string
+	UID   string
+}
+
+// Recipients returns the id and user id of each key an armored message was encrypted to
+// Ids are formatted with KeyIDFormat, keys in neither keyring have an empty user id
+func (p *Pki) Recipients(cipherText string) ([]Recipient, error) {
+	var recipients []Recipient
+
+	ids, err := RecipientKeyIDs(cipherText)
+	if err != nil {
+		return recipients, err
+	}
+
+	for _, id := range ids {
+		keys := p.PublicKeys().KeysById(id, nil)
+		if len(keys) == 0 && p.SecRing != nil {
+			keys = p.SecRing.KeysById(id, nil)
+		}
+		if len(keys) > 0 && keys[0].Entity != nil {
+			recipients = append(recipients, Recipient{FormatKeyID(keys[0].PublicKey, p.KeyIDFormat), EntityName(keys[0].Entity)})
+			continue
+		}
+		keyID := fmt.Sprintf("%016X", id)
+		if p.KeyIDFormat == ShortKeyID {
+			keyID = fmt.Sprintf("%08X", uint32(id))
+		}
+		recipients = append(recipients, Recipient{keyID, ""})
+	}
+
+	return recipients, nil
+}
+
+// VerifyCipherText checks that an armored message is well formed and only encrypted
+// to keys in the public keyring, the message is not decrypted so no secret keyring is needed
+func (p *Pki) VerifyCipherText(cipherText string) error {
+	armored, err := ArmorCipherText(cipherText)
+	if err != nil {
+		return err
+	}
+
+	block, err := armor.Decode(strings.NewReader(armored))
+	if err != nil {
+		return fmt.Errorf("unable to decode PGP armor: %s", err)
+	}
+	if block.Type != "PGP MESSAGE" {
+		return fmt.Errorf("block type is not PGP MESSAGE: %s", block.Type)
+	}
+
+	var ids []uint64
+	packets := packet.NewReader(block.Body)
+	for {
+		pkt, err := packets.Next()
+		if err == io.EOF {
+			return fmt.Errorf("PGP message has no encrypted data")
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read PGP message: %s", err)
+		}
+		if key, ok := pkt.(*packet.EncryptedKey); ok {
+			ids = append(ids, key.KeyId)
+			continue
+		}
+		if _, ok := pkt.(*packet.SymmetricallyEncrypted); !ok {
+			return fmt.Errorf("unexpected %T packet in PGP message", pkt)
+		}
+		break
+	}
+	// the encrypted data runs to the end of the message, reading
+	// it through checks the armor checksum
+	if _, err = ioutil.ReadAll(block.Body); err != nil {
+		return fmt.Errorf("unable to read encrypted data: %s", err)
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("PGP message has no recipients")
+	}
+
+	for _, id := range ids {
+		if len(p.PublicKeys().KeysById(id, nil)) == 0 {
+			return fmt.Errorf("encrypted to unknown key %016X", id)
+		}
+	}
+
+	return nil
+}
+
+// RecipientEntities returns the keys in the public keyring an armored message was
+// encrypted to, a recipient missing from the public keyring is an error
+func (p *Pki) RecipientEntities(cipherText string) ([]*openpgp.Entity, error) {
+	var entities []*openpgp.Entity
+
+	ids, err := RecipientKeyIDs(cipherText)
+	if err != nil {
+		return entities, err
+	}
+
+	for _, id := range ids {
+		keys := p.PublicKeys().KeysById(id, nil)
+		if len(keys) == 0 || keys[0].Entity == nil {
+			return entities, fmt.Errorf("recipient %016X is not in %s", id, ringLabel("public", p.PublicKeyRing))
+		}
+		entities = append(entities, keys[0].Entity)
+	}
+
+	return entities, nil
+}
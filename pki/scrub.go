@@ -0,0 +1,21 @@
+package pki
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Paranoid leaves the text of OpenPGP library errors out of the errors for
+// encrypting and decrypting values, only the reason given here is kept
+var Paranoid bool
+
+// scrubError returns reason with the library error err, or reason alone with Paranoid
+// The errors of this package never include a plain text value, the library
+// text is the only part of them this package does not write itself
+func scrubError(reason string, err error) error {
+	if Paranoid {
+		return errors.New(reason)
+	}
+
+	return fmt.Errorf("%s: %s", reason, err)
+}
@@ -0,0 +1,88 @@
+package pki
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/keybase/go-crypto/openpgp"
+)
+
+// LatestEncryptionKeyID returns the id of the key new messages to entity are
+// encrypted to: its newest valid encryption subkey or, without one, its primary
+// key when that may encrypt. This is the choice openpgp.Encrypt makes
+func LatestEncryptionKeyID(entity *openpgp.Entity, now time.Time) (uint64, bool) {
+	var latest uint64
+	var latestTime time.Time
+	found := false
+	for _, subkey := range entity.Subkeys {
+		if !subkey.Sig.FlagsValid || !subkey.Sig.FlagEncryptCommunications ||
+			!subkey.PublicKey.PubKeyAlgo.CanEncrypt() || subkey.Sig.KeyExpired(now) {
+			continue
+		}
+		if !found || subkey.Sig.CreationTime.After(latestTime) {
+			latest, latestTime, found = subkey.PublicKey.KeyId, subkey.Sig.CreationTime, true
+		}
+	}
+	if found {
+		return latest, true
+	}
+
+	identity := primaryIdentity(entity)
+	if identity == nil {
+		return 0, false
+	}
+	sig := identity.SelfSignature
+	if !sig.FlagsValid || sig.FlagEncryptCommunications && entity.PrimaryKey.PubKeyAlgo.CanEncrypt() && !sig.KeyExpired(now) {
+		return entity.PrimaryKey.KeyId, true
+	}
+
+	return 0, false
+}
+
+// primaryIdentity returns the identity marked primary, or any identity without one
+func primaryIdentity(entity *openpgp.Entity) *openpgp.Identity {
+	var first *openpgp.Identity
+	for _, identity := range entity.Identities {
+		if first == nil {
+			first = identity
+		}
+		if identity.SelfSignature != nil && identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			return identity
+		}
+	}
+
+	return first
+}
+
+// SupersededKeys returns a line for each key an armored message was encrypted to
+// that is no longer the latest encryption key of its recipient, and all of
+// the recipients of the message, so it can be encrypted to them again
+// The message is not decrypted so no secret keyring is needed
+func (p *Pki) SupersededKeys(cipherText string) ([]string, []*openpgp.Entity, error) {
+	var superseded []string
+	var recipients []*openpgp.Entity
+
+	ids, err := RecipientKeyIDs(cipherText)
+	if err != nil {
+		return superseded, recipients, err
+	}
+
+	seen := make(map[uint64]bool)
+	now := time.Now()
+	for _, id := range ids {
+		keys := p.PublicKeys().KeysById(id, nil)
+		if len(keys) == 0 || keys[0].Entity == nil {
+			return superseded, recipients, fmt.Errorf("recipient %016X is not in %s", id, ringLabel("public", p.PublicKeyRing))
+		}
+		entity := keys[0].Entity
+		if latest, ok := LatestEncryptionKeyID(entity, now); ok && latest != id {
+			superseded = append(superseded, fmt.Sprintf("%s: %016X superseded by %016X", EntityName(entity), id, latest))
+		}
+		if !seen[entity.PrimaryKey.KeyId] {
+			seen[entity.PrimaryKey.KeyId] = true
+			recipients = append(recipients, entity)
+		}
+	}
+
+	return superseded, recipients, nil
+}
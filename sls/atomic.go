@@ -0,0 +1,58 @@
+package sls
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// writeLock is held while a file is written, WaitIdle takes it so a run
+// that is stopped never exits part way through a write
+var writeLock sync.Mutex
+
+// writeAtomic writes data to a temp file in the directory of filePath and
+// renames it over filePath, so readers and an interrupted run never see a
+// partly written file and the data is never in a file with a wider mode
+// The temp file is created 0600 and given mode before it is renamed
+func writeAtomic(filePath string, data []byte, mode os.FileMode) error {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	tmpfile, err := ioutil.TempFile(filepath.Dir(filePath), ".gsp-")
+	if err != nil {
+		return err
+	}
+	if _, err = tmpfile.Write(data); err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	if err = tmpfile.Close(); err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	if err = os.Chmod(tmpfile.Name(), mode); err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	if err = os.Rename(tmpfile.Name(), filePath); err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+
+	return nil
+}
+
+// outputMode returns the mode a written file gets: OutputPerms when it is set,
+// otherwise the mode of the file being replaced, or 0644 for a new file
+func outputMode(filePath string) os.FileMode {
+	if OutputPerms != 0 {
+		return OutputPerms
+	}
+	if info, err := os.Stat(filePath); err == nil {
+		return info.Mode().Perm()
+	}
+
+	return 0644
+}
@@ -0,0 +1,45 @@
+package sls
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// backupFile copies a file to BackupDir keeping its path relative to BackupRoot,
+// files outside of BackupRoot are copied to the top of BackupDir
+func (s *Sls) backupFile(file string) error {
+	fullPath, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+
+	relPath := filepath.Base(fullPath)
+	if s.BackupRoot != "" {
+		root, err := filepath.Abs(s.BackupRoot)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, fullPath)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			relPath = rel
+		}
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(fullPath)
+	if err != nil {
+		return err
+	}
+
+	backupPath := filepath.Join(s.BackupDir, relPath)
+	if err = os.MkdirAll(filepath.Dir(backupPath), 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(backupPath, buf, info.Mode().Perm())
+}
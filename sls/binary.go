@@ -0,0 +1,50 @@
+package sls
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// WriteBinaryValue decrypts the value at path, base64 decodes it and writes the
+// bytes to a 0600 file at filePath, undoing Base64FileSource
+func (s *Sls) WriteBinaryValue(path string, filePath string) error {
+	vals := s.GetValueFromPath(path)
+	if vals == nil {
+		return fmt.Errorf("unable to find path: '%s'", path)
+	}
+	cipherText, ok := vals.(string)
+	if !ok {
+		return fmt.Errorf("the value at '%s' is not a single value", path)
+	}
+	if !isEncrypted(cipherText) {
+		return fmt.Errorf("the value at '%s' is not encrypted", path)
+	}
+
+	plainText, err := s.Pki.DecryptSecret(cipherText)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	// base64 text may have been wrapped when it was pasted into a file
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(plainText), ""))
+	if err != nil {
+		return fmt.Errorf("the value at '%s' is not base64 encoded: %s", path, err)
+	}
+
+	if DryRun {
+		logger.Infof("would write %d bytes to %s", len(data), filePath)
+		return nil
+	}
+	if err = ioutil.WriteFile(filePath, data, 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of an existing file
+	if err = os.Chmod(filePath, 0600); err != nil {
+		return err
+	}
+	logger.Infof("wrote %d bytes to %s", len(data), filePath)
+
+	return nil
+}
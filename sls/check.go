@@ -0,0 +1,176 @@
+package sls
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// zeroRev is the git revision used for created or deleted refs
+const zeroRev = "0000000000000000000000000000000000000000"
+
+// CheckGitInput checks the sls files named on each line of the reader for plain text values
+// and returns a "file: path" line for each plain text value found
+// Lines may be git hook 'oldrev newrev refname' lines, 'objectid path' blob lines
+// or plain file paths, git commands are run in gitDir
+// With AllowNonSls files named on a line are checked whatever their extension
+// Files that cannot be parsed or contain include directives are returned as
+// a "file: not checked, reason" line unless AllowUnchecked is set
+func (s *Sls) CheckGitInput(reader io.Reader, gitDir string) ([]string, error) {
+	found := []string{}
+	extensions := s.Extensions
+	if len(extensions) == 0 {
+		extensions = []string{slsExt}
+	}
+
+	scanner := newLineScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		var blobs map[string][]byte
+		var err error
+
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			blobs = make(map[string][]byte)
+			blobs[fields[0]], err = ioutil.ReadFile(fields[0])
+		case 2:
+			blobs = make(map[string][]byte)
+			blobs[fields[1]], err = gitOutput(gitDir, "cat-file", "blob", fields[0])
+		case 3:
+			blobs, err = gitPushedFiles(gitDir, fields[0], fields[1], extensions)
+		default:
+			err = fmt.Errorf("unable to parse line: '%s'", scanner.Text())
+		}
+		if err != nil {
+			return found, err
+		}
+
+		// files named on the line were chosen explicitly
+		named := len(fields) < 3 && s.AllowNonSls
+		for file, buf := range blobs {
+			if !named && !hasExtension(file, extensions) {
+				continue
+			}
+			paths, err := s.PlainTextPathsInBytes(buf)
+			if err != nil {
+				if s.AllowUnchecked {
+					logger.Warnf("%s: %s", file, err)
+				} else {
+					found = append(found, fmt.Sprintf("%s: not checked, %s", file, err))
+				}
+				continue
+			}
+			for _, path := range paths {
+				found = append(found, fmt.Sprintf("%s: %s", file, path))
+			}
+		}
+	}
+
+	return found, scanner.Err()
+}
+
+// gitPushedFiles returns the contents of the files added or changed by each
+// commit between oldRev and newRev keyed 'commit:path', so a value pushed in
+// plain text and encrypted by a later commit of the same push is still found
+// A new ref is checked in each commit not on another ref and in its tree at newRev
+// Each blob is returned once, for the first commit it appears in
+func gitPushedFiles(gitDir string, oldRev string, newRev string, extensions []string) (map[string][]byte, error) {
+	blobs := make(map[string][]byte)
+	if newRev == zeroRev {
+		// the ref is being deleted
+		return blobs, nil
+	}
+
+	seen := make(map[string]bool)
+	addBlob := func(rev string, file string, blob string) error {
+		if seen[blob] || !hasExtension(file, extensions) {
+			return nil
+		}
+		seen[blob] = true
+		buf, err := gitOutput(gitDir, "cat-file", "blob", blob)
+		if err != nil {
+			return err
+		}
+		blobs[fmt.Sprintf("%.12s:%s", rev, file)] = buf
+		return nil
+	}
+
+	revs := []string{oldRev + ".." + newRev}
+	if oldRev == zeroRev {
+		revs = []string{newRev, "--not", "--all"}
+	}
+	out, err := gitOutput(gitDir, append([]string{"rev-list", "--reverse"}, revs...)...)
+	if err != nil {
+		return blobs, err
+	}
+	for _, commit := range strings.Fields(string(out)) {
+		// ':oldmode newmode oldblob newblob status<TAB>path' for each file, against each parent of a merge
+		diff, err := gitOutput(gitDir, "diff-tree", "-r", "-m", "--root", "--no-commit-id", "--diff-filter=d", commit)
+		if err != nil {
+			return blobs, err
+		}
+		for _, line := range treeLines(diff) {
+			fields := strings.Fields(line[0])
+			if len(fields) < 4 || fields[1] == gitLinkMode {
+				continue
+			}
+			if err = addBlob(commit, line[1], fields[3]); err != nil {
+				return blobs, err
+			}
+		}
+	}
+
+	if oldRev == zeroRev {
+		// 'mode type blob<TAB>path' for each file
+		out, err = gitOutput(gitDir, "ls-tree", "-r", newRev)
+		if err != nil {
+			return blobs, err
+		}
+		for _, line := range treeLines(out) {
+			fields := strings.Fields(line[0])
+			if len(fields) < 3 || fields[1] != "blob" {
+				continue
+			}
+			if err = addBlob(newRev, line[1], fields[2]); err != nil {
+				return blobs, err
+			}
+		}
+	}
+
+	return blobs, nil
+}
+
+// gitLinkMode is the mode git gives submodules, they have no blob to check
+const gitLinkMode = "160000"
+
+// treeLines splits git output lines at the tab before the path
+func treeLines(out []byte) [][2]string {
+	var lines [][2]string
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) == 2 {
+			lines = append(lines, [2]string{parts[0], parts[1]})
+		}
+	}
+
+	return lines
+}
+
+func gitOutput(gitDir string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = gitDir
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("git %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
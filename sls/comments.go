@@ -0,0 +1,175 @@
+package sls
+
+import (
+	"fmt"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// CommentsKey is the top level key holding the encrypted comments of a file
+// Its value is one encrypted YAML list with a node, head, line and foot entry
+// per commented node, where node counts the nodes of the document depth first,
+// keys before their values, leaving out the CommentsKey entry itself
+const CommentsKey = "_encrypted_comments"
+
+// nodeComment holds the comments of one node
+type nodeComment struct {
+	Node int    `yaml:"node"`
+	Head string `yaml:"head,omitempty"`
+	Line string `yaml:"line,omitempty"`
+	Foot string `yaml:"foot,omitempty"`
+}
+
+// commentDocument parses buf into a node tree when comments are to be
+// encrypted or the file holds encrypted comments
+func (s *Sls) commentDocument(buf []byte) *yamlv3.Node {
+	if !s.EncryptComments && !s.commentsEncrypted {
+		return nil
+	}
+
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(buf, &doc); err != nil {
+		return nil
+	}
+
+	return &doc
+}
+
+// encryptComments moves the comments of the document into one encrypted
+// value under CommentsKey, the '#!' renderer line is left in place
+// A document that still holds encrypted comments keeps its other comments as
+// plain text unless EncryptComments asks for them to be encrypted
+func (s *Sls) encryptComments(doc *yamlv3.Node) error {
+	root := documentRoot(doc)
+	if root == nil {
+		return fmt.Errorf("comments can only be encrypted in a document that is a map")
+	}
+
+	var comments []nodeComment
+	var commented []*yamlv3.Node
+	walkNodes(doc, func(index int, node *yamlv3.Node) {
+		_, moved := splitRendererLine(node.HeadComment)
+		if moved != "" || node.LineComment != "" || node.FootComment != "" {
+			comments = append(comments, nodeComment{index, moved, node.LineComment, node.FootComment})
+			commented = append(commented, node)
+		}
+	})
+	if len(comments) == 0 {
+		return nil
+	}
+	for index := 0; index < len(root.Content); index += 2 {
+		if root.Content[index].Value != CommentsKey {
+			continue
+		}
+		if !s.EncryptComments {
+			logger.Warnf("comments added next to %s were left as plain text, decrypt the file before encrypting them", CommentsKey)
+			return nil
+		}
+		return fmt.Errorf("the file already has encrypted comments, decrypt it before adding more")
+	}
+
+	plainText, err := yamlv3.Marshal(comments)
+	if err != nil {
+		return err
+	}
+	for _, node := range commented {
+		node.HeadComment, _ = splitRendererLine(node.HeadComment)
+		node.LineComment, node.FootComment = "", ""
+	}
+	value := &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: s.encryptVal(string(plainText))}
+	if strings.Contains(value.Value, "\n") {
+		value.Style = yamlv3.LiteralStyle
+	}
+	root.Content = append(root.Content, &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: CommentsKey}, value)
+
+	return nil
+}
+
+// restoreComments decrypts the comments under CommentsKey, puts them back
+// on their nodes and removes the CommentsKey entry
+func (s *Sls) restoreComments(doc *yamlv3.Node) error {
+	root := documentRoot(doc)
+	if root == nil {
+		return nil
+	}
+
+	var cipherText string
+	for index := 0; index+1 < len(root.Content); index += 2 {
+		if root.Content[index].Value == CommentsKey {
+			cipherText = root.Content[index+1].Value
+			root.Content = append(root.Content[:index], root.Content[index+2:]...)
+			break
+		}
+	}
+	if cipherText == "" {
+		return nil
+	}
+
+	plainText, err := s.Pki.DecryptSecret(cipherText)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt comments: %s", err)
+	}
+	var comments []nodeComment
+	if err = yamlv3.Unmarshal([]byte(plainText), &comments); err != nil {
+		return fmt.Errorf("unable to read comments: %s", err)
+	}
+
+	byNode := make(map[int]nodeComment)
+	for _, comment := range comments {
+		byNode[comment.Node] = comment
+	}
+	walkNodes(doc, func(index int, node *yamlv3.Node) {
+		comment, ok := byNode[index]
+		if !ok {
+			return
+		}
+		if comment.Head != "" {
+			node.HeadComment = strings.TrimPrefix(node.HeadComment+"\n"+comment.Head, "\n")
+		}
+		node.LineComment = comment.Line
+		node.FootComment = comment.Foot
+	})
+
+	return nil
+}
+
+// documentRoot returns the top level map of a document
+func documentRoot(doc *yamlv3.Node) *yamlv3.Node {
+	if doc.Kind != yamlv3.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yamlv3.MappingNode {
+		return nil
+	}
+
+	return doc.Content[0]
+}
+
+// walkNodes calls fn with each node under node depth first and its index in
+// that order, aliases are not followed
+func walkNodes(node *yamlv3.Node, fn func(int, *yamlv3.Node)) {
+	index := 0
+	var walk func(*yamlv3.Node)
+	walk = func(node *yamlv3.Node) {
+		fn(index, node)
+		index++
+		for _, child := range node.Content {
+			walk(child)
+		}
+	}
+	walk(node)
+}
+
+// splitRendererLine splits the '#!' renderer line from the rest of a comment
+func splitRendererLine(comment string) (string, string) {
+	var kept, moved []string
+	for _, line := range strings.Split(comment, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#!") {
+			kept = append(kept, line)
+			continue
+		}
+		if line != "" {
+			moved = append(moved, line)
+		}
+	}
+
+	return strings.Join(kept, "\n"), strings.Join(moved, "\n")
+}
@@ -0,0 +1,55 @@
+package sls
+
+import (
+	"encoding/csv"
+	"sort"
+)
+
+// KeysCSVHeader names the columns of the rows returned by KeysCSVRecords
+var KeysCSVHeader = []string{"file", "path", "keyid", "uid"}
+
+// KeysCSVRecords returns a file, path, keyid, uid row for each recipient of each
+// encrypted value in a file, sorted by path
+func (s *Sls) KeysCSVRecords(filePath string, file string) ([][]string, error) {
+	var records [][]string
+
+	if err := s.ReadSlsFile(filePath); err != nil {
+		return records, err
+	}
+
+	leaves := s.leafStrings()
+	var paths []string
+	for path, val := range leaves {
+		if isEncrypted(val) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		recipients, err := s.Pki.Recipients(leaves[path])
+		if err != nil {
+			return records, err
+		}
+		for _, recipient := range recipients {
+			records = append(records, []string{file, path, recipient.KeyID, recipient.UID})
+		}
+	}
+
+	return records, nil
+}
+
+// writeKeysCSV writes the key rows of a validated file, files with errors are skipped
+func (s *Sls) writeKeysCSV(writer *csv.Writer, result FileResult, file string) {
+	if result.Err != nil {
+		return
+	}
+	records, err := s.KeysCSVRecords(result.Path, file)
+	if err != nil {
+		logger.Warnf("%s: %s", file, err)
+		return
+	}
+	if err = writer.WriteAll(records); err != nil {
+		logger.Fatal(err)
+	}
+}
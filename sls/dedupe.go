@@ -0,0 +1,140 @@
+package sls
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// anchorUnsafe matches the characters left out of anchor names made from keys
+var anchorUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// dedupeValue is a plain text value found while deduplicating and where it is held
+type dedupeValue struct {
+	key  string
+	slot **yamlv3.Node
+}
+
+// performDedupeAction encrypts the values on a node tree, plain text values
+// that occur more than once are encrypted once under an anchor where they
+// first appear and replaced by aliases of it everywhere else
+func (s *Sls) performDedupeAction() bytes.Buffer {
+	if s.mergeNode == nil {
+		var root yamlv3.Node
+		if err := root.Encode(s.Yaml.Values); err != nil {
+			logger.Fatal(err)
+		}
+		s.mergeNode = &yamlv3.Node{Kind: yamlv3.DocumentNode, Content: []*yamlv3.Node{&root}}
+	}
+
+	anchors := make(map[string]bool)
+	collectAnchors(s.mergeNode, anchors)
+
+	var order []string
+	groups := make(map[string][]dedupeValue)
+	for _, root := range s.mergeNode.Content {
+		if root.Kind != yamlv3.MappingNode {
+			continue
+		}
+		for index := 0; index+1 < len(root.Content); index += 2 {
+			key := root.Content[index].Value
+			if root.Content[index].ShortTag() == mergeTag {
+				continue
+			}
+			if s.TopLevelElement != "" && s.TopLevelElement != key {
+				continue
+			}
+			s.plainValues(key, key, &root.Content[index+1], func(val string, found dedupeValue) {
+				if _, ok := groups[val]; !ok {
+					order = append(order, val)
+				}
+				groups[val] = append(groups[val], found)
+			})
+		}
+	}
+
+	for _, val := range order {
+		group := groups[val]
+		if len(group) < 2 {
+			continue
+		}
+		anchor := anchorName(group[0].key, anchors)
+		target := *group[0].slot
+		target.Anchor = anchor
+		for _, found := range group[1:] {
+			*found.slot = &yamlv3.Node{Kind: yamlv3.AliasNode, Value: anchor, Alias: target}
+		}
+		logger.Infof("'%s' is shared by %d values", anchor, len(group))
+	}
+
+	return s.performNodeAction(encrypt)
+}
+
+// plainValues calls fn with each plain text string value under the node at path held
+// in slot in document order, values that are anchored, already encrypted or left
+// as plain text by checkValues are left out
+func (s *Sls) plainValues(key string, path string, slot **yamlv3.Node, fn func(string, dedupeValue)) {
+	node := *slot
+	switch node.Kind {
+	case yamlv3.MappingNode:
+		for index := 0; index+1 < len(node.Content); index += 2 {
+			if node.Content[index].ShortTag() == mergeTag {
+				continue
+			}
+			s.plainValues(node.Content[index].Value, joinPath(path, node.Content[index].Value), &node.Content[index+1], fn)
+		}
+	case yamlv3.SequenceNode:
+		for index := range node.Content {
+			s.plainValues(key, joinPath(path, fmt.Sprintf("%d", index)), &node.Content[index], fn)
+		}
+	case yamlv3.ScalarNode:
+		if node.ShortTag() != "!!str" || node.Anchor != "" || s.skipKey(key, encrypt) {
+			return
+		}
+		if isEncrypted(node.Value) || (node.Value == "" && !s.EncryptEmpty) || s.skippedValues[path] {
+			return
+		}
+		fn(node.Value, dedupeValue{key, slot})
+	}
+}
+
+// anchorName returns an anchor name made from key that is not in use, and marks it used
+func anchorName(key string, used map[string]bool) string {
+	base := anchorUnsafe.ReplaceAllString(key, "_")
+	if base == "" {
+		base = "shared"
+	}
+
+	name := base
+	for count := 2; used[name]; count++ {
+		name = fmt.Sprintf("%s_%d", base, count)
+	}
+	used[name] = true
+
+	return name
+}
+
+func collectAnchors(node *yamlv3.Node, anchors map[string]bool) {
+	if node.Anchor != "" {
+		anchors[node.Anchor] = true
+	}
+	for _, child := range node.Content {
+		collectAnchors(child, anchors)
+	}
+}
+
+// hasAlias reports whether any node under node is an alias
+func hasAlias(node *yamlv3.Node) bool {
+	if node.Kind == yamlv3.AliasNode {
+		return true
+	}
+	for _, child := range node.Content {
+		if hasAlias(child) {
+			return true
+		}
+	}
+
+	return false
+}
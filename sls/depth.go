@@ -0,0 +1,55 @@
+package sls
+
+import (
+	"fmt"
+)
+
+// DefaultMaxDepth is the default limit for how deeply maps and lists may be nested
+const DefaultMaxDepth = 1000
+
+// CheckDepth returns an error when maps and lists in vals are nested more than
+// MaxDepth levels deep, 0 is no limit. The values are walked without recursion
+// so the check itself is safe for any depth
+// Values read from a file are checked after yaml.v2 has built them, which it
+// does recursively, so the check does not bound the parse itself
+func (s *Sls) CheckDepth(vals interface{}) error {
+	if s.MaxDepth <= 0 {
+		return nil
+	}
+
+	type level struct {
+		vals  interface{}
+		depth int
+	}
+	stack := []level{{vals, 0}}
+	for len(stack) > 0 {
+		cur := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		var children []interface{}
+		switch c := cur.vals.(type) {
+		case map[string]interface{}:
+			for _, child := range c {
+				children = append(children, child)
+			}
+		case map[interface{}]interface{}:
+			for _, child := range c {
+				children = append(children, child)
+			}
+		case []interface{}:
+			children = c
+		default:
+			continue
+		}
+
+		depth := cur.depth + 1
+		if depth > s.MaxDepth {
+			return fmt.Errorf("values are nested more than %d levels deep", s.MaxDepth)
+		}
+		for _, child := range children {
+			stack = append(stack, level{child, depth})
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package sls
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// shmDir is used for temp files when available so plain text never touches disk
+const shmDir = "/dev/shm"
+
+// EditFile decrypts a file to a temp file, opens it with the given editor
+// and re-encrypts the changed values back into the file when the editor exits
+// The temp file is created 0600 in TempDir, or /dev/shm when TempDir is not set
+// Unchanged values keep their original cipher text to minimize diffs
+func (s *Sls) EditFile(filePath string, editor string) error {
+	err := CheckForFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	err = s.ReadSlsFile(filePath)
+	if err != nil {
+		return err
+	}
+	original := s.Yaml.Values
+	s.decryptErrors = nil
+	plainBuffer := s.PerformAction(decrypt)
+	if err = s.decryptError(); err != nil {
+		return fmt.Errorf("%s was not opened, %w:\n%s", filePath, err, strings.Join(s.decryptErrors, "\n"))
+	}
+	plain := s.Yaml.Values
+
+	tmpDir := s.TempDir
+	if tmpDir == "" && CheckForDir(shmDir) == nil {
+		tmpDir = shmDir
+	}
+	tmpfile, err := ioutil.TempFile(tmpDir, "gsp-edit-*.sls")
+	if err != nil {
+		return err
+	}
+	defer secureRemove(tmpfile.Name())
+
+	if _, err = tmpfile.Write(plainBuffer.Bytes()); err != nil {
+		tmpfile.Close()
+		return err
+	}
+	if err = tmpfile.Close(); err != nil {
+		return err
+	}
+
+	args := strings.Fields(editor)
+	if len(args) == 0 {
+		return fmt.Errorf("no editor given")
+	}
+	cmd := exec.Command(args[0], append(args[1:], tmpfile.Name())...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("editor failed, %s was not changed: %s", filePath, err)
+	}
+
+	buf, err := ioutil.ReadFile(tmpfile.Name())
+	if err != nil {
+		return err
+	}
+	commentsEncrypted := s.commentsEncrypted
+	err = s.ReadBytes(buf)
+	if err != nil {
+		return err
+	}
+	if commentsEncrypted {
+		// the comments were decrypted for editing and are encrypted again
+		s.commentsEncrypted = true
+		if s.mergeNode == nil {
+			s.mergeNode = s.commentDocument(buf)
+		}
+	}
+
+	var stuff = make(map[string]interface{})
+	for key, val := range s.Yaml.Values {
+		inScope := s.TopLevelElement == "" || s.TopLevelElement == key
+		stuff[key] = s.mergeEdited(val, plain[key], original[key], inScope)
+	}
+	s.Yaml.Values = stuff
+
+	var buffer bytes.Buffer
+	if s.commentsEncrypted && s.mergeNode != nil {
+		setNodeValues(s.mergeNode, stuff)
+		buffer = s.nodeBuffer(encrypt)
+	} else {
+		buffer = s.FormatBuffer("")
+	}
+	WriteSlsFile(buffer, filePath)
+
+	return nil
+}
+
+// mergeEdited keeps the original value for unchanged leaves and encrypts changed ones
+func (s *Sls) mergeEdited(edited interface{}, plain interface{}, original interface{}, inScope bool) interface{} {
+	switch val := edited.(type) {
+	case map[interface{}]interface{}:
+		plainMap, _ := plain.(map[interface{}]interface{})
+		origMap, _ := original.(map[interface{}]interface{})
+		var ret = make(map[interface{}]interface{})
+		for key, item := range val {
+			ret[key] = s.mergeEdited(item, plainMap[key], origMap[key], inScope)
+		}
+		return ret
+	case []interface{}:
+		plainSlice, _ := plain.([]interface{})
+		origSlice, _ := original.([]interface{})
+		var things []interface{}
+		for index, item := range val {
+			var plainItem, origItem interface{}
+			if index < len(plainSlice) {
+				plainItem = plainSlice[index]
+			}
+			if index < len(origSlice) {
+				origItem = origSlice[index]
+			}
+			things = append(things, s.mergeEdited(item, plainItem, origItem, inScope))
+		}
+		return things
+	case string:
+		if plainStr, ok := plain.(string); ok && plainStr == val && original != nil {
+			return original
+		}
+		if inScope {
+			return s.encryptVal(val)
+		}
+	}
+
+	return edited
+}
+
+// setNodeValues sets the string scalars under node to the string values at
+// the same keys and indexes of vals, keeping the comments of the node tree
+func setNodeValues(node *yamlv3.Node, vals interface{}) {
+	switch node.Kind {
+	case yamlv3.DocumentNode:
+		for _, child := range node.Content {
+			setNodeValues(child, vals)
+		}
+	case yamlv3.MappingNode:
+		for index := 0; index+1 < len(node.Content); index += 2 {
+			if node.Content[index].ShortTag() == mergeTag {
+				continue
+			}
+			if val, ok := mapValue(vals, node.Content[index].Value); ok {
+				setNodeValues(node.Content[index+1], val)
+			}
+		}
+	case yamlv3.SequenceNode:
+		list, _ := vals.([]interface{})
+		for index, child := range node.Content {
+			if index < len(list) {
+				setNodeValues(child, list[index])
+			}
+		}
+	case yamlv3.ScalarNode:
+		str, ok := vals.(string)
+		if !ok || node.ShortTag() != "!!str" || str == node.Value {
+			return
+		}
+		node.Value = str
+		node.Style = 0
+		if strings.Contains(str, "\n") {
+			node.Style = yamlv3.LiteralStyle
+		}
+	}
+}
+
+// mapValue returns the value of the map vals under the key written as key
+func mapValue(vals interface{}, key string) (interface{}, bool) {
+	switch val := vals.(type) {
+	case map[string]interface{}:
+		item, ok := val[key]
+		return item, ok
+	case map[interface{}]interface{}:
+		for k, item := range val {
+			if fmt.Sprint(k) == key {
+				return item, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// secureRemove overwrites a file with zeros before removing it
+func secureRemove(filePath string) {
+	fi, err := os.Stat(filePath)
+	if err == nil {
+		err = ioutil.WriteFile(filePath, make([]byte, fi.Size()), 0600)
+		if err != nil {
+			logger.Warnf("unable to overwrite %s: %s", filePath, err)
+		}
+	}
+	if err = os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("unable to remove %s: %s", filePath, err)
+	}
+}
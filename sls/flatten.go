@@ -0,0 +1,254 @@
+package sls
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "github.com/esilva-everbridge/yaml"
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+// DefaultSeparator joins the keys of a flattened path
+const DefaultSeparator = "."
+
+// flatAssign separates a flattened path from its value
+const flatAssign = " = "
+
+// Flatten returns the values as 'a.b.c = <value>' lines sorted by path
+// The separator, '[' and '\' are escaped with a '\' in keys and list items
+// are written as 'key[index]', string values are quoted so cipher text
+// keeps its line breaks and other values are written as inline YAML
+func (s *Sls) Flatten(separator string) (bytes.Buffer, error) {
+	var buffer bytes.Buffer
+
+	if separator == "" {
+		return buffer, fmt.Errorf("separator cannot be empty")
+	}
+
+	var lines []string
+	for key, vals := range s.Yaml.Values {
+		err := flattenValue(escapeFlatKey(key, separator), vals, separator, &lines)
+		if err != nil {
+			return buffer, err
+		}
+	}
+	sort.Strings(lines)
+
+	for _, line := range lines {
+		buffer.WriteString(line)
+		buffer.WriteString("\n")
+	}
+
+	return buffer, nil
+}
+
+// Unflatten reads 'a.b.c = <value>' lines written by Flatten and rebuilds
+// the nested values, blank lines and lines starting with '#' are ignored
+func (s *Sls) Unflatten(reader io.Reader, separator string) error {
+	if separator == "" {
+		return fmt.Errorf("separator cannot be empty")
+	}
+
+	values := make(map[interface{}]interface{})
+	scanner := newLineScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		segments, rawVal, err := splitFlatLine(line, separator)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		val, err := parseFlatValue(rawVal)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		var root interface{} = values
+		root, err = setFlatValue(root, segments, val)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		values = root.(map[interface{}]interface{})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.Yaml = yaml.New()
+	for key, val := range values {
+		s.Yaml.Values[fmt.Sprintf("%v", key)] = val
+	}
+
+	return nil
+}
+
+// flatSegment is one part of a flattened path, either a map key or a list index
+type flatSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+func flattenValue(path string, vals interface{}, separator string, lines *[]string) error {
+	switch val := vals.(type) {
+	case map[interface{}]interface{}:
+		if len(val) == 0 {
+			*lines = append(*lines, path+flatAssign+"{}")
+		}
+		for key, item := range val {
+			childPath := path + separator + escapeFlatKey(fmt.Sprintf("%v", key), separator)
+			if err := flattenValue(childPath, item, separator, lines); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if len(val) == 0 {
+			*lines = append(*lines, path+flatAssign+"[]")
+		}
+		for index, item := range val {
+			if err := flattenValue(fmt.Sprintf("%s[%d]", path, index), item, separator, lines); err != nil {
+				return err
+			}
+		}
+	case string:
+		*lines = append(*lines, path+flatAssign+strconv.Quote(val))
+	default:
+		out, err := yamlv2.Marshal(val)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		*lines = append(*lines, path+flatAssign+strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+func escapeFlatKey(key string, separator string) string {
+	key = strings.Replace(key, `\`, `\\`, -1)
+	key = strings.Replace(key, "[", `\[`, -1)
+	return strings.Replace(key, separator, `\`+separator, -1)
+}
+
+// splitFlatLine splits a line into its path segments and raw value
+func splitFlatLine(line string, separator string) ([]flatSegment, string, error) {
+	var segments []flatSegment
+	var current strings.Builder
+	hasKey := false
+
+	for pos := 0; pos < len(line); {
+		switch {
+		case line[pos] == '\\':
+			if pos+1 >= len(line) {
+				return nil, "", fmt.Errorf("trailing escape in key")
+			}
+			if strings.HasPrefix(line[pos+1:], separator) {
+				current.WriteString(separator)
+				pos += 1 + len(separator)
+			} else {
+				current.WriteByte(line[pos+1])
+				pos += 2
+			}
+			hasKey = true
+		case strings.HasPrefix(line[pos:], flatAssign):
+			if hasKey {
+				segments = append(segments, flatSegment{key: current.String()})
+			}
+			if len(segments) == 0 {
+				return nil, "", fmt.Errorf("missing key")
+			}
+			return segments, line[pos+len(flatAssign):], nil
+		case strings.HasPrefix(line[pos:], separator):
+			if !hasKey && (len(segments) == 0 || !segments[len(segments)-1].isIndex) {
+				return nil, "", fmt.Errorf("empty key")
+			}
+			if hasKey {
+				segments = append(segments, flatSegment{key: current.String()})
+			}
+			current.Reset()
+			hasKey = false
+			pos += len(separator)
+		case line[pos] == '[':
+			end := strings.IndexByte(line[pos:], ']')
+			if end < 0 {
+				return nil, "", fmt.Errorf("unterminated list index")
+			}
+			index, err := strconv.Atoi(line[pos+1 : pos+end])
+			if err != nil || index < 0 {
+				return nil, "", fmt.Errorf("invalid list index: %s", line[pos+1:pos+end])
+			}
+			if hasKey {
+				segments = append(segments, flatSegment{key: current.String()})
+			}
+			if len(segments) == 0 {
+				return nil, "", fmt.Errorf("list index without a key")
+			}
+			segments = append(segments, flatSegment{index: index, isIndex: true})
+			current.Reset()
+			hasKey = false
+			pos += end + 1
+		default:
+			current.WriteByte(line[pos])
+			hasKey = true
+			pos++
+		}
+	}
+
+	return nil, "", fmt.Errorf("missing '%s'", strings.TrimSpace(flatAssign))
+}
+
+func parseFlatValue(rawVal string) (interface{}, error) {
+	if strings.HasPrefix(rawVal, `"`) {
+		return strconv.Unquote(rawVal)
+	}
+
+	var val interface{}
+	err := yamlv2.Unmarshal([]byte(rawVal), &val)
+	return val, err
+}
+
+// setFlatValue sets val at the path under node, creating maps and lists as needed
+func setFlatValue(node interface{}, segments []flatSegment, val interface{}) (interface{}, error) {
+	if len(segments) == 0 {
+		return val, nil
+	}
+	segment := segments[0]
+
+	if segment.isIndex {
+		list, ok := node.([]interface{})
+		if node != nil && !ok {
+			return nil, fmt.Errorf("list index [%d] used on a map", segment.index)
+		}
+		for len(list) <= segment.index {
+			list = append(list, nil)
+		}
+		item, err := setFlatValue(list[segment.index], segments[1:], val)
+		if err != nil {
+			return nil, err
+		}
+		list[segment.index] = item
+		return list, nil
+	}
+
+	dict, ok := node.(map[interface{}]interface{})
+	if node != nil && !ok {
+		return nil, fmt.Errorf("key '%s' used on a list or value", segment.key)
+	}
+	if dict == nil {
+		dict = make(map[interface{}]interface{})
+	}
+	item, err := setFlatValue(dict[segment.key], segments[1:], val)
+	if err != nil {
+		return nil, err
+	}
+	dict[segment.key] = item
+
+	return dict, nil
+}
@@ -0,0 +1,44 @@
+package sls
+
+import (
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// forceStringOutput returns out with every string value double quoted so
+// YAML 1.1 readers such as Salt's keep values like 0123, true or yes as strings
+// Map keys and multi-line values are left as they are
+func forceStringOutput(out []byte) []byte {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(out, &doc); err != nil {
+		logger.Warnf("unable to quote string values: %s", err)
+		return out
+	}
+	quoteStrings(&doc)
+
+	quoted, err := encodeNode(&doc)
+	if err != nil {
+		logger.Warnf("unable to quote string values: %s", err)
+		return out
+	}
+
+	return quoted
+}
+
+func quoteStrings(node *yamlv3.Node) {
+	switch node.Kind {
+	case yamlv3.MappingNode:
+		for index := 0; index+1 < len(node.Content); index += 2 {
+			quoteStrings(node.Content[index+1])
+		}
+	case yamlv3.SequenceNode, yamlv3.DocumentNode:
+		for _, child := range node.Content {
+			quoteStrings(child)
+		}
+	case yamlv3.ScalarNode:
+		if node.ShortTag() == "!!str" && !strings.Contains(node.Value, "\n") {
+			node.Style = yamlv3.DoubleQuotedStyle
+		}
+	}
+}
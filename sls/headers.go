@@ -0,0 +1,35 @@
+package sls
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Everbridge/generate-secure-pillar/pki"
+)
+
+// ArmorHeaders returns a "path: Key: value" line for each armor header of each
+// encrypted value in the file, values are not decrypted
+func (s *Sls) ArmorHeaders(filePath string) ([]string, error) {
+	found := []string{}
+
+	err := s.ReadSlsFile(filePath)
+	if err != nil {
+		return found, err
+	}
+
+	for path, val := range s.leafStrings() {
+		if !isEncrypted(val) {
+			continue
+		}
+		headers, err := pki.ArmorHeaders(val)
+		if err != nil {
+			return found, fmt.Errorf("%s: %s", path, err)
+		}
+		for key, value := range headers {
+			found = append(found, fmt.Sprintf("%s: %s: %s", path, key, value))
+		}
+	}
+	sort.Strings(found)
+
+	return found, nil
+}
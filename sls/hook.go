@@ -0,0 +1,60 @@
+package sls
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// HookFileEnv is the environment variable holding the path of the file a hook runs for
+const HookFileEnv = "GSP_FILE"
+
+// writeFile writes a file found while recursing or rotating, running PreHook
+// before and PostHook after it. A failed pre-hook leaves the file unwritten
+// A failed hook is logged, with FailOnHook it ends the run
+func (s *Sls) writeFile(buffer bytes.Buffer, filePath string) {
+	if DryRun {
+		WriteSlsFile(buffer, filePath)
+		return
+	}
+
+	if err := runHook(s.PreHook, filePath); err != nil {
+		s.hookFailed(fmt.Errorf("%s was not written, pre-hook failed: %s", shortFileName(filePath), err))
+		return
+	}
+	WriteSlsFile(buffer, filePath)
+	if err := runHook(s.PostHook, filePath); err != nil {
+		s.hookFailed(fmt.Errorf("post-hook failed for %s: %s", shortFileName(filePath), err))
+	}
+}
+
+func (s *Sls) hookFailed(err error) {
+	if s.FailOnHook {
+		logger.Fatal(err)
+	}
+	logger.Error(err)
+}
+
+// runHook runs the hook command split on white space with the file path
+// as its last argument and in HookFileEnv
+func runHook(hook string, filePath string) error {
+	args := strings.Fields(hook)
+	if len(args) == 0 {
+		return nil
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], append(args[1:], filePath)...)
+	cmd.Env = append(os.Environ(), HookFileEnv+"="+filePath)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return err
+	}
+
+	return nil
+}
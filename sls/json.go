@@ -0,0 +1,72 @@
+package sls
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ReadSecretsJSON reads a JSON object of secret names to values
+// Names may be colon separated paths, nested objects are joined into
+// paths the same way, every value must be a string
+// The names are returned sorted with their values in the same order
+func ReadSecretsJSON(reader io.Reader) ([]string, []string, error) {
+	var obj map[string]interface{}
+
+	decoder := json.NewDecoder(reader)
+	if err := decoder.Decode(&obj); err != nil {
+		return nil, nil, fmt.Errorf("error reading JSON object: %s", err)
+	}
+	if len(obj) == 0 {
+		return nil, nil, fmt.Errorf("JSON object has no secrets")
+	}
+
+	secrets := make(map[string]string)
+	if err := jsonSecrets("", obj, secrets); err != nil {
+		return nil, nil, err
+	}
+
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	for index, name := range names {
+		values[index] = secrets[name]
+	}
+
+	return names, values, nil
+}
+
+func jsonSecrets(path string, obj map[string]interface{}, secrets map[string]string) error {
+	for key, val := range obj {
+		if key == "" {
+			return fmt.Errorf("empty key under '%s'", path)
+		}
+		name := key
+		if path != "" {
+			if strings.Contains(key, ":") {
+				return fmt.Errorf("key '%s' under '%s' cannot contain ':'", key, path)
+			}
+			name = path + ":" + key
+		}
+		switch v := val.(type) {
+		case string:
+			if _, ok := secrets[name]; ok {
+				return fmt.Errorf("'%s' is given more than once", name)
+			}
+			secrets[name] = v
+		case map[string]interface{}:
+			if err := jsonSecrets(name, v, secrets); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("value at '%s' is not a string", name)
+		}
+	}
+
+	return nil
+}
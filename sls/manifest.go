@@ -0,0 +1,152 @@
+package sls
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+// Manifest records the fingerprints of the keys the values of each sls file
+// are encrypted to, keyed by the path of the file relative to its directory
+// Keys missing from the public keyring are recorded by id
+type Manifest struct {
+	Files map[string][]string `yaml:"files"`
+}
+
+// BuildManifest returns the manifest of every sls file under recurseDir
+func (s *Sls) BuildManifest(recurseDir string) (Manifest, error) {
+	manifest := Manifest{Files: make(map[string][]string)}
+
+	err := s.walkRecipients(recurseDir, func(rel string, recipients []string) {
+		fingerprints := []string{}
+		for _, recipient := range recipients {
+			fingerprints = append(fingerprints, strings.Fields(recipient)[0])
+		}
+		sort.Strings(fingerprints)
+		manifest.Files[rel] = fingerprints
+	})
+
+	return manifest, err
+}
+
+// walkRecipients calls fn with the slash separated path relative to recurseDir
+// and the recipients from leafRecipients of each sls file under recurseDir
+func (s *Sls) walkRecipients(recurseDir string, fn func(rel string, recipients []string)) error {
+	slsFiles, count := FindSlsFiles(recurseDir, s.Extensions...)
+	if count == 0 {
+		return fmt.Errorf("%s has no sls files", recurseDir)
+	}
+	root, err := filepath.Abs(recurseDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range slsFiles {
+		if err = s.ReadSlsFile(file); err != nil {
+			return fmt.Errorf("%s: %s", shortFileName(file), err)
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		fn(filepath.ToSlash(rel), s.leafRecipients())
+	}
+
+	return nil
+}
+
+// WriteManifest writes the manifest of every sls file under recurseDir to manifestPath
+func (s *Sls) WriteManifest(recurseDir string, manifestPath string) error {
+	manifest, err := s.BuildManifest(recurseDir)
+	if err != nil {
+		return err
+	}
+	if DryRun {
+		logger.Infof("would write manifest %s for %d files", shortFileName(manifestPath), len(manifest.Files))
+		return nil
+	}
+
+	out, err := yamlv2.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(manifestPath, out, 0644)
+}
+
+// ReadManifest reads a manifest written by WriteManifest
+func ReadManifest(manifestPath string) (Manifest, error) {
+	var manifest Manifest
+
+	buf, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return manifest, fmt.Errorf("cannot read manifest: %s", err)
+	}
+	if err = yamlv2.UnmarshalStrict(buf, &manifest); err != nil {
+		return manifest, fmt.Errorf("%s is not a valid manifest: %s", manifestPath, err)
+	}
+
+	return manifest, nil
+}
+
+// Drift returns a line for each file whose recipients in actual differ from m
+func (m Manifest) Drift(actual Manifest) []string {
+	drift := []string{}
+
+	for file, fingerprints := range actual.Files {
+		recorded, ok := m.Files[file]
+		if !ok {
+			drift = append(drift, fmt.Sprintf("%s: not in the manifest", file))
+			continue
+		}
+		if added := missingFrom(recorded, fingerprints); len(added) > 0 {
+			drift = append(drift, fmt.Sprintf("%s: added %s", file, strings.Join(added, ", ")))
+		}
+		if removed := missingFrom(fingerprints, recorded); len(removed) > 0 {
+			drift = append(drift, fmt.Sprintf("%s: removed %s", file, strings.Join(removed, ", ")))
+		}
+	}
+	for file := range m.Files {
+		if _, ok := actual.Files[file]; !ok {
+			drift = append(drift, fmt.Sprintf("%s: in the manifest but not found", file))
+		}
+	}
+	sort.Strings(drift)
+
+	return drift
+}
+
+// missingFrom returns the items of want that are not in have
+func missingFrom(have []string, want []string) []string {
+	found := make(map[string]bool)
+	for _, item := range have {
+		found[item] = true
+	}
+
+	var missing []string
+	for _, item := range want {
+		if !found[item] {
+			missing = append(missing, item)
+		}
+	}
+
+	return missing
+}
+
+// VerifyManifest returns the drift of the sls files under recurseDir from the manifest at manifestPath
+func (s *Sls) VerifyManifest(manifestPath string, recurseDir string) ([]string, error) {
+	manifest, err := ReadManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := s.BuildManifest(recurseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest.Drift(actual), nil
+}
@@ -0,0 +1,244 @@
+package sls
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	yaml "github.com/esilva-everbridge/yaml"
+	yamlv2 "gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+const mergeTag = "!!merge"
+const rendererLine = "#!yaml|gpg"
+
+// mergeDocument parses buf into a node tree if it contains YAML merge keys (<<)
+// yaml.v2 expands merge keys into plain maps, so documents using them are
+// encrypted and decrypted on the node tree instead to keep the anchors,
+// aliases and merge keys as they are in the file, unless ResolveAnchors is set
+// With keepAnchors documents with aliases are kept as a node tree too
+// Files without a merge key, anchor or alias are not parsed a second time
+func mergeDocument(buf []byte, keepAnchors bool) *yamlv3.Node {
+	if !mayUseAnchors(buf) {
+		return nil
+	}
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(buf, &doc); err != nil {
+		return nil
+	}
+	if !hasMergeKey(&doc) && !(keepAnchors && hasAlias(&doc)) {
+		return nil
+	}
+
+	return &doc
+}
+
+// mayUseAnchors reports whether buf can hold a merge key, an anchor or an alias
+// Cipher text is armored and never does, so encrypted files skip the yaml.v3 parse
+func mayUseAnchors(buf []byte) bool {
+	return bytes.Contains(buf, []byte("<<")) || bytes.ContainsAny(buf, "&*")
+}
+
+func hasMergeKey(node *yamlv3.Node) bool {
+	if node.Kind == yamlv3.MappingNode {
+		for index := 0; index+1 < len(node.Content); index += 2 {
+			if node.Content[index].ShortTag() == mergeTag {
+				return true
+			}
+		}
+	}
+	for _, child := range node.Content {
+		if hasMergeKey(child) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// performNodeAction encrypts or decrypts the string values of the merge document
+// Anchored values are processed once where they are defined, aliases and
+// merge keys are left pointing at them
+// With EncryptComments the comments are encrypted under CommentsKey, decrypting restores them
+func (s *Sls) performNodeAction(action string) bytes.Buffer {
+	if action == decrypt {
+		if err := s.restoreComments(s.mergeNode); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	for _, root := range s.mergeNode.Content {
+		if root.Kind != yamlv3.MappingNode {
+			s.processNode(nil, "", root, action)
+			continue
+		}
+		for index := 0; index+1 < len(root.Content); index += 2 {
+			if root.Content[index].ShortTag() == mergeTag {
+				continue
+			}
+			if s.TopLevelElement != "" && s.TopLevelElement != root.Content[index].Value {
+				continue
+			}
+			s.processNode(root.Content[index].Value, root.Content[index].Value, root.Content[index+1], action)
+		}
+	}
+
+	return s.nodeBuffer(action)
+}
+
+// nodeBuffer renders the merge document after action
+// Comments are encrypted with EncryptComments or when the file was read with
+// encrypted comments, so decrypting and encrypting again keeps them encrypted
+func (s *Sls) nodeBuffer(action string) bytes.Buffer {
+	var buffer bytes.Buffer
+
+	if action == encrypt && (s.EncryptComments || s.commentsEncrypted) {
+		if err := s.encryptComments(s.mergeNode); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	normalizeNode(s.mergeNode, "")
+
+	out, err := encodeNode(s.mergeNode)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if s.SortKeys {
+		out = sortedNodeOutput(out)
+	}
+	if s.ForceStringValues && action == decrypt {
+		out = forceStringOutput(out)
+	}
+
+	// keep the expanded values in sync for path lookups
+	s.Yaml = yaml.New()
+	if err = yamlv2.Unmarshal(out, &s.Yaml.Values); err != nil {
+		logger.Fatal(err)
+	}
+
+	header := s.rendererHeader()
+	if s.renderer != "" {
+		// yaml.v3 kept the renderer line of the file as a comment
+		out = bytes.TrimLeft(bytes.TrimPrefix(out, []byte(s.renderer)), "\n")
+	}
+	if !bytes.HasPrefix(out, []byte(header)) {
+		buffer.WriteString(header + "\n\n")
+	}
+	buffer.Write(out)
+
+	return buffer
+}
+
+// processNode processes the values of node at path, key is the map key of the node
+func (s *Sls) processNode(key interface{}, path string, node *yamlv3.Node, action string) {
+	switch node.Kind {
+	case yamlv3.AliasNode:
+		// the anchor is processed where it is defined
+		return
+	case yamlv3.MappingNode:
+		for index := 0; index+1 < len(node.Content); index += 2 {
+			if node.Content[index].ShortTag() == mergeTag {
+				continue
+			}
+			s.processNode(node.Content[index].Value, joinPath(path, node.Content[index].Value), node.Content[index+1], action)
+		}
+	case yamlv3.SequenceNode:
+		for index, child := range node.Content {
+			s.processNode(key, joinPath(path, fmt.Sprintf("%d", index)), child, action)
+		}
+	case yamlv3.DocumentNode:
+		for _, child := range node.Content {
+			s.processNode(key, path, child, action)
+		}
+	case yamlv3.ScalarNode:
+		if node.ShortTag() != "!!str" || s.skipKey(key, action) {
+			return
+		}
+		val := node.Value
+		switch action {
+		case encrypt:
+			val = s.encryptPathVal(path, val)
+		case decrypt:
+			val = s.decryptVal(key, val)
+		}
+		if val != node.Value {
+			node.Value = val
+			node.Style = 0
+			if strings.Contains(val, "\n") {
+				node.Style = yamlv3.LiteralStyle
+			}
+		}
+	}
+}
+
+func encodeNode(node *yamlv3.Node) ([]byte, error) {
+	clearMergeTags(node)
+
+	var out bytes.Buffer
+	encoder := yamlv3.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+	err := encoder.Close()
+
+	return out.Bytes(), err
+}
+
+// clearMergeTags drops the explicit tag of merge keys, yaml.v3 writes '!!merge <<' otherwise
+func clearMergeTags(node *yamlv3.Node) {
+	if node.Kind == yamlv3.MappingNode {
+		for index := 0; index+1 < len(node.Content); index += 2 {
+			if node.Content[index].ShortTag() == mergeTag {
+				node.Content[index].Tag = ""
+			}
+		}
+	}
+	for _, child := range node.Content {
+		clearMergeTags(child)
+	}
+}
+
+// sortedNodeOutput returns out with the map keys sorted, sorting is skipped
+// with a warning when it would move an alias ahead of its anchor
+func sortedNodeOutput(out []byte) []byte {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(out, &doc); err != nil {
+		logger.Warnf("unable to sort keys: %s", err)
+		return out
+	}
+	sortNode(&doc)
+
+	sorted, err := encodeNode(&doc)
+	if err == nil {
+		var check yamlv3.Node
+		err = yamlv3.Unmarshal(sorted, &check)
+	}
+	if err != nil {
+		logger.Warnf("keys were not sorted, sorting would move an alias ahead of its anchor: %s", err)
+		return out
+	}
+
+	return sorted
+}
+
+func sortNode(node *yamlv3.Node) {
+	if node.Kind == yamlv3.MappingNode {
+		pairs := make([][2]*yamlv3.Node, 0, len(node.Content)/2)
+		for index := 0; index+1 < len(node.Content); index += 2 {
+			pairs = append(pairs, [2]*yamlv3.Node{node.Content[index], node.Content[index+1]})
+		}
+		sort.SliceStable(pairs, func(i, j int) bool {
+			return pairs[i][0].Value < pairs[j][0].Value
+		})
+		for index, pair := range pairs {
+			node.Content[index*2] = pair[0]
+			node.Content[index*2+1] = pair[1]
+		}
+	}
+	for _, child := range node.Content {
+		sortNode(child)
+	}
+}
@@ -0,0 +1,84 @@
+package sls
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// Stats holds the counts gathered while scanning sls files
+type Stats struct {
+	Files           int
+	Undecryptable   int
+	PlainTextLeaves int
+}
+
+// ScanDir scans all sls files in the given directory and returns the counts
+func (s *Sls) ScanDir(searchDir string) Stats {
+	var stats Stats
+
+	slsFiles, count := FindSlsFiles(searchDir, s.Extensions...)
+	if count == 0 {
+		logger.Warnf("%s has no sls files", searchDir)
+	}
+	for _, file := range slsFiles {
+		err := s.ScanFile(file, &stats)
+		if err != nil {
+			logger.Warnf("%s: %s", shortFileName(file), err)
+		}
+	}
+
+	return stats
+}
+
+// ScanFile adds the counts for a single sls file to the given stats
+// Encrypted values are counted as undecryptable if the secret keyring cannot decrypt them
+func (s *Sls) ScanFile(filePath string, stats *Stats) error {
+	stats.Files++
+
+	err := s.ReadSlsFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	for key, vals := range s.Yaml.Values {
+		if s.TopLevelElement != "" && s.TopLevelElement != key {
+			continue
+		}
+		walkLeaves(key, vals, func(path string, strVal string) {
+			if !isEncrypted(strVal) {
+				stats.PlainTextLeaves++
+			} else if _, err := s.Pki.DecryptSecret(strVal); err != nil {
+				stats.Undecryptable++
+			}
+		})
+	}
+
+	return nil
+}
+
+// WritePromTextfile atomically writes the stats as node-exporter textfile metrics
+func WritePromTextfile(stats Stats, outFilePath string) error {
+	var buffer bytes.Buffer
+
+	writeMetric(&buffer, "gsp_files_total", "Number of sls files scanned.", int64(stats.Files))
+	writeMetric(&buffer, "gsp_undecryptable_total", "Number of encrypted values that could not be decrypted.", int64(stats.Undecryptable))
+	writeMetric(&buffer, "gsp_plaintext_leaves_total", "Number of values that are not encrypted.", int64(stats.PlainTextLeaves))
+	writeMetric(&buffer, "gsp_last_run_timestamp", "Unix time of the last scan.", time.Now().Unix())
+
+	fullPath, err := filepath.Abs(outFilePath)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file in the same directory and rename it into place
+	// so the node exporter never reads a partially written file
+	return writeAtomic(fullPath, buffer.Bytes(), 0644)
+}
+
+func writeMetric(buffer *bytes.Buffer, name string, help string, value int64) {
+	fmt.Fprintf(buffer, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buffer, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(buffer, "%s %d\n", name, value)
+}
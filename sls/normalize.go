@@ -0,0 +1,59 @@
+package sls
+
+import (
+	"fmt"
+
+	"github.com/Everbridge/generate-secure-pillar/pki"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// normalizeValues re-wraps each armored value in the yaml values to the
+// canonical form so files touched by other PGP tools write the same cipher text
+// A value that cannot be decoded is left as it is and logged
+func (s *Sls) normalizeValues() {
+	for key, vals := range s.Yaml.Values {
+		vals, _ = rewrapValues(key, vals, func(path string, cipherText string) (string, error) {
+			return normalizeArmor(path, cipherText), nil
+		})
+		s.Yaml.Values[key] = vals
+	}
+}
+
+// normalizeNode re-wraps each armored scalar under node to the canonical form
+func normalizeNode(node *yamlv3.Node, path string) {
+	switch node.Kind {
+	case yamlv3.DocumentNode:
+		for _, child := range node.Content {
+			normalizeNode(child, path)
+		}
+	case yamlv3.SequenceNode:
+		for index, child := range node.Content {
+			normalizeNode(child, joinPath(path, fmt.Sprintf("%d", index)))
+		}
+	case yamlv3.MappingNode:
+		for index := 0; index+1 < len(node.Content); index += 2 {
+			normalizeNode(node.Content[index+1], joinPath(path, node.Content[index].Value))
+		}
+	case yamlv3.ScalarNode:
+		if isEncrypted(node.Value) {
+			node.Value = normalizeArmor(path, node.Value)
+		}
+	}
+}
+
+func normalizeArmor(path string, cipherText string) string {
+	normalized, err := pki.NormalizeArmor(cipherText)
+	if err != nil {
+		logger.Warnf("%s: armor not normalized: %s", path, err)
+	}
+
+	return normalized
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + ":" + key
+}
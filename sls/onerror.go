@@ -0,0 +1,77 @@
+package sls
+
+import "fmt"
+
+// OnError policies, from stopping the most to the least
+const (
+	// OnErrorAbort stops a recursive run at the first file that fails
+	OnErrorAbort = "abort"
+	// OnErrorSkipFile leaves a file that fails as it is and goes on to the next file
+	OnErrorSkipFile = "skip-file"
+	// OnErrorContinue leaves a value that fails as it is and writes the rest of its file
+	OnErrorContinue = "continue"
+)
+
+// ValidOnError checks for a known OnError policy
+func ValidOnError(policy string) bool {
+	return policy == OnErrorAbort || policy == OnErrorSkipFile || policy == OnErrorContinue
+}
+
+// AbortOnError reports whether a failed file stops a recursive run
+func (s *Sls) AbortOnError() bool {
+	return s.FailFast || s.OnError == OnErrorAbort
+}
+
+// continueOnError reports whether a value that fails is left as it is
+// rather than failing its file
+func (s *Sls) continueOnError(action string) bool {
+	if action == decrypt && s.IgnoreDecryptErrors {
+		return true
+	}
+
+	return s.OnError == OnErrorContinue
+}
+
+// checkValues runs the checks on the plain text values before they are encrypted
+// With OnErrorContinue each value that fails is logged and its path recorded
+// so it is left as plain text, otherwise the first failure is returned
+func (s *Sls) checkValues() error {
+	s.skippedValues = nil
+	if !s.continueOnError(encrypt) {
+		if err := s.CheckValueSizes(); err != nil {
+			return err
+		}
+		return s.CheckPlaceholders()
+	}
+
+	for key, vals := range s.Yaml.Values {
+		if s.TopLevelElement != "" && s.TopLevelElement != key {
+			continue
+		}
+		walkLeaves(key, vals, func(path string, strVal string) {
+			if isEncrypted(strVal) {
+				return
+			}
+			err := s.checkValueSize(path, strVal)
+			if err == nil {
+				err = s.checkPlaceholder(path, strVal)
+			}
+			if err != nil {
+				logger.Warnf("%s, it is left as plain text", err)
+				if s.skippedValues == nil {
+					s.skippedValues = make(map[string]bool)
+				}
+				s.skippedValues[path] = true
+			}
+		})
+	}
+
+	return nil
+}
+
+// fileError returns err for a file that was not processed
+func fileError(filePath string, action string, err error) error {
+	done := map[string]string{encrypt: "encrypted", decrypt: "decrypted", validate: "listed", rotate: "rotated"}
+
+	return fmt.Errorf("%s was not %s: %w", shortFileName(filePath), done[action], err)
+}
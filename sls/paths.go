@@ -0,0 +1,121 @@
+package sls
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// valueAtPath returns the value at the path parts below values
+// A numeric part is a list index when its parent is a list and
+// matches a map key by its string form when its parent is a map
+func valueAtPath(values map[string]interface{}, parts []string) interface{} {
+	var cur interface{} = values
+	for _, part := range parts {
+		var ok bool
+		cur, ok = childValue(cur, part)
+		if !ok {
+			return nil
+		}
+	}
+
+	return cur
+}
+
+func childValue(cur interface{}, part string) (interface{}, bool) {
+	switch c := cur.(type) {
+	case map[string]interface{}:
+		val, ok := c[part]
+		return val, ok
+	case map[interface{}]interface{}:
+		key, ok := mapKey(c, part)
+		if !ok {
+			return nil, false
+		}
+		return c[key], true
+	case []interface{}:
+		index, err := strconv.Atoi(part)
+		if err != nil || index < 0 || index >= len(c) {
+			return nil, false
+		}
+		return c[index], true
+	}
+
+	return nil, false
+}
+
+// mapKey returns the key of m whose string form is part, e.g. the int 2019 for "2019"
+func mapKey(m map[interface{}]interface{}, part string) (interface{}, bool) {
+	if _, ok := m[part]; ok {
+		return part, true
+	}
+	for key := range m {
+		if fmt.Sprintf("%v", key) == part {
+			return key, true
+		}
+	}
+
+	return nil, false
+}
+
+// setValueAtPath sets the value at the path parts below values, resolving each
+// part the same way as valueAtPath, missing maps along the path are created
+func setValueAtPath(values map[string]interface{}, parts []string, value interface{}) error {
+	var cur interface{} = values
+	for index, part := range parts {
+		last := index == len(parts)-1
+		var next interface{}
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			if last {
+				c[part] = value
+				return nil
+			}
+			next = c[part]
+			if !isContainer(next) {
+				next = map[interface{}]interface{}{}
+				c[part] = next
+			}
+		case map[interface{}]interface{}:
+			key, ok := mapKey(c, part)
+			if !ok {
+				key = part
+			}
+			if last {
+				c[key] = value
+				return nil
+			}
+			next = c[key]
+			if !isContainer(next) {
+				next = map[interface{}]interface{}{}
+				c[key] = next
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(c) {
+				return fmt.Errorf("'%s' is not an index of the list at '%s'", part, strings.Join(parts[:index], ":"))
+			}
+			if last {
+				c[i] = value
+				return nil
+			}
+			next = c[i]
+			if !isContainer(next) {
+				next = map[interface{}]interface{}{}
+				c[i] = next
+			}
+		}
+		cur = next
+	}
+
+	return nil
+}
+
+func isContainer(val interface{}) bool {
+	switch val.(type) {
+	case map[interface{}]interface{}, []interface{}:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,42 @@
+package sls
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultPlaceholders are the values rejected when no placeholders are given
+var DefaultPlaceholders = []string{"CHANGEME", "TODO", "FIXME", "xxx"}
+
+// CheckPlaceholders returns an error for the first plain text value that is one of Placeholders
+func (s *Sls) CheckPlaceholders() error {
+	var err error
+
+	for key, vals := range s.Yaml.Values {
+		if s.TopLevelElement != "" && s.TopLevelElement != key {
+			continue
+		}
+		walkLeaves(key, vals, func(path string, strVal string) {
+			if err == nil && !isEncrypted(strVal) {
+				err = s.checkPlaceholder(path, strVal)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkPlaceholder matches the whole value, ignoring case and surrounding white space
+func (s *Sls) checkPlaceholder(path string, value string) error {
+	value = strings.TrimSpace(value)
+	for _, placeholder := range s.Placeholders {
+		if strings.EqualFold(value, placeholder) {
+			return fmt.Errorf("value at '%s' is the placeholder '%s', set the real value before encrypting it", path, placeholder)
+		}
+	}
+
+	return nil
+}
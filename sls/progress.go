@@ -0,0 +1,34 @@
+package sls
+
+import (
+	"sync/atomic"
+)
+
+// progress counts the files of the run, so a run that is stopped before it
+// reaches its own summary can still report how far it got
+var progress struct {
+	done  int64
+	total int64
+}
+
+// AddFiles adds count files to the files the run has to process
+func AddFiles(count int) {
+	atomic.AddInt64(&progress.total, int64(count))
+}
+
+// FileDone records that a file of the run was processed
+func FileDone() {
+	atomic.AddInt64(&progress.done, 1)
+}
+
+// Progress returns the number of files processed and the number the run has to process
+func Progress() (int, int) {
+	return int(atomic.LoadInt64(&progress.done)), int(atomic.LoadInt64(&progress.total))
+}
+
+// WaitIdle returns once no file is being written and keeps any further file
+// from being written, so the caller can exit without leaving a file part way
+// written. Files still being processed are abandoned before they are written
+func WaitIdle() {
+	writeLock.Lock()
+}
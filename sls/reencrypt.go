@@ -0,0 +1,135 @@
+package sls
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Everbridge/generate-secure-pillar/pki"
+	"github.com/keybase/go-crypto/openpgp"
+)
+
+// Reencrypt re-encrypts the values of each sls file under recurseDir whose
+// recipients differ from those policy gives for the file, so the tree converges
+// to the policy. policy maps slash separated directories relative to recurseDir,
+// "." for recurseDir itself, to a key name, email, or ID or a '@group', the
+// deepest directory holding a file applies to it. Files no directory applies
+// to are left as they are, as are files whose values all match
+// Only changed files are written, their paths relative to recurseDir are returned
+func (s *Sls) Reencrypt(recurseDir string, policy map[string]string) ([]string, error) {
+	changed := []string{}
+	if len(policy) == 0 {
+		return changed, fmt.Errorf("no recipients are defined")
+	}
+
+	desired := make(map[string][]*openpgp.Entity)
+	for dir, name := range policy {
+		keys, err := s.Pki.KeysFor(name)
+		if err != nil {
+			return changed, fmt.Errorf("recipients of '%s': %s", dir, err)
+		}
+		desired[path.Clean(dir)] = keys
+	}
+
+	slsFiles, count := s.findModifiedSlsFiles(recurseDir)
+	if count == 0 {
+		return changed, fmt.Errorf("%s has no sls files", recurseDir)
+	}
+	root, err := filepath.Abs(recurseDir)
+	if err != nil {
+		return changed, err
+	}
+	// values are decrypted to re-encrypt them
+	if err = s.Pki.CheckSecRing(); err != nil {
+		return changed, fmt.Errorf("no usable secret keyring, no files were changed: %s", err)
+	}
+
+	for _, file := range slsFiles {
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return changed, err
+		}
+		rel = filepath.ToSlash(rel)
+		recipients := policyFor(desired, rel)
+		if recipients == nil {
+			if s.Verbose {
+				logger.Infof("%s has no recipients defined, it is left as it is", rel)
+			}
+			continue
+		}
+		buffer, values, err := s.reencryptFile(file, recipients)
+		if err != nil {
+			return changed, fmt.Errorf("%s: %s", rel, err)
+		}
+		if values == 0 {
+			continue
+		}
+		if !SummaryOnly {
+			logger.Infof("re-encrypted %d values in %s", values, rel)
+		}
+		s.writeFile(buffer, file)
+		changed = append(changed, rel)
+	}
+
+	return changed, nil
+}
+
+// policyFor returns the recipients of the deepest directory in desired holding rel,
+// an init.sls takes those of its own directory, see slsDir
+func policyFor(desired map[string][]*openpgp.Entity, rel string) []*openpgp.Entity {
+	for dir := slsDir(rel); ; dir = path.Dir(dir) {
+		if recipients, ok := desired[dir]; ok {
+			return recipients
+		}
+		if dir == "." {
+			return nil
+		}
+	}
+}
+
+// reencryptFile returns the file with each value whose recipients differ
+// from recipients re-encrypted to them and how many values were re-encrypted
+func (s *Sls) reencryptFile(filePath string, recipients []*openpgp.Entity) (bytes.Buffer, int, error) {
+	var buffer bytes.Buffer
+
+	if err := s.ReadSlsFile(filePath); err != nil {
+		return buffer, 0, err
+	}
+
+	count := 0
+	for key, vals := range s.Yaml.Values {
+		if s.TopLevelElement != "" && s.TopLevelElement != key {
+			continue
+		}
+		vals, err := rewrapValues(key, vals, func(path string, cipherText string) (string, error) {
+			missing, extra, err := s.Pki.RecipientDiff(cipherText, recipients)
+			if err != nil {
+				return cipherText, fmt.Errorf("%s: %s", path, err)
+			}
+			if len(missing) == 0 && len(extra) == 0 {
+				return cipherText, nil
+			}
+			if s.Verbose {
+				logger.Infof("%s: missing [%s], extra [%s]", path, strings.Join(missing, ", "), strings.Join(extra, ", "))
+			}
+			plainText, err := s.Pki.DecryptSecret(cipherText)
+			if err != nil {
+				return cipherText, fmt.Errorf("%s: %s", path, err)
+			}
+			count++
+			newText := s.Pki.EncryptSecretTo(plainText, recipients)
+			if pki.IsInline(cipherText) {
+				return pki.InlineCipherText(newText)
+			}
+			return newText, nil
+		})
+		if err != nil {
+			return buffer, count, err
+		}
+		s.Yaml.Values[key] = vals
+	}
+
+	return s.FormatBuffer(""), count, nil
+}
@@ -0,0 +1,48 @@
+package sls
+
+import (
+	"strings"
+)
+
+// readRenderer returns the '#!' renderer line that starts buf, if there is one
+func readRenderer(buf []byte) string {
+	line := strings.SplitN(string(buf), "\n", 2)[0]
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "#!") {
+		return ""
+	}
+
+	return line
+}
+
+// rendererHeader returns the renderer line to write, the gpg renderer unless
+// PreserveRenderer kept the line the file was read with
+// gpg is appended to a kept renderer chain without it when values are encrypted
+func (s *Sls) rendererHeader() string {
+	if s.renderer == "" {
+		return rendererLine
+	}
+	for _, renderer := range strings.Split(strings.TrimPrefix(s.renderer, "#!"), "|") {
+		if strings.TrimSpace(renderer) == "gpg" {
+			return s.renderer
+		}
+	}
+	if s.hasEncryptedValues() {
+		return s.renderer + "|gpg"
+	}
+
+	return s.renderer
+}
+
+func (s *Sls) hasEncryptedValues() bool {
+	found := false
+	for key, vals := range s.Yaml.Values {
+		walkLeaves(key, vals, func(path string, val string) {
+			if isEncrypted(val) {
+				found = true
+			}
+		})
+	}
+
+	return found
+}
@@ -0,0 +1,36 @@
+package sls
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Repair normalizes a file to a single '#!yaml|gpg' header followed by one
+// blank line, dropping stray header lines and leading blank lines
+// The values are not parsed or decrypted, the number of stray headers is returned
+func Repair(buf []byte) (bytes.Buffer, int) {
+	var buffer bytes.Buffer
+
+	headers := 0
+	var body []string
+	for _, line := range strings.SplitAfter(string(buf), "\n") {
+		if strings.TrimSpace(line) == rendererLine {
+			headers++
+			continue
+		}
+		if len(body) == 0 && strings.TrimSpace(line) == "" {
+			continue
+		}
+		body = append(body, line)
+	}
+
+	buffer.WriteString(rendererLine + "\n\n")
+	buffer.WriteString(strings.Join(body, ""))
+
+	stray := 0
+	if headers > 1 {
+		stray = headers - 1
+	}
+
+	return buffer, stray
+}
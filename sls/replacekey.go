@@ -0,0 +1,91 @@
+package sls
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Everbridge/generate-secure-pillar/pki"
+	"github.com/keybase/go-crypto/openpgp"
+)
+
+// ReplaceKey re-encrypts each value under recurseDir that was encrypted to oldKey
+// to its other recipients and newKey, values not encrypted to oldKey are left as they are
+// Only files with a replaced value are written, the number of them is returned
+func (s *Sls) ReplaceKey(recurseDir string, oldKey string, newKey string) (int, error) {
+	entities, err := s.Pki.EntitiesByName([]string{oldKey, newKey})
+	if err != nil {
+		return 0, err
+	}
+	oldEntity, newEntity := entities[0], entities[1]
+	if oldEntity.PrimaryKey.KeyId == newEntity.PrimaryKey.KeyId {
+		return 0, fmt.Errorf("the old and new keys are the same key")
+	}
+
+	slsFiles, count := s.findModifiedSlsFiles(recurseDir)
+	if count == 0 {
+		return 0, fmt.Errorf("%s has no sls files", recurseDir)
+	}
+	// values are decrypted to re-encrypt them
+	if err = s.Pki.CheckSecRing(); err != nil {
+		return 0, fmt.Errorf("no usable secret keyring, no files were changed: %s", err)
+	}
+
+	changed := 0
+	for _, file := range slsFiles {
+		buffer, replaced, err := s.replaceKeyInFile(file, oldEntity, newEntity)
+		if err != nil {
+			return changed, fmt.Errorf("%s: %s", shortFileName(file), err)
+		}
+		if replaced == 0 {
+			continue
+		}
+		if !SummaryOnly {
+			logger.Infof("replaced the key of %d values in %s", replaced, shortFileName(file))
+		}
+		s.writeFile(buffer, file)
+		changed++
+	}
+
+	return changed, nil
+}
+
+// replaceKeyInFile returns the file with oldEntity replaced by newEntity in
+// the recipients of each value and how many values were replaced
+func (s *Sls) replaceKeyInFile(filePath string, oldEntity *openpgp.Entity, newEntity *openpgp.Entity) (bytes.Buffer, int, error) {
+	var buffer bytes.Buffer
+
+	if err := s.ReadSlsFile(filePath); err != nil {
+		return buffer, 0, err
+	}
+
+	oldIDs := make(map[uint64]bool)
+	for _, id := range pki.EntityKeyIDs(oldEntity) {
+		oldIDs[id] = true
+	}
+
+	replaced := 0
+	for key, vals := range s.Yaml.Values {
+		if s.TopLevelElement != "" && s.TopLevelElement != key {
+			continue
+		}
+		vals, err := rewrapValues(key, vals, func(path string, cipherText string) (string, error) {
+			ids, err := pki.RecipientKeyIDs(cipherText)
+			if err != nil {
+				return cipherText, fmt.Errorf("%s: %s", path, err)
+			}
+			for _, id := range ids {
+				if oldIDs[id] {
+					replaced++
+					return s.rewrapValue(path, cipherText, []*openpgp.Entity{newEntity}, []*openpgp.Entity{oldEntity})
+				}
+			}
+			return cipherText, nil
+		})
+		if err != nil {
+			return buffer, replaced, err
+		}
+		s.Yaml.Values[key] = vals
+	}
+
+	return s.FormatBuffer(""), replaced, nil
+}
@@ -0,0 +1,123 @@
+package sls
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"github.com/Everbridge/generate-secure-pillar/pki"
+	"github.com/gosexy/to"
+	"github.com/keybase/go-crypto/openpgp"
+)
+
+// Rewrap re-encrypts each encrypted value in the file to its current recipients
+// with the keys named in add added and the keys named in remove taken away
+// Each value is decrypted, so the secret keyring is needed
+func (s *Sls) Rewrap(filePath string, add []string, remove []string) (bytes.Buffer, error) {
+	var buffer bytes.Buffer
+
+	added, err := s.Pki.EntitiesByName(add)
+	if err != nil {
+		return buffer, err
+	}
+	removed, err := s.Pki.EntitiesByName(remove)
+	if err != nil {
+		return buffer, err
+	}
+
+	if err = s.ReadSlsFile(filePath); err != nil {
+		return buffer, err
+	}
+
+	for key, vals := range s.Yaml.Values {
+		if s.TopLevelElement != "" && s.TopLevelElement != key {
+			continue
+		}
+		vals, err = rewrapValues(key, vals, func(path string, cipherText string) (string, error) {
+			return s.rewrapValue(path, cipherText, added, removed)
+		})
+		if err != nil {
+			return buffer, err
+		}
+		s.Yaml.Values[key] = vals
+	}
+
+	return s.FormatBuffer(""), nil
+}
+
+// rewrapValues replaces each encrypted value under vals with the result of fn
+func rewrapValues(path string, vals interface{}, fn func(path string, cipherText string) (string, error)) (interface{}, error) {
+	if vals == nil {
+		return vals, nil
+	}
+
+	var err error
+	switch reflect.TypeOf(vals).Kind() {
+	case reflect.Slice:
+		items := vals.([]interface{})
+		for index, item := range items {
+			items[index], err = rewrapValues(fmt.Sprintf("%s:%d", path, index), item, fn)
+			if err != nil {
+				return vals, err
+			}
+		}
+	case reflect.Map:
+		items := vals.(map[interface{}]interface{})
+		for key, item := range items {
+			items[key], err = rewrapValues(fmt.Sprintf("%s:%v", path, key), item, fn)
+			if err != nil {
+				return vals, err
+			}
+		}
+	case reflect.String:
+		strVal := to.String(vals)
+		if !isEncrypted(strVal) {
+			return vals, nil
+		}
+		return fn(path, strVal)
+	}
+
+	return vals, nil
+}
+
+// rewrapValue re-encrypts one value to its adjusted recipients
+func (s *Sls) rewrapValue(path string, cipherText string, added []*openpgp.Entity, removed []*openpgp.Entity) (string, error) {
+	current, err := s.Pki.RecipientEntities(cipherText)
+	if err != nil {
+		return cipherText, fmt.Errorf("%s: %s", path, err)
+	}
+
+	var recipients []*openpgp.Entity
+	seen := make(map[uint64]bool)
+	for _, entity := range append(current, added...) {
+		if seen[entity.PrimaryKey.KeyId] || hasEntity(removed, entity) {
+			continue
+		}
+		seen[entity.PrimaryKey.KeyId] = true
+		recipients = append(recipients, entity)
+	}
+	if len(recipients) == 0 {
+		return cipherText, fmt.Errorf("%s would have no recipients left", path)
+	}
+
+	plainText, err := s.Pki.DecryptSecret(cipherText)
+	if err != nil {
+		return cipherText, fmt.Errorf("%s: %s", path, err)
+	}
+	newText := s.Pki.EncryptSecretTo(plainText, recipients)
+	if pki.IsInline(cipherText) {
+		return pki.InlineCipherText(newText)
+	}
+
+	return newText, nil
+}
+
+func hasEntity(entities []*openpgp.Entity, entity *openpgp.Entity) bool {
+	for _, e := range entities {
+		if e.PrimaryKey.KeyId == entity.PrimaryKey.KeyId {
+			return true
+		}
+	}
+
+	return false
+}
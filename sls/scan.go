@@ -0,0 +1,220 @@
+package sls
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gosexy/to"
+)
+
+// FileReport lists the plain text value paths found in a file
+type FileReport struct {
+	File      string   `json:"file"`
+	PlainText []string `json:"plaintext"`
+}
+
+// KeysRecord is the json record printed for each file by keys recurse --ndjson
+type KeysRecord struct {
+	File  string            `json:"file"`
+	Keys  map[string]string `json:"keys"`
+	Error string            `json:"error,omitempty"`
+}
+
+// printKeysRecord prints the key info for the last validated file as a single json line
+func (s *Sls) printKeysRecord(file string, err error) {
+	record := KeysRecord{File: file, Keys: make(map[string]string)}
+	if err != nil {
+		record.Error = err.Error()
+	} else {
+		for key, vals := range s.Yaml.Values {
+			walkLeaves(key, vals, func(path string, keyInfo string) {
+				if keyInfo != "" {
+					record.Keys[path] = strings.TrimSpace(keyInfo)
+				}
+			})
+		}
+	}
+
+	out, err := json.Marshal(record)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	fmt.Printf("%s\n", out)
+}
+
+// PlainTextReport returns a report for each sls file in the given directory
+func (s *Sls) PlainTextReport(searchDir string) []FileReport {
+	reports := []FileReport{}
+
+	slsFiles, count := s.findModifiedSlsFiles(searchDir)
+	if count == 0 {
+		logger.Warnf("%s has no sls files", searchDir)
+	}
+	for _, file := range slsFiles {
+		paths, err := s.PlainTextPaths(file)
+		if err != nil {
+			logger.Warnf("%s: %s", shortFileName(file), err)
+			continue
+		}
+		reports = append(reports, FileReport{File: shortFileName(file), PlainText: paths})
+	}
+
+	return reports
+}
+
+// PlainTextPaths returns the sorted paths of all values in a file that are not encrypted
+func (s *Sls) PlainTextPaths(filePath string) ([]string, error) {
+	paths := []string{}
+	err := s.ReadSlsFile(filePath)
+	if err != nil {
+		return paths, err
+	}
+
+	return s.plainTextPaths(), nil
+}
+
+// PlainTextPathsInBytes returns the sorted paths of all values in the given YAML that are not encrypted
+func (s *Sls) PlainTextPathsInBytes(buf []byte) ([]string, error) {
+	err := s.ReadBytes(buf)
+	if err != nil {
+		return []string{}, err
+	}
+
+	return s.plainTextPaths(), nil
+}
+
+func (s *Sls) plainTextPaths() []string {
+	paths := []string{}
+
+	for key, vals := range s.Yaml.Values {
+		if s.TopLevelElement != "" && s.TopLevelElement != key {
+			continue
+		}
+		walkLeaves(key, vals, func(path string, strVal string) {
+			if !isEncrypted(strVal) {
+				paths = append(paths, path)
+			}
+		})
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// walkLeaves calls fn with the path and value of every string under vals
+// paths are joined with ':' the same way GetValueFromPath splits them
+func walkLeaves(path string, vals interface{}, fn func(string, string)) {
+	if vals == nil {
+		return
+	}
+
+	switch reflect.TypeOf(vals).Kind() {
+	case reflect.Slice:
+		for index, item := range vals.([]interface{}) {
+			walkLeaves(fmt.Sprintf("%s:%d", path, index), item, fn)
+		}
+	case reflect.Map:
+		for key, item := range vals.(map[interface{}]interface{}) {
+			walkLeaves(fmt.Sprintf("%s:%v", path, key), item, fn)
+		}
+	case reflect.String:
+		fn(path, to.String(vals))
+	}
+}
+
+// HasEncryptedValue reports whether vals, a single value or a map or list of
+// them, holds at least one encrypted value
+func HasEncryptedValue(vals interface{}) bool {
+	found := false
+	walkLeaves("", vals, func(path string, strVal string) {
+		found = found || isEncrypted(strVal)
+	})
+
+	return found
+}
+
+// CheckRecipients returns a line for each value whose recipients differ from the named keys
+func (s *Sls) CheckRecipients(filePath string, keyNames []string) ([]string, error) {
+	diffs := []string{}
+
+	desired, err := s.Pki.EntitiesByName(keyNames)
+	if err != nil {
+		return diffs, err
+	}
+
+	err = s.ReadSlsFile(filePath)
+	if err != nil {
+		return diffs, err
+	}
+
+	for key, vals := range s.Yaml.Values {
+		if s.TopLevelElement != "" && s.TopLevelElement != key {
+			continue
+		}
+		walkLeaves(key, vals, func(path string, strVal string) {
+			if !isEncrypted(strVal) {
+				diffs = append(diffs, fmt.Sprintf("%s: not encrypted", path))
+				return
+			}
+			missing, extra, err := s.Pki.RecipientDiff(strVal, desired)
+			if err != nil {
+				diffs = append(diffs, fmt.Sprintf("%s: %s", path, err))
+				return
+			}
+			for _, name := range missing {
+				diffs = append(diffs, fmt.Sprintf("%s: missing recipient %s", path, name))
+			}
+			for _, name := range extra {
+				diffs = append(diffs, fmt.Sprintf("%s: extra recipient %s", path, name))
+			}
+		})
+	}
+	sort.Strings(diffs)
+
+	return diffs, nil
+}
+
+// DisallowedRecipients returns a "path: disallowed recipient <key>" line for each
+// recipient of a value in the file that is not one of the AllowedRecipients keys
+func (s *Sls) DisallowedRecipients(filePath string) ([]string, error) {
+	err := s.ReadSlsFile(filePath)
+	if err != nil {
+		return []string{}, err
+	}
+
+	return s.disallowedRecipients()
+}
+
+func (s *Sls) disallowedRecipients() ([]string, error) {
+	found := []string{}
+
+	allowed, err := s.Pki.EntitiesByName(s.AllowedRecipients)
+	if err != nil {
+		return found, err
+	}
+
+	for key, vals := range s.Yaml.Values {
+		if s.TopLevelElement != "" && s.TopLevelElement != key {
+			continue
+		}
+		walkLeaves(key, vals, func(path string, strVal string) {
+			if !isEncrypted(strVal) {
+				return
+			}
+			_, extra, err := s.Pki.RecipientDiff(strVal, allowed)
+			if err != nil {
+				found = append(found, fmt.Sprintf("%s: %s", path, err))
+				return
+			}
+			for _, name := range extra {
+				found = append(found, fmt.Sprintf("%s: disallowed recipient %s", path, name))
+			}
+		})
+	}
+	sort.Strings(found)
+
+	return found, nil
+}
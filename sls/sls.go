@@ -3,19 +3,26 @@ package sls
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Everbridge/generate-secure-pillar/pki"
 	yaml "github.com/esilva-everbridge/yaml"
 	"github.com/gosexy/to"
 	"github.com/sirupsen/logrus"
 	yamlv2 "gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
 )
 
 // pgpHeader header const
@@ -23,29 +30,138 @@ const pgpHeader = "-----BEGIN PGP MESSAGE-----"
 const encrypt = "encrypt"
 const decrypt = "decrypt"
 const validate = "validate"
+const rotate = "rotate"
+const slsExt = ".sls"
 
-var logger *logrus.Logger
+// StdinPath is the file path used to read from STDIN
+const StdinPath = "-"
+
+// DefaultMaxValueSize is the default limit for plain text values to encrypt
+const DefaultMaxValueSize = 1024 * 1024
+
+var logger = logrus.New()
+
+// ErrContainsIncludes is returned for files with include directives, they are not processed
+// It may be wrapped, use errors.Is to check for it
+var ErrContainsIncludes = errors.New("contains include directives")
+
+// ErrDecryptFailed is returned when values of a file cannot be decrypted and
+// IgnoreDecryptErrors is not set, nothing is written for the file
+// It may be wrapped, use errors.Is to check for it
+var ErrDecryptFailed = errors.New("values could not be decrypted")
+
+// ErrTimedOut is returned when the context of a Sls ends before all files were processed
+// It may be wrapped, use errors.Is to check for it
+var ErrTimedOut = errors.New("timed out")
+
+// ErrFailFast is returned when FailFast or OnErrorAbort stops a run at the first file that failed
+// It may be wrapped, use errors.Is to check for it
+var ErrFailFast = errors.New("stopped at the first failed file")
+
+// TimeoutExitCode is the exit status used when a run is stopped by its deadline
+const TimeoutExitCode = 124
+
+// DryRun makes WriteSlsFile log what it would write instead of writing files
+var DryRun bool
+
+// OutputPerms is the mode WriteSlsFile gives the files it writes, new or
+// overwritten, 0 creates new files 0644 and leaves the mode of existing ones
+var OutputPerms os.FileMode
+
+// SummaryOnly leaves out the per file log lines, the totals at the end of a run are still logged
+var SummaryOnly bool
 
 // Sls sls data
 type Sls struct {
-	SecretNames     []string
-	SecretValues    []string
-	TopLevelElement string
-	PublicKeyRing   string
-	SecretKeyRing   string
-	PgpKeyName      string
-	Yaml            *yaml.Yaml
-	Pki             *pki.Pki
-	Keys            []string
+	SecretNames         []string
+	SecretValues        []string
+	TopLevelElement     string
+	PublicKeyRing       string
+	SecretKeyRing       string
+	PgpKeyName          string
+	Yaml                *yaml.Yaml
+	Pki                 *pki.Pki
+	Keys                []string
+	EncryptEmpty        bool
+	PruneEmpty          bool
+	TempDir             string
+	InlineCipherText    bool
+	Extensions          []string
+	IfAbsent            bool
+	IfPresent           bool
+	NDJSON              bool
+	AllowMissing        bool
+	MaxValueSize        int
+	ResolveAnchors      bool
+	SortKeys            bool
+	Verbose             bool
+	VerifyRotation      bool
+	BackupDir           string
+	BackupRoot          string
+	EncryptIfChanged    bool
+	FastKeys            bool
+	Append              bool
+	ModifiedSince       time.Time
+	KeyPattern          *regexp.Regexp
+	AllowNonSls         bool
+	AllowUnchecked      bool
+	KeysCSV             bool
+	StampRotated        bool
+	AllowedRecipients   []string
+	ValueSource         ValueSource
+	Context             context.Context
+	StringKeys          bool
+	PreHook             string
+	PostHook            string
+	FailOnHook          bool
+	DedupeAnchors       bool
+	KeepAnchors         bool
+	MaxDepth            int
+	EncryptComments     bool
+	PreserveRenderer    bool
+	Placeholders        []string
+	ForceStringValues   bool
+	IgnoreDecryptErrors bool
+	FailFast            bool
+	OnError             string
+	Colors              Colorizer
+	SummaryOnly         bool
+	mergeNode           *yamlv3.Node
+	commentsEncrypted   bool
+	renderer            string
+	decryptErrors       []string
+	skippedValues       map[string]bool
 }
 
 // New returns a Sls object
 func New(secretNames []string, secretValues []string, topLevelElement string, publicKeyRing string, secretKeyRing string, pgpKeyName string) Sls {
 	logger = logrus.New()
 
-	var keys []string
 	p := pki.New(pgpKeyName, publicKeyRing, secretKeyRing)
-	s := Sls{secretNames, secretValues, topLevelElement, publicKeyRing, secretKeyRing, pgpKeyName, yaml.New(), &p, keys}
+	s := NewWithPki(secretNames, secretValues, topLevelElement, &p)
+	s.PublicKeyRing = publicKeyRing
+	s.SecretKeyRing = secretKeyRing
+
+	return s
+}
+
+// NewWithPki returns a Sls object using keyrings that are already loaded
+// so many objects can be made without reading the keyrings for each one
+func NewWithPki(secretNames []string, secretValues []string, topLevelElement string, p *pki.Pki) Sls {
+	s := Sls{
+		SecretNames:     secretNames,
+		SecretValues:    secretValues,
+		TopLevelElement: topLevelElement,
+		PublicKeyRing:   p.PublicKeyRing,
+		SecretKeyRing:   p.SecretKeyRing,
+		PgpKeyName:      p.PgpKeyName,
+		Yaml:            yaml.New(),
+		Pki:             p,
+		MaxValueSize:    DefaultMaxValueSize,
+		MaxDepth:        DefaultMaxDepth,
+		OnError:         OnErrorSkipFile,
+		SummaryOnly:     SummaryOnly,
+	}
 
 	return s
 }
@@ -54,26 +170,59 @@ func New(secretNames []string, secretValues []string, topLevelElement string, pu
 func (s *Sls) ReadBytes(buf []byte) error {
 	s.Yaml = yaml.New()
 
-	reader := strings.NewReader(string(buf))
+	// read buf in place, a large file is not copied to scan it
+	err := s.ScanForIncludes(bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
 
-	err := s.ScanForIncludes(reader)
+	err = yamlv2.Unmarshal(buf, &s.Yaml.Values)
 	if err != nil {
 		return err
 	}
+	if err = s.CheckDepth(s.Yaml.Values); err != nil {
+		return err
+	}
+	s.renderer = ""
+	if s.PreserveRenderer {
+		s.renderer = readRenderer(buf)
+	}
+	s.commentsEncrypted = s.Yaml.Values[CommentsKey] != nil
+	s.mergeNode = nil
+	if !s.ResolveAnchors {
+		s.mergeNode = mergeDocument(buf, s.KeepAnchors)
+	}
+	if s.mergeNode == nil {
+		s.mergeNode = s.commentDocument(buf)
+	}
 
-	return yamlv2.Unmarshal(buf, &s.Yaml.Values)
+	return nil
+}
+
+// maxLineSize is the longest line newLineScanner reads, inline cipher text
+// puts a whole value on one line, far past the 64KB bufio.Scanner default
+const maxLineSize = 64 * 1024 * 1024
+
+// newLineScanner returns a scanner splitting reader into lines of up to maxLineSize
+func newLineScanner(reader io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	return scanner
 }
 
 // ScanForIncludes looks for include statements in the given io.Reader
+// The error wraps ErrContainsIncludes with the line of the first include
 func (s *Sls) ScanForIncludes(reader io.Reader) error {
-	// Splits on newlines by default.
-	scanner := bufio.NewScanner(reader)
+	scanner := newLineScanner(reader)
 
 	// https://golang.org/pkg/bufio/#Scanner.Scan
+	line := 0
 	for scanner.Scan() {
+		line++
 		txt := scanner.Text()
 		if strings.Contains(txt, "include:") {
-			return fmt.Errorf("contains include directives")
+			return fmt.Errorf("line %d %w", line, ErrContainsIncludes)
 		}
 	}
 	return scanner.Err()
@@ -81,12 +230,29 @@ func (s *Sls) ScanForIncludes(reader io.Reader) error {
 
 // ReadSlsFile open and read a yaml file, if the file has include statements
 // we throw an error as the YAML parser will try to act on the include directives
+// If AllowMissing is set a missing file is read as an empty document
+// A file path of '-' reads STDIN
 func (s *Sls) ReadSlsFile(filePath string) error {
+	if filePath == StdinPath {
+		buf, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		return s.ReadBytes(buf)
+	}
+
 	fullPath, err := filepath.Abs(filePath)
 	if err != nil {
 		return err
 	}
 
+	if s.missingAllowed(fullPath) {
+		s.Yaml = yaml.New()
+		s.mergeNode = nil
+		s.commentsEncrypted = false
+		return nil
+	}
+
 	var buf []byte
 	buf, err = ioutil.ReadFile(fullPath)
 	if err != nil {
@@ -97,6 +263,7 @@ func (s *Sls) ReadSlsFile(filePath string) error {
 }
 
 // WriteSlsFile writes a buffer to the specified file
+// Regular files are replaced with a rename so they are never partly written
 // If the outFilePath is not stdout an INFO string will be printed to stdout
 func WriteSlsFile(buffer bytes.Buffer, outFilePath string) {
 	fullPath, err := filepath.Abs(outFilePath)
@@ -109,6 +276,11 @@ func WriteSlsFile(buffer bytes.Buffer, outFilePath string) {
 		stdOut = true
 	}
 
+	if DryRun && !stdOut {
+		logger.Infof("would write %s, %d values changed", shortFileName(outFilePath), changedValues(fullPath, buffer.Bytes()))
+		return
+	}
+
 	// check that the path exists, create it if not
 	if !stdOut {
 		dir := filepath.Dir(fullPath)
@@ -118,19 +290,93 @@ func WriteSlsFile(buffer bytes.Buffer, outFilePath string) {
 		}
 	}
 
-	err = ioutil.WriteFile(fullPath, buffer.Bytes(), 0644)
+	err = writeSlsBytes(fullPath, buffer.Bytes(), stdOut)
 	if err != nil {
 		logger.Fatal("error writing sls file: ", err)
 	}
-	if !stdOut {
+	if !stdOut && !SummaryOnly {
 		shortFile := shortFileName(outFilePath)
 		logger.Infof("wrote out to file: '%s'", shortFile)
 	}
 }
 
+// writeSlsBytes writes a regular file atomically, through a symlink to its
+// target, and stdout or a device as it is
+func writeSlsBytes(fullPath string, data []byte, stdOut bool) error {
+	if stdOut {
+		return ioutil.WriteFile(fullPath, data, 0644)
+	}
+	if resolved, err := filepath.EvalSymlinks(fullPath); err == nil {
+		fullPath = resolved
+	}
+	if info, err := os.Stat(fullPath); err == nil && !info.Mode().IsRegular() {
+		return ioutil.WriteFile(fullPath, data, 0644)
+	}
+
+	return writeAtomic(fullPath, data, outputMode(fullPath))
+}
+
+// ParseOutputPerms parses an octal file mode such as 0640 for OutputPerms
+func ParseOutputPerms(perms string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(perms, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("invalid output permissions '%s', use an octal mode from 0001 to 0777 such as 0640", perms)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// changedValues counts the leaf values that differ between a file and the given YAML
+func changedValues(filePath string, buf []byte) int {
+	before := leafValues(filePath, nil)
+	after := leafValues("", buf)
+
+	changed := 0
+	for path, val := range after {
+		if old, ok := before[path]; !ok || old != val {
+			changed++
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changed++
+		}
+	}
+
+	return changed
+}
+
+// leafValues maps the paths of all leaf values to their values, a file
+// that cannot be read counts as empty
+func leafValues(filePath string, buf []byte) map[string]string {
+	leaves := make(map[string]string)
+	if filePath != "" {
+		var err error
+		if buf, err = ioutil.ReadFile(filePath); err != nil {
+			return leaves
+		}
+	}
+
+	var values map[string]interface{}
+	if err := yamlv2.Unmarshal(buf, &values); err != nil {
+		return leaves
+	}
+	for key, vals := range values {
+		walkLeaves(key, vals, func(path string, val string) {
+			leaves[path] = val
+		})
+	}
+
+	return leaves
+}
+
 // FindSlsFiles recurses through the given searchDir returning a list of .sls files and it's length
-func FindSlsFiles(searchDir string) ([]string, int) {
+// Files with any of the given extensions are matched instead of .sls if extensions are given
+func FindSlsFiles(searchDir string, extensions ...string) ([]string, int) {
 	fileList := []string{}
+	if len(extensions) == 0 {
+		extensions = []string{slsExt}
+	}
 	searchDir, err := filepath.Abs(searchDir)
 	if err != nil {
 		logger.Error(err)
@@ -143,7 +389,15 @@ func FindSlsFiles(searchDir string) ([]string, int) {
 	}
 
 	err = filepath.Walk(searchDir, func(path string, f os.FileInfo, err error) error {
-		if !f.IsDir() && strings.Contains(f.Name(), ".sls") {
+		if err != nil {
+			// skip what cannot be read so the rest of the tree is still found
+			logger.Warnf("skipping %s: %s", path, err)
+			if f != nil && f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !f.IsDir() && hasExtension(f.Name(), extensions) {
 			fileList = append(fileList, path)
 		}
 		return nil
@@ -155,6 +409,36 @@ func FindSlsFiles(searchDir string) ([]string, int) {
 	return fileList, len(fileList)
 }
 
+// FilesModifiedSince returns the files with a modification time after since
+// Files that cannot be stat'ed are logged and left out
+func FilesModifiedSince(files []string, since time.Time) []string {
+	modified := []string{}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			logger.Warnf("skipping %s: %s", file, err)
+			continue
+		}
+		if info.ModTime().After(since) {
+			modified = append(modified, file)
+		}
+	}
+
+	return modified
+}
+
+// findModifiedSlsFiles applies FindSlsFiles, keeping only the files modified after ModifiedSince when it is set
+func (s *Sls) findModifiedSlsFiles(searchDir string) ([]string, int) {
+	slsFiles, count := FindSlsFiles(searchDir, s.Extensions...)
+	if count == 0 || s.ModifiedSince.IsZero() {
+		return slsFiles, count
+	}
+	modified := FilesModifiedSince(slsFiles, s.ModifiedSince)
+	logger.Infof("%d of %d files modified since %s", len(modified), count, s.ModifiedSince.Format(time.RFC3339))
+
+	return modified, count
+}
+
 // CipherTextYamlBuffer returns a buffer with encrypted and formatted yaml text
 // If the 'all' flag is set all values under the designated top level element are encrypted
 func (s *Sls) CipherTextYamlBuffer(filePath string) (bytes.Buffer, error) {
@@ -174,45 +458,129 @@ func (s *Sls) KeysForYamlBuffer(filePath string) (bytes.Buffer, error) {
 // FileAction performs an action on a file
 func (s *Sls) FileAction(filePath string, action string) (bytes.Buffer, error) {
 	var buffer bytes.Buffer
-	err := CheckForFile(filePath)
-	if err != nil {
-		return buffer, err
+	if filePath != StdinPath {
+		if !s.missingAllowed(filePath) {
+			err := CheckForFile(filePath)
+			if err != nil {
+				return buffer, err
+			}
+		}
+		var err error
+		filePath, err = filepath.Abs(filePath)
+		if err != nil {
+			return buffer, err
+		}
 	}
-	filePath, err = filepath.Abs(filePath)
+
+	err := s.ReadSlsFile(filePath)
 	if err != nil {
 		return buffer, err
 	}
+	if action == decrypt && len(s.AllowedRecipients) > 0 {
+		found, err := s.disallowedRecipients()
+		if err != nil {
+			return buffer, err
+		}
+		if len(found) > 0 {
+			return buffer, fmt.Errorf("%s was not decrypted, %d values are encrypted to keys that are not allowed:\n%s", shortFileName(filePath), len(found), strings.Join(found, "\n"))
+		}
+	}
 
-	err = s.ReadSlsFile(filePath)
+	s.decryptErrors = nil
+	buffer, err = s.performAction(action)
 	if err != nil {
-		return buffer, err
+		return bytes.Buffer{}, fileError(filePath, action, err)
 	}
+	if err = s.decryptError(); err != nil {
+		return bytes.Buffer{}, fmt.Errorf("%s was not decrypted, %w:\n%s", shortFileName(filePath), err, strings.Join(s.decryptErrors, "\n"))
+	}
+
+	return buffer, nil
+}
 
-	buffer = s.PerformAction(action)
-	return buffer, err
+// missingAllowed checks if a missing file should be treated as an empty document
+func (s *Sls) missingAllowed(filePath string) bool {
+	_, err := os.Stat(filePath)
+	return s.AllowMissing && os.IsNotExist(err)
 }
 
 // FormatBuffer returns a formatted .sls buffer with the gpg renderer line
+// With PreserveRenderer the renderer line of the file read is kept instead
+// With ForceStringValues decrypted string values are double quoted
+// Armored values are re-wrapped to the canonical form written by EncryptSecret
 func (s *Sls) FormatBuffer(action string) bytes.Buffer {
 	var buffer bytes.Buffer
 
+	if s.PruneEmpty && action != validate {
+		s.Prune()
+	}
+
 	if len(s.Yaml.Values) == 0 {
 		logger.Error("no values to format")
 	}
+	if s.mergeNode != nil && action != validate {
+		logger.Warn("YAML merge keys are expanded when writing values changed outside of encrypt and decrypt")
+	}
+	if action != validate {
+		s.normalizeValues()
+	}
 
 	out, err := yamlv2.Marshal(s.Yaml.Values)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	if s.ForceStringValues && action == decrypt {
+		out = forceStringOutput(out)
+	}
 
 	if action != validate {
-		buffer.WriteString("#!yaml|gpg\n\n")
+		buffer.WriteString(s.rendererHeader() + "\n\n")
 	}
 	buffer.WriteString(string(out))
 
 	return buffer
 }
 
+// Prune recursively removes empty or nil map and slice entries from the yaml values
+func (s *Sls) Prune() {
+	for key, val := range s.Yaml.Values {
+		pruned, empty := pruneValue(val)
+		if empty {
+			delete(s.Yaml.Values, key)
+		} else {
+			s.Yaml.Values[key] = pruned
+		}
+	}
+}
+
+func pruneValue(val interface{}) (interface{}, bool) {
+	switch v := val.(type) {
+	case nil:
+		return nil, true
+	case map[interface{}]interface{}:
+		for key, item := range v {
+			pruned, empty := pruneValue(item)
+			if empty {
+				delete(v, key)
+			} else {
+				v[key] = pruned
+			}
+		}
+		return v, len(v) == 0
+	case []interface{}:
+		var items []interface{}
+		for _, item := range v {
+			pruned, empty := pruneValue(item)
+			if !empty {
+				items = append(items, pruned)
+			}
+		}
+		return items, len(items) == 0
+	}
+
+	return val, false
+}
+
 // CheckForFile does exactly what it says on the tin
 func CheckForFile(filePath string) error {
 	fi, err := os.Stat(filePath)
@@ -246,61 +614,206 @@ func CheckForDir(filePath string) error {
 }
 
 // ProcessYaml encrypts elements matching keys specified on the command line
-func (s *Sls) ProcessYaml() {
+// With IfAbsent only paths without a value are set, with IfPresent only paths with one
+// With EncryptIfChanged values whose existing cipher text decrypts to the same plain text are left as they are
+// With Append values are appended to the list at their path, a missing path starts a new list
+// Values are resolved through ValueSource first
+func (s *Sls) ProcessYaml() error {
+	values, err := s.resolveValues()
+	if err != nil {
+		return err
+	}
+
 	for index := 0; index < len(s.SecretNames); index++ {
+		existing := s.GetValueFromPath(s.SecretNames[index])
+		if s.IfAbsent && existing != nil {
+			logger.Infof("skipping '%s', it already has a value", s.SecretNames[index])
+			continue
+		}
+		if s.IfPresent && existing == nil {
+			logger.Infof("skipping '%s', it has no value", s.SecretNames[index])
+			continue
+		}
 		cipherText := ""
-		if index >= 0 && index < len(s.SecretValues) {
-			cipherText = s.Pki.EncryptSecret(s.SecretValues[index])
+		if index >= 0 && index < len(values) {
+			err = s.checkValueSize(s.SecretNames[index], values[index])
+			if err != nil {
+				return err
+			}
+			if err = s.checkPlaceholder(s.SecretNames[index], values[index]); err != nil {
+				return err
+			}
+			if s.EncryptIfChanged && s.unchangedValue(existing, values[index]) {
+				logger.Infof("skipping '%s', its value is unchanged", s.SecretNames[index])
+				continue
+			}
+			cipherText = s.encryptVal(values[index])
+		}
+		if s.Append {
+			list, ok := existing.([]interface{})
+			if existing != nil && !ok {
+				return fmt.Errorf("cannot append to '%s', it is not a list", s.SecretNames[index])
+			}
+			if err := s.setValue(s.SecretNames[index], append(list, cipherText)); err != nil {
+				return fmt.Errorf("error setting value: %s", err)
+			}
+			continue
 		}
-		err := s.SetValueFromPath(s.SecretNames[index], cipherText)
+		err = s.SetValueFromPath(s.SecretNames[index], cipherText)
 		if err != nil {
-			logger.Fatalf("error setting value: %s", err)
+			return fmt.Errorf("error setting value: %s", err)
 		}
 	}
+
+	return nil
+}
+
+// unchangedValue reports whether existing is cipher text that decrypts to plainText
+func (s *Sls) unchangedValue(existing interface{}, plainText string) bool {
+	strVal, ok := existing.(string)
+	if !ok || !isEncrypted(strVal) {
+		return false
+	}
+	decrypted, err := s.Pki.DecryptSecret(strVal)
+	if err != nil {
+		logger.Warnf("unable to decrypt the existing value, it will be replaced: %s", err)
+		return false
+	}
+
+	return decrypted == plainText
+}
+
+// CheckValueSizes returns an error for the first plain text value larger than MaxValueSize
+func (s *Sls) CheckValueSizes() error {
+	var err error
+
+	for key, vals := range s.Yaml.Values {
+		if s.TopLevelElement != "" && s.TopLevelElement != key {
+			continue
+		}
+		walkLeaves(key, vals, func(path string, strVal string) {
+			if err == nil && !isEncrypted(strVal) {
+				err = s.checkValueSize(path, strVal)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Sls) checkValueSize(path string, value string) error {
+	if s.MaxValueSize > 0 && len(value) > s.MaxValueSize {
+		return fmt.Errorf("value at '%s' is %d bytes, larger than the maximum of %d bytes", path, len(value), s.MaxValueSize)
+	}
+	return nil
+}
+
+// Colorizer colors the counts of the summary logged by ProcessDir,
+// red for failed files and yellow for skipped ones
+type Colorizer interface {
+	Red(text string) string
+	Yellow(text string) string
 }
 
 // ProcessDir will recursively apply FindSlsFiles
 // It will either encrypt or decrypt, as specified by the action flag
 // It replaces the contents of the files found
-func (s *Sls) ProcessDir(recurseDir string, action string) {
-	info, err := os.Stat(recurseDir)
-	if err != nil {
-		logger.Fatalf("cannot stat %s: %s", recurseDir, err)
-	}
-	if info.IsDir() && info.Name() != ".." {
-		slsFiles, count := FindSlsFiles(recurseDir)
-		if count == 0 {
-			logger.Fatalf("%s has no sls files", recurseDir)
-		}
-		for _, file := range slsFiles {
-			shortFile := shortFileName(file)
-			logger.Infof("processing %s", shortFile)
-			var buffer bytes.Buffer
-			if action == encrypt {
-				buffer, err = s.CipherTextYamlBuffer(file)
-				WriteSlsFile(buffer, file)
-			} else if action == decrypt {
-				buffer, err = s.PlainTextYamlBuffer(file)
-				WriteSlsFile(buffer, file)
-			} else if action == validate {
-				buffer, err = s.KeysForYamlBuffer(file)
-				fmt.Printf("%s\n", buffer.String())
+// Files with include directives are skipped, a count is logged at the end
+// and they are listed when Verbose is set. The skipped files are returned
+// When the context ends the run stops after the current file
+// PreHook and PostHook run around each file written
+// The number of files processed, skipped and failed is logged at the end
+func (s *Sls) ProcessDir(recurseDir string, action string) []string {
+	skipped, _ := s.ProcessDirErr(recurseDir, action)
+
+	return skipped
+}
+
+// ProcessDirErr is ProcessDir returning an error wrapping ErrTimedOut when
+// the context ends before all files were processed
+func (s *Sls) ProcessDirErr(recurseDir string, action string) ([]string, error) {
+	var skipped []string
+
+	var csvOut *csv.Writer
+	if action == validate && s.KeysCSV {
+		csvOut = csv.NewWriter(os.Stdout)
+		if err := csvOut.Write(KeysCSVHeader); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	processed, failed := 0, 0
+	err := s.walkDir(recurseDir, action, AddFiles, func(result FileResult) {
+		defer FileDone()
+		processed++
+		shortFile := shortFileName(result.Path)
+		if action == validate {
+			if csvOut != nil {
+				s.writeKeysCSV(csvOut, result, shortFile)
+			} else if s.NDJSON {
+				s.printKeysRecord(shortFile, result.Err)
 			} else {
-				logger.Fatalf("unknown action: %s", action)
+				fmt.Printf("%s\n", result.Buffer.String())
 			}
-			if err != nil {
-				logger.Warnf("%s", err)
-				continue
+		}
+		if errors.Is(result.Err, ErrContainsIncludes) {
+			skipped = append(skipped, shortFile)
+			return
+		}
+		if result.Err != nil {
+			failed++
+			logger.Warnf("%s", result.Err)
+			return
+		}
+		if action != validate {
+			s.writeFile(result.Buffer, result.Path)
+		}
+	})
+	if err != nil && !errors.Is(err, ErrTimedOut) && !errors.Is(err, ErrFailFast) {
+		logger.Fatal(err)
+	}
+	if csvOut != nil {
+		csvOut.Flush()
+	}
+
+	if len(skipped) > 0 {
+		logger.Warnf("skipped %d files containing include directives", len(skipped))
+		if s.Verbose {
+			for _, file := range skipped {
+				logger.Warnf("skipped %s", file)
 			}
 		}
-	} else {
-		logger.Fatalf("%s is not a directory", recurseDir)
 	}
+	done := map[string]string{encrypt: "encrypted", decrypt: "decrypted", validate: "listed"}
+	skippedText, failedText := fmt.Sprintf("%d skipped", len(skipped)), fmt.Sprintf("%d failed", failed)
+	if s.Colors != nil && len(skipped) > 0 {
+		skippedText = s.Colors.Yellow(skippedText)
+	}
+	if s.Colors != nil && failed > 0 {
+		failedText = s.Colors.Red(failedText)
+	}
+	logger.Infof("processed %d files: %d %s, %s, %s", processed, processed-len(skipped)-failed, done[action], skippedText, failedText)
+	if errors.Is(err, ErrFailFast) {
+		logger.Fatal(err)
+	}
+	if err != nil {
+		logger.Error(err)
+		return skipped, err
+	}
+
+	return skipped, nil
 }
 
 // GetValueFromPath returns the value from a path string
+// With StringKeys numeric parts are list indices under lists and map keys under maps
 func (s *Sls) GetValueFromPath(path string) interface{} {
 	parts := strings.Split(path, ":")
+	if s.StringKeys {
+		return valueAtPath(s.Yaml.Values, parts)
+	}
 
 	args := make([]interface{}, len(parts))
 	for i := 0; i < len(parts); i++ {
@@ -312,7 +825,14 @@ func (s *Sls) GetValueFromPath(path string) interface{} {
 
 // SetValueFromPath returns the value from a path string
 func (s *Sls) SetValueFromPath(path string, value string) error {
+	return s.setValue(path, value)
+}
+
+func (s *Sls) setValue(path string, value interface{}) error {
 	parts := strings.Split(path, ":")
+	if s.StringKeys {
+		return setValueAtPath(s.Yaml.Values, parts, value)
+	}
 
 	// construct the args list
 	args := make([]interface{}, len(parts)+1)
@@ -330,6 +850,31 @@ func (s *Sls) SetValueFromPath(path string, value string) error {
 // PerformAction takes an action string (encrypt or decrypt)
 // and applies that action on all items
 func (s *Sls) PerformAction(action string) bytes.Buffer {
+	buffer, err := s.performAction(action)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	return buffer
+}
+
+// performAction applies action on all items, an error is returned for values
+// that are nested too deep or fail the checks before encrypting
+func (s *Sls) performAction(action string) (bytes.Buffer, error) {
+	if err := s.CheckDepth(s.Yaml.Values); err != nil {
+		return bytes.Buffer{}, err
+	}
+	if action == encrypt {
+		if err := s.checkValues(); err != nil {
+			return bytes.Buffer{}, err
+		}
+	}
+	if s.DedupeAnchors && action == encrypt {
+		return s.performDedupeAction(), nil
+	}
+	if s.mergeNode != nil && (action == encrypt || action == decrypt) {
+		return s.performNodeAction(action), nil
+	}
 	if validAction(action) {
 		var stuff = make(map[string]interface{})
 
@@ -337,24 +882,47 @@ func (s *Sls) PerformAction(action string) bytes.Buffer {
 			if s.TopLevelElement != "" {
 				vals := s.GetValueFromPath(key)
 				if s.TopLevelElement == key {
-					stuff[key] = s.ProcessValues(vals, action)
-				} else {
+					stuff[key] = s.processValues(key, key, vals, action)
+				} else if action != validate {
+					// keys outside the element are left out of the key report
 					stuff[key] = vals
 				}
 			} else {
 				vals := s.GetValueFromPath(key)
-				stuff[key] = s.ProcessValues(vals, action)
+				stuff[key] = s.processValues(key, key, vals, action)
 			}
 		}
 		// replace the values in the Yaml object
 		s.Yaml.Values = stuff
 	}
 
-	return s.FormatBuffer(action)
+	return s.FormatBuffer(action), nil
 }
 
 // ProcessValues will encrypt or decrypt given values
 func (s *Sls) ProcessValues(vals interface{}, action string) interface{} {
+	return s.processValues(nil, "", vals, action)
+}
+
+// ProcessValuesErr will encrypt or decrypt given values, values nested more
+// than MaxDepth levels deep and values that cannot be decrypted are an error
+func (s *Sls) ProcessValuesErr(vals interface{}, action string) (interface{}, error) {
+	if err := s.CheckDepth(vals); err != nil {
+		return vals, err
+	}
+
+	s.decryptErrors = nil
+	vals = s.processValues(nil, "", vals, action)
+	if err := s.decryptError(); err != nil {
+		return vals, fmt.Errorf("%w: %s", err, strings.Join(s.decryptErrors, ", "))
+	}
+
+	return vals, nil
+}
+
+// processValues processes the values under key, the top level key of the values
+// at path, the ':' joined keys and list indexes leading to them
+func (s *Sls) processValues(key interface{}, path string, vals interface{}, action string) interface{} {
 	var res interface{}
 
 	if vals == nil {
@@ -364,18 +932,19 @@ func (s *Sls) ProcessValues(vals interface{}, action string) interface{} {
 	vtype := reflect.TypeOf(vals).Kind()
 	switch vtype {
 	case reflect.Slice:
-		res = s.doSlice(vals, action)
+		res = s.doSlice(key, path, vals, action)
 	case reflect.Map:
-		res = s.doMap(vals.(map[interface{}]interface{}), action)
+		res = s.doMap(path, vals.(map[interface{}]interface{}), action)
 	case reflect.String:
 		strVal := to.String(vals)
+		if s.skipKey(key, action) {
+			return strVal
+		}
 		switch action {
 		case decrypt:
-			strVal = s.decryptVal(strVal)
+			strVal = s.decryptVal(key, strVal)
 		case encrypt:
-			if !isEncrypted(strVal) {
-				strVal = s.Pki.EncryptSecret(strVal)
-			}
+			strVal = s.encryptPathVal(path, strVal)
 		case validate:
 			strVal = s.keyInfo(strVal)
 		}
@@ -385,32 +954,37 @@ func (s *Sls) ProcessValues(vals interface{}, action string) interface{} {
 	return res
 }
 
-func (s *Sls) doSlice(vals interface{}, action string) interface{} {
+// doSlice processes the items of the list at path, key is the map key of the list
+func (s *Sls) doSlice(key interface{}, path string, vals interface{}, action string) interface{} {
 	var things []interface{}
 
 	if vals == nil {
 		return things
 	}
 
-	for _, item := range vals.([]interface{}) {
+	for index, item := range vals.([]interface{}) {
 		var thing interface{}
+		itemPath := fmt.Sprintf("%s:%d", path, index)
 		vtype := reflect.TypeOf(item).Kind()
 
 		switch vtype {
 		case reflect.Slice:
-			things = append(things, s.doSlice(item, action))
+			things = append(things, s.doSlice(key, itemPath, item, action))
 		case reflect.Map:
 			thing = item
-			things = append(things, s.doMap(thing.(map[interface{}]interface{}), action))
+			things = append(things, s.doMap(itemPath, thing.(map[interface{}]interface{}), action))
 		case reflect.String:
 			strVal := to.String(item)
+			thing = strVal
+			if s.skipKey(key, action) {
+				things = append(things, thing)
+				continue
+			}
 			switch action {
 			case decrypt:
-				thing = s.decryptVal(strVal)
+				thing = s.decryptVal(key, strVal)
 			case encrypt:
-				if !isEncrypted(strVal) {
-					thing = s.Pki.EncryptSecret(strVal)
-				}
+				thing = s.encryptPathVal(itemPath, strVal)
 			case validate:
 				thing = s.keyInfo(strVal)
 			}
@@ -421,7 +995,7 @@ func (s *Sls) doSlice(vals interface{}, action string) interface{} {
 	return things
 }
 
-func (s *Sls) doMap(vals map[interface{}]interface{}, action string) map[interface{}]interface{} {
+func (s *Sls) doMap(path string, vals map[interface{}]interface{}, action string) map[interface{}]interface{} {
 	var ret = make(map[interface{}]interface{})
 
 	for key, val := range vals {
@@ -429,21 +1003,24 @@ func (s *Sls) doMap(vals map[interface{}]interface{}, action string) map[interfa
 			return ret
 		}
 
+		valPath := fmt.Sprintf("%s:%v", path, key)
 		vtype := reflect.TypeOf(val).Kind()
 		switch vtype {
 		case reflect.Slice:
-			ret[key] = s.doSlice(val, action)
+			ret[key] = s.doSlice(key, valPath, val, action)
 		case reflect.Map:
-			ret[key] = s.doMap(val.(map[interface{}]interface{}), action)
+			ret[key] = s.doMap(valPath, val.(map[interface{}]interface{}), action)
 		case reflect.String:
 			strVal := to.String(val)
+			if s.skipKey(key, action) {
+				ret[key] = strVal
+				continue
+			}
 			switch action {
 			case decrypt:
-				val = s.decryptVal(strVal)
+				val = s.decryptVal(key, strVal)
 			case encrypt:
-				if !isEncrypted(strVal) {
-					val = s.Pki.EncryptSecret(strVal)
-				}
+				val = s.encryptPathVal(valPath, strVal)
 			case validate:
 				val = s.keyInfo(strVal)
 			}
@@ -454,69 +1031,190 @@ func (s *Sls) doMap(vals map[interface{}]interface{}, action string) map[interfa
 	return ret
 }
 
+// skipKey reports whether a value under key is left as plain text when encrypting
+// because KeyPattern is set and does not match the key
+func (s *Sls) skipKey(key interface{}, action string) bool {
+	if action != encrypt || s.KeyPattern == nil {
+		return false
+	}
+	if key == nil {
+		return true
+	}
+
+	return !s.KeyPattern.MatchString(fmt.Sprintf("%v", key))
+}
+
 func isEncrypted(str string) bool {
-	return strings.Contains(str, pgpHeader)
+	return strings.Contains(str, pgpHeader) || pki.IsInline(str)
 }
 
 // RotateFile decrypts a file and re-encrypts with the given key
-func (s *Sls) RotateFile(file string, limChan chan bool) {
+// With BackupDir set the file is first copied to the same path relative to BackupRoot under BackupDir
+// With VerifyRotation set the file is only written if every new value decrypts to its original plain text
+// With Verbose set the keys the new values are encrypted to are logged
+// With StampRotated set a '# rotated: <time> by <key id>' comment is written above each encrypted value
+// PreHook and PostHook run around writing the file
+// The error of a file that was not rotated is logged and returned, a file that
+// cannot be read is never written and for a file with include directives the
+// error wraps ErrContainsIncludes
+func (s *Sls) RotateFile(file string, limChan chan bool) error {
 	shortFile := shortFileName(file)
-	logger.Infof("processing %s", shortFile)
+	if !SummaryOnly {
+		logger.Infof("processing %s", shortFile)
+	}
 
+	// a file that cannot be read is left as it is, files with include
+	// directives are skipped as ProcessDir does
 	_, err := s.PlainTextYamlBuffer(file)
 	if err != nil {
-		logger.Errorf("%s", err)
+		err = fileError(file, rotate, err)
+		if errors.Is(err, ErrContainsIncludes) {
+			logger.Warnf("%s", err)
+		} else {
+			logger.Error(err)
+		}
+		limChan <- true
+		return err
 	}
-	buffer := s.PerformAction("encrypt")
-	WriteSlsFile(buffer, file)
+	if s.BackupDir != "" && !DryRun {
+		if err = s.backupFile(file); err != nil {
+			err = fmt.Errorf("%s was not rotated, unable to back it up: %s", shortFile, err)
+			logger.Error(err)
+			limChan <- true
+			return err
+		}
+	}
+	plain := s.leafStrings()
+	buffer, err := s.performAction(encrypt)
+	if err != nil {
+		err = fileError(file, rotate, err)
+		logger.Error(err)
+		limChan <- true
+		return err
+	}
+	if s.VerifyRotation {
+		if err = s.verifyRotation(plain); err != nil {
+			err = fmt.Errorf("%s was not written, rotation failed verification: %s", shortFile, err)
+			logger.Error(err)
+			limChan <- true
+			return err
+		}
+	}
+	if s.Verbose {
+		logger.Infof("%s encrypted to %s", shortFile, strings.Join(s.leafRecipients(), ", "))
+	}
+	if s.StampRotated {
+		stamp := fmt.Sprintf("%s by %s", time.Now().UTC().Format(time.RFC3339), pki.FormatKeyID(s.Pki.PublicKey.PrimaryKey, s.Pki.KeyIDFormat))
+		if buffer, err = stampRotated(buffer, stamp); err != nil {
+			err = fmt.Errorf("%s was not written, unable to stamp it: %s", shortFile, err)
+			logger.Error(err)
+			limChan <- true
+			return err
+		}
+	}
+	s.writeFile(buffer, file)
 	limChan <- true
+
+	return nil
 }
 
 func (s *Sls) keyInfo(val string) string {
+	if pki.IsKeyBlock(val) {
+		return pki.ErrKeyBlock.Error()
+	}
 	if !isEncrypted(val) {
 		return ""
 	}
 
-	tmpfile, err := ioutil.TempFile("", "gsp-")
+	keyUsed := s.Pki.KeyUsedForEncryptedText
+	if s.FastKeys {
+		keyUsed = s.Pki.KeyUsedForEncryptedTextFast
+	}
+	keyInfo, err := keyUsed(val)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	if _, err = tmpfile.Write([]byte(val)); err != nil {
-		logger.Fatal(err)
-	}
+	return keyInfo
+}
 
-	keyInfo, err := s.Pki.KeyUsedForEncryptedFile(tmpfile.Name())
-	if err != nil {
-		logger.Fatal(err)
+// encryptPathVal encrypts the value at path, unless it failed the checks with
+// OnErrorContinue and is left as plain text
+func (s *Sls) encryptPathVal(path string, strVal string) string {
+	if s.skippedValues[path] {
+		return strVal
 	}
 
-	if err = tmpfile.Close(); err != nil {
-		logger.Fatal(err)
+	return s.encryptVal(strVal)
+}
+
+// encryptVal encrypts a plain text value, already encrypted values are returned as is
+// Empty strings are left empty unless EncryptEmpty is set, in which case they
+// are encrypted and will decrypt back to an empty string
+func (s *Sls) encryptVal(strVal string) string {
+	if isEncrypted(strVal) {
+		return strVal
 	}
-	if err = os.Remove(tmpfile.Name()); err != nil {
-		logger.Fatal(err)
+	if strVal == "" && !s.EncryptEmpty {
+		return strVal
 	}
 
-	return keyInfo
+	cipherText := s.Pki.EncryptSecret(strVal)
+	if s.InlineCipherText {
+		inline, err := pki.InlineCipherText(cipherText)
+		if err != nil {
+			logger.Fatalf("error inlining cipher text: %s", err)
+		}
+		cipherText = inline
+	}
+
+	return cipherText
 }
 
-func (s *Sls) decryptVal(strVal string) string {
+// decryptVal returns the plain text of an encrypted value under key
+// A value that cannot be decrypted is recorded for decryptError and its
+// cipher text is kept, with IgnoreDecryptErrors or OnErrorContinue it is logged as left encrypted
+func (s *Sls) decryptVal(key interface{}, strVal string) string {
 	var plainText string
-
-	if isEncrypted(strVal) {
-		var err error
+	var err error
+	switch {
+	case pki.IsKeyBlock(strVal):
+		err = pki.ErrKeyBlock
+	case !isEncrypted(strVal):
+		return strVal
+	default:
 		plainText, err = s.Pki.DecryptSecret(strVal)
-		if err != nil {
-			logger.Errorf("error decrypting value: %s", err)
+	}
+	if err != nil {
+		s.decryptErrors = append(s.decryptErrors, fmt.Sprintf("%v: %s", key, err))
+		if s.continueOnError(decrypt) {
+			logger.Warnf("the value of '%v' could not be decrypted and is left encrypted: %s", key, err)
 		}
-	} else {
 		return strVal
 	}
 
 	return plainText
 }
 
+// decryptError returns an error wrapping ErrDecryptFailed when values could
+// not be decrypted since decryptErrors was reset, unless IgnoreDecryptErrors or OnErrorContinue is set
+func (s *Sls) decryptError() error {
+	if len(s.decryptErrors) == 0 || s.continueOnError(decrypt) {
+		return nil
+	}
+
+	return fmt.Errorf("%d %w", len(s.decryptErrors), ErrDecryptFailed)
+}
+
+func hasExtension(name string, extensions []string) bool {
+	for _, ext := range extensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
 func validAction(action string) bool {
 	return action == encrypt || action == decrypt || action == validate
 }
@@ -0,0 +1,105 @@
+package sls
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ValueSource resolves the reference given for a secret name to its value
+// New secret stores can be supported by adding an implementation
+type ValueSource interface {
+	Resolve(ref string) (string, error)
+}
+
+// LiteralSource uses the reference as the value
+type LiteralSource struct{}
+
+// Resolve returns ref
+func (LiteralSource) Resolve(ref string) (string, error) {
+	return ref, nil
+}
+
+// FileSource reads the value from the file named by the reference
+type FileSource struct{}
+
+// Resolve returns the contents of the file ref without a trailing newline
+func (FileSource) Resolve(ref string) (string, error) {
+	buf, err := ioutil.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(string(buf), "\n"), nil
+}
+
+// Base64FileSource reads the raw, possibly binary, contents of the file named
+// by the reference, the value is them base64 encoded so it can be kept as text
+type Base64FileSource struct{}
+
+// Resolve returns the base64 encoded contents of the file ref, nothing is trimmed
+func (Base64FileSource) Resolve(ref string) (string, error) {
+	buf, err := ioutil.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// EnvSource reads the value from the environment variable named by the reference
+type EnvSource struct{}
+
+// Resolve returns the value of the environment variable ref, an unset variable is an error
+func (EnvSource) Resolve(ref string) (string, error) {
+	val, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+
+	return val, nil
+}
+
+// CommandSource runs the reference as a command and uses its output as the value
+type CommandSource struct{}
+
+// Resolve runs ref split on white space and returns its output without a trailing newline
+func (CommandSource) Resolve(ref string) (string, error) {
+	args := strings.Fields(ref)
+	if len(args) == 0 {
+		return "", fmt.Errorf("no value command given")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("value command '%s' failed: %s %s", ref, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// resolveValues resolves SecretValues through ValueSource, literal values are used when it is nil
+func (s *Sls) resolveValues() ([]string, error) {
+	source := s.ValueSource
+	if source == nil {
+		source = LiteralSource{}
+	}
+
+	values := make([]string, len(s.SecretValues))
+	for index, ref := range s.SecretValues {
+		val, err := source.Resolve(ref)
+		if err != nil {
+			return nil, err
+		}
+		values[index] = val
+	}
+
+	return values, nil
+}
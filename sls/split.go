@@ -0,0 +1,84 @@
+package sls
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// WriteSplitDir writes each leaf value to its own 0600 file in splitDir
+// The file name is the path of the value with its keys joined by separator,
+// list items use their index as the key
+func (s *Sls) WriteSplitDir(splitDir string, separator string) error {
+	if separator == "" {
+		return fmt.Errorf("separator cannot be empty")
+	}
+
+	leaves := make(map[string]string)
+	for key, vals := range s.Yaml.Values {
+		if s.TopLevelElement != "" && s.TopLevelElement != key {
+			continue
+		}
+		if err := splitLeaves(key, vals, separator, leaves); err != nil {
+			return err
+		}
+	}
+
+	var names []string
+	for name := range leaves {
+		if name == "." || name == ".." || strings.ContainsRune(name, os.PathSeparator) {
+			return fmt.Errorf("cannot use '%s' as a file name", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if DryRun {
+		logger.Infof("would write %d files to %s", len(names), splitDir)
+		return nil
+	}
+
+	err := os.MkdirAll(splitDir, 0700)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		// an existing file is replaced, never written to with its old mode
+		if err = writeAtomic(filepath.Join(splitDir, name), []byte(leaves[name]), 0600); err != nil {
+			return err
+		}
+	}
+	logger.Infof("wrote %d files to %s", len(names), splitDir)
+
+	return nil
+}
+
+// splitLeaves adds each leaf under vals to leaves by its joined path, two paths
+// that join to the same name, e.g. 'a: {b.c: x}' and 'a.b: {c: y}' with '.', are an error
+func splitLeaves(path string, vals interface{}, separator string, leaves map[string]string) error {
+	switch val := vals.(type) {
+	case nil:
+		return nil
+	case map[interface{}]interface{}:
+		for key, item := range val {
+			if err := splitLeaves(fmt.Sprintf("%s%s%v", path, separator, key), item, separator, leaves); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for index, item := range val {
+			if err := splitLeaves(fmt.Sprintf("%s%s%d", path, separator, index), item, separator, leaves); err != nil {
+				return err
+			}
+		}
+	default:
+		if _, ok := leaves[path]; ok {
+			return fmt.Errorf("more than one value would be written to '%s', use another separator", path)
+		}
+		leaves[path] = fmt.Sprintf("%v", val)
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package sls
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// stampPrefix starts the comment stamped above rotated values
+const stampPrefix = "rotated: "
+
+// stampRotated returns buffer with a '# rotated: <stamp>' comment above each
+// encrypted value, replacing any earlier stamp
+func stampRotated(buffer bytes.Buffer, stamp string) (bytes.Buffer, error) {
+	var out bytes.Buffer
+
+	header, body := rendererLine, buffer.Bytes()
+	if bytes.HasPrefix(body, []byte("#!")) {
+		// keep whichever renderer line the buffer was written with
+		lines := bytes.SplitN(body, []byte("\n"), 2)
+		header, body = string(lines[0]), nil
+		if len(lines) > 1 {
+			body = lines[1]
+		}
+	}
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(body, &doc); err != nil {
+		return buffer, err
+	}
+	stampNode(&doc, nil, stamp)
+
+	stamped, err := encodeNode(&doc)
+	if err != nil {
+		return buffer, err
+	}
+	out.WriteString(header + "\n\n")
+	out.Write(stamped)
+
+	return out, nil
+}
+
+// stampNode stamps the encrypted values under node, the comment goes on the
+// key of a map value or on the item itself in a list
+func stampNode(node *yamlv3.Node, key *yamlv3.Node, stamp string) {
+	switch node.Kind {
+	case yamlv3.DocumentNode, yamlv3.SequenceNode:
+		for _, child := range node.Content {
+			stampNode(child, nil, stamp)
+		}
+	case yamlv3.MappingNode:
+		for index := 0; index+1 < len(node.Content); index += 2 {
+			stampNode(node.Content[index+1], node.Content[index], stamp)
+		}
+	case yamlv3.ScalarNode:
+		if !isEncrypted(node.Value) {
+			return
+		}
+		target := node
+		if key != nil {
+			target = key
+		}
+		target.HeadComment = setStamp(target.HeadComment, stamp)
+	}
+}
+
+// setStamp replaces the stamp line of a comment, other comment lines are kept
+func setStamp(comment string, stamp string) string {
+	var lines []string
+	for _, line := range strings.Split(comment, "\n") {
+		if line == "" || strings.HasPrefix(strings.TrimSpace(strings.TrimPrefix(line, "#")), stampPrefix) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, fmt.Sprintf("# %s%s", stampPrefix, stamp))
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,110 @@
+package sls
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Everbridge/generate-secure-pillar/pki"
+)
+
+// RotateSubkeys re-encrypts the values of the sls file at target, or of each
+// sls file under it when it is a directory, that were encrypted to an encryption
+// subkey its recipient has since replaced
+// The values keep their recipients, only the subkeys used change
+// Only changed files are written, their paths relative to target, or to the
+// directory of a single file, are returned
+func (s *Sls) RotateSubkeys(target string) ([]string, error) {
+	changed := []string{}
+
+	root, err := filepath.Abs(target)
+	if err != nil {
+		return changed, err
+	}
+	slsFiles := []string{root}
+	if CheckForDir(root) == nil {
+		var count int
+		slsFiles, count = s.findModifiedSlsFiles(target)
+		if count == 0 {
+			return changed, fmt.Errorf("%s has no sls files", target)
+		}
+	} else {
+		if err = CheckForFile(root); err != nil {
+			return changed, err
+		}
+		root = filepath.Dir(root)
+	}
+	// values are decrypted to re-encrypt them
+	if err = s.Pki.CheckSecRing(); err != nil {
+		return changed, fmt.Errorf("no usable secret keyring, no files were changed: %s", err)
+	}
+
+	for _, file := range slsFiles {
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return changed, err
+		}
+		rel = filepath.ToSlash(rel)
+		buffer, values, err := s.RotateSubkeysFile(file)
+		if err != nil {
+			return changed, fmt.Errorf("%s: %s", rel, err)
+		}
+		if values == 0 {
+			continue
+		}
+		if !SummaryOnly {
+			logger.Infof("re-encrypted %d values in %s", values, rel)
+		}
+		s.writeFile(buffer, file)
+		changed = append(changed, rel)
+	}
+
+	return changed, nil
+}
+
+// RotateSubkeysFile returns the file with each value encrypted to a superseded
+// subkey re-encrypted to the latest encryption keys of the same recipients,
+// and how many values were re-encrypted
+func (s *Sls) RotateSubkeysFile(filePath string) (bytes.Buffer, int, error) {
+	var buffer bytes.Buffer
+
+	if err := s.ReadSlsFile(filePath); err != nil {
+		return buffer, 0, err
+	}
+
+	count := 0
+	for key, vals := range s.Yaml.Values {
+		if s.TopLevelElement != "" && s.TopLevelElement != key {
+			continue
+		}
+		vals, err := rewrapValues(key, vals, func(path string, cipherText string) (string, error) {
+			superseded, recipients, err := s.Pki.SupersededKeys(cipherText)
+			if err != nil {
+				return cipherText, fmt.Errorf("%s: %s", path, err)
+			}
+			if len(superseded) == 0 {
+				return cipherText, nil
+			}
+			if s.Verbose {
+				logger.Infof("%s: %s", path, strings.Join(superseded, ", "))
+			}
+			plainText, err := s.Pki.DecryptSecret(cipherText)
+			if err != nil {
+				return cipherText, fmt.Errorf("%s: %s", path, err)
+			}
+			count++
+			newText := s.Pki.EncryptSecretTo(plainText, recipients)
+			if pki.IsInline(cipherText) {
+				return pki.InlineCipherText(newText)
+			}
+			return newText, nil
+		})
+		if err != nil {
+			return buffer, count, err
+		}
+		s.Yaml.Values[key] = vals
+	}
+
+	return s.FormatBuffer(""), count, nil
+}
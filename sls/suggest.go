@@ -0,0 +1,100 @@
+package sls
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// maxSuggestions is the most paths SuggestPaths returns
+const maxSuggestions = 3
+
+// SuggestPaths returns the existing paths closest to a path that was not
+// found, nearest first, so typos like 'db:prd:password' suggest 'db:prod:password'
+// Paths more than a third of their length away are not suggested
+func (s *Sls) SuggestPaths(path string) []string {
+	type candidate struct {
+		path     string
+		distance int
+	}
+
+	limit := len(path) / 3
+	if limit < 2 {
+		limit = 2
+	}
+
+	var candidates []candidate
+	for key, vals := range s.Yaml.Values {
+		walkPaths(fmt.Sprintf("%v", key), vals, func(found string) {
+			if distance := levenshtein(path, found); distance <= limit {
+				candidates = append(candidates, candidate{found, distance})
+			}
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].path < candidates[j].path
+	})
+
+	suggestions := []string{}
+	for index := 0; index < len(candidates) && index < maxSuggestions; index++ {
+		suggestions = append(suggestions, candidates[index].path)
+	}
+
+	return suggestions
+}
+
+// walkPaths calls fn with path and the path of every map, list and value below vals
+func walkPaths(path string, vals interface{}, fn func(string)) {
+	fn(path)
+	if vals == nil {
+		return
+	}
+
+	switch reflect.TypeOf(vals).Kind() {
+	case reflect.Slice:
+		if items, ok := vals.([]interface{}); ok {
+			for index, item := range items {
+				walkPaths(fmt.Sprintf("%s:%d", path, index), item, fn)
+			}
+		}
+	case reflect.Map:
+		if items, ok := vals.(map[interface{}]interface{}); ok {
+			for key, item := range items {
+				walkPaths(fmt.Sprintf("%s:%v", path, key), item, fn)
+			}
+		}
+	}
+}
+
+// levenshtein returns the number of single character edits between a and b
+func levenshtein(a string, b string) int {
+	source, target := []rune(a), []rune(b)
+	previous := make([]int, len(target)+1)
+	current := make([]int, len(target)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(source); i++ {
+		current[0] = i
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if source[i-1] == target[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(target)]
+}
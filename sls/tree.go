@@ -0,0 +1,103 @@
+package sls
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// RecipientTree is a directory with the keys the values of the files under it
+// are encrypted to, each key is given by fingerprint and name as in leafRecipients
+type RecipientTree struct {
+	Name       string           `json:"name"`
+	Recipients []string         `json:"recipients"`
+	Children   []*RecipientTree `json:"children,omitempty"`
+}
+
+// RecipientTree returns the directories under recurseDir with the keys used below each of them
+// An init.sls is reported under the directory it is the default of, see slsDir
+func (s *Sls) RecipientTree(recurseDir string) (*RecipientTree, error) {
+	root := &RecipientTree{Name: recurseDir, Recipients: []string{}}
+
+	err := s.walkRecipients(recurseDir, func(rel string, recipients []string) {
+		node := root
+		node.add(recipients)
+		dir := slsDir(rel)
+		if dir == "." {
+			return
+		}
+		for _, name := range strings.Split(dir, "/") {
+			node = node.child(name)
+			node.add(recipients)
+		}
+	})
+	root.sort()
+
+	return root, err
+}
+
+// slsDir returns the slash separated directory the values of the sls file rel
+// are attributed to. Salt reads dir/init.sls as the state 'dir', so its values
+// belong to dir rather than to a state named 'init', as do those of every other
+// file in dir
+func slsDir(rel string) string {
+	return path.Dir(rel)
+}
+
+func (t *RecipientTree) child(name string) *RecipientTree {
+	for _, child := range t.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	child := &RecipientTree{Name: name, Recipients: []string{}}
+	t.Children = append(t.Children, child)
+
+	return child
+}
+
+func (t *RecipientTree) add(recipients []string) {
+	for _, recipient := range recipients {
+		found := false
+		for _, known := range t.Recipients {
+			if known == recipient {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Recipients = append(t.Recipients, recipient)
+		}
+	}
+}
+
+func (t *RecipientTree) sort() {
+	sort.Strings(t.Recipients)
+	sort.Slice(t.Children, func(i, j int) bool {
+		return t.Children[i].Name < t.Children[j].Name
+	})
+	for _, child := range t.Children {
+		child.sort()
+	}
+}
+
+// Lines returns the tree as 'name/: recipient, recipient' lines indented two spaces a level
+func (t *RecipientTree) Lines() []string {
+	var lines []string
+
+	var walk func(node *RecipientTree, depth int)
+	walk = func(node *RecipientTree, depth int) {
+		recipients := strings.Join(node.Recipients, ", ")
+		if recipients == "" {
+			recipients = "no encrypted values"
+		}
+		lines = append(lines, fmt.Sprintf("%s%s/: %s", strings.Repeat("  ", depth), strings.TrimSuffix(node.Name, "/"), recipients))
+		for _, child := range node.Children {
+			walk(child, depth+1)
+		}
+	}
+	walk(t, 0)
+
+	return lines
+}
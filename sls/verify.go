@@ -0,0 +1,109 @@
+package sls
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Everbridge/generate-secure-pillar/pki"
+)
+
+// leafStrings maps the path of each string value in scope to its value
+func (s *Sls) leafStrings() map[string]string {
+	leaves := make(map[string]string)
+	for key, vals := range s.Yaml.Values {
+		if s.TopLevelElement != "" && s.TopLevelElement != key {
+			continue
+		}
+		walkLeaves(key, vals, func(path string, val string) {
+			leaves[path] = val
+		})
+	}
+
+	return leaves
+}
+
+// verifyRotation decrypts each re-encrypted value and compares it to the
+// plain text it was encrypted from
+func (s *Sls) verifyRotation(plain map[string]string) error {
+	rotated := s.leafStrings()
+	if len(rotated) != len(plain) {
+		return fmt.Errorf("value count changed from %d to %d", len(plain), len(rotated))
+	}
+
+	for path, val := range rotated {
+		want, ok := plain[path]
+		if !ok {
+			return fmt.Errorf("%s was not in the decrypted file", path)
+		}
+		if isEncrypted(val) {
+			var err error
+			val, err = s.Pki.DecryptSecret(val)
+			if err != nil {
+				return fmt.Errorf("%s cannot be decrypted: %s", path, err)
+			}
+		}
+		if val != want {
+			return fmt.Errorf("%s does not decrypt to its original value", path)
+		}
+	}
+
+	return nil
+}
+
+// leafRecipients returns the fingerprint and name of each key the values in
+// scope are encrypted to, keys missing from the public keyring are given by id
+func (s *Sls) leafRecipients() []string {
+	found := make(map[string]bool)
+	for _, val := range s.leafStrings() {
+		if !isEncrypted(val) {
+			continue
+		}
+		ids, err := pki.RecipientKeyIDs(val)
+		if err != nil {
+			continue
+		}
+		for _, id := range ids {
+			recipient := fmt.Sprintf("%016X", id)
+			if keys := s.Pki.PublicKeys().KeysById(id, nil); len(keys) > 0 && keys[0].Entity != nil {
+				recipient = fmt.Sprintf("%s %s", pki.FormatKeyID(keys[0].Entity.PrimaryKey, pki.FingerprintKeyID), pki.EntityName(keys[0].Entity))
+			}
+			found[recipient] = true
+		}
+	}
+
+	var recipients []string
+	for recipient := range found {
+		recipients = append(recipients, recipient)
+	}
+	sort.Strings(recipients)
+
+	return recipients
+}
+
+// VerifyFile returns a "path: error" line for each encrypted value in the file that is
+// not a well formed PGP message encrypted to keys in the public keyring
+// Only the public keyring is used, values are not decrypted
+func (s *Sls) VerifyFile(filePath string) ([]string, error) {
+	found := []string{}
+
+	err := s.ReadSlsFile(filePath)
+	if err != nil {
+		return found, err
+	}
+
+	for path, val := range s.leafStrings() {
+		if pki.IsKeyBlock(val) {
+			found = append(found, fmt.Sprintf("%s: %s", path, pki.ErrKeyBlock))
+			continue
+		}
+		if !isEncrypted(val) {
+			continue
+		}
+		if err := s.Pki.VerifyCipherText(val); err != nil {
+			found = append(found, fmt.Sprintf("%s: %s", path, err))
+		}
+	}
+	sort.Strings(found)
+
+	return found, nil
+}
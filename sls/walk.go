@@ -0,0 +1,103 @@
+package sls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// FileResult holds the outcome of an action on one file found by WalkDir
+type FileResult struct {
+	Path   string
+	Buffer bytes.Buffer
+	Err    error
+}
+
+// WalkDir applies the action to each sls file under recurseDir and returns
+// the results without writing anything, leaving it to the caller to persist them
+// Files with include directives have an error wrapping ErrContainsIncludes
+// When the context of s ends no further files are started and an error
+// wrapping ErrTimedOut is returned with the results so far
+// With FailFast the walk stops at the first file that fails and an error
+// wrapping ErrFailFast is returned with the results so far
+// WalkDir changes no package state, walks of different Sls values can run at once
+func (s *Sls) WalkDir(recurseDir string, action string) ([]FileResult, error) {
+	var results []FileResult
+
+	err := s.walkDir(recurseDir, action, nil, func(result FileResult) {
+		results = append(results, result)
+	})
+
+	return results, err
+}
+
+// walkDir calls found with the number of files before the first one and fn
+// with the result of each file
+func (s *Sls) walkDir(recurseDir string, action string, found func(int), fn func(FileResult)) error {
+	if action != encrypt && action != decrypt && action != validate {
+		return fmt.Errorf("unknown action: %s", action)
+	}
+
+	info, err := os.Stat(recurseDir)
+	if err != nil {
+		return fmt.Errorf("cannot stat %s: %s", recurseDir, err)
+	}
+	if !info.IsDir() || info.Name() == ".." {
+		return fmt.Errorf("%s is not a directory", recurseDir)
+	}
+
+	slsFiles, count := s.findModifiedSlsFiles(recurseDir)
+	if count == 0 {
+		return fmt.Errorf("%s has no sls files", recurseDir)
+	}
+	if action == decrypt {
+		// without a secret key every file would be rewritten without its values
+		if err = s.Pki.CheckSecRing(); err != nil {
+			return fmt.Errorf("no usable secret keyring, no files were changed: %s", err)
+		}
+	}
+
+	ctx := s.context()
+	if found != nil {
+		found(len(slsFiles))
+	}
+	for done, file := range slsFiles {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %d of %d files were processed", ErrTimedOut, done, len(slsFiles))
+		}
+		if !s.SummaryOnly {
+			logger.Infof("processing %s", shortFileName(file))
+		}
+		result := FileResult{Path: file}
+		switch action {
+		case encrypt:
+			result.Buffer, result.Err = s.CipherTextYamlBuffer(file)
+		case decrypt:
+			result.Buffer, result.Err = s.PlainTextYamlBuffer(file)
+		case validate:
+			if s.KeysCSV {
+				// the rows are read from the cipher text, which validating replaces
+				result.Err = CheckForFile(file)
+				break
+			}
+			result.Buffer, result.Err = s.KeysForYamlBuffer(file)
+		}
+		fn(result)
+		if s.AbortOnError() && result.Err != nil && !errors.Is(result.Err, ErrContainsIncludes) {
+			return fmt.Errorf("%w: %d of %d files were processed", ErrFailFast, done+1, len(slsFiles))
+		}
+	}
+
+	return nil
+}
+
+// context returns the context of s, runs without one are not bounded
+func (s *Sls) context() context.Context {
+	if s.Context == nil {
+		return context.Background()
+	}
+
+	return s.Context
+}